@@ -3,8 +3,10 @@ package persistence
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -214,41 +216,54 @@ func (aof *AOF) LoadCommands() ([][]string, error) {
 	defer file.Close()
 	
 	var commands [][]string
-	scanner := bufio.NewScanner(file)
-	
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "*") {
-			// Parse Redis protocol format
-			var argCount int
-			fmt.Sscanf(line, "*%d", &argCount)
-			
-			command := make([]string, 0, argCount)
-			
-			for i := 0; i < argCount; i++ {
-				// Read $length line
-				if !scanner.Scan() {
-					break
-				}
-				lengthLine := strings.TrimSpace(scanner.Text())
-				var length int
-				fmt.Sscanf(lengthLine, "$%d", &length)
-				
-				// Read actual argument
-				if !scanner.Scan() {
-					break
-				}
-				arg := scanner.Text()
-				command = append(command, arg)
+	reader := bufio.NewReader(file)
+	
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return commands, nil
+			}
+			return commands, err
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "*") {
+			continue
+		}
+		
+		// Parse Redis protocol format; arguments are read by length so
+		// binary values (e.g. RESTORE payloads) survive a reload
+		argCount, err := strconv.Atoi(line[1:])
+		if err != nil {
+			continue
+		}
+		
+		command := make([]string, 0, argCount)
+		for i := 0; i < argCount; i++ {
+			lengthLine, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			lengthLine = strings.TrimSpace(lengthLine)
+			if !strings.HasPrefix(lengthLine, "$") {
+				break
+			}
+			length, err := strconv.Atoi(lengthLine[1:])
+			if err != nil || length < 0 {
+				break
 			}
 			
-			if len(command) > 0 {
-				commands = append(commands, command)
+			arg := make([]byte, length+2)
+			if _, err := io.ReadFull(reader, arg); err != nil {
+				break
 			}
+			command = append(command, string(arg[:length]))
+		}
+		
+		if len(command) == argCount && argCount > 0 {
+			commands = append(commands, command)
 		}
 	}
-	
-	return commands, scanner.Err()
 }
 
 func (aof *AOF) Rewrite(getCurrentState func() ([][]string, error)) (*AOFRewriteStats, error) {
@@ -342,7 +357,6 @@ func (aof *AOF) ShouldLogCommand(command string) bool {
 		"LINSERT":   true,
 		"SADD":      true,
 		"SREM":      true,
-		"SPOP":      true,
 		"SMOVE":     true,
 		"HSET":      true,
 		"HDEL":      true,
@@ -350,6 +364,7 @@ func (aof *AOF) ShouldLogCommand(command string) bool {
 		"HINCRBYFLOAT": true,
 		"HMSET":     true,
 		"HSETNX":    true,
+		"HPERSIST":  true,
 		"ZADD":      true,
 		"ZREM":      true,
 		"ZINCRBY":   true,
@@ -369,11 +384,45 @@ func (aof *AOF) ShouldLogCommand(command string) bool {
 		"JSON.ARRPOP":    true,
 		"JSON.ARRINSERT": true,
 		"JSON.ARRTRIM":   true,
+		"JSON.MSET":      true,
+		"JSON.MERGE":     true,
+		"JSON.TOGGLE":    true,
+		"JSON.CLEAR":     true,
+		// Search commands
+		"FT.CREATE":    true,
+		"FT.DROPINDEX": true,
+		// Time series commands
+		"TS.CREATE":     true,
+		"TS.ALTER":      true,
+		"TS.DEL":        true,
+		"TS.CREATERULE": true,
+		"TS.DELETERULE": true,
+		// Probabilistic commands
+		"BF.RESERVE":     true,
+		"BF.ADD":         true,
+		"BF.MADD":        true,
+		"CF.RESERVE":     true,
+		"CF.ADD":         true,
+		"CF.ADDNX":       true,
+		"CF.DEL":         true,
+		"CMS.INITBYDIM":  true,
+		"CMS.INITBYPROB": true,
+		"CMS.INCRBY":     true,
+		"CMS.MERGE":      true,
+		"TOPK.RESERVE":   true,
+		"TOPK.ADD":       true,
+		"TOPK.INCRBY":    true,
+		"TDIGEST.CREATE": true,
+		"TDIGEST.ADD":    true,
+		"TDIGEST.MERGE":  true,
+		"TDIGEST.RESET":  true,
 		// Stream commands
-		"XADD":   true,
 		"XTRIM":  true,
 		"XDEL":   true,
 		"XGROUP": true,
+		"XREADGROUP": true,
+		"XACK":   true,
+		"XSETID": true,
 	}
 	
 	return writeCommands[strings.ToUpper(command)]
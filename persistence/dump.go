@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc64"
+)
+
+// DumpVersion is the version of the DUMP payload format
+const DumpVersion uint16 = 1
+
+var dumpCRCTable = crc64.MakeTable(crc64.ECMA)
+
+var ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+var ErrDumpFormat = errors.New("Bad data format")
+
+// EncodeDump serializes a single value as
+// [type tag][gob SerializedValue][version uint16 LE][crc64 LE].
+// The checksum covers everything before it.
+func EncodeDump(value SerializedValue) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(value.Type))
+
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+
+	var version [2]byte
+	binary.LittleEndian.PutUint16(version[:], DumpVersion)
+	buf.Write(version[:])
+
+	var checksum [8]byte
+	binary.LittleEndian.PutUint64(checksum[:], crc64.Checksum(buf.Bytes(), dumpCRCTable))
+	buf.Write(checksum[:])
+
+	return buf.Bytes(), nil
+}
+
+// DecodeDump validates and decodes a payload produced by EncodeDump
+func DecodeDump(payload []byte) (SerializedValue, error) {
+	var value SerializedValue
+
+	if len(payload) < 1+2+8 {
+		return value, ErrDumpPayload
+	}
+
+	body := payload[:len(payload)-8]
+	checksum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if crc64.Checksum(body, dumpCRCTable) != checksum {
+		return value, ErrDumpPayload
+	}
+
+	version := binary.LittleEndian.Uint16(body[len(body)-2:])
+	if version == 0 || version > DumpVersion {
+		return value, ErrDumpPayload
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(body[1 : len(body)-2])).Decode(&value); err != nil {
+		return value, ErrDumpFormat
+	}
+	if byte(value.Type) != body[0] || value.Type < StringType || value.Type > TDigestType {
+		return value, ErrDumpFormat
+	}
+
+	return value, nil
+}
@@ -18,6 +18,12 @@ const (
 	ZSetType
 	JSONType
 	StreamType
+	TimeSeriesType
+	BloomType
+	CuckooType
+	CMSType
+	TopKType
+	TDigestType
 )
 
 // ZSetMember mirrors store.ZSetMember for persistence
@@ -32,35 +38,166 @@ type ZSetData struct {
 	Sorted  []ZSetMember
 }
 
-// StreamEntry for persistence
+// StreamEntry for persistence. Values holds alternating fields and values
+// in insertion order; Fields is only set by snapshots predating it.
 type StreamEntry struct {
 	ID     string
 	Fields map[string]string
+	Values []string
+}
+
+// StreamPendingEntry for persistence
+type StreamPendingEntry struct {
+	ID            string
+	Consumer      string
+	DeliveryTime  time.Time
+	DeliveryCount int64
+}
+
+// StreamConsumer for persistence
+type StreamConsumer struct {
+	Name       string
+	SeenTime   time.Time
+	ActiveTime time.Time
+}
+
+// StreamGroup holds serializable consumer group data
+type StreamGroup struct {
+	Name            string
+	LastDeliveredID string
+	EntriesRead     int64
+	Consumers       []StreamConsumer
+	Pending         []StreamPendingEntry
 }
 
 // StreamData holds serializable Stream data
 type StreamData struct {
-	Entries []StreamEntry
-	LastID  string
-	FirstID string
+	Entries      []StreamEntry
+	LastID       string
+	FirstID      string
+	EntriesAdded int64
+	MaxDeletedID string
+	Groups       []StreamGroup
+}
+
+// TimeSeriesSample for persistence
+type TimeSeriesSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// TimeSeriesRule for persistence
+type TimeSeriesRule struct {
+	DestKey     string
+	Aggregation string
+	Bucket      int64
+	Align       int64
+}
+
+// TimeSeriesData holds serializable time series data. Labels alternate
+// names and values.
+type TimeSeriesData struct {
+	Samples         []TimeSeriesSample
+	Retention       int64
+	DuplicatePolicy string
+	ChunkSize       int64
+	Labels          []string
+	Rules           []TimeSeriesRule
+	SourceKey       string
+}
+
+// BloomLayer holds one serializable bloom sub-filter
+type BloomLayer struct {
+	Bits      []byte
+	NumBits   uint64
+	Hashes    int
+	Capacity  int64
+	Count     int64
+	ErrorRate float64
+}
+
+// BloomData holds serializable scalable bloom filter data
+type BloomData struct {
+	ErrorRate  float64
+	Expansion  int64
+	NonScaling bool
+	Filters    []BloomLayer
+}
+
+// CuckooLayer holds one serializable cuckoo sub-filter
+type CuckooLayer struct {
+	NumBuckets uint64
+	Slots      []byte
+}
+
+// CuckooData holds serializable cuckoo filter data
+type CuckooData struct {
+	BucketSize    int
+	MaxIterations int
+	Expansion     int64
+	Inserted      int64
+	Deleted       int64
+	Filters       []CuckooLayer
+}
+
+// CMSData holds serializable count-min sketch data
+type CMSData struct {
+	Width    int64
+	Depth    int64
+	Count    int64
+	Counters []int64
+}
+
+// TopKData holds serializable top-k data. Fingerprints and Counts hold the
+// buckets; Items and ItemCounts the tracked items.
+type TopKData struct {
+	K            int64
+	Width        int64
+	Depth        int64
+	Decay        float64
+	Fingerprints []uint64
+	Counts       []int64
+	Items        []string
+	ItemCounts   []int64
+	Rng          uint64
+}
+
+// TDigestData holds serializable t-digest data
+type TDigestData struct {
+	Compression  float64
+	Means        []float64
+	Weights      []float64
+	Buffer       []float64
+	Min          float64
+	Max          float64
+	Compressions int64
 }
 
 // SerializedValue represents a serializable version of RedisValue
 type SerializedValue struct {
-	Type         DataType
-	StringValue  string
-	ListValue    []string
-	HashValue    map[string]string
-	SetValue     map[string]bool
-	ZSetValue    *ZSetData
-	JSONValue    []byte // JSON stored as raw bytes
-	StreamValue  *StreamData
+	Type            DataType
+	StringValue     string
+	ListValue       []string
+	HashValue       map[string]string
+	SetValue        map[string]bool
+	ZSetValue       *ZSetData
+	JSONValue       []byte // JSON in the binary node encoding, or text in older snapshots
+	StreamValue     *StreamData
+	TimeSeriesValue *TimeSeriesData
+	BloomValue      *BloomData
+	CuckooValue     *CuckooData
+	CMSValue        *CMSData
+	TopKValue       *TopKData
+	TDigestValue    *TDigestData
+
+	HashFieldExpiration map[string]time.Time
 }
 
 // DatabaseSnapshot represents a single database's state
 type DatabaseSnapshot struct {
 	Data       map[string]SerializedValue
 	Expiration map[string]time.Time
+	Indexes    [][]string // FT.CREATE arguments of the search indexes
 }
 
 // DataSnapshot represents the full state of all databases
@@ -82,6 +219,19 @@ func init() {
 	gob.Register(DataSnapshot{})
 	gob.Register(StreamData{})
 	gob.Register(StreamEntry{})
+	gob.Register(StreamGroup{})
+	gob.Register(StreamConsumer{})
+	gob.Register(StreamPendingEntry{})
+	gob.Register(TimeSeriesData{})
+	gob.Register(TimeSeriesSample{})
+	gob.Register(TimeSeriesRule{})
+	gob.Register(BloomData{})
+	gob.Register(BloomLayer{})
+	gob.Register(CuckooData{})
+	gob.Register(CuckooLayer{})
+	gob.Register(CMSData{})
+	gob.Register(TopKData{})
+	gob.Register(TDigestData{})
 }
 
 func New(filename string) *Persistence {
@@ -151,6 +301,7 @@ func (p *Persistence) LoadDatabases() ([16]DatabaseSnapshot, error) {
 	// Filter out expired keys
 	for dbIdx := 0; dbIdx < 16; dbIdx++ {
 		dbSnapshot := snapshot.Databases[dbIdx]
+		databases[dbIdx].Indexes = dbSnapshot.Indexes
 		if dbSnapshot.Data == nil {
 			continue
 		}
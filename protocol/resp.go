@@ -124,6 +124,33 @@ func (p *Parser) parseArray(line string) ([]string, error) {
 	return args, nil
 }
 
+// ParseReply reads a single status, error or integer reply and returns
+// the line including its type prefix
+func (p *Parser) ParseReply() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", fmt.Errorf("empty line")
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	default:
+		return "", fmt.Errorf("unsupported RESP reply type: %c", line[0])
+	}
+}
+
+// Peek waits until input is available without consuming it
+func (p *Parser) Peek() error {
+	_, err := p.reader.Peek(1)
+	return err
+}
+
 func (p *Parser) ReleaseArgs(args []string) {
 	if args != nil {
 		p.stringsPool.Put(args)
@@ -146,7 +173,9 @@ func EncodeInteger(i int) string {
 }
 
 func EncodeError(msg string) string {
-	if strings.HasPrefix(msg, "ERR ") || strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "NOAUTH") {
+	if strings.HasPrefix(msg, "ERR ") || strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "NOAUTH") ||
+		strings.HasPrefix(msg, "WRONGTYPE ") || strings.HasPrefix(msg, "BUSYKEY ") || strings.HasPrefix(msg, "IOERR ") ||
+		strings.HasPrefix(msg, "NOGROUP ") || strings.HasPrefix(msg, "BUSYGROUP ") || strings.HasPrefix(msg, "UNBLOCKED ") {
 		return fmt.Sprintf("-%s\r\n", msg)
 	}
 	return fmt.Sprintf("-ERR %s\r\n", msg)
@@ -15,6 +15,22 @@ func (s *Server) handleQuit(args []string) string {
 	return protocol.EncodeSimpleString("OK")
 }
 
+// RESET discards the transaction and watched keys, leaves subscriber and
+// monitor mode and, when a password is set, requires authenticating again
+func (s *Server) handleReset(args []string, connKey string) string {
+	if len(args) != 0 {
+		return protocol.EncodeError("wrong number of arguments for 'reset' command")
+	}
+
+	s.transactionContexts.Delete(connKey)
+	s.removeMonitorConnection(connKey)
+	s.pubsub.RemoveSubscriber(connKey)
+	if s.requiresAuth() {
+		s.authenticatedConns.Delete(connKey)
+	}
+	return protocol.EncodeSimpleString("RESET")
+}
+
 func (s *Server) handleHello(args []string, connKey string) string {
 	// Default to RESP2 if no version specified
 	protocolVersion := 2
@@ -155,11 +171,13 @@ func (s *Server) handleDBSize(args []string) string {
 
 func (s *Server) handleFlushDB(args []string) string {
 	s.store.FlushDB()
+	s.blockingKeys.signalAll()
 	return protocol.EncodeSimpleString("OK")
 }
 
 func (s *Server) handleFlushAll(args []string) string {
 	s.store.FlushDB()
+	s.blockingKeys.signalAll()
 	return protocol.EncodeSimpleString("OK")
 }
 
@@ -253,6 +271,8 @@ func (s *Server) handleInfo(args []string) string {
 		info.WriteString("keyspace_misses:0\r\n")
 		info.WriteString("pubsub_channels:0\r\n")
 		info.WriteString("pubsub_patterns:0\r\n")
+		info.WriteString("pubsub_dropped_messages:" + strconv.FormatInt(s.pubsub.DroppedMessages(), 10) + "\r\n")
+		info.WriteString("client_output_buffer_limit_disconnections:" + strconv.FormatInt(s.outputLimits.Disconnections(), 10) + "\r\n")
 		info.WriteString("latest_fork_usec:0\r\n")
 		info.WriteString("migrate_cached_sockets:0\r\n")
 		info.WriteString("slave_expires_tracked_keys:0\r\n")
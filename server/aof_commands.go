@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 
+	"keyra/persistence"
 	"keyra/protocol"
 )
 
@@ -68,6 +69,10 @@ func (s *Server) getCurrentDatabaseState() ([][]string, error) {
 					commands = append(commands, []string{"HSET", key, field, value})
 				}
 			}
+			for field, at := range s.store.HashFieldExpirations(key) {
+				commands = append(commands, []string{"HPEXPIREAT", key,
+					fmt.Sprintf("%d", at.UnixMilli()), "FIELDS", "1", field})
+			}
 			
 		case "zset":
 			if zset := s.store.GetZSet(key); zset != nil {
@@ -76,6 +81,16 @@ func (s *Server) getCurrentDatabaseState() ([][]string, error) {
 						fmt.Sprintf("%g", member.Score), member.Member})
 				}
 			}
+
+		case "stream":
+			if stream := s.store.StreamSnapshot(key); stream != nil {
+				commands = append(commands, streamRewriteCommands(key, stream)...)
+			}
+
+		case "ReJSON-RL", "TSDB-TYPE", "MBbloom--", "MBbloomCF", "CMSk-TYPE", "TopK-TYPE", "TDIS-TYPE":
+			if payload, exists, err := s.store.Dump(key); err == nil && exists {
+				commands = append(commands, []string{"RESTORE", key, "0", string(payload), "REPLACE"})
+			}
 		}
 		
 		// Add expiration if key has TTL
@@ -85,11 +100,48 @@ func (s *Server) getCurrentDatabaseState() ([][]string, error) {
 		}
 	}
 
+	for _, def := range s.store.SearchIndexDefinitions() {
+		commands = append(commands, append([]string{"FT.CREATE"}, def.Args()...))
+	}
+
 	return commands, nil
 }
 
+// streamRewriteCommands recreates a stream with its consumer groups,
+// consumers and pending entries
+func streamRewriteCommands(key string, stream *persistence.StreamData) [][]string {
+	var commands [][]string
+
+	for _, entry := range stream.Entries {
+		commands = append(commands, append([]string{"XADD", key, entry.ID}, entry.Values...))
+	}
+
+	if len(stream.Entries) == 0 {
+		commands = append(commands, []string{"XADD", key, "MAXLEN", "0", "0-1", "x", "y"})
+	}
+	commands = append(commands, []string{"XSETID", key, stream.LastID,
+		"ENTRIESADDED", fmt.Sprintf("%d", stream.EntriesAdded),
+		"MAXDELETEDID", stream.MaxDeletedID})
+
+	for _, group := range stream.Groups {
+		commands = append(commands, []string{"XGROUP", "CREATE", key, group.Name, group.LastDeliveredID,
+			"ENTRIESREAD", fmt.Sprintf("%d", group.EntriesRead)})
+		for _, consumer := range group.Consumers {
+			commands = append(commands, []string{"XGROUP", "CREATECONSUMER", key, group.Name, consumer.Name})
+		}
+		for _, pending := range group.Pending {
+			commands = append(commands, []string{"XCLAIM", key, group.Name, pending.Consumer, "0", pending.ID,
+				"TIME", fmt.Sprintf("%d", pending.DeliveryTime.UnixMilli()),
+				"RETRYCOUNT", fmt.Sprintf("%d", pending.DeliveryCount),
+				"FORCE", "JUSTID"})
+		}
+	}
+
+	return commands
+}
+
 func (s *Server) logCommandToAOF(command string, args []string) {
-	if s.aof == nil || !s.aof.IsEnabled() {
+	if s.aof == nil || !s.aof.IsEnabled() || s.aofLoading {
 		return
 	}
 
@@ -97,6 +149,17 @@ func (s *Server) logCommandToAOF(command string, args []string) {
 		return
 	}
 
+	s.propagateToAOF(command, args)
+}
+
+// propagateToAOF appends a command to the AOF without consulting the list of
+// write commands. Handlers use it to log a deterministic rewrite of what they
+// executed, e.g. relative expirations converted to absolute ones.
+func (s *Server) propagateToAOF(command string, args []string) {
+	if s.aof == nil || !s.aof.IsEnabled() || s.aofLoading {
+		return
+	}
+
 	fullCommand := make([]string, len(args)+1)
 	fullCommand[0] = command
 	copy(fullCommand[1:], args)
@@ -108,8 +171,8 @@ func (s *Server) executeCommandWithAOF(command string, args []string, connKey st
 	// Execute the command first
 	result := s.executeCommandWithoutAOF(command, args, connKey)
 	
-	// Only log if command was successful (doesn't start with -ERR)
-	if !strings.HasPrefix(result, "-ERR") {
+	// Only log if command was successful (not an error reply)
+	if !strings.HasPrefix(result, "-") {
 		s.logCommandToAOF(command, args)
 	}
 	
@@ -160,6 +223,18 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 		return s.handlePTTL(args)
 	case "RANDOMKEY":
 		return s.handleRandomKey(args)
+	case "OBJECT":
+		return s.handleObject(args)
+	case "SORT":
+		return s.handleSort(args)
+	case "SORT_RO":
+		return s.handleSortRO(args)
+	case "DUMP":
+		return s.handleDump(args)
+	case "RESTORE":
+		return s.handleRestore(args)
+	case "MIGRATE":
+		return s.handleMigrate(args)
 	
 	// List commands
 	case "LPUSH":
@@ -183,9 +258,9 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 	case "LINSERT":
 		return s.handleLInsert(args)
 	case "BLPOP":
-		return s.handleBLPop(args)
+		return s.handleBLPop(args, connKey)
 	case "BRPOP":
-		return s.handleBRPop(args)
+		return s.handleBRPop(args, connKey)
 	
 	// Hash commands
 	case "HSET":
@@ -216,6 +291,30 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 		return s.handleHSetNX(args)
 	case "HSCAN":
 		return s.handleHScan(args)
+	case "HEXPIRE":
+		return s.handleHExpire(args)
+	case "HPEXPIRE":
+		return s.handleHPExpire(args)
+	case "HEXPIREAT":
+		return s.handleHExpireAt(args)
+	case "HPEXPIREAT":
+		return s.handleHPExpireAt(args)
+	case "HTTL":
+		return s.handleHTTL(args)
+	case "HPTTL":
+		return s.handleHPTTL(args)
+	case "HEXPIRETIME":
+		return s.handleHExpireTime(args)
+	case "HPEXPIRETIME":
+		return s.handleHPExpireTime(args)
+	case "HPERSIST":
+		return s.handleHPersist(args)
+	case "HGETDEL":
+		return s.handleHGetDel(args)
+	case "HGETEX":
+		return s.handleHGetEx(args)
+	case "HSETEX":
+		return s.handleHSetEx(args)
 	case "HSTRLEN":
 		return s.handleHStrLen(args)
 	case "HRANDFIELD":
@@ -250,6 +349,12 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 		return s.handleSDiffStore(args)
 	case "SMOVE":
 		return s.handleSMove(args)
+	case "SMISMEMBER":
+		return s.handleSMIsMember(args)
+	case "SINTERCARD":
+		return s.handleSInterCard(args)
+	case "SSCAN":
+		return s.handleSScan(args)
 	
 	// Sorted Set commands
 	case "ZADD":
@@ -317,13 +422,19 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 	case "PUBLISH":
 		return s.handlePublish(args)
 	case "SUBSCRIBE":
-		return s.handleSubscribe(args, connKey, nil)
+		return s.handleSubscribe(args, connKey)
 	case "UNSUBSCRIBE":
 		return s.handleUnsubscribe(args, connKey)
 	case "PSUBSCRIBE":
-		return s.handlePSubscribe(args, connKey, nil)
+		return s.handlePSubscribe(args, connKey)
 	case "PUNSUBSCRIBE":
 		return s.handlePUnsubscribe(args, connKey)
+	case "SPUBLISH":
+		return s.handleSPublish(args)
+	case "SSUBSCRIBE":
+		return s.handleSSubscribe(args, connKey)
+	case "SUNSUBSCRIBE":
+		return s.handleSUnsubscribe(args, connKey)
 	case "PUBSUB":
 		return s.handlePubSub(args)
 	
@@ -362,11 +473,131 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 		return s.handleJSONObjKeys(args)
 	case "JSON.OBJLEN":
 		return s.handleJSONObjLen(args)
+	case "JSON.MSET":
+		return s.handleJSONMSet(args)
+	case "JSON.MERGE":
+		return s.handleJSONMerge(args)
+	case "JSON.TOGGLE":
+		return s.handleJSONToggle(args)
+	case "JSON.CLEAR":
+		return s.handleJSONClear(args)
+	case "JSON.DEBUG":
+		return s.handleJSONDebug(args)
 	case "JSON.MGET":
 		return s.handleJSONMGet(args)
 	case "JSON.RESP":
 		return s.handleJSONResp(args)
 	
+	// Search commands
+	case "FT.CREATE":
+		return s.handleFTCreate(args)
+	case "FT.SEARCH":
+		return s.handleFTSearch(args)
+	case "FT.AGGREGATE":
+		return s.handleFTAggregate(args)
+	case "FT.INFO":
+		return s.handleFTInfo(args)
+	case "FT.DROPINDEX":
+		return s.handleFTDropIndex(args)
+	case "FT._LIST":
+		return s.handleFTList(args)
+	
+	// Time series commands
+	case "TS.CREATE":
+		return s.handleTSCreate(args)
+	case "TS.ALTER":
+		return s.handleTSAlter(args)
+	case "TS.ADD":
+		return s.handleTSAdd(args)
+	case "TS.MADD":
+		return s.handleTSMAdd(args)
+	case "TS.INCRBY", "TS.DECRBY":
+		return s.handleTSIncrBy(command, args)
+	case "TS.DEL":
+		return s.handleTSDel(args)
+	case "TS.GET":
+		return s.handleTSGet(args)
+	case "TS.MGET":
+		return s.handleTSMGet(args)
+	case "TS.RANGE", "TS.REVRANGE":
+		return s.handleTSRange(command, args)
+	case "TS.MRANGE", "TS.MREVRANGE":
+		return s.handleTSMRange(command, args)
+	case "TS.QUERYINDEX":
+		return s.handleTSQueryIndex(args)
+	case "TS.INFO":
+		return s.handleTSInfo(args)
+	case "TS.CREATERULE":
+		return s.handleTSCreateRule(args)
+	case "TS.DELETERULE":
+		return s.handleTSDeleteRule(args)
+	// Probabilistic commands
+	case "BF.RESERVE":
+		return s.handleBFReserve(args)
+	case "BF.ADD":
+		return s.handleBFAdd(args)
+	case "BF.MADD":
+		return s.handleBFMAdd(args)
+	case "BF.EXISTS":
+		return s.handleBFExists(args)
+	case "BF.MEXISTS":
+		return s.handleBFMExists(args)
+	case "BF.INFO":
+		return s.handleBFInfo(args)
+	case "CF.RESERVE":
+		return s.handleCFReserve(args)
+	case "CF.ADD", "CF.ADDNX":
+		return s.handleCFAdd(command, args)
+	case "CF.EXISTS":
+		return s.handleCFExists(args)
+	case "CF.MEXISTS":
+		return s.handleCFMExists(args)
+	case "CF.COUNT":
+		return s.handleCFCount(args)
+	case "CF.DEL":
+		return s.handleCFDel(args)
+	case "CF.INFO":
+		return s.handleCFInfo(args)
+	case "CMS.INITBYDIM":
+		return s.handleCMSInitByDim(args)
+	case "CMS.INITBYPROB":
+		return s.handleCMSInitByProb(args)
+	case "CMS.INCRBY":
+		return s.handleCMSIncrBy(args)
+	case "CMS.QUERY":
+		return s.handleCMSQuery(args)
+	case "CMS.MERGE":
+		return s.handleCMSMerge(args)
+	case "CMS.INFO":
+		return s.handleCMSInfo(args)
+	case "TOPK.RESERVE":
+		return s.handleTopKReserve(args)
+	case "TOPK.ADD":
+		return s.handleTopKAdd(args)
+	case "TOPK.INCRBY":
+		return s.handleTopKIncrBy(args)
+	case "TOPK.QUERY":
+		return s.handleTopKQuery(args)
+	case "TOPK.LIST":
+		return s.handleTopKList(args)
+	case "TOPK.INFO":
+		return s.handleTopKInfo(args)
+	case "TDIGEST.CREATE":
+		return s.handleTDigestCreate(args)
+	case "TDIGEST.ADD":
+		return s.handleTDigestAdd(args)
+	case "TDIGEST.QUANTILE":
+		return s.handleTDigestQuantile(args)
+	case "TDIGEST.CDF":
+		return s.handleTDigestCDF(args)
+	case "TDIGEST.MERGE":
+		return s.handleTDigestMerge(args)
+	case "TDIGEST.MIN", "TDIGEST.MAX":
+		return s.handleTDigestMinMax(command, args)
+	case "TDIGEST.RESET":
+		return s.handleTDigestReset(args)
+	case "TDIGEST.INFO":
+		return s.handleTDigestInfo(args)
 	// Stream commands
 	case "XADD":
 		return s.handleXAdd(args)
@@ -377,7 +608,7 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 	case "XREVRANGE":
 		return s.handleXRevRange(args)
 	case "XREAD":
-		return s.handleXRead(args)
+		return s.handleXRead(args, connKey)
 	case "XTRIM":
 		return s.handleXTrim(args)
 	case "XDEL":
@@ -386,6 +617,18 @@ func (s *Server) executeCommandWithoutAOF(command string, args []string, connKey
 		return s.handleXInfo(args)
 	case "XGROUP":
 		return s.handleXGroup(args)
+	case "XREADGROUP":
+		return s.handleXReadGroup(args, connKey)
+	case "XACK":
+		return s.handleXAck(args)
+	case "XPENDING":
+		return s.handleXPending(args)
+	case "XCLAIM":
+		return s.handleXClaim(args)
+	case "XAUTOCLAIM":
+		return s.handleXAutoClaim(args)
+	case "XSETID":
+		return s.handleXSetID(args)
 	
 	default:
 		return protocol.EncodeError(fmt.Sprintf("unknown command '%s'", command))
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// blockedClient is a client waiting for data on one or more keys
+type blockedClient struct {
+	keys  []string
+	ready chan struct{}
+}
+
+// BlockingKeys tracks the clients blocked on each key so that commands
+// adding data can wake them up
+type BlockingKeys struct {
+	mu      sync.Mutex
+	waiters map[string]map[*blockedClient]bool
+}
+
+func NewBlockingKeys() *BlockingKeys {
+	return &BlockingKeys{
+		waiters: make(map[string]map[*blockedClient]bool),
+	}
+}
+
+func (bk *BlockingKeys) add(keys []string) *blockedClient {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	client := &blockedClient{keys: keys, ready: make(chan struct{}, 1)}
+	for _, key := range keys {
+		if bk.waiters[key] == nil {
+			bk.waiters[key] = make(map[*blockedClient]bool)
+		}
+		bk.waiters[key][client] = true
+	}
+	return client
+}
+
+func (bk *BlockingKeys) remove(client *blockedClient) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	for _, key := range client.keys {
+		delete(bk.waiters[key], client)
+		if len(bk.waiters[key]) == 0 {
+			delete(bk.waiters, key)
+		}
+	}
+}
+
+func (bk *BlockingKeys) signal(key string) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	for client := range bk.waiters[key] {
+		client.wake()
+	}
+}
+
+// signalAll wakes up every blocked client, for commands that replace whole
+// databases
+func (bk *BlockingKeys) signalAll() {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	for _, clients := range bk.waiters {
+		for client := range clients {
+			client.wake()
+		}
+	}
+}
+
+func (bk *BlockingKeys) empty() bool {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	return len(bk.waiters) == 0
+}
+
+func (client *blockedClient) wake() {
+	select {
+	case client.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) blockingKey(key string) string {
+	return blockingKeyIn(s.store.GetCurrentDBIndex(), key)
+}
+
+func blockingKeyIn(db int, key string) string {
+	return fmt.Sprintf("%d:%s", db, key)
+}
+
+// signalKeyReady wakes up the clients blocked on key after data was added
+func (s *Server) signalKeyReady(key string) {
+	s.blockingKeys.signal(s.blockingKey(key))
+}
+
+// signalKeyChanged wakes up the clients blocked on key in db after the
+// store raised an event on it, which is how a client blocked on a consumer
+// group learns that its stream or group was removed
+func (s *Server) signalKeyChanged(db int, key string) {
+	if s.blockingKeys.empty() {
+		return
+	}
+	s.blockingKeys.signal(blockingKeyIn(db, key))
+}
+
+// blockOn calls try until it reports that it is done. Between attempts the
+// client is blocked until one of keys is signalled, the timeout expires (zero
+// blocks forever) or the client disconnects, in which case it returns false.
+// Clients without a connection, such as the AOF loader or a transaction,
+// never block.
+func (s *Server) blockOn(connKey string, keys []string, timeout time.Duration, try func() bool) bool {
+	if try() {
+		return true
+	}
+	if s.aofLoading {
+		return false
+	}
+
+	clientConn := s.connPool.GetConnection(connKey)
+	if clientConn == nil || clientConn.parser == nil {
+		return false
+	}
+
+	blockingKeys := make([]string, len(keys))
+	for i, key := range keys {
+		blockingKeys[i] = s.blockingKey(key)
+	}
+	client := s.blockingKeys.add(blockingKeys)
+	defer s.blockingKeys.remove(client)
+
+	// Data may have arrived between the first attempt and registering
+	if try() {
+		return true
+	}
+
+	clientConn.blocked.Store(true)
+	defer clientConn.blocked.Store(false)
+	closed, stopWatching := clientConn.watchDisconnect()
+	defer stopWatching()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-client.ready:
+			if try() {
+				return true
+			}
+		case <-expired:
+			return false
+		case <-closed:
+			return false
+		case <-clientConn.ctx.Done():
+			return false
+		}
+	}
+}
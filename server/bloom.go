@@ -0,0 +1,334 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"keyra/protocol"
+	"keyra/store"
+)
+
+// BF.RESERVE key error_rate capacity [EXPANSION expansion] [NONSCALING]
+func (s *Server) handleBFReserve(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.RESERVE' command")
+	}
+
+	errorRate, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return protocol.EncodeError("ERR bad error rate")
+	}
+	if errorRate <= 0 || errorRate >= 1 {
+		return protocol.EncodeError("ERR (0 < error rate range < 1)")
+	}
+	capacity, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("ERR bad capacity")
+	}
+	if capacity <= 0 || capacity > store.MaxBloomCapacity {
+		return protocol.EncodeError(fmt.Sprintf("ERR (capacity should be between 1 and %d)", store.MaxBloomCapacity))
+	}
+
+	expansion := int64(store.DefaultBloomExpansion)
+	nonScaling, expansionSet := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NONSCALING":
+			nonScaling = true
+		case "EXPANSION":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("ERR no expansion")
+			}
+			expansion, err = strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || expansion < 1 || expansion > store.MaxBloomExpansion {
+				return protocol.EncodeError(fmt.Sprintf("ERR expansion should be between 1 and %d", store.MaxBloomExpansion))
+			}
+			expansionSet = true
+			i++
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+	if nonScaling && expansionSet {
+		return protocol.EncodeError("ERR Nonscaling filters cannot expand")
+	}
+
+	if err := s.store.BFReserve(args[0], errorRate, capacity, expansion, nonScaling); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// BF.ADD key item
+func (s *Server) handleBFAdd(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.ADD' command")
+	}
+
+	added, errs, err := s.store.BFAdd(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if errs[0] != nil {
+		return protocol.EncodeError(errs[0].Error())
+	}
+	return encodeBool(added[0])
+}
+
+// BF.MADD key item [item ...]
+func (s *Server) handleBFMAdd(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.MADD' command")
+	}
+
+	added, errs, err := s.store.BFAdd(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(added)))
+	for i := range added {
+		if errs[i] != nil {
+			response.WriteString(protocol.EncodeError(errs[i].Error()))
+		} else {
+			response.WriteString(encodeBool(added[i]))
+		}
+	}
+	return response.String()
+}
+
+// BF.EXISTS key item
+func (s *Server) handleBFExists(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.EXISTS' command")
+	}
+
+	exists, err := s.store.BFExists(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBool(exists[0])
+}
+
+// BF.MEXISTS key item [item ...]
+func (s *Server) handleBFMExists(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.MEXISTS' command")
+	}
+
+	exists, err := s.store.BFExists(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBoolArray(exists)
+}
+
+// BF.INFO key [CAPACITY | SIZE | FILTERS | ITEMS | EXPANSION]
+func (s *Server) handleBFInfo(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'BF.INFO' command")
+	}
+
+	info, err := s.store.BFInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	expansion := protocol.EncodeInteger(int(info.Expansion))
+	if info.Expansion == 0 {
+		expansion = protocol.EncodeNull()
+	}
+	fields := []struct {
+		option, name, value string
+	}{
+		{"CAPACITY", "Capacity", protocol.EncodeInteger(int(info.Capacity))},
+		{"SIZE", "Size", protocol.EncodeInteger(int(info.Size))},
+		{"FILTERS", "Number of filters", protocol.EncodeInteger(int(info.Filters))},
+		{"ITEMS", "Number of items inserted", protocol.EncodeInteger(int(info.Items))},
+		{"EXPANSION", "Expansion rate", expansion},
+	}
+
+	if len(args) == 2 {
+		for _, field := range fields {
+			if strings.EqualFold(args[1], field.option) {
+				return "*1\r\n" + field.value
+			}
+		}
+		return protocol.EncodeError("ERR Invalid information value")
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(fields)*2))
+	for _, field := range fields {
+		response.WriteString(encodeBulk(field.name))
+		response.WriteString(field.value)
+	}
+	return response.String()
+}
+
+// CF.RESERVE key capacity [BUCKETSIZE bucketsize] [MAXITERATIONS maxiterations] [EXPANSION expansion]
+func (s *Server) handleCFReserve(args []string) string {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.RESERVE' command")
+	}
+
+	capacity, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("ERR Bad capacity")
+	}
+	if capacity <= 0 {
+		return protocol.EncodeError("ERR (capacity should be larger than 0)")
+	}
+
+	bucketSize := store.DefaultCuckooBucketSize
+	maxIterations := store.DefaultCuckooMaxIterations
+	expansion := int64(store.DefaultCuckooExpansion)
+	for i := 2; i < len(args); i += 2 {
+		value, err := strconv.ParseInt(args[i+1], 10, 64)
+		switch strings.ToUpper(args[i]) {
+		case "BUCKETSIZE":
+			if err != nil || value < 1 || value > 255 {
+				return protocol.EncodeError("ERR bucket size should be between 1 and 255")
+			}
+			bucketSize = int(value)
+		case "MAXITERATIONS":
+			if err != nil || value < 1 || value > 65535 {
+				return protocol.EncodeError("ERR max iterations should be between 1 and 65535")
+			}
+			maxIterations = int(value)
+		case "EXPANSION":
+			if err != nil || value < 0 || value > 32768 {
+				return protocol.EncodeError("ERR expansion should be between 0 and 32768")
+			}
+			expansion = value
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+
+	if err := s.store.CFReserve(args[0], capacity, bucketSize, maxIterations, expansion); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// CF.ADD key item / CF.ADDNX key item
+func (s *Server) handleCFAdd(command string, args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+	}
+
+	added, err := s.store.CFAdd(args[0], args[1], command == "CF.ADDNX")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBool(added)
+}
+
+// CF.EXISTS key item
+func (s *Server) handleCFExists(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.EXISTS' command")
+	}
+
+	counts, err := s.store.CFCount(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBool(counts[0] > 0)
+}
+
+// CF.MEXISTS key item [item ...]
+func (s *Server) handleCFMExists(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.MEXISTS' command")
+	}
+
+	counts, err := s.store.CFCount(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	exists := make([]bool, len(counts))
+	for i, count := range counts {
+		exists[i] = count > 0
+	}
+	return encodeBoolArray(exists)
+}
+
+// CF.COUNT key item
+func (s *Server) handleCFCount(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.COUNT' command")
+	}
+
+	counts, err := s.store.CFCount(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeInteger(int(counts[0]))
+}
+
+// CF.DEL key item
+func (s *Server) handleCFDel(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.DEL' command")
+	}
+
+	deleted, err := s.store.CFDel(args[0], args[1])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBool(deleted)
+}
+
+// CF.INFO key
+func (s *Server) handleCFInfo(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CF.INFO' command")
+	}
+
+	info, err := s.store.CFInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"Size", info.Size},
+		{"Number of buckets", info.Buckets},
+		{"Number of filters", info.Filters},
+		{"Number of items inserted", info.Inserted},
+		{"Number of items deleted", info.Deleted},
+		{"Bucket size", info.BucketSize},
+		{"Expansion rate", info.Expansion},
+		{"Max iterations", info.MaxIterations},
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(fields)*2))
+	for _, field := range fields {
+		response.WriteString(encodeBulk(field.name))
+		response.WriteString(protocol.EncodeInteger(int(field.value)))
+	}
+	return response.String()
+}
+
+func encodeBool(b bool) string {
+	if b {
+		return protocol.EncodeInteger(1)
+	}
+	return protocol.EncodeInteger(0)
+}
+
+func encodeBoolArray(values []bool) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		response.WriteString(encodeBool(v))
+	}
+	return response.String()
+}
@@ -121,6 +121,11 @@ func (rc *RuntimeConfig) initializeDefaults() {
 			Description: "Client output buffer limits",
 			ReadOnly:    false,
 		},
+		"notify-keyspace-events": {
+			Value:       "",
+			Description: "Keyspace event classes published to pub/sub",
+			ReadOnly:    false,
+		},
 		"hz": {
 			Value:       "10",
 			Description: "Background task frequency",
@@ -166,6 +171,41 @@ func (rc *RuntimeConfig) initializeDefaults() {
 			Description: "Load truncated AOF files",
 			ReadOnly:    false,
 		},
+		"hash-max-listpack-entries": {
+			Value:       "128",
+			Description: "Maximum number of fields in a listpack-encoded hash",
+			ReadOnly:    false,
+		},
+		"hash-max-listpack-value": {
+			Value:       "64",
+			Description: "Maximum field or value length in a listpack-encoded hash",
+			ReadOnly:    false,
+		},
+		"set-max-intset-entries": {
+			Value:       "512",
+			Description: "Maximum number of members in an intset-encoded set",
+			ReadOnly:    false,
+		},
+		"set-max-listpack-entries": {
+			Value:       "128",
+			Description: "Maximum number of members in a listpack-encoded set",
+			ReadOnly:    false,
+		},
+		"set-max-listpack-value": {
+			Value:       "64",
+			Description: "Maximum member length in a listpack-encoded set",
+			ReadOnly:    false,
+		},
+		"zset-max-listpack-entries": {
+			Value:       "128",
+			Description: "Maximum number of members in a listpack-encoded sorted set",
+			ReadOnly:    false,
+		},
+		"zset-max-listpack-value": {
+			Value:       "64",
+			Description: "Maximum member length in a listpack-encoded sorted set",
+			ReadOnly:    false,
+		},
 	}
 
 	for key, value := range defaults {
@@ -262,6 +302,19 @@ func (rc *RuntimeConfig) validateValue(key, value string) error {
 		if _, err := strconv.Atoi(value); err != nil {
 			return fmt.Errorf("invalid value for %s: must be a number", key)
 		}
+	case "hash-max-listpack-entries", "hash-max-listpack-value", "set-max-intset-entries", "set-max-listpack-entries",
+		"set-max-listpack-value", "zset-max-listpack-entries", "zset-max-listpack-value":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("invalid value for %s: must be a non-negative number", key)
+		}
+	case "client-output-buffer-limit":
+		if _, err := parseOutputBufferLimits(value); err != nil {
+			return err
+		}
+	case "notify-keyspace-events":
+		if _, err := parseKeyspaceEvents(value); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -423,5 +476,37 @@ func (s *Server) applyConfigChange(key, value string) {
 			s.aof.SetSyncPolicy(value)
 			fmt.Printf("AOF sync policy set to %s\n", value)
 		}
+	case "hash-max-listpack-entries", "hash-max-listpack-value", "set-max-intset-entries", "set-max-listpack-entries",
+		"set-max-listpack-value", "zset-max-listpack-entries", "zset-max-listpack-value":
+		if n, err := strconv.Atoi(value); err == nil {
+			config := s.store.GetEncodingConfig()
+			switch key {
+			case "hash-max-listpack-entries":
+				config.HashMaxListpackEntries = n
+			case "hash-max-listpack-value":
+				config.HashMaxListpackValue = n
+			case "set-max-intset-entries":
+				config.SetMaxIntsetEntries = n
+			case "set-max-listpack-entries":
+				config.SetMaxListpackEntries = n
+			case "set-max-listpack-value":
+				config.SetMaxListpackValue = n
+			case "zset-max-listpack-entries":
+				config.ZSetMaxListpackEntries = n
+			case "zset-max-listpack-value":
+				config.ZSetMaxListpackValue = n
+			}
+			s.store.SetEncodingConfig(config)
+		}
+	case "client-output-buffer-limit":
+		// Classes left out of value keep their limits, so store all of them
+		if err := s.outputLimits.Set(value); err == nil {
+			s.runtimeConfig.Set(key, s.outputLimits.String())
+		}
+	case "notify-keyspace-events":
+		if events, err := parseKeyspaceEvents(value); err == nil {
+			s.keyspaceEvents.Store(uint32(events))
+			s.runtimeConfig.Set(key, events.String())
+		}
 	}
 }
@@ -7,6 +7,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"keyra/protocol"
 )
 
 type ConnectionPool struct {
@@ -27,8 +29,19 @@ type ClientConnection struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	writeMu      sync.Mutex
+	writeTimeout time.Duration
+	parser       *protocol.Parser
+	blocked      atomic.Bool
+	subscribed   atomic.Bool
+	// softLimitSince is when the reply being written went over the soft
+	// output buffer limit
+	softLimitSince time.Time
 }
 
+// outputStallInterval is how long a reply write may block before the bytes
+// the client has not taken yet are checked against its output buffer limit
+const outputStallInterval = 100 * time.Millisecond
+
 type TrackedConn struct {
 	net.Conn
 	server *Server
@@ -104,6 +117,7 @@ func (cp *ConnectionPool) AcceptConnection(conn net.Conn) (*ClientConnection, er
 		lastActivity: time.Now(),
 		ctx:          ctx,
 		cancel:       cancel,
+		writeTimeout: cp.writeTimeout,
 	}
 	
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
@@ -165,6 +179,41 @@ func (cc *ClientConnection) WriteWithTimeout(data []byte, timeout time.Duration)
 	return err
 }
 
+// writeReply writes a command reply, holding the bytes the client has not
+// taken yet against limit whenever the write stalls. It reports whether the
+// client reached the limit, in which case the rest of the reply is dropped.
+func (cc *ClientConnection) writeReply(data []byte, timeout time.Duration, limit OutputBufferLimit) (bool, error) {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	defer cc.conn.SetWriteDeadline(time.Time{})
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		stall := time.Now().Add(outputStallInterval)
+		if !deadline.IsZero() && deadline.Before(stall) {
+			stall = deadline
+		}
+		cc.conn.SetWriteDeadline(stall)
+
+		n, err := cc.conn.Write(data)
+		data = data[n:]
+		now := time.Now()
+		if err == nil {
+			cc.softLimitSince = time.Time{}
+			return false, nil
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || (!deadline.IsZero() && !now.Before(deadline)) {
+			return false, err
+		}
+		if limit.reached(int64(len(data)), &cc.softLimitSince, now) {
+			return true, nil
+		}
+	}
+}
+
 func (cc *ClientConnection) SetReadTimeout(timeout time.Duration) error {
 	if timeout > 0 {
 		return cc.conn.SetReadDeadline(time.Now().Add(timeout))
@@ -172,6 +221,31 @@ func (cc *ClientConnection) SetReadTimeout(timeout time.Duration) error {
 	return cc.conn.SetReadDeadline(time.Time{})
 }
 
+// watchDisconnect reports on the returned channel when the peer closes the
+// connection while no command is being read. The returned function stops
+// watching and must be called before the connection is read again.
+func (cc *ClientConnection) watchDisconnect() (<-chan struct{}, func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+
+	cc.conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(done)
+		if err := cc.parser.Peek(); err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				close(closed)
+			}
+		}
+	}()
+
+	stop := func() {
+		cc.conn.SetReadDeadline(time.Now())
+		<-done
+		cc.conn.SetReadDeadline(time.Time{})
+	}
+	return closed, stop
+}
+
 func (cp *ConnectionPool) cleanupIdleConnections() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -192,7 +266,7 @@ func (cp *ConnectionPool) removeIdleConnections() {
 	
 	cp.mu.RLock()
 	for connID, clientConn := range cp.connections {
-		if now.Sub(clientConn.lastActivity) > cp.idleTimeout {
+		if now.Sub(clientConn.lastActivity) > cp.idleTimeout && !clientConn.blocked.Load() && !clientConn.subscribed.Load() {
 			toRemove = append(toRemove, connID)
 		}
 	}
@@ -53,6 +53,7 @@ func (s *Server) handleSwapDB(args []string) string {
 	}
 
 	if s.store.SwapDB(db1, db2) {
+		s.blockingKeys.signalAll()
 		return protocol.EncodeSimpleString("OK")
 	}
 	return protocol.EncodeError("invalid DB index")
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"keyra/protocol"
+)
+
+// DUMP key
+func (s *Server) handleDump(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("wrong number of arguments for 'dump' command")
+	}
+
+	payload, exists, err := s.store.Dump(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if !exists {
+		return protocol.EncodeNull()
+	}
+	return protocol.EncodeBulkString(string(payload))
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func (s *Server) handleRestore(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("wrong number of arguments for 'restore' command")
+	}
+
+	key := args[0]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.EncodeError("Invalid TTL value, must be >= 0")
+	}
+
+	replace, absTTL := false, false
+	hasIdleTime, hasFreq := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || hasFreq {
+				return protocol.EncodeError("syntax error")
+			}
+			idle, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return protocol.EncodeError("value is not an integer or out of range")
+			}
+			if idle < 0 {
+				return protocol.EncodeError("Invalid IDLETIME value, must be >= 0")
+			}
+			hasIdleTime = true
+			i++
+		case "FREQ":
+			if i+1 >= len(args) || hasIdleTime {
+				return protocol.EncodeError("syntax error")
+			}
+			freq, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return protocol.EncodeError("value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return protocol.EncodeError("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			hasFreq = true
+			i++
+		default:
+			return protocol.EncodeError("syntax error")
+		}
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+
+	if err := s.store.Restore(key, []byte(args[2]), expireAt, replace); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	// Propagate an absolute expiration so that replaying the AOF does not
+	// shift the deadline
+	deadline := "0"
+	if !expireAt.IsZero() {
+		deadline = strconv.FormatInt(expireAt.UnixMilli(), 10)
+	}
+	logArgs := []string{key, deadline, args[2], "ABSTTL"}
+	if replace {
+		logArgs = append(logArgs, "REPLACE")
+	}
+	s.propagateToAOF("RESTORE", logArgs)
+	s.signalKeyReady(key)
+	return protocol.EncodeSimpleString("OK")
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+func (s *Server) handleMigrate(args []string) string {
+	if len(args) < 5 {
+		return protocol.EncodeError("wrong number of arguments for 'migrate' command")
+	}
+
+	host, port := args[0], args[1]
+	destDB, err := strconv.Atoi(args[3])
+	if err != nil {
+		return protocol.EncodeError("value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("value is not an integer or out of range")
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = 1000
+	}
+
+	copyKeys, replace := false, false
+	var auth []string
+	keys := []string{args[2]}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			auth = []string{"AUTH", args[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return protocol.EncodeError("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return protocol.EncodeError("syntax error")
+		}
+	}
+
+	var request strings.Builder
+	if auth != nil {
+		request.WriteString(protocol.EncodeStringArray(auth))
+	}
+	request.WriteString(protocol.EncodeStringArray([]string{"SELECT", strconv.Itoa(destDB)}))
+
+	var migrated []string
+	for _, key := range keys {
+		payload, exists, err := s.store.Dump(key)
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		if !exists {
+			continue
+		}
+
+		ttl := s.store.PTTL(key)
+		if ttl < 0 {
+			ttl = 0
+		} else if ttl == 0 {
+			ttl = 1
+		}
+
+		restore := []string{"RESTORE", key, strconv.Itoa(ttl), string(payload)}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		request.WriteString(protocol.EncodeStringArray(restore))
+		migrated = append(migrated, key)
+	}
+
+	if len(migrated) == 0 {
+		return protocol.EncodeSimpleString("NOKEY")
+	}
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return protocol.EncodeError("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		return protocol.EncodeError("IOERR error or timeout writing to target instance")
+	}
+
+	parser := protocol.NewParser(conn)
+	preamble := 1
+	if auth != nil {
+		preamble++
+	}
+	for i := 0; i < preamble; i++ {
+		reply, err := parser.ParseReply()
+		if err != nil {
+			return protocol.EncodeError("IOERR error or timeout reading to target instance")
+		}
+		if reply[0] == '-' {
+			return protocol.EncodeError("Target instance replied with error: " + reply[1:])
+		}
+	}
+
+	var restored []string
+	var replyErr string
+	for _, key := range migrated {
+		reply, err := parser.ParseReply()
+		if err != nil {
+			replyErr = "IOERR error or timeout reading to target instance"
+			break
+		}
+		if reply[0] == '-' {
+			if replyErr == "" {
+				replyErr = "Target instance replied with error: " + reply[1:]
+			}
+			continue
+		}
+		restored = append(restored, key)
+	}
+
+	if !copyKeys && len(restored) > 0 {
+		for _, key := range restored {
+			s.store.Del(key)
+		}
+		s.logCommandToAOF("DEL", restored)
+	}
+
+	if replyErr != "" {
+		return protocol.EncodeError(replyErr)
+	}
+	return protocol.EncodeSimpleString("OK")
+}
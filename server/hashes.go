@@ -5,8 +5,10 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
 	"keyra/protocol"
+	"keyra/store"
 )
 
 // Hash commands
@@ -32,21 +34,13 @@ func (s *Server) handleHSet(args []string) string {
 		return protocol.EncodeInteger(0)
 	}
 
-	existingHash := s.store.HGetAll(key)
-	newFields := 0
 	fieldMap := make(map[string]string)
-	
 	for i := 0; i < len(fieldValuePairs); i += 2 {
-		field := fieldValuePairs[i]
-		value := fieldValuePairs[i+1]
-		fieldMap[field] = value
-		
-		if _, exists := existingHash[field]; !exists {
-			newFields++
-		}
+		fieldMap[fieldValuePairs[i]] = fieldValuePairs[i+1]
 	}
 	
-	if !s.store.HMSet(key, fieldMap) {
+	newFields, ok := s.store.HMSet(key, fieldMap)
+	if !ok {
 		return protocol.EncodeError("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 	
@@ -199,7 +193,7 @@ func (s *Server) handleHMSet(args []string) string {
 		fieldMap[fieldValuePairs[i]] = fieldValuePairs[i+1]
 	}
 
-	if s.store.HMSet(key, fieldMap) {
+	if _, ok := s.store.HMSet(key, fieldMap); ok {
 		return protocol.EncodeSimpleString("OK")
 	}
 	return protocol.EncodeError("WRONGTYPE Operation against a key holding the wrong kind of value")
@@ -272,7 +266,7 @@ func (s *Server) handleHScan(args []string) string {
 	
 	var matchedFields []string
 	for field := range hash {
-		if matchPattern(pattern, field) {
+		if store.GlobMatch(pattern, field) {
 			matchedFields = append(matchedFields, field)
 		}
 	}
@@ -393,42 +387,376 @@ func (s *Server) handleHRandField(args []string) string {
 	return result
 }
 
-func matchPattern(pattern, str string) bool {
-	if pattern == "*" {
-		return true
+const wrongTypeError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// parseHashFields parses "FIELDS numfields field [field ...]" starting at
+// args[start] and returns the fields
+func parseHashFields(args []string, start int) ([]string, string) {
+	if start >= len(args) || strings.ToUpper(args[start]) != "FIELDS" {
+		return nil, "Mandatory argument FIELDS is missing or not at the right position"
 	}
-	
-	if !strings.Contains(pattern, "*") && !strings.Contains(pattern, "?") {
-		return pattern == str
+	if start+1 >= len(args) {
+		return nil, "wrong number of arguments"
 	}
-	
-	return simpleGlobMatch(pattern, str)
+	numFields, err := strconv.Atoi(args[start+1])
+	if err != nil || numFields <= 0 {
+		return nil, "Parameter `numFields` should be greater than 0"
+	}
+	fields := args[start+2:]
+	if len(fields) != numFields {
+		return nil, "The `numfields` parameter must match the number of arguments"
+	}
+	return fields, ""
+}
+
+func fieldsArgs(key string, fields []string) []string {
+	args := []string{key, "FIELDS", strconv.Itoa(len(fields))}
+	return append(args, fields...)
 }
 
-func simpleGlobMatch(pattern, str string) bool {
-	if pattern == "" {
-		return str == ""
+func encodeIntegerArray(values []int) string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		result.WriteString(protocol.EncodeInteger(v))
 	}
-	if pattern == "*" {
-		return true
+	return result.String()
+}
+
+func encodeOptionalValues(values []string, found []bool) string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for i, v := range values {
+		if found[i] {
+			result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+		} else {
+			result.WriteString(protocol.EncodeNull())
+		}
 	}
-	
-	if len(pattern) > 0 && pattern[0] == '*' {
-		for i := 0; i <= len(str); i++ {
-			if simpleGlobMatch(pattern[1:], str[i:]) {
-				return true
+	return result.String()
+}
+
+// HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func (s *Server) handleHExpire(args []string) string {
+	return s.hashExpireCommand("hexpire", args, time.Second, false)
+}
+
+// HPEXPIRE key milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func (s *Server) handleHPExpire(args []string) string {
+	return s.hashExpireCommand("hpexpire", args, time.Millisecond, false)
+}
+
+// HEXPIREAT key unix-time-seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func (s *Server) handleHExpireAt(args []string) string {
+	return s.hashExpireCommand("hexpireat", args, time.Second, true)
+}
+
+// HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func (s *Server) handleHPExpireAt(args []string) string {
+	return s.hashExpireCommand("hpexpireat", args, time.Millisecond, true)
+}
+
+func (s *Server) hashExpireCommand(name string, args []string, unit time.Duration, absolute bool) string {
+	if len(args) < 5 {
+		return protocol.EncodeError(fmt.Sprintf("wrong number of arguments for '%s' command", name))
+	}
+
+	key := args[0]
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("value is not an integer or out of range")
+	}
+	if amount < 0 {
+		return protocol.EncodeError(fmt.Sprintf("invalid expire time in '%s' command", name))
+	}
+
+	condition := ""
+	fieldsAt := 2
+	switch strings.ToUpper(args[2]) {
+	case "NX", "XX", "GT", "LT":
+		condition = strings.ToUpper(args[2])
+		fieldsAt = 3
+	}
+
+	fields, errMsg := parseHashFields(args, fieldsAt)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
+	}
+
+	var at time.Time
+	if absolute {
+		at = time.UnixMilli(amount * unit.Milliseconds())
+	} else {
+		at = time.Now().Add(time.Duration(amount) * unit)
+	}
+
+	results, ok := s.store.HExpireAt(key, at, condition, fields...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+
+	// Propagate an absolute expiration so that replaying the AOF does not
+	// shift the deadline
+	var changed []string
+	for i, result := range results {
+		if result == store.HashFieldTTLSet || result == store.HashFieldExpiredNow {
+			changed = append(changed, fields[i])
+		}
+	}
+	if len(changed) > 0 {
+		logArgs := fieldsArgs(key, changed)
+		logArgs = append([]string{logArgs[0], strconv.FormatInt(at.UnixMilli(), 10)}, logArgs[1:]...)
+		s.propagateToAOF("HPEXPIREAT", logArgs)
+	}
+
+	return encodeIntegerArray(results)
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+func (s *Server) handleHPersist(args []string) string {
+	if len(args) < 4 {
+		return protocol.EncodeError("wrong number of arguments for 'hpersist' command")
+	}
+
+	fields, errMsg := parseHashFields(args, 1)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
+	}
+
+	results, ok := s.store.HPersist(args[0], fields...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+	return encodeIntegerArray(results)
+}
+
+// HTTL key FIELDS numfields field [field ...]
+func (s *Server) handleHTTL(args []string) string {
+	return s.hashTTLCommand("httl", args, func(at time.Time) int {
+		return int((time.Until(at) + time.Second - 1) / time.Second)
+	})
+}
+
+// HPTTL key FIELDS numfields field [field ...]
+func (s *Server) handleHPTTL(args []string) string {
+	return s.hashTTLCommand("hpttl", args, func(at time.Time) int {
+		return int(time.Until(at).Milliseconds())
+	})
+}
+
+// HEXPIRETIME key FIELDS numfields field [field ...]
+func (s *Server) handleHExpireTime(args []string) string {
+	return s.hashTTLCommand("hexpiretime", args, func(at time.Time) int {
+		return int(at.Unix())
+	})
+}
+
+// HPEXPIRETIME key FIELDS numfields field [field ...]
+func (s *Server) handleHPExpireTime(args []string) string {
+	return s.hashTTLCommand("hpexpiretime", args, func(at time.Time) int {
+		return int(at.UnixMilli())
+	})
+}
+
+func (s *Server) hashTTLCommand(name string, args []string, convert func(time.Time) int) string {
+	if len(args) < 4 {
+		return protocol.EncodeError(fmt.Sprintf("wrong number of arguments for '%s' command", name))
+	}
+
+	fields, errMsg := parseHashFields(args, 1)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
+	}
+
+	expirations, found, ok := s.store.HFieldExpirations(args[0], fields...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+
+	results := make([]int, len(fields))
+	for i := range fields {
+		switch {
+		case !found[i]:
+			results[i] = store.HashFieldMissing
+		case expirations[i].IsZero():
+			results[i] = store.HashFieldNoTTL
+		default:
+			results[i] = convert(expirations[i])
+		}
+	}
+	return encodeIntegerArray(results)
+}
+
+// HGETDEL key FIELDS numfields field [field ...]
+func (s *Server) handleHGetDel(args []string) string {
+	if len(args) < 4 {
+		return protocol.EncodeError("wrong number of arguments for 'hgetdel' command")
+	}
+
+	key := args[0]
+	fields, errMsg := parseHashFields(args, 1)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
+	}
+
+	values, found, ok := s.store.HGetDel(key, fields...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+
+	var deleted []string
+	for i, field := range fields {
+		if found[i] {
+			deleted = append(deleted, field)
+		}
+	}
+	if len(deleted) > 0 {
+		s.logCommandToAOF("HDEL", append([]string{key}, deleted...))
+	}
+
+	return encodeOptionalValues(values, found)
+}
+
+// parseExpireOption parses an EX/PX/EXAT/PXAT option and its argument
+func parseExpireOption(option, value string) (time.Time, string) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, "value is not an integer or out of range"
+	}
+	if amount <= 0 {
+		return time.Time{}, "invalid expire time"
+	}
+
+	switch option {
+	case "EX":
+		return time.Now().Add(time.Duration(amount) * time.Second), ""
+	case "PX":
+		return time.Now().Add(time.Duration(amount) * time.Millisecond), ""
+	case "EXAT":
+		return time.Unix(amount, 0), ""
+	default:
+		return time.UnixMilli(amount), ""
+	}
+}
+
+// HGETEX key [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|PERSIST] FIELDS numfields field [field ...]
+func (s *Server) handleHGetEx(args []string) string {
+	if len(args) < 4 {
+		return protocol.EncodeError("wrong number of arguments for 'hgetex' command")
+	}
+
+	key := args[0]
+	var at time.Time
+	persist := false
+	fieldsAt := 1
+	switch option := strings.ToUpper(args[1]); option {
+	case "EX", "PX", "EXAT", "PXAT":
+		var errMsg string
+		at, errMsg = parseExpireOption(option, args[2])
+		if errMsg != "" {
+			return protocol.EncodeError(errMsg)
+		}
+		fieldsAt = 3
+	case "PERSIST":
+		persist = true
+		fieldsAt = 2
+	}
+
+	fields, errMsg := parseHashFields(args, fieldsAt)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
+	}
+
+	values, found, ok := s.store.HGetEx(key, at, persist, fields...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+
+	var touched []string
+	for i, field := range fields {
+		if found[i] {
+			touched = append(touched, field)
+		}
+	}
+	if len(touched) > 0 {
+		if persist {
+			s.propagateToAOF("HPERSIST", fieldsArgs(key, touched))
+		} else if !at.IsZero() {
+			logArgs := fieldsArgs(key, touched)
+			logArgs = append([]string{logArgs[0], strconv.FormatInt(at.UnixMilli(), 10)}, logArgs[1:]...)
+			s.propagateToAOF("HPEXPIREAT", logArgs)
+		}
+	}
+
+	return encodeOptionalValues(values, found)
+}
+
+// HSETEX key [FNX|FXX] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL] FIELDS numfields field value [field value ...]
+func (s *Server) handleHSetEx(args []string) string {
+	if len(args) < 5 {
+		return protocol.EncodeError("wrong number of arguments for 'hsetex' command")
+	}
+
+	key := args[0]
+	condition := ""
+	var at time.Time
+	keepTTL := false
+	i := 1
+	for ; i < len(args) && strings.ToUpper(args[i]) != "FIELDS"; i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "FNX", "FXX":
+			if condition != "" {
+				return protocol.EncodeError("syntax error")
+			}
+			condition = option
+		case "EX", "PX", "EXAT", "PXAT":
+			if !at.IsZero() || keepTTL || i+1 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			var errMsg string
+			at, errMsg = parseExpireOption(option, args[i+1])
+			if errMsg != "" {
+				return protocol.EncodeError(errMsg)
+			}
+			i++
+		case "KEEPTTL":
+			if !at.IsZero() {
+				return protocol.EncodeError("syntax error")
 			}
+			keepTTL = true
+		default:
+			return protocol.EncodeError("syntax error")
 		}
-		return false
 	}
-	
-	if len(str) == 0 {
-		return false
+
+	if i+1 >= len(args) {
+		return protocol.EncodeError("Mandatory argument FIELDS is missing or not at the right position")
 	}
-	
-	if len(pattern) > 0 && (pattern[0] == '?' || pattern[0] == str[0]) {
-		return simpleGlobMatch(pattern[1:], str[1:])
+	numFields, err := strconv.Atoi(args[i+1])
+	if err != nil || numFields <= 0 {
+		return protocol.EncodeError("Parameter `numFields` should be greater than 0")
 	}
-	
-	return false
+	fieldValues := args[i+2:]
+	if len(fieldValues) != numFields*2 {
+		return protocol.EncodeError("The `numfields` parameter must match the number of arguments")
+	}
+
+	set, ok := s.store.HSetEx(key, fieldValues, condition, at, keepTTL)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+	if !set {
+		return protocol.EncodeInteger(0)
+	}
+
+	logArgs := []string{key}
+	if !at.IsZero() {
+		logArgs = append(logArgs, "PXAT", strconv.FormatInt(at.UnixMilli(), 10))
+	} else if keepTTL {
+		logArgs = append(logArgs, "KEEPTTL")
+	}
+	logArgs = append(logArgs, "FIELDS", strconv.Itoa(numFields))
+	s.propagateToAOF("HSETEX", append(logArgs, fieldValues...))
+
+	return protocol.EncodeInteger(1)
 }
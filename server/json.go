@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"keyra/protocol"
+	"keyra/store"
 )
 
 // JSON.SET key path value [NX | XX]
@@ -28,28 +29,70 @@ func (s *Server) handleJSONSet(args []string) string {
 			nx = true
 		case "XX":
 			xx = true
+		default:
+			return protocol.EncodeError("ERR syntax error")
 		}
 	}
+	if nx && xx {
+		return protocol.EncodeError("ERR syntax error")
+	}
 
-	// Check NX/XX conditions
-	exists := s.store.Exists(key)
-	if nx && exists {
-		return protocol.EncodeNull()
+	// Parse the JSON value
+	value, err := store.ParseJSON(valueStr)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
 	}
-	if xx && !exists {
+
+	set, err := s.store.JSONSet(key, path, value, nx, xx)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if !set {
 		return protocol.EncodeNull()
 	}
+	return protocol.EncodeSimpleString("OK")
+}
 
-	// Parse the JSON value
-	var value interface{}
-	if err := json.Unmarshal([]byte(valueStr), &value); err != nil {
-		return protocol.EncodeError("ERR invalid JSON value")
+// JSON.MSET key path value [key path value ...]
+func (s *Server) handleJSONMSet(args []string) string {
+	if len(args) < 3 || len(args)%3 != 0 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.MSET' command")
 	}
 
-	if s.store.JSONSet(key, path, value) {
-		return protocol.EncodeSimpleString("OK")
+	sets := make([]store.JSONSetArgs, 0, len(args)/3)
+	for i := 0; i < len(args); i += 3 {
+		value, err := store.ParseJSON(args[i+2])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		sets = append(sets, store.JSONSetArgs{Key: args[i], Path: args[i+1], Value: value})
 	}
-	return protocol.EncodeError("ERR could not set JSON value")
+
+	if err := s.store.JSONMSet(sets); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// JSON.MERGE key path value
+func (s *Server) handleJSONMerge(args []string) string {
+	if len(args) != 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.MERGE' command")
+	}
+
+	patch, err := store.ParseJSON(args[2])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	merged, err := s.store.JSONMerge(args[0], args[1], patch)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if !merged {
+		return protocol.EncodeNull()
+	}
+	return protocol.EncodeSimpleString("OK")
 }
 
 // JSON.GET key [path [path ...]]
@@ -61,17 +104,43 @@ func (s *Server) handleJSONGet(args []string) string {
 	key := args[0]
 	paths := args[1:]
 
-	result, ok := s.store.JSONGet(key, paths...)
-	if !ok {
+	results, err := s.store.JSONGet(key, paths...)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if results == nil {
 		return protocol.EncodeNull()
 	}
 
-	jsonBytes, err := json.Marshal(result)
-	if err != nil {
-		return protocol.EncodeNull()
+	var result *store.JSONNode
+	if len(paths) <= 1 {
+		path := "."
+		if len(paths) == 1 {
+			path = paths[0]
+		}
+		if !store.IsLegacyJSONPath(path) {
+			result = &store.JSONNode{Kind: store.JSONArray, Items: results[0]}
+		} else if len(results[0]) > 0 {
+			result = results[0][0]
+		} else {
+			return protocol.EncodeNull()
+		}
+	} else {
+		legacy := true
+		for _, path := range paths {
+			legacy = legacy && store.IsLegacyJSONPath(path)
+		}
+		result = &store.JSONNode{Kind: store.JSONObject}
+		for i, path := range paths {
+			if !legacy {
+				result.Set(path, &store.JSONNode{Kind: store.JSONArray, Items: results[i]})
+			} else if len(results[i]) > 0 {
+				result.Set(path, results[i][0])
+			}
+		}
 	}
 
-	return protocol.EncodeBulkString(string(jsonBytes))
+	return protocol.EncodeBulkString(result.String())
 }
 
 // JSON.DEL key [path]
@@ -81,12 +150,15 @@ func (s *Server) handleJSONDel(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	count := s.store.JSONDel(key, path)
+	count, err := s.store.JSONDel(key, path)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
 	return protocol.EncodeInteger(count)
 }
 
@@ -102,17 +174,13 @@ func (s *Server) handleJSONType(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	jsonType := s.store.JSONType(key, path)
-	if jsonType == "" {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeBulkString(jsonType)
+	results, err := s.store.JSONType(key, path)
+	return encodeJSONResults(path, results, err, encodeJSONString)
 }
 
 // JSON.NUMINCRBY key path value
@@ -123,17 +191,13 @@ func (s *Server) handleJSONNumIncrBy(args []string) string {
 
 	key := args[0]
 	path := args[1]
-	increment, err := strconv.ParseFloat(args[2], 64)
-	if err != nil {
+	increment, err := store.ParseJSON(args[2])
+	if err != nil || !increment.IsNumber() {
 		return protocol.EncodeError("ERR value is not a valid float")
 	}
 
-	result, ok := s.store.JSONNumIncrBy(key, path, increment)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeBulkString(strconv.FormatFloat(result, 'f', -1, 64))
+	results, err := s.store.JSONNumIncrBy(key, path, increment)
+	return encodeJSONNumbers(path, results, err)
 }
 
 // JSON.NUMMULTBY key path value
@@ -144,17 +208,13 @@ func (s *Server) handleJSONNumMultBy(args []string) string {
 
 	key := args[0]
 	path := args[1]
-	multiplier, err := strconv.ParseFloat(args[2], 64)
-	if err != nil {
+	multiplier, err := store.ParseJSON(args[2])
+	if err != nil || !multiplier.IsNumber() {
 		return protocol.EncodeError("ERR value is not a valid float")
 	}
 
-	result, ok := s.store.JSONNumMultBy(key, path, multiplier)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeBulkString(strconv.FormatFloat(result, 'f', -1, 64))
+	results, err := s.store.JSONNumMultBy(key, path, multiplier)
+	return encodeJSONNumbers(path, results, err)
 }
 
 // JSON.STRAPPEND key [path] value
@@ -167,7 +227,7 @@ func (s *Server) handleJSONStrAppend(args []string) string {
 	var path, appendStr string
 
 	if len(args) == 2 {
-		path = "$"
+		path = "."
 		appendStr = args[1]
 	} else {
 		path = args[1]
@@ -181,12 +241,8 @@ func (s *Server) handleJSONStrAppend(args []string) string {
 		str = appendStr
 	}
 
-	result, ok := s.store.JSONStrAppend(key, path, str)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONStrAppend(key, path, str)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.STRLEN key [path]
@@ -196,17 +252,13 @@ func (s *Server) handleJSONStrLen(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	result, ok := s.store.JSONStrLen(key, path)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONStrLen(key, path)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.ARRAPPEND key path value [value ...]
@@ -217,22 +269,18 @@ func (s *Server) handleJSONArrAppend(args []string) string {
 
 	key := args[0]
 	path := args[1]
-	
-	values := make([]interface{}, 0, len(args)-2)
+
+	values := make([]*store.JSONNode, 0, len(args)-2)
 	for i := 2; i < len(args); i++ {
-		var value interface{}
-		if err := json.Unmarshal([]byte(args[i]), &value); err != nil {
-			return protocol.EncodeError("ERR invalid JSON value")
+		value, err := store.ParseJSON(args[i])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
 		}
 		values = append(values, value)
 	}
 
-	result, ok := s.store.JSONArrAppend(key, path, values...)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONArrAppend(key, path, values...)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.ARRLEN key [path]
@@ -242,17 +290,13 @@ func (s *Server) handleJSONArrLen(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	result, ok := s.store.JSONArrLen(key, path)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONArrLen(key, path)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.ARRPOP key [path [index]]
@@ -262,7 +306,7 @@ func (s *Server) handleJSONArrPop(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	index := -1 // Default to last element
 
 	if len(args) > 1 {
@@ -276,39 +320,35 @@ func (s *Server) handleJSONArrPop(args []string) string {
 		}
 	}
 
-	result, ok := s.store.JSONArrPop(key, path, index)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	jsonBytes, err := json.Marshal(result)
-	if err != nil {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeBulkString(string(jsonBytes))
+	results, err := s.store.JSONArrPop(key, path, index)
+	return encodeJSONResults(path, results, err, encodeJSONString)
 }
 
 // JSON.ARRINDEX key path value [start [stop]]
 func (s *Server) handleJSONArrIndex(args []string) string {
-	if len(args) < 3 {
+	if len(args) < 3 || len(args) > 5 {
 		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.ARRINDEX' command")
 	}
 
 	key := args[0]
 	path := args[1]
 
-	var value interface{}
-	if err := json.Unmarshal([]byte(args[2]), &value); err != nil {
-		return protocol.EncodeError("ERR invalid JSON value")
+	value, err := store.ParseJSON(args[2])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
 	}
 
-	result, ok := s.store.JSONArrIndex(key, path, value)
-	if !ok {
-		return protocol.EncodeNull()
+	bounds := []int{0, 0}
+	for i, arg := range args[3:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return protocol.EncodeError("ERR value is not an integer or out of range")
+		}
+		bounds[i] = n
 	}
 
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONArrIndex(key, path, value, bounds[0], bounds[1])
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.ARRINSERT key path index value [value ...]
@@ -324,21 +364,17 @@ func (s *Server) handleJSONArrInsert(args []string) string {
 		return protocol.EncodeError("ERR index is not an integer")
 	}
 
-	values := make([]interface{}, 0, len(args)-3)
+	values := make([]*store.JSONNode, 0, len(args)-3)
 	for i := 3; i < len(args); i++ {
-		var value interface{}
-		if err := json.Unmarshal([]byte(args[i]), &value); err != nil {
-			return protocol.EncodeError("ERR invalid JSON value")
+		value, err := store.ParseJSON(args[i])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
 		}
 		values = append(values, value)
 	}
 
-	result, ok := s.store.JSONArrInsert(key, path, index, values...)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONArrInsert(key, path, index, values...)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.ARRTRIM key path start stop
@@ -358,12 +394,8 @@ func (s *Server) handleJSONArrTrim(args []string) string {
 		return protocol.EncodeError("ERR stop is not an integer")
 	}
 
-	result, ok := s.store.JSONArrTrim(key, path, start, stop)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONArrTrim(key, path, start, stop)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
 }
 
 // JSON.OBJKEYS key [path]
@@ -373,17 +405,15 @@ func (s *Server) handleJSONObjKeys(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	keys, ok := s.store.JSONObjKeys(key, path)
-	if !ok {
-		return protocol.EncodeNull()
-	}
-
-	return protocol.EncodeStringArray(keys)
+	results, err := s.store.JSONObjKeys(key, path)
+	return encodeJSONResults(path, results, err, func(v interface{}) string {
+		return protocol.EncodeStringArray(v.([]string))
+	})
 }
 
 // JSON.OBJLEN key [path]
@@ -393,17 +423,92 @@ func (s *Server) handleJSONObjLen(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	result, ok := s.store.JSONObjLen(key, path)
-	if !ok {
-		return protocol.EncodeNull()
+	results, err := s.store.JSONObjLen(key, path)
+	return encodeJSONResults(path, results, err, encodeJSONInteger)
+}
+
+// JSON.TOGGLE key [path]
+func (s *Server) handleJSONToggle(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.TOGGLE' command")
+	}
+
+	key := args[0]
+	path := "."
+	if len(args) > 1 {
+		path = args[1]
 	}
 
-	return protocol.EncodeInteger(result)
+	results, err := s.store.JSONToggle(key, path)
+	if store.IsLegacyJSONPath(path) {
+		return encodeJSONResults(path, results, err, func(v interface{}) string {
+			return protocol.EncodeBulkString(strconv.FormatBool(v.(bool)))
+		})
+	}
+	return encodeJSONResults(path, results, err, func(v interface{}) string {
+		if v.(bool) {
+			return protocol.EncodeInteger(1)
+		}
+		return protocol.EncodeInteger(0)
+	})
+}
+
+// JSON.CLEAR key [path]
+func (s *Server) handleJSONClear(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.CLEAR' command")
+	}
+
+	key := args[0]
+	path := "."
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	cleared, err := s.store.JSONClear(key, path)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeInteger(cleared)
+}
+
+// JSON.DEBUG MEMORY key [path] | HELP
+func (s *Server) handleJSONDebug(args []string) string {
+	if len(args) < 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'JSON.DEBUG' command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "MEMORY":
+		if len(args) < 2 || len(args) > 3 {
+			return protocol.EncodeError("ERR wrong number of arguments for 'JSON.DEBUG MEMORY' command")
+		}
+		key := args[1]
+		path := "."
+		if len(args) > 2 {
+			path = args[2]
+		}
+
+		results, err := s.store.JSONDebugMemory(key, path)
+		if err == nil && results == nil {
+			if store.IsLegacyJSONPath(path) {
+				return protocol.EncodeInteger(0)
+			}
+			results = []interface{}{}
+		}
+		return encodeJSONResults(path, results, err, encodeJSONInteger)
+	case "HELP":
+		return protocol.EncodeStringArray([]string{
+			"JSON.DEBUG MEMORY <key> [path] - reports memory usage",
+			"JSON.DEBUG HELP                - this message",
+		})
+	}
+	return protocol.EncodeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try JSON.DEBUG HELP.", args[0]))
 }
 
 // JSON.MGET key [key ...] path
@@ -415,20 +520,29 @@ func (s *Server) handleJSONMGet(args []string) string {
 	// Last argument is the path
 	path := args[len(args)-1]
 	keys := args[:len(args)-1]
+	legacy := store.IsLegacyJSONPath(path)
 
 	results := make([]string, len(keys))
 	for i, key := range keys {
-		result, ok := s.store.JSONGet(key, path)
-		if !ok {
-			results[i] = ""
-		} else {
-			jsonBytes, err := json.Marshal(result)
-			if err != nil {
-				results[i] = ""
-			} else {
-				results[i] = string(jsonBytes)
+		matches, err := s.store.JSONGet(key, path)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+				continue
 			}
+			return protocol.EncodeError(err.Error())
 		}
+		if matches == nil {
+			continue
+		}
+
+		result := &store.JSONNode{Kind: store.JSONArray, Items: matches[0]}
+		if legacy {
+			if len(matches[0]) == 0 {
+				continue
+			}
+			result = matches[0][0]
+		}
+		results[i] = result.String()
 	}
 
 	// Encode as array with null for missing values
@@ -451,54 +565,129 @@ func (s *Server) handleJSONResp(args []string) string {
 	}
 
 	key := args[0]
-	path := "$"
+	path := "."
 	if len(args) > 1 {
 		path = args[1]
 	}
 
-	result, ok := s.store.JSONGet(key, path)
-	if !ok {
+	results, err := s.store.JSONGet(key, path)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if results == nil {
 		return protocol.EncodeNull()
 	}
 
-	return encodeJSONAsRESP(result)
+	if store.IsLegacyJSONPath(path) {
+		if len(results[0]) == 0 {
+			return protocol.EncodeNull()
+		}
+		return encodeJSONAsRESP(results[0][0])
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(results[0])))
+	for _, value := range results[0] {
+		response.WriteString(encodeJSONAsRESP(value))
+	}
+	return response.String()
 }
 
-// encodeJSONAsRESP converts a JSON value to RESP format
-func encodeJSONAsRESP(v interface{}) string {
-	if v == nil {
+// encodeJSONResults encodes the per-match results of a JSON command. Legacy
+// paths reply with the first result alone, JSONPath paths with an array
+// holding null for matches the command did not apply to.
+func encodeJSONResults(path string, results []interface{}, err error, encode func(interface{}) string) string {
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if results == nil {
+		return protocol.EncodeNull()
+	}
+
+	if store.IsLegacyJSONPath(path) {
+		if len(results) == 0 || results[0] == nil {
+			return protocol.EncodeNull()
+		}
+		return encode(results[0])
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(results)))
+	for _, result := range results {
+		if result == nil {
+			response.WriteString(protocol.EncodeNull())
+		} else {
+			response.WriteString(encode(result))
+		}
+	}
+	return response.String()
+}
+
+// encodeJSONNumbers encodes the results of NUMINCRBY and NUMMULTBY, which
+// reply with a JSON array of the new values for JSONPath paths
+func encodeJSONNumbers(path string, results []interface{}, err error) string {
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if results == nil {
 		return protocol.EncodeNull()
 	}
 
-	switch val := v.(type) {
-	case bool:
-		if val {
-			return protocol.EncodeBulkString("true")
+	if store.IsLegacyJSONPath(path) {
+		if len(results) == 0 || results[0] == nil {
+			return protocol.EncodeNull()
+		}
+		return protocol.EncodeBulkString(results[0].(*store.JSONNode).String())
+	}
+
+	values := &store.JSONNode{Kind: store.JSONArray, Items: make([]*store.JSONNode, len(results))}
+	for i, result := range results {
+		if result == nil {
+			values.Items[i] = &store.JSONNode{Kind: store.JSONNull}
+		} else {
+			values.Items[i] = result.(*store.JSONNode)
 		}
-		return protocol.EncodeBulkString("false")
-	case float64:
-		return protocol.EncodeBulkString(strconv.FormatFloat(val, 'f', -1, 64))
-	case string:
-		return protocol.EncodeBulkString(val)
-	case []interface{}:
+	}
+	return protocol.EncodeBulkString(values.String())
+}
+
+func encodeJSONInteger(v interface{}) string {
+	return protocol.EncodeInteger(v.(int))
+}
+
+func encodeJSONString(v interface{}) string {
+	return protocol.EncodeBulkString(v.(string))
+}
+
+// encodeJSONAsRESP converts a JSON value to RESP format
+func encodeJSONAsRESP(node *store.JSONNode) string {
+	switch node.Kind {
+	case store.JSONBool:
+		return protocol.EncodeBulkString(strconv.FormatBool(node.Bool))
+	case store.JSONInt:
+		return protocol.EncodeInteger(int(node.Int))
+	case store.JSONFloat:
+		return protocol.EncodeBulkString(node.String())
+	case store.JSONString:
+		return protocol.EncodeBulkString(node.Str)
+	case store.JSONArray:
 		var response strings.Builder
-		response.WriteString(fmt.Sprintf("*%d\r\n", len(val)+1))
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(node.Items)+1))
 		response.WriteString("$1\r\n[\r\n")
-		for _, item := range val {
+		for _, item := range node.Items {
 			response.WriteString(encodeJSONAsRESP(item))
 		}
 		return response.String()
-	case map[string]interface{}:
+	case store.JSONObject:
 		var response strings.Builder
-		response.WriteString(fmt.Sprintf("*%d\r\n", len(val)*2+1))
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(node.Keys)*2+1))
 		response.WriteString("$1\r\n{\r\n")
-		for k, item := range val {
-			response.WriteString(protocol.EncodeBulkString(k))
-			response.WriteString(encodeJSONAsRESP(item))
+		for i, key := range node.Keys {
+			response.WriteString(protocol.EncodeBulkString(key))
+			response.WriteString(encodeJSONAsRESP(node.Items[i]))
 		}
 		return response.String()
 	default:
 		return protocol.EncodeNull()
 	}
 }
-
@@ -221,3 +221,25 @@ func (s *Server) handleRandomKey(args []string) string {
 	}
 	return protocol.EncodeBulkString(key)
 }
+
+// OBJECT ENCODING key
+func (s *Server) handleObject(args []string) string {
+	if len(args) < 1 {
+		return protocol.EncodeError("wrong number of arguments for 'object' command")
+	}
+
+	subcommand := strings.ToUpper(args[0])
+	switch subcommand {
+	case "ENCODING":
+		if len(args) != 2 {
+			return protocol.EncodeError("wrong number of arguments for 'object|encoding' command")
+		}
+		encoding, exists := s.store.ObjectEncoding(args[1])
+		if !exists {
+			return protocol.EncodeNull()
+		}
+		return protocol.EncodeBulkString(encoding)
+	default:
+		return protocol.EncodeError(fmt.Sprintf("unknown subcommand '%s'. Try OBJECT HELP.", args[0]))
+	}
+}
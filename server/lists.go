@@ -2,7 +2,9 @@ package server
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"time"
 
 	"keyra/protocol"
 )
@@ -19,6 +21,7 @@ func (s *Server) handleLPush(args []string) string {
 	if length == -1 {
 		return protocol.EncodeError("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
+	s.signalKeyReady(key)
 	return protocol.EncodeInteger(length)
 }
 
@@ -33,6 +36,7 @@ func (s *Server) handleRPush(args []string) string {
 	if length == -1 {
 		return protocol.EncodeError("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
+	s.signalKeyReady(key)
 	return protocol.EncodeInteger(length)
 }
 
@@ -158,54 +162,45 @@ func (s *Server) handleLInsert(args []string) string {
 	return protocol.EncodeInteger(result)
 }
 
-func (s *Server) handleBLPop(args []string) string {
-	if len(args) < 2 {
-		return protocol.EncodeError("wrong number of arguments for 'blpop' command")
-	}
-
-	// Extract timeout (last argument)
-	timeout, err := strconv.Atoi(args[len(args)-1])
-	if err != nil {
-		return protocol.EncodeError("timeout is not an integer or out of range")
-	}
-
-	// Extract keys (all but last argument)
-	keys := args[:len(args)-1]
-
-	resultKey, resultValue, exists := s.store.BLPop(keys, timeout)
-	if !exists {
-		return protocol.EncodeBulkString("")
-	}
+// BLPOP key [key ...] timeout
+func (s *Server) handleBLPop(args []string, connKey string) string {
+	return s.blockingPop("blpop", "LPOP", s.store.BLPop, args, connKey)
+}
 
-	// Return array with key and value
-	result := "*2\r\n"
-	result += protocol.EncodeBulkString(resultKey)
-	result += protocol.EncodeBulkString(resultValue)
-	return result
+// BRPOP key [key ...] timeout
+func (s *Server) handleBRPop(args []string, connKey string) string {
+	return s.blockingPop("brpop", "RPOP", s.store.BRPop, args, connKey)
 }
 
-func (s *Server) handleBRPop(args []string) string {
+// blockingPop pops from the first non-empty list, blocking until one of the
+// lists receives an element or the timeout in seconds expires. The pop is
+// propagated to the AOF as a plain LPOP or RPOP.
+func (s *Server) blockingPop(name, popCommand string, pop func([]string, int) (string, string, bool), args []string, connKey string) string {
 	if len(args) < 2 {
-		return protocol.EncodeError("wrong number of arguments for 'brpop' command")
+		return protocol.EncodeError(fmt.Sprintf("wrong number of arguments for '%s' command", name))
 	}
 
-	// Extract timeout (last argument)
-	timeout, err := strconv.Atoi(args[len(args)-1])
-	if err != nil {
-		return protocol.EncodeError("timeout is not an integer or out of range")
+	timeout, err := strconv.ParseFloat(args[len(args)-1], 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return protocol.EncodeError("timeout is not a float or out of range")
+	}
+	if timeout < 0 {
+		return protocol.EncodeError("timeout is negative")
 	}
 
-	// Extract keys (all but last argument)
 	keys := args[:len(args)-1]
 
-	resultKey, resultValue, exists := s.store.BRPop(keys, timeout)
-	if !exists {
-		return protocol.EncodeBulkString("")
+	var resultKey, resultValue string
+	popped := s.blockOn(connKey, keys, time.Duration(timeout*float64(time.Second)), func() bool {
+		var exists bool
+		resultKey, resultValue, exists = pop(keys, 0)
+		return exists
+	})
+	if !popped {
+		return "*-1\r\n"
 	}
 
-	// Return array with key and value
-	result := "*2\r\n"
-	result += protocol.EncodeBulkString(resultKey)
-	result += protocol.EncodeBulkString(resultValue)
-	return result
+	s.logCommandToAOF(popCommand, []string{resultKey})
+
+	return protocol.EncodeStringArray([]string{resultKey, resultValue})
 }
@@ -148,6 +148,9 @@ func (s *Server) loadFromAOF() error {
 	
 	fmt.Printf("Loading %d commands from AOF...\n", len(commands))
 	
+	s.aofLoading = true
+	defer func() { s.aofLoading = false }()
+	
 	for _, command := range commands {
 		if len(command) > 0 {
 			// Execute command directly against store, bypassing AOF logging
@@ -190,6 +193,8 @@ func (s *Server) executeCommandDirectly(command string, args []string) {
 			s.store.FlushDB()
 			s.store.SelectDB(currentDB)
 		}
+	default:
+		s.executeCommandWithoutAOF(command, args, "aof-loader")
 	}
 }
 
@@ -325,7 +330,7 @@ func (s *Server) executeCommandWithTiming(command string, args []string, connKey
 
 	result := s.executeCommand(command, args, connKey)
 	
-	if !strings.HasPrefix(result, "-ERR") {
+	if !strings.HasPrefix(result, "-") {
 		s.logCommandToAOF(command, args)
 	}
 	
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"keyra/store"
+)
+
+// keyspaceEventFlags lists the notify-keyspace-events flags in the order
+// CONFIG GET reports them. K and E select the channels, the others the
+// event classes.
+const keyspaceEventFlags = "g$lshzxetnKEm"
+
+// allKeyspaceEventClasses is the set of classes the A flag stands for
+const allKeyspaceEventClasses = "g$lshzxet"
+
+// keyspaceEvents is a notify-keyspace-events setting, one bit per flag
+type keyspaceEvents uint32
+
+func (s *Server) initializeKeyspaceEvents() {
+	if eventsConfig, exists := s.runtimeConfig.Get("notify-keyspace-events"); exists {
+		if events, err := parseKeyspaceEvents(eventsConfig.Value); err == nil {
+			s.keyspaceEvents.Store(uint32(events))
+		}
+	}
+	s.store.SetKeyspaceNotifier(s.notifyKeyspaceEvent)
+}
+
+func parseKeyspaceEvents(value string) (keyspaceEvents, error) {
+	var events keyspaceEvents
+	for _, flag := range value {
+		if flag == 'A' {
+			for _, class := range allKeyspaceEventClasses {
+				events |= keyspaceEventBit(class)
+			}
+			continue
+		}
+		if !strings.ContainsRune(keyspaceEventFlags, flag) {
+			return 0, fmt.Errorf("invalid event class character '%c' for notify-keyspace-events, use 'Ag$lshzxetKEmn'", flag)
+		}
+		events |= keyspaceEventBit(flag)
+	}
+	return events, nil
+}
+
+func keyspaceEventBit(flag rune) keyspaceEvents {
+	return 1 << strings.IndexRune(keyspaceEventFlags, flag)
+}
+
+func (events keyspaceEvents) has(flag rune) bool {
+	return events&keyspaceEventBit(flag) != 0
+}
+
+// String formats events the way CONFIG GET reports them, folding the
+// classes A stands for back into it
+func (events keyspaceEvents) String() string {
+	var all keyspaceEvents
+	for _, class := range allKeyspaceEventClasses {
+		all |= keyspaceEventBit(class)
+	}
+
+	var b strings.Builder
+	if events&all == all {
+		b.WriteByte('A')
+		events &^= all
+	}
+	for _, flag := range keyspaceEventFlags {
+		if events.has(flag) {
+			b.WriteRune(flag)
+		}
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes an event raised by the store on the
+// keyspace and keyevent channels enabled by notify-keyspace-events, and
+// wakes up the clients blocked on the key
+func (s *Server) notifyKeyspaceEvent(class store.KeyspaceEventClass, event string, db int, key string) {
+	s.signalKeyChanged(db, key)
+
+	events := keyspaceEvents(s.keyspaceEvents.Load())
+	if !events.has(rune(class)) {
+		return
+	}
+	if events.has('K') {
+		s.pubsub.Publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+	}
+	if events.has('E') {
+		s.pubsub.Publish(fmt.Sprintf("__keyevent@%d__:%s", db, event), key)
+	}
+}
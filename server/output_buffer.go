@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutputBufferLimit bounds the bytes waiting to be written to a client. A
+// client over Hard, or over Soft for longer than SoftSeconds, is
+// disconnected. A zero limit is disabled.
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// outputBufferClasses lists the client classes in the order CONFIG GET
+// reports them
+var outputBufferClasses = []string{"normal", "slave", "pubsub"}
+
+// ClientOutputBufferLimits holds the client-output-buffer-limit of each
+// client class and counts the clients disconnected for exceeding them
+type ClientOutputBufferLimits struct {
+	mu             sync.RWMutex
+	limits         map[string]OutputBufferLimit
+	disconnections int64
+}
+
+func (s *Server) initializeOutputBufferLimits() {
+	s.outputLimits = &ClientOutputBufferLimits{limits: make(map[string]OutputBufferLimit)}
+	if limitConfig, exists := s.runtimeConfig.Get("client-output-buffer-limit"); exists {
+		s.outputLimits.Set(limitConfig.Value)
+	}
+}
+
+// Set updates the classes named in value, a list of
+// "<class> <hard> <soft> <soft seconds>" groups, leaving the others as
+// they are
+func (l *ClientOutputBufferLimits) Set(value string) error {
+	limits, err := parseOutputBufferLimits(value)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for class, limit := range limits {
+		l.limits[class] = limit
+	}
+	return nil
+}
+
+func (l *ClientOutputBufferLimits) Get(class string) OutputBufferLimit {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limits[class]
+}
+
+// String formats every class the way CONFIG GET reports it
+func (l *ClientOutputBufferLimits) String() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	groups := make([]string, len(outputBufferClasses))
+	for i, class := range outputBufferClasses {
+		limit := l.limits[class]
+		groups[i] = fmt.Sprintf("%s %d %d %d", class, limit.Hard, limit.Soft, limit.SoftSeconds)
+	}
+	return strings.Join(groups, " ")
+}
+
+func (l *ClientOutputBufferLimits) addDisconnection() {
+	atomic.AddInt64(&l.disconnections, 1)
+}
+
+func (l *ClientOutputBufferLimits) Disconnections() int64 {
+	return atomic.LoadInt64(&l.disconnections)
+}
+
+// reached reports whether a client with size bytes pending must be
+// disconnected. softSince records when the client went over the soft
+// limit and is cleared once it is back under.
+func (limit OutputBufferLimit) reached(size int64, softSince *time.Time, now time.Time) bool {
+	if limit.Hard > 0 && size >= limit.Hard {
+		return true
+	}
+	if limit.Soft == 0 || size < limit.Soft {
+		*softSince = time.Time{}
+		return false
+	}
+	if softSince.IsZero() {
+		*softSince = now
+		return false
+	}
+	return now.Sub(*softSince) > time.Duration(limit.SoftSeconds)*time.Second
+}
+
+func parseOutputBufferLimits(value string) (map[string]OutputBufferLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return nil, fmt.Errorf("invalid value for client-output-buffer-limit: expected <class> <hard> <soft> <soft seconds>")
+	}
+
+	limits := make(map[string]OutputBufferLimit)
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "replica" {
+			class = "slave"
+		}
+		if class != "normal" && class != "slave" && class != "pubsub" {
+			return nil, fmt.Errorf("invalid client class for client-output-buffer-limit: %s", fields[i])
+		}
+
+		hard, err := parseMemorySize(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hard limit for client-output-buffer-limit: %s", fields[i+1])
+		}
+		soft, err := parseMemorySize(fields[i+2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit for client-output-buffer-limit: %s", fields[i+2])
+		}
+		seconds, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid soft seconds for client-output-buffer-limit: %s", fields[i+3])
+		}
+		limits[class] = OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	return limits, nil
+}
+
+// parseMemorySize parses a byte count with an optional k, kb, m, mb, g or
+// gb unit, where the b forms are powers of 1024
+func parseMemorySize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/scale {
+		return 0, fmt.Errorf("invalid memory size: %s", value)
+	}
+	return n * scale, nil
+}
@@ -2,14 +2,16 @@ package server
 
 import (
 	"fmt"
-	"net"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"keyra/store"
 )
 
 type PubSubMessage struct {
-	Type    string // "message", "pmessage", "subscribe", "unsubscribe", "psubscribe", "punsubscribe"
+	Type    string // "message", "pmessage", "smessage", "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe"
 	Channel string
 	Pattern string // For pattern messages
 	Data    string
@@ -17,33 +19,50 @@ type PubSubMessage struct {
 }
 
 type Subscriber struct {
-	conn         net.Conn
-	connKey      string
-	channels     map[string]bool
-	patterns     map[string]*regexp.Regexp
-	messageChan  chan PubSubMessage
-	quit         chan bool
-	mu           sync.RWMutex
+	client        *ClientConnection
+	connKey       string
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+	quit          chan bool
+	mu            sync.RWMutex
+	sendMu        sync.Mutex // orders confirmations and delivered messages
+
+	// Published messages wait in queue until messageLoop writes them. Its
+	// size is the client's output buffer, bounded by the pubsub class of
+	// client-output-buffer-limit.
+	queueMu        sync.Mutex
+	queue          []string
+	queuedBytes    int64
+	softLimitSince time.Time
+	overLimit      bool
+	ready          chan struct{}
+	outputLimits   *ClientOutputBufferLimits
 }
 
 type PubSubSystem struct {
-	mu              sync.RWMutex
-	subscribers     map[string]*Subscriber // connKey -> Subscriber
-	channelSubs     map[string]map[string]*Subscriber // channel -> connKey -> Subscriber
-	patternSubs     map[string]map[string]*Subscriber // pattern -> connKey -> Subscriber
-	messageCount    int64
-	subscribeCount  int64
+	mu               sync.RWMutex
+	subscribers      map[string]*Subscriber            // connKey -> Subscriber
+	channelSubs      map[string]map[string]*Subscriber // channel -> connKey -> Subscriber
+	patternSubs      map[string]map[string]*Subscriber // pattern -> connKey -> Subscriber
+	shardChannelSubs map[string]map[string]*Subscriber // shard channel -> connKey -> Subscriber
+	messageCount     int64
+	subscribeCount   int64
+	droppedMessages  int64
+	outputLimits     *ClientOutputBufferLimits
 }
 
-func NewPubSubSystem() *PubSubSystem {
+func NewPubSubSystem(outputLimits *ClientOutputBufferLimits) *PubSubSystem {
 	return &PubSubSystem{
-		subscribers: make(map[string]*Subscriber),
-		channelSubs: make(map[string]map[string]*Subscriber),
-		patternSubs: make(map[string]map[string]*Subscriber),
+		subscribers:      make(map[string]*Subscriber),
+		channelSubs:      make(map[string]map[string]*Subscriber),
+		patternSubs:      make(map[string]map[string]*Subscriber),
+		shardChannelSubs: make(map[string]map[string]*Subscriber),
+		outputLimits:     outputLimits,
 	}
 }
 
-func (ps *PubSubSystem) GetSubscriber(connKey string, conn net.Conn) *Subscriber {
+func (ps *PubSubSystem) GetSubscriber(connKey string, client *ClientConnection) *Subscriber {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	
@@ -52,12 +71,14 @@ func (ps *PubSubSystem) GetSubscriber(connKey string, conn net.Conn) *Subscriber
 	}
 	
 	sub := &Subscriber{
-		conn:        conn,
-		connKey:     connKey,
-		channels:    make(map[string]bool),
-		patterns:    make(map[string]*regexp.Regexp),
-		messageChan: make(chan PubSubMessage, 1000),
-		quit:        make(chan bool, 1),
+		client:        client,
+		connKey:       connKey,
+		channels:      make(map[string]bool),
+		patterns:      make(map[string]bool),
+		shardChannels: make(map[string]bool),
+		quit:          make(chan bool, 1),
+		ready:         make(chan struct{}, 1),
+		outputLimits:  ps.outputLimits,
 	}
 	
 	ps.subscribers[connKey] = sub
@@ -95,17 +116,31 @@ func (ps *PubSubSystem) RemoveSubscriber(connKey string) {
 		}
 	}
 	
+	// Remove from all shard channel subscriptions
+	for channel := range sub.shardChannels {
+		if subs, exists := ps.shardChannelSubs[channel]; exists {
+			delete(subs, connKey)
+			if len(subs) == 0 {
+				delete(ps.shardChannelSubs, channel)
+			}
+		}
+	}
+	
 	// Signal subscriber to quit and clean up
 	close(sub.quit)
 	delete(ps.subscribers, connKey)
 }
 
-func (ps *PubSubSystem) Subscribe(connKey string, conn net.Conn, channels []string) []PubSubMessage {
-	sub := ps.GetSubscriber(connKey, conn)
+// Subscribe subscribes the client to channels and writes a confirmation
+// for each. Holding sendMu while registering keeps messages published to
+// the new channels from reaching the client before their confirmation.
+func (ps *PubSubSystem) Subscribe(connKey string, client *ClientConnection, channels []string) {
+	sub := ps.GetSubscriber(connKey, client)
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
 	var responses []PubSubMessage
 	
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
 	
 	for _, channel := range channels {
 		if !sub.channels[channel] {
@@ -124,18 +159,25 @@ func (ps *PubSubSystem) Subscribe(connKey string, conn net.Conn, channels []stri
 			Count:   len(sub.channels) + len(sub.patterns),
 		})
 	}
+	ps.mu.Unlock()
 	
-	return responses
+	sub.sendMessages(responses)
 }
 
-func (ps *PubSubSystem) Unsubscribe(connKey string, channels []string) []PubSubMessage {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	
+// Unsubscribe unsubscribes the client from channels, or from all of them
+// when none are given, and writes a confirmation for each. It reports
+// false when the client has never subscribed.
+func (ps *PubSubSystem) Unsubscribe(connKey string, channels []string) bool {
+	ps.mu.RLock()
 	sub, exists := ps.subscribers[connKey]
+	ps.mu.RUnlock()
 	if !exists {
-		return nil
+		return false
 	}
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	
+	ps.mu.Lock()
 	
 	var responses []PubSubMessage
 	
@@ -165,30 +207,36 @@ func (ps *PubSubSystem) Unsubscribe(connKey string, channels []string) []PubSubM
 			Count:   len(sub.channels) + len(sub.patterns),
 		})
 	}
+	count := len(sub.channels) + len(sub.patterns)
+	ps.mu.Unlock()
 	
-	return responses
+	if len(responses) == 0 {
+		sub.write(fmt.Sprintf("*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:%d\r\n", count))
+		return true
+	}
+	sub.sendMessages(responses)
+	return true
 }
 
-func (ps *PubSubSystem) PSubscribe(connKey string, conn net.Conn, patterns []string) []PubSubMessage {
-	sub := ps.GetSubscriber(connKey, conn)
+// PSubscribe subscribes the client to patterns and writes a confirmation
+// for each
+func (ps *PubSubSystem) PSubscribe(connKey string, client *ClientConnection, patterns []string) {
+	sub := ps.GetSubscriber(connKey, client)
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
 	var responses []PubSubMessage
 	
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
 	
 	for _, pattern := range patterns {
-		if _, exists := sub.patterns[pattern]; !exists {
-			// Convert Redis pattern to Go regexp
-			regexPattern := ps.redisPatternToRegex(pattern)
-			if regex, err := regexp.Compile(regexPattern); err == nil {
-				sub.patterns[pattern] = regex
-				
-				if ps.patternSubs[pattern] == nil {
-					ps.patternSubs[pattern] = make(map[string]*Subscriber)
-				}
-				ps.patternSubs[pattern][connKey] = sub
-				ps.subscribeCount++
+		if !sub.patterns[pattern] {
+			sub.patterns[pattern] = true
+			
+			if ps.patternSubs[pattern] == nil {
+				ps.patternSubs[pattern] = make(map[string]*Subscriber)
 			}
+			ps.patternSubs[pattern][connKey] = sub
+			ps.subscribeCount++
 		}
 		
 		responses = append(responses, PubSubMessage{
@@ -197,18 +245,25 @@ func (ps *PubSubSystem) PSubscribe(connKey string, conn net.Conn, patterns []str
 			Count:   len(sub.channels) + len(sub.patterns),
 		})
 	}
+	ps.mu.Unlock()
 	
-	return responses
+	sub.sendMessages(responses)
 }
 
-func (ps *PubSubSystem) PUnsubscribe(connKey string, patterns []string) []PubSubMessage {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	
+// PUnsubscribe unsubscribes the client from patterns, or from all of them
+// when none are given, and writes a confirmation for each. It reports
+// false when the client has never subscribed.
+func (ps *PubSubSystem) PUnsubscribe(connKey string, patterns []string) bool {
+	ps.mu.RLock()
 	sub, exists := ps.subscribers[connKey]
+	ps.mu.RUnlock()
 	if !exists {
-		return nil
+		return false
 	}
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	
+	ps.mu.Lock()
 	
 	var responses []PubSubMessage
 	
@@ -220,7 +275,7 @@ func (ps *PubSubSystem) PUnsubscribe(connKey string, patterns []string) []PubSub
 	}
 	
 	for _, pattern := range patterns {
-		if _, exists := sub.patterns[pattern]; exists {
+		if sub.patterns[pattern] {
 			delete(sub.patterns, pattern)
 			
 			if subs, exists := ps.patternSubs[pattern]; exists {
@@ -238,8 +293,100 @@ func (ps *PubSubSystem) PUnsubscribe(connKey string, patterns []string) []PubSub
 			Count:   len(sub.channels) + len(sub.patterns),
 		})
 	}
+	count := len(sub.channels) + len(sub.patterns)
+	ps.mu.Unlock()
+	
+	if len(responses) == 0 {
+		sub.write(fmt.Sprintf("*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:%d\r\n", count))
+		return true
+	}
+	sub.sendMessages(responses)
+	return true
+}
+
+// SSubscribe subscribes the client to shard channels and writes a
+// confirmation for each. Shard channels are a namespace of their own, so
+// PUBLISH never reaches them and their count excludes other subscriptions.
+func (ps *PubSubSystem) SSubscribe(connKey string, client *ClientConnection, channels []string) {
+	sub := ps.GetSubscriber(connKey, client)
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	var responses []PubSubMessage
+	
+	ps.mu.Lock()
+	for _, channel := range channels {
+		if !sub.shardChannels[channel] {
+			sub.shardChannels[channel] = true
+			
+			if ps.shardChannelSubs[channel] == nil {
+				ps.shardChannelSubs[channel] = make(map[string]*Subscriber)
+			}
+			ps.shardChannelSubs[channel][connKey] = sub
+			ps.subscribeCount++
+		}
+		
+		responses = append(responses, PubSubMessage{
+			Type:    "ssubscribe",
+			Channel: channel,
+			Count:   len(sub.shardChannels),
+		})
+	}
+	ps.mu.Unlock()
 	
-	return responses
+	sub.sendMessages(responses)
+}
+
+// SUnsubscribe unsubscribes the client from shard channels, or from all of
+// them when none are given, and writes a confirmation for each. It reports
+// false when the client has never subscribed.
+func (ps *PubSubSystem) SUnsubscribe(connKey string, channels []string) bool {
+	ps.mu.RLock()
+	sub, exists := ps.subscribers[connKey]
+	ps.mu.RUnlock()
+	if !exists {
+		return false
+	}
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	
+	ps.mu.Lock()
+	
+	var responses []PubSubMessage
+	
+	// If no channels specified, unsubscribe from all shard channels
+	if len(channels) == 0 {
+		for channel := range sub.shardChannels {
+			channels = append(channels, channel)
+		}
+	}
+	
+	for _, channel := range channels {
+		if sub.shardChannels[channel] {
+			delete(sub.shardChannels, channel)
+			
+			if subs, exists := ps.shardChannelSubs[channel]; exists {
+				delete(subs, connKey)
+				if len(subs) == 0 {
+					delete(ps.shardChannelSubs, channel)
+				}
+			}
+			ps.subscribeCount--
+		}
+		
+		responses = append(responses, PubSubMessage{
+			Type:    "sunsubscribe",
+			Channel: channel,
+			Count:   len(sub.shardChannels),
+		})
+	}
+	ps.mu.Unlock()
+	
+	if len(responses) == 0 {
+		sub.write("*3\r\n$12\r\nsunsubscribe\r\n$-1\r\n:0\r\n")
+		return true
+	}
+	sub.sendMessages(responses)
+	return true
 }
 
 func (ps *PubSubSystem) Publish(channel string, message string) int {
@@ -247,39 +394,35 @@ func (ps *PubSubSystem) Publish(channel string, message string) int {
 	defer ps.mu.RUnlock()
 	
 	recipients := 0
-	ps.messageCount++
+	atomic.AddInt64(&ps.messageCount, 1)
+	limit := ps.outputLimits.Get("pubsub")
 	
 	// Send to direct channel subscribers
 	if subs, exists := ps.channelSubs[channel]; exists {
 		for _, sub := range subs {
-			select {
-			case sub.messageChan <- PubSubMessage{
+			if ps.deliver(sub, PubSubMessage{
 				Type:    "message",
 				Channel: channel,
 				Data:    message,
-			}:
+			}, limit) {
 				recipients++
-			default:
-				// Channel is full, skip this subscriber
 			}
 		}
 	}
 	
 	// Send to pattern subscribers
 	for pattern, subs := range ps.patternSubs {
+		if !store.GlobMatch(pattern, channel) {
+			continue
+		}
 		for _, sub := range subs {
-			if regex := sub.patterns[pattern]; regex != nil && regex.MatchString(channel) {
-				select {
-				case sub.messageChan <- PubSubMessage{
-					Type:    "pmessage",
-					Pattern: pattern,
-					Channel: channel,
-					Data:    message,
-				}:
-					recipients++
-				default:
-					// Channel is full, skip this subscriber
-				}
+			if ps.deliver(sub, PubSubMessage{
+				Type:    "pmessage",
+				Pattern: pattern,
+				Channel: channel,
+				Data:    message,
+			}, limit) {
+				recipients++
 			}
 		}
 	}
@@ -287,6 +430,66 @@ func (ps *PubSubSystem) Publish(channel string, message string) int {
 	return recipients
 }
 
+// SPublish posts message to the subscribers of a shard channel
+func (ps *PubSubSystem) SPublish(channel string, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	
+	recipients := 0
+	atomic.AddInt64(&ps.messageCount, 1)
+	limit := ps.outputLimits.Get("pubsub")
+	
+	for _, sub := range ps.shardChannelSubs[channel] {
+		if ps.deliver(sub, PubSubMessage{
+			Type:    "smessage",
+			Channel: channel,
+			Data:    message,
+		}, limit) {
+			recipients++
+		}
+	}
+	
+	return recipients
+}
+
+// deliver queues msg for sub and reports whether it was queued. A
+// subscriber whose queue reaches limit is disconnected and the messages
+// still waiting for it are dropped.
+func (ps *PubSubSystem) deliver(sub *Subscriber, msg PubSubMessage, limit OutputBufferLimit) bool {
+	response := encodePubSubMessage(msg)
+	
+	sub.queueMu.Lock()
+	if sub.overLimit {
+		sub.queueMu.Unlock()
+		atomic.AddInt64(&ps.droppedMessages, 1)
+		return false
+	}
+	sub.queue = append(sub.queue, response)
+	sub.queuedBytes += int64(len(response))
+	if !limit.reached(sub.queuedBytes, &sub.softLimitSince, time.Now()) {
+		sub.queueMu.Unlock()
+		select {
+		case sub.ready <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	dropped := len(sub.queue)
+	sub.queue, sub.overLimit = nil, true
+	sub.queueMu.Unlock()
+	
+	atomic.AddInt64(&ps.droppedMessages, int64(dropped))
+	ps.outputLimits.addDisconnection()
+	sub.client.conn.Close()
+	return false
+}
+
+// DroppedMessages counts the messages discarded because their subscriber
+// exceeded its output buffer limit
+func (ps *PubSubSystem) DroppedMessages() int64 {
+	return atomic.LoadInt64(&ps.droppedMessages)
+}
+
 func (ps *PubSubSystem) GetChannels(pattern string) []string {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
@@ -298,12 +501,9 @@ func (ps *PubSubSystem) GetChannels(pattern string) []string {
 			channels = append(channels, channel)
 		}
 	} else {
-		regexPattern := ps.redisPatternToRegex(pattern)
-		if regex, err := regexp.Compile(regexPattern); err == nil {
-			for channel := range ps.channelSubs {
-				if regex.MatchString(channel) {
-					channels = append(channels, channel)
-				}
+		for channel := range ps.channelSubs {
+			if store.GlobMatch(pattern, channel) {
+				channels = append(channels, channel)
 			}
 		}
 	}
@@ -328,42 +528,96 @@ func (ps *PubSubSystem) GetNumSub(channels []string) map[string]int {
 	return result
 }
 
-func (ps *PubSubSystem) GetNumPat() int {
+func (ps *PubSubSystem) GetShardChannels(pattern string) []string {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
 	
-	return len(ps.patternSubs)
+	var channels []string
+	for channel := range ps.shardChannelSubs {
+		if pattern == "" || pattern == "*" || store.GlobMatch(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	
+	return channels
+}
+
+func (ps *PubSubSystem) GetShardNumSub(channels []string) map[string]int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	
+	result := make(map[string]int)
+	for _, channel := range channels {
+		result[channel] = len(ps.shardChannelSubs[channel])
+	}
+	
+	return result
 }
 
-func (ps *PubSubSystem) redisPatternToRegex(pattern string) string {
-	// Convert Redis glob pattern to Go regex
-	// * matches any sequence of characters
-	// ? matches any single character
-	// [abc] matches any character in the set
-	// [^abc] matches any character not in the set
-	
-	escaped := regexp.QuoteMeta(pattern)
-	escaped = strings.ReplaceAll(escaped, `\*`, ".*")
-	escaped = strings.ReplaceAll(escaped, `\?`, ".")
-	escaped = strings.ReplaceAll(escaped, `\[`, "[")
-	escaped = strings.ReplaceAll(escaped, `\]`, "]")
-	escaped = strings.ReplaceAll(escaped, `\^`, "^")
-	
-	return "^" + escaped + "$"
+func (ps *PubSubSystem) GetNumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	
+	return len(ps.patternSubs)
 }
 
 func (sub *Subscriber) messageLoop() {
 	for {
 		select {
-		case msg := <-sub.messageChan:
-			sub.sendMessage(msg)
+		case <-sub.ready:
+			sub.flush()
 		case <-sub.quit:
 			return
 		}
 	}
 }
 
-func (sub *Subscriber) sendMessage(msg PubSubMessage) {
+// flush writes the queued messages, releasing their share of the output
+// buffer once the client has taken them
+func (sub *Subscriber) flush() {
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	
+	sub.queueMu.Lock()
+	pending := sub.queue
+	sub.queue = nil
+	sub.queueMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	
+	response := strings.Join(pending, "")
+	sub.write(response)
+	
+	sub.queueMu.Lock()
+	sub.queuedBytes -= int64(len(response))
+	if limit := sub.outputLimits.Get("pubsub"); sub.queuedBytes < limit.Soft {
+		sub.softLimitSince = time.Time{}
+	}
+	sub.queueMu.Unlock()
+}
+
+func (sub *Subscriber) sendMessages(messages []PubSubMessage) {
+	var response strings.Builder
+	for _, msg := range messages {
+		response.WriteString(encodePubSubMessage(msg))
+	}
+	sub.write(response.String())
+}
+
+// write sends response to the client through its serialized writer. A
+// failed write closes the connection so its read loop exits and removes
+// the subscriber.
+func (sub *Subscriber) write(response string) {
+	if response == "" {
+		return
+	}
+	if err := sub.client.WriteWithTimeout([]byte(response), sub.client.writeTimeout); err != nil {
+		sub.client.conn.Close()
+	}
+}
+
+func encodePubSubMessage(msg PubSubMessage) string {
 	var response string
 	
 	switch msg.Type {
@@ -373,6 +627,9 @@ func (sub *Subscriber) sendMessage(msg PubSubMessage) {
 	case "pmessage":
 		response = fmt.Sprintf("*4\r\n$8\r\npmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
 			len(msg.Pattern), msg.Pattern, len(msg.Channel), msg.Channel, len(msg.Data), msg.Data)
+	case "smessage":
+		response = fmt.Sprintf("*3\r\n$8\r\nsmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			len(msg.Channel), msg.Channel, len(msg.Data), msg.Data)
 	case "subscribe":
 		response = fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
 			len(msg.Channel), msg.Channel, msg.Count)
@@ -385,17 +642,21 @@ func (sub *Subscriber) sendMessage(msg PubSubMessage) {
 	case "punsubscribe":
 		response = fmt.Sprintf("*3\r\n$12\r\npunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
 			len(msg.Pattern), msg.Pattern, msg.Count)
+	case "ssubscribe":
+		response = fmt.Sprintf("*3\r\n$10\r\nssubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
+			len(msg.Channel), msg.Channel, msg.Count)
+	case "sunsubscribe":
+		response = fmt.Sprintf("*3\r\n$12\r\nsunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
+			len(msg.Channel), msg.Channel, msg.Count)
 	}
 	
-	if response != "" {
-		sub.conn.Write([]byte(response))
-	}
+	return response
 }
 
 func (sub *Subscriber) IsSubscribed() bool {
 	sub.mu.RLock()
 	defer sub.mu.RUnlock()
-	return len(sub.channels) > 0 || len(sub.patterns) > 0
+	return len(sub.channels) > 0 || len(sub.patterns) > 0 || len(sub.shardChannels) > 0
 }
 
 func (sub *Subscriber) GetSubscriptionCount() int {
@@ -2,7 +2,6 @@ package server
 
 import (
 	"fmt"
-	"net"
 	"strings"
 
 	"keyra/protocol"
@@ -20,85 +19,80 @@ func (s *Server) handlePublish(args []string) string {
 	return protocol.EncodeInteger(recipients)
 }
 
-func (s *Server) handleSubscribe(args []string, connKey string, conn net.Conn) string {
+func (s *Server) handleSubscribe(args []string, connKey string) string {
 	if len(args) == 0 {
 		return protocol.EncodeError("wrong number of arguments for 'subscribe' command")
 	}
 
-	// If conn is nil, try to find it from the connection pool
-	if conn == nil {
-		if clientConn := s.connPool.GetConnection(connKey); clientConn != nil {
-			conn = clientConn.conn
-		}
-	}
-
-	responses := s.pubsub.Subscribe(connKey, conn, args)
-	
-	var result strings.Builder
-	for _, resp := range responses {
-		result.WriteString(fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
-			len(resp.Channel), resp.Channel, resp.Count))
+	clientConn := s.connPool.GetConnection(connKey)
+	if clientConn == nil {
+		return protocol.EncodeError("ERR SUBSCRIBE is not supported on this connection")
 	}
 
-	// Put connection into subscriber mode
-	return result.String()
+	// Confirmations are written by the subscriber, ahead of any message
+	s.pubsub.Subscribe(connKey, clientConn, args)
+	return ""
 }
 
 func (s *Server) handleUnsubscribe(args []string, connKey string) string {
-	responses := s.pubsub.Unsubscribe(connKey, args)
-	
-	if len(responses) == 0 {
+	if !s.pubsub.Unsubscribe(connKey, args) {
 		// If no channels specified and no subscriptions exist
 		return "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"
 	}
-	
-	var result strings.Builder
-	for _, resp := range responses {
-		result.WriteString(fmt.Sprintf("*3\r\n$11\r\nunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
-			len(resp.Channel), resp.Channel, resp.Count))
-	}
-
-	return result.String()
+	return ""
 }
 
-func (s *Server) handlePSubscribe(args []string, connKey string, conn net.Conn) string {
+func (s *Server) handlePSubscribe(args []string, connKey string) string {
 	if len(args) == 0 {
 		return protocol.EncodeError("wrong number of arguments for 'psubscribe' command")
 	}
 
-	// If conn is nil, try to find it from the connection pool
-	if conn == nil {
-		if clientConn := s.connPool.GetConnection(connKey); clientConn != nil {
-			conn = clientConn.conn
-		}
+	clientConn := s.connPool.GetConnection(connKey)
+	if clientConn == nil {
+		return protocol.EncodeError("ERR PSUBSCRIBE is not supported on this connection")
 	}
 
-	responses := s.pubsub.PSubscribe(connKey, conn, args)
-	
-	var result strings.Builder
-	for _, resp := range responses {
-		result.WriteString(fmt.Sprintf("*3\r\n$10\r\npsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
-			len(resp.Pattern), resp.Pattern, resp.Count))
-	}
-
-	return result.String()
+	s.pubsub.PSubscribe(connKey, clientConn, args)
+	return ""
 }
 
 func (s *Server) handlePUnsubscribe(args []string, connKey string) string {
-	responses := s.pubsub.PUnsubscribe(connKey, args)
-	
-	if len(responses) == 0 {
+	if !s.pubsub.PUnsubscribe(connKey, args) {
 		// If no patterns specified and no subscriptions exist
 		return "*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n"
 	}
-	
-	var result strings.Builder
-	for _, resp := range responses {
-		result.WriteString(fmt.Sprintf("*3\r\n$12\r\npunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n",
-			len(resp.Pattern), resp.Pattern, resp.Count))
+	return ""
+}
+
+func (s *Server) handleSPublish(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("wrong number of arguments for 'spublish' command")
+	}
+
+	recipients := s.pubsub.SPublish(args[0], args[1])
+	return protocol.EncodeInteger(recipients)
+}
+
+func (s *Server) handleSSubscribe(args []string, connKey string) string {
+	if len(args) == 0 {
+		return protocol.EncodeError("wrong number of arguments for 'ssubscribe' command")
+	}
+
+	clientConn := s.connPool.GetConnection(connKey)
+	if clientConn == nil {
+		return protocol.EncodeError("ERR SSUBSCRIBE is not supported on this connection")
 	}
 
-	return result.String()
+	s.pubsub.SSubscribe(connKey, clientConn, args)
+	return ""
+}
+
+func (s *Server) handleSUnsubscribe(args []string, connKey string) string {
+	if !s.pubsub.SUnsubscribe(connKey, args) {
+		// If no channels specified and no subscriptions exist
+		return "*3\r\n$12\r\nsunsubscribe\r\n$-1\r\n:0\r\n"
+	}
+	return ""
 }
 
 func (s *Server) handlePubSub(args []string) string {
@@ -116,6 +110,10 @@ func (s *Server) handlePubSub(args []string) string {
 		return s.handlePubSubNumSub(subArgs)
 	case "NUMPAT":
 		return s.handlePubSubNumPat(subArgs)
+	case "SHARDCHANNELS":
+		return s.handlePubSubShardChannels(subArgs)
+	case "SHARDNUMSUB":
+		return s.handlePubSubShardNumSub(subArgs)
 	default:
 		return protocol.EncodeError(fmt.Sprintf("unknown pubsub subcommand '%s'", subcommand))
 	}
@@ -162,6 +160,38 @@ func (s *Server) handlePubSubNumPat(args []string) string {
 	return protocol.EncodeInteger(numPat)
 }
 
+func (s *Server) handlePubSubShardChannels(args []string) string {
+	if len(args) > 1 {
+		return protocol.EncodeError("wrong number of arguments for 'pubsub shardchannels' command")
+	}
+
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+
+	channels := s.pubsub.GetShardChannels(pattern)
+	
+	response := fmt.Sprintf("*%d\r\n", len(channels))
+	for _, channel := range channels {
+		response += protocol.EncodeBulkString(channel)
+	}
+
+	return response
+}
+
+func (s *Server) handlePubSubShardNumSub(args []string) string {
+	numSub := s.pubsub.GetShardNumSub(args)
+	
+	response := fmt.Sprintf("*%d\r\n", len(args)*2)
+	for _, channel := range args {
+		response += protocol.EncodeBulkString(channel)
+		response += protocol.EncodeInteger(numSub[channel])
+	}
+
+	return response
+}
+
 func (s *Server) isSubscriberConnection(connKey string) bool {
 	s.pubsub.mu.RLock()
 	defer s.pubsub.mu.RUnlock()
@@ -172,17 +202,21 @@ func (s *Server) isSubscriberConnection(connKey string) bool {
 	return false
 }
 
-func (s *Server) handleSubscriberCommand(command string, args []string, connKey string, conn net.Conn) string {
+func (s *Server) handleSubscriberCommand(command string, args []string, connKey string) string {
 	// In subscriber mode, only certain commands are allowed
 	switch strings.ToUpper(command) {
 	case "SUBSCRIBE":
-		return s.handleSubscribe(args, connKey, conn)
+		return s.handleSubscribe(args, connKey)
 	case "UNSUBSCRIBE":
 		return s.handleUnsubscribe(args, connKey)
 	case "PSUBSCRIBE":
-		return s.handlePSubscribe(args, connKey, conn)
+		return s.handlePSubscribe(args, connKey)
 	case "PUNSUBSCRIBE":
 		return s.handlePUnsubscribe(args, connKey)
+	case "SSUBSCRIBE":
+		return s.handleSSubscribe(args, connKey)
+	case "SUNSUBSCRIBE":
+		return s.handleSUnsubscribe(args, connKey)
 	case "PING":
 		if len(args) == 0 {
 			return "*2\r\n$4\r\npong\r\n$0\r\n\r\n"
@@ -191,7 +225,9 @@ func (s *Server) handleSubscriberCommand(command string, args []string, connKey
 		}
 	case "QUIT":
 		return s.handleQuit(args)
+	case "RESET":
+		return s.handleReset(args, connKey)
 	default:
-		return protocol.EncodeError("only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+		return protocol.EncodeError("only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET allowed in this context")
 	}
 }
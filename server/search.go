@@ -0,0 +1,320 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"keyra/protocol"
+	"keyra/store"
+)
+
+// FT.CREATE index [ON HASH|JSON] [PREFIX count prefix ...] [STOPWORDS count word ...] SCHEMA field [AS name] TEXT|TAG|NUMERIC|GEO|VECTOR [options] ...
+func (s *Server) handleFTCreate(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT.CREATE' command")
+	}
+
+	def, err := store.ParseSearchDefinition(args)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if err := s.store.CreateSearchIndex(def); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// FT.SEARCH index query [NOCONTENT] [VERBATIM] [WITHSCORES] [RETURN count field [AS name] ...] [SORTBY field [ASC|DESC]] [LIMIT offset num] [PARAMS nargs name value ...] [DIALECT n]
+func (s *Server) handleFTSearch(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT.SEARCH' command")
+	}
+
+	index := args[0]
+	query := args[1]
+	opts := store.SearchOptions{Limit: 10}
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOCONTENT":
+			opts.NoContent = true
+		case "WITHSCORES":
+			opts.WithScores = true
+		case "VERBATIM", "NOSTOPWORDS":
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return protocol.EncodeError("ERR LIMIT requires two arguments")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			num, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil || offset < 0 || num < 0 {
+				return protocol.EncodeError("ERR LIMIT argument is not a valid non-negative integer")
+			}
+			opts.Offset, opts.Limit = offset, num
+			i += 2
+		case "SORTBY":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("ERR SORTBY requires a field")
+			}
+			opts.SortBy = args[i+1]
+			i++
+			if i+1 < len(args) {
+				switch strings.ToUpper(args[i+1]) {
+				case "ASC":
+					i++
+				case "DESC":
+					opts.SortDesc = true
+					i++
+				}
+			}
+		case "RETURN":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("ERR RETURN requires a count")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 || i+2+count > len(args) {
+				return protocol.EncodeError("ERR Bad arguments for RETURN: Value is not a valid count")
+			}
+			opts.Return = []store.SearchReturnField{}
+			fields := args[i+2 : i+2+count]
+			for j := 0; j < len(fields); j++ {
+				field := store.SearchReturnField{Identifier: fields[j], Name: strings.TrimPrefix(fields[j], "@")}
+				if j+2 < len(fields) && strings.EqualFold(fields[j+1], "AS") {
+					field.Name = fields[j+2]
+					j += 2
+				}
+				opts.Return = append(opts.Return, field)
+			}
+			if count == 0 {
+				opts.NoContent = true
+			}
+			i += 1 + count
+		case "PARAMS":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("ERR PARAMS requires a count")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 || count%2 != 0 || i+2+count > len(args) {
+				return protocol.EncodeError("ERR Bad arguments for PARAMS: Expected an even number of arguments")
+			}
+			opts.Params = make(map[string]string, count/2)
+			for j := i + 2; j < i+2+count; j += 2 {
+				opts.Params[args[j]] = args[j+1]
+			}
+			i += 1 + count
+		case "DIALECT", "TIMEOUT":
+			if i+1 >= len(args) {
+				return protocol.EncodeError(fmt.Sprintf("ERR %s requires an argument", strings.ToUpper(args[i])))
+			}
+			i++
+		default:
+			return protocol.EncodeError(fmt.Sprintf("ERR Unknown argument `%s`", args[i]))
+		}
+	}
+
+	result, err := s.store.Search(index, query, opts)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	perHit := 1
+	if opts.WithScores {
+		perHit++
+	}
+	if !opts.NoContent {
+		perHit++
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", 1+len(result.Hits)*perHit))
+	response.WriteString(protocol.EncodeInteger(result.Total))
+	for _, hit := range result.Hits {
+		response.WriteString(encodeBulk(hit.Key))
+		if opts.WithScores {
+			response.WriteString(encodeBulk(strconv.FormatFloat(hit.Score, 'f', -1, 64)))
+		}
+		if !opts.NoContent {
+			response.WriteString(fmt.Sprintf("*%d\r\n", len(hit.Fields)))
+			for _, field := range hit.Fields {
+				response.WriteString(encodeBulk(field))
+			}
+		}
+	}
+	return response.String()
+}
+
+// FT.AGGREGATE index query [VERBATIM] [PARAMS nargs name value ...] [LOAD count field ...] [GROUPBY nargs property ... [REDUCE function nargs arg ... [AS name]] ...] [SORTBY nargs property [ASC|DESC] ... [MAX num]] [APPLY expression AS name] [FILTER expression] [LIMIT offset num]
+func (s *Server) handleFTAggregate(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT.AGGREGATE' command")
+	}
+
+	req, err := store.ParseAggregateRequest(args[2:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	result, err := s.store.Aggregate(args[0], args[1], req)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", 1+len(result.Rows)))
+	response.WriteString(protocol.EncodeInteger(result.Total))
+	for _, row := range result.Rows {
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(row.Names)*2))
+		for i, name := range row.Names {
+			response.WriteString(encodeBulk(name))
+			response.WriteString(encodeAggregateValue(row.Values[i]))
+		}
+	}
+	return response.String()
+}
+
+// FT.INFO index
+func (s *Server) handleFTInfo(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT.INFO' command")
+	}
+
+	info, err := s.store.SearchIndexInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	def := info.Definition
+
+	keyType := "HASH"
+	if def.On == store.JSONType {
+		keyType = "JSON"
+	}
+	prefixes := def.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	var attributes strings.Builder
+	attributes.WriteString(fmt.Sprintf("*%d\r\n", len(def.Fields)))
+	for _, field := range def.Fields {
+		values := []string{"identifier", field.Identifier, "attribute", field.Name, "type", field.Type.String()}
+		switch field.Type {
+		case store.SearchText:
+			values = append(values, "WEIGHT", strconv.FormatFloat(field.Weight, 'f', -1, 64))
+		case store.SearchTag:
+			values = append(values, "SEPARATOR", field.Separator)
+			if field.CaseSensitive {
+				values = append(values, "CASESENSITIVE")
+			}
+		case store.SearchVector:
+			values = append(values,
+				"algorithm", field.Vector.Algorithm,
+				"data_type", field.Vector.Type,
+				"dim", strconv.Itoa(field.Vector.Dim),
+				"distance_metric", field.Vector.Metric)
+			if field.Vector.Algorithm == "HNSW" {
+				values = append(values,
+					"M", strconv.Itoa(field.Vector.M),
+					"ef_construction", strconv.Itoa(field.Vector.EFConstruction),
+					"ef_runtime", strconv.Itoa(field.Vector.EFRuntime))
+			}
+		}
+		if field.Sortable {
+			values = append(values, "SORTABLE")
+		}
+		if field.NoIndex {
+			values = append(values, "NOINDEX")
+		}
+		attributes.WriteString(encodeBulkArray(values))
+	}
+
+	var response strings.Builder
+	response.WriteString("*22\r\n")
+	response.WriteString(encodeBulk("index_name"))
+	response.WriteString(encodeBulk(def.Name))
+	response.WriteString(encodeBulk("index_options"))
+	response.WriteString("*0\r\n")
+	response.WriteString(encodeBulk("index_definition"))
+	response.WriteString("*6\r\n")
+	response.WriteString(encodeBulk("key_type"))
+	response.WriteString(encodeBulk(keyType))
+	response.WriteString(encodeBulk("prefixes"))
+	response.WriteString(encodeBulkArray(prefixes))
+	response.WriteString(encodeBulk("default_score"))
+	response.WriteString(encodeBulk("1"))
+	response.WriteString(encodeBulk("attributes"))
+	response.WriteString(attributes.String())
+	response.WriteString(encodeBulk("num_docs"))
+	response.WriteString(protocol.EncodeInteger(info.NumDocs))
+	response.WriteString(encodeBulk("max_doc_id"))
+	response.WriteString(protocol.EncodeInteger(int(info.MaxDocID)))
+	response.WriteString(encodeBulk("num_terms"))
+	response.WriteString(protocol.EncodeInteger(info.NumTerms))
+	response.WriteString(encodeBulk("num_records"))
+	response.WriteString(protocol.EncodeInteger(info.NumRecords))
+	response.WriteString(encodeBulk("indexing"))
+	response.WriteString(protocol.EncodeInteger(0))
+	response.WriteString(encodeBulk("percent_indexed"))
+	response.WriteString(encodeBulk("1"))
+	response.WriteString(encodeBulk("hash_indexing_failures"))
+	response.WriteString(protocol.EncodeInteger(info.IndexingFailures))
+	return response.String()
+}
+
+// FT.DROPINDEX index [DD]
+func (s *Server) handleFTDropIndex(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT.DROPINDEX' command")
+	}
+
+	deleteDocs := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "DD") {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		deleteDocs = true
+	}
+
+	if err := s.store.DropSearchIndex(args[0], deleteDocs); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// FT._LIST
+func (s *Server) handleFTList(args []string) string {
+	if len(args) != 0 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'FT._LIST' command")
+	}
+	return encodeBulkArray(s.store.SearchIndexNames())
+}
+
+// encodeBulk encodes a bulk string, keeping empty strings distinct from null
+func encodeBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func encodeBulkArray(values []string) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		response.WriteString(encodeBulk(v))
+	}
+	return response.String()
+}
+
+func encodeAggregateValue(value interface{}) string {
+	switch value := value.(type) {
+	case float64:
+		return encodeBulk(store.FormatAggregateNumber(value))
+	case string:
+		return encodeBulk(value)
+	case []interface{}:
+		var response strings.Builder
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(value)))
+		for _, item := range value {
+			response.WriteString(encodeAggregateValue(item))
+		}
+		return response.String()
+	}
+	return protocol.EncodeNull()
+}
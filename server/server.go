@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,7 +36,11 @@ type Server struct {
 	monitorMutex       sync.RWMutex
 	slowLog            *SlowLog
 	aof                *persistence.AOF
+	aofLoading         bool
 	pubsub             *PubSubSystem
+	blockingKeys       *BlockingKeys
+	outputLimits       *ClientOutputBufferLimits
+	keyspaceEvents     atomic.Uint32
 }
 
 type NetworkStats struct {
@@ -160,11 +165,17 @@ func NewWithConfig(address string, config ServerConfig) *Server {
 	}
 	
 	server.initializeMonitoring()
-	server.initializeAOF()
-	server.pubsub = NewPubSubSystem()
+	server.initializeOutputBufferLimits()
+	server.pubsub = NewPubSubSystem(server.outputLimits)
+	server.initializeKeyspaceEvents()
+	server.blockingKeys = NewBlockingKeys()
 	
 	server.connPool = NewConnectionPool(server, config.ConnectionConfig)
 	
+	// Replaying the AOF runs commands that signal blocked clients and raise
+	// keyspace events, so it comes after everything they use
+	server.initializeAOF()
+	
 	fmt.Printf("Server configuration: Max connections: %d, Max memory: %dMB\n", 
 		config.ConnectionConfig.MaxConnections, config.MaxMemoryMB)
 	
@@ -193,11 +204,17 @@ func NewInMemoryWithConfig(address string, config ServerConfig) *Server {
 	}
 	
 	server.initializeMonitoring()
-	server.initializeAOF()
-	server.pubsub = NewPubSubSystem()
+	server.initializeOutputBufferLimits()
+	server.pubsub = NewPubSubSystem(server.outputLimits)
+	server.initializeKeyspaceEvents()
+	server.blockingKeys = NewBlockingKeys()
 	
 	server.connPool = NewConnectionPool(server, config.ConnectionConfig)
 	
+	// Replaying the AOF runs commands that signal blocked clients and raise
+	// keyspace events, so it comes after everything they use
+	server.initializeAOF()
+	
 	fmt.Printf("In-memory server configuration: Max connections: %d, Max memory: %dMB\n", 
 		config.ConnectionConfig.MaxConnections, config.MaxMemoryMB)
 	
@@ -220,6 +237,7 @@ func (s *Server) Start() error {
 	}
 	
 	go s.periodicNetworkStatsUpdate()
+	go s.periodicActiveExpire()
 	
 	s.StartMetricsServer(8080)
 	s.StartHTTPServer(8081)
@@ -280,6 +298,35 @@ func (s *Server) periodicSave() {
 	}
 }
 
+// periodicActiveExpire removes expired keys and hash fields in the
+// background, hz times per second, so those never accessed again still go
+// away
+func (s *Server) periodicActiveExpire() {
+	ticker := time.NewTicker(s.activeExpireInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.store.ActiveExpireKeys(20)
+			s.store.ActiveExpireHashFields(20)
+			ticker.Reset(s.activeExpireInterval())
+		case <-s.shutdownSignal:
+			return
+		}
+	}
+}
+
+func (s *Server) activeExpireInterval() time.Duration {
+	hz := 10
+	if config, exists := s.runtimeConfig.Get("hz"); exists {
+		if v, err := strconv.Atoi(config.Value); err == nil && v > 0 {
+			hz = v
+		}
+	}
+	return time.Second / time.Duration(hz)
+}
+
 func (s *Server) periodicNetworkStatsUpdate() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -352,9 +399,17 @@ func (s *Server) handlePooledConnection(clientConn *ClientConnection) {
 	}()
 
 	parser := protocol.NewParser(clientConn.conn)
+	clientConn.parser = parser
 
 	for {
-		clientConn.SetReadTimeout(s.connPool.readTimeout)
+		// Subscribers wait on the connection for as long as they stay subscribed
+		subscribed := s.isSubscriberConnection(connKey)
+		clientConn.subscribed.Store(subscribed)
+		if subscribed {
+			clientConn.SetReadTimeout(0)
+		} else {
+			clientConn.SetReadTimeout(s.connPool.readTimeout)
+		}
 		
 		s.connPool.UpdateActivity(connKey)
 		
@@ -378,9 +433,20 @@ func (s *Server) handlePooledConnection(clientConn *ClientConnection) {
 		
 		response := s.executeCommandWithTiming(command, args[1:], connKey, clientIP)
 		
-		err = clientConn.WriteWithTimeout([]byte(response), s.connPool.writeTimeout)
-		if err != nil {
-			return
+		// Pub/sub confirmations are written by the subscriber itself
+		if response != "" {
+			class := "normal"
+			if subscribed {
+				class = "pubsub"
+			}
+			overLimit, err := clientConn.writeReply([]byte(response), s.connPool.writeTimeout, s.outputLimits.Get(class))
+			if overLimit {
+				s.outputLimits.addDisconnection()
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
 		
 		parser.ReleaseArgs(args)
@@ -442,6 +508,10 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handleHello(args, connKey)
 	}
 	
+	if command == "RESET" {
+		return s.handleReset(args, connKey)
+	}
+	
 	// Check authentication for all other commands (including PING)
 	if !s.isAuthenticated(connKey) {
 		return protocol.EncodeError("NOAUTH Authentication required.")
@@ -449,7 +519,7 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 	
 	// Check if connection is in subscriber mode
 	if s.isSubscriberConnection(connKey) {
-		return s.handleSubscriberCommand(command, args, connKey, nil)
+		return s.handleSubscriberCommand(command, args, connKey)
 	}
 	
 	// Handle Pub/Sub commands first
@@ -457,13 +527,19 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 	case "PUBLISH":
 		return s.handlePublish(args)
 	case "SUBSCRIBE":
-		return s.handleSubscribe(args, connKey, nil)
+		return s.handleSubscribe(args, connKey)
 	case "UNSUBSCRIBE":
 		return s.handleUnsubscribe(args, connKey)
 	case "PSUBSCRIBE":
-		return s.handlePSubscribe(args, connKey, nil)
+		return s.handlePSubscribe(args, connKey)
 	case "PUNSUBSCRIBE":
 		return s.handlePUnsubscribe(args, connKey)
+	case "SPUBLISH":
+		return s.handleSPublish(args)
+	case "SSUBSCRIBE":
+		return s.handleSSubscribe(args, connKey)
+	case "SUNSUBSCRIBE":
+		return s.handleSUnsubscribe(args, connKey)
 	case "PUBSUB":
 		return s.handlePubSub(args)
 	}
@@ -530,6 +606,18 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handlePTTL(args)
 	case "RANDOMKEY":
 		return s.handleRandomKey(args)
+	case "OBJECT":
+		return s.handleObject(args)
+	case "SORT":
+		return s.handleSort(args)
+	case "SORT_RO":
+		return s.handleSortRO(args)
+	case "DUMP":
+		return s.handleDump(args)
+	case "RESTORE":
+		return s.handleRestore(args)
+	case "MIGRATE":
+		return s.handleMigrate(args)
 	
 	// List commands
 	case "LPUSH":
@@ -553,9 +641,9 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 	case "LINSERT":
 		return s.handleLInsert(args)
 	case "BLPOP":
-		return s.handleBLPop(args)
+		return s.handleBLPop(args, connKey)
 	case "BRPOP":
-		return s.handleBRPop(args)
+		return s.handleBRPop(args, connKey)
 	
 	// Hash commands
 	case "HSET":
@@ -586,6 +674,30 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handleHSetNX(args)
 	case "HSCAN":
 		return s.handleHScan(args)
+	case "HEXPIRE":
+		return s.handleHExpire(args)
+	case "HPEXPIRE":
+		return s.handleHPExpire(args)
+	case "HEXPIREAT":
+		return s.handleHExpireAt(args)
+	case "HPEXPIREAT":
+		return s.handleHPExpireAt(args)
+	case "HTTL":
+		return s.handleHTTL(args)
+	case "HPTTL":
+		return s.handleHPTTL(args)
+	case "HEXPIRETIME":
+		return s.handleHExpireTime(args)
+	case "HPEXPIRETIME":
+		return s.handleHPExpireTime(args)
+	case "HPERSIST":
+		return s.handleHPersist(args)
+	case "HGETDEL":
+		return s.handleHGetDel(args)
+	case "HGETEX":
+		return s.handleHGetEx(args)
+	case "HSETEX":
+		return s.handleHSetEx(args)
 	case "HSTRLEN":
 		return s.handleHStrLen(args)
 	case "HRANDFIELD":
@@ -620,6 +732,12 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handleSDiffStore(args)
 	case "SMOVE":
 		return s.handleSMove(args)
+	case "SMISMEMBER":
+		return s.handleSMIsMember(args)
+	case "SINTERCARD":
+		return s.handleSInterCard(args)
+	case "SSCAN":
+		return s.handleSScan(args)
 	
 	// Sorted Set commands
 	case "ZADD":
@@ -720,11 +838,131 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handleJSONObjKeys(args)
 	case "JSON.OBJLEN":
 		return s.handleJSONObjLen(args)
+	case "JSON.MSET":
+		return s.handleJSONMSet(args)
+	case "JSON.MERGE":
+		return s.handleJSONMerge(args)
+	case "JSON.TOGGLE":
+		return s.handleJSONToggle(args)
+	case "JSON.CLEAR":
+		return s.handleJSONClear(args)
+	case "JSON.DEBUG":
+		return s.handleJSONDebug(args)
 	case "JSON.MGET":
 		return s.handleJSONMGet(args)
 	case "JSON.RESP":
 		return s.handleJSONResp(args)
 	
+	// Search commands
+	case "FT.CREATE":
+		return s.handleFTCreate(args)
+	case "FT.SEARCH":
+		return s.handleFTSearch(args)
+	case "FT.AGGREGATE":
+		return s.handleFTAggregate(args)
+	case "FT.INFO":
+		return s.handleFTInfo(args)
+	case "FT.DROPINDEX":
+		return s.handleFTDropIndex(args)
+	case "FT._LIST":
+		return s.handleFTList(args)
+	
+	// Time series commands
+	case "TS.CREATE":
+		return s.handleTSCreate(args)
+	case "TS.ALTER":
+		return s.handleTSAlter(args)
+	case "TS.ADD":
+		return s.handleTSAdd(args)
+	case "TS.MADD":
+		return s.handleTSMAdd(args)
+	case "TS.INCRBY", "TS.DECRBY":
+		return s.handleTSIncrBy(command, args)
+	case "TS.DEL":
+		return s.handleTSDel(args)
+	case "TS.GET":
+		return s.handleTSGet(args)
+	case "TS.MGET":
+		return s.handleTSMGet(args)
+	case "TS.RANGE", "TS.REVRANGE":
+		return s.handleTSRange(command, args)
+	case "TS.MRANGE", "TS.MREVRANGE":
+		return s.handleTSMRange(command, args)
+	case "TS.QUERYINDEX":
+		return s.handleTSQueryIndex(args)
+	case "TS.INFO":
+		return s.handleTSInfo(args)
+	case "TS.CREATERULE":
+		return s.handleTSCreateRule(args)
+	case "TS.DELETERULE":
+		return s.handleTSDeleteRule(args)
+	// Probabilistic commands
+	case "BF.RESERVE":
+		return s.handleBFReserve(args)
+	case "BF.ADD":
+		return s.handleBFAdd(args)
+	case "BF.MADD":
+		return s.handleBFMAdd(args)
+	case "BF.EXISTS":
+		return s.handleBFExists(args)
+	case "BF.MEXISTS":
+		return s.handleBFMExists(args)
+	case "BF.INFO":
+		return s.handleBFInfo(args)
+	case "CF.RESERVE":
+		return s.handleCFReserve(args)
+	case "CF.ADD", "CF.ADDNX":
+		return s.handleCFAdd(command, args)
+	case "CF.EXISTS":
+		return s.handleCFExists(args)
+	case "CF.MEXISTS":
+		return s.handleCFMExists(args)
+	case "CF.COUNT":
+		return s.handleCFCount(args)
+	case "CF.DEL":
+		return s.handleCFDel(args)
+	case "CF.INFO":
+		return s.handleCFInfo(args)
+	case "CMS.INITBYDIM":
+		return s.handleCMSInitByDim(args)
+	case "CMS.INITBYPROB":
+		return s.handleCMSInitByProb(args)
+	case "CMS.INCRBY":
+		return s.handleCMSIncrBy(args)
+	case "CMS.QUERY":
+		return s.handleCMSQuery(args)
+	case "CMS.MERGE":
+		return s.handleCMSMerge(args)
+	case "CMS.INFO":
+		return s.handleCMSInfo(args)
+	case "TOPK.RESERVE":
+		return s.handleTopKReserve(args)
+	case "TOPK.ADD":
+		return s.handleTopKAdd(args)
+	case "TOPK.INCRBY":
+		return s.handleTopKIncrBy(args)
+	case "TOPK.QUERY":
+		return s.handleTopKQuery(args)
+	case "TOPK.LIST":
+		return s.handleTopKList(args)
+	case "TOPK.INFO":
+		return s.handleTopKInfo(args)
+	case "TDIGEST.CREATE":
+		return s.handleTDigestCreate(args)
+	case "TDIGEST.ADD":
+		return s.handleTDigestAdd(args)
+	case "TDIGEST.QUANTILE":
+		return s.handleTDigestQuantile(args)
+	case "TDIGEST.CDF":
+		return s.handleTDigestCDF(args)
+	case "TDIGEST.MERGE":
+		return s.handleTDigestMerge(args)
+	case "TDIGEST.MIN", "TDIGEST.MAX":
+		return s.handleTDigestMinMax(command, args)
+	case "TDIGEST.RESET":
+		return s.handleTDigestReset(args)
+	case "TDIGEST.INFO":
+		return s.handleTDigestInfo(args)
 	// Stream commands
 	case "XADD":
 		return s.handleXAdd(args)
@@ -735,7 +973,7 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 	case "XREVRANGE":
 		return s.handleXRevRange(args)
 	case "XREAD":
-		return s.handleXRead(args)
+		return s.handleXRead(args, connKey)
 	case "XTRIM":
 		return s.handleXTrim(args)
 	case "XDEL":
@@ -744,6 +982,18 @@ func (s *Server) executeCommand(command string, args []string, connKey string) s
 		return s.handleXInfo(args)
 	case "XGROUP":
 		return s.handleXGroup(args)
+	case "XREADGROUP":
+		return s.handleXReadGroup(args, connKey)
+	case "XACK":
+		return s.handleXAck(args)
+	case "XPENDING":
+		return s.handleXPending(args)
+	case "XCLAIM":
+		return s.handleXClaim(args)
+	case "XAUTOCLAIM":
+		return s.handleXAutoClaim(args)
+	case "XSETID":
+		return s.handleXSetID(args)
 	
 	default:
 		return protocol.EncodeError(fmt.Sprintf("unknown command '%s'", command))
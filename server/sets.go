@@ -2,8 +2,11 @@ package server
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"keyra/protocol"
+	"keyra/store"
 )
 
 // Set commands
@@ -67,29 +70,177 @@ func (s *Server) handleSCard(args []string) string {
 }
 
 func (s *Server) handleSPop(args []string) string {
-	if len(args) < 1 {
+	if len(args) < 1 || len(args) > 2 {
 		return protocol.EncodeError("wrong number of arguments for 'spop' command")
 	}
 
 	key := args[0]
-	members := s.store.SPop(key, 1)
-	if len(members) == 0 {
-		return protocol.EncodeBulkString("")
+	count := 1
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return protocol.EncodeError("value is out of range, must be positive")
+		}
+	}
+
+	// Popped members are random, so propagate the deterministic SREM instead
+	members := s.store.SPop(key, count)
+	if len(members) > 0 {
+		s.logCommandToAOF("SREM", append([]string{key}, members...))
+	}
+
+	if len(args) == 1 {
+		if len(members) == 0 {
+			return protocol.EncodeNull()
+		}
+		return protocol.EncodeBulkString(members[0])
 	}
-	return protocol.EncodeBulkString(members[0])
+
+	result := fmt.Sprintf("*%d\r\n", len(members))
+	for _, member := range members {
+		result += protocol.EncodeBulkString(member)
+	}
+	return result
 }
 
 func (s *Server) handleSRandMember(args []string) string {
-	if len(args) < 1 {
+	if len(args) < 1 || len(args) > 2 {
 		return protocol.EncodeError("wrong number of arguments for 'srandmember' command")
 	}
 
 	key := args[0]
-	members := s.store.SRandMember(key, 1)
-	if len(members) == 0 {
-		return protocol.EncodeBulkString("")
+	if len(args) == 1 {
+		members := s.store.SRandMember(key, 1)
+		if len(members) == 0 {
+			return protocol.EncodeNull()
+		}
+		return protocol.EncodeBulkString(members[0])
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return protocol.EncodeError("value is not an integer or out of range")
+	}
+
+	members := s.store.SRandMember(key, count)
+	result := fmt.Sprintf("*%d\r\n", len(members))
+	for _, member := range members {
+		result += protocol.EncodeBulkString(member)
+	}
+	return result
+}
+
+func (s *Server) handleSMIsMember(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("wrong number of arguments for 'smismember' command")
+	}
+
+	key := args[0]
+	found, ok := s.store.SMIsMember(key, args[1:]...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
 	}
-	return protocol.EncodeBulkString(members[0])
+	result := fmt.Sprintf("*%d\r\n", len(found))
+	for _, isMember := range found {
+		if isMember {
+			result += protocol.EncodeInteger(1)
+		} else {
+			result += protocol.EncodeInteger(0)
+		}
+	}
+	return result
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func (s *Server) handleSInterCard(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("wrong number of arguments for 'sintercard' command")
+	}
+
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return protocol.EncodeError("numkeys should be greater than 0")
+	}
+	if len(args) < numKeys+1 {
+		return protocol.EncodeError("Number of keys can't be greater than number of args")
+	}
+
+	keys := args[1 : numKeys+1]
+	limit := 0
+	rest := args[numKeys+1:]
+	for i := 0; i < len(rest); i++ {
+		if strings.ToUpper(rest[i]) != "LIMIT" || i+1 >= len(rest) {
+			return protocol.EncodeError("syntax error")
+		}
+		limit, err = strconv.Atoi(rest[i+1])
+		if err != nil || limit < 0 {
+			return protocol.EncodeError("LIMIT can't be negative")
+		}
+		i++
+	}
+
+	count, ok := s.store.SInterCard(limit, keys...)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+	return protocol.EncodeInteger(count)
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *Server) handleSScan(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("wrong number of arguments for 'sscan' command")
+	}
+
+	key := args[0]
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("invalid cursor")
+	}
+
+	pattern := "*"
+	count := 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.EncodeError("syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			c, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return protocol.EncodeError("value is not an integer or out of range")
+			}
+			if c < 1 {
+				return protocol.EncodeError("syntax error")
+			}
+			count = c
+		default:
+			return protocol.EncodeError("syntax error")
+		}
+	}
+
+	members, nextCursor, ok := s.store.SScan(key, cursor, count)
+	if !ok {
+		return protocol.EncodeError(wrongTypeError)
+	}
+
+	var page []string
+	for _, member := range members {
+		if pattern == "*" || store.GlobMatch(pattern, member) {
+			page = append(page, member)
+		}
+	}
+
+	result := "*2\r\n"
+	result += protocol.EncodeBulkString(strconv.FormatUint(nextCursor, 10))
+	result += fmt.Sprintf("*%d\r\n", len(page))
+	for _, member := range page {
+		result += protocol.EncodeBulkString(member)
+	}
+	return result
 }
 
 func (s *Server) handleSInter(args []string) string {
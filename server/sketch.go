@@ -0,0 +1,525 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"keyra/protocol"
+	"keyra/store"
+)
+
+// CMS.INITBYDIM key width depth
+func (s *Server) handleCMSInitByDim(args []string) string {
+	if len(args) != 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.INITBYDIM' command")
+	}
+
+	width, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || width <= 0 {
+		return protocol.EncodeError("ERR CMS: invalid width")
+	}
+	depth, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || depth <= 0 {
+		return protocol.EncodeError("ERR CMS: invalid depth")
+	}
+	if !store.ValidSketchDimensions(width, depth) {
+		return protocol.EncodeError(fmt.Sprintf("ERR CMS: width*depth must not exceed %d", store.MaxSketchCounters))
+	}
+	if err := s.store.CMSInit(args[0], width, depth); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// CMS.INITBYPROB key error probability
+func (s *Server) handleCMSInitByProb(args []string) string {
+	if len(args) != 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.INITBYPROB' command")
+	}
+
+	errorRate, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return protocol.EncodeError("ERR CMS: invalid overestimation value")
+	}
+	probability, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || probability <= 0 || probability >= 1 {
+		return protocol.EncodeError("ERR CMS: invalid prob value")
+	}
+	width, depth := store.CMSDimensions(errorRate, probability)
+	if !store.ValidSketchDimensions(width, depth) {
+		return protocol.EncodeError(fmt.Sprintf("ERR CMS: width*depth must not exceed %d", store.MaxSketchCounters))
+	}
+	if err := s.store.CMSInit(args[0], width, depth); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// CMS.INCRBY key item increment [item increment ...]
+func (s *Server) handleCMSIncrBy(args []string) string {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.INCRBY' command")
+	}
+
+	items, increments, err := parseSketchIncrements(args[1:], "ERR CMS: Cannot parse number")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	counts, err := s.store.CMSIncrBy(args[0], items, increments)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeIntArray(counts)
+}
+
+// CMS.QUERY key item [item ...]
+func (s *Server) handleCMSQuery(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.QUERY' command")
+	}
+
+	counts, err := s.store.CMSQuery(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeIntArray(counts)
+}
+
+// CMS.MERGE destination numKeys source [source ...] [WEIGHTS weight [weight ...]]
+func (s *Server) handleCMSMerge(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.MERGE' command")
+	}
+
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 || 2+numKeys > len(args) {
+		return protocol.EncodeError("ERR CMS: invalid numkeys")
+	}
+	sources := args[2 : 2+numKeys]
+	weights := make([]int64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if rest := args[2+numKeys:]; len(rest) > 0 {
+		if !strings.EqualFold(rest[0], "WEIGHTS") || len(rest)-1 != numKeys {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		for i, w := range rest[1:] {
+			if weights[i], err = strconv.ParseInt(w, 10, 64); err != nil {
+				return protocol.EncodeError("ERR CMS: invalid weight value")
+			}
+		}
+	}
+
+	if err := s.store.CMSMerge(args[0], sources, weights); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// CMS.INFO key
+func (s *Server) handleCMSInfo(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'CMS.INFO' command")
+	}
+
+	info, err := s.store.CMSInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	response.WriteString("*6\r\n")
+	response.WriteString(encodeBulk("width"))
+	response.WriteString(protocol.EncodeInteger(int(info.Width)))
+	response.WriteString(encodeBulk("depth"))
+	response.WriteString(protocol.EncodeInteger(int(info.Depth)))
+	response.WriteString(encodeBulk("count"))
+	response.WriteString(protocol.EncodeInteger(int(info.Count)))
+	return response.String()
+}
+
+// TOPK.RESERVE key topk [width depth decay]
+func (s *Server) handleTopKReserve(args []string) string {
+	if len(args) != 2 && len(args) != 5 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.RESERVE' command")
+	}
+
+	k, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || k <= 0 {
+		return protocol.EncodeError("ERR TopK: invalid k")
+	}
+	width, depth, decay := int64(store.DefaultTopKWidth), int64(store.DefaultTopKDepth), store.DefaultTopKDecay
+	if len(args) == 5 {
+		if width, err = strconv.ParseInt(args[2], 10, 64); err != nil || width <= 0 {
+			return protocol.EncodeError("ERR TopK: invalid width")
+		}
+		if depth, err = strconv.ParseInt(args[3], 10, 64); err != nil || depth <= 0 {
+			return protocol.EncodeError("ERR TopK: invalid depth")
+		}
+		if decay, err = strconv.ParseFloat(args[4], 64); err != nil || decay <= 0 || decay > 1 {
+			return protocol.EncodeError("ERR TopK: invalid decay value. must be '<= 1' & '> 0'")
+		}
+		if !store.ValidSketchDimensions(width, depth) {
+			return protocol.EncodeError(fmt.Sprintf("ERR TopK: width*depth must not exceed %d", store.MaxSketchCounters))
+		}
+	}
+
+	if err := s.store.TopKReserve(args[0], k, width, depth, decay); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TOPK.ADD key item [item ...]
+func (s *Server) handleTopKAdd(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.ADD' command")
+	}
+
+	increments := make([]int64, len(args)-1)
+	for i := range increments {
+		increments[i] = 1
+	}
+	expelled, err := s.store.TopKIncrBy(args[0], args[1:], increments)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeExpelled(expelled)
+}
+
+// TOPK.INCRBY key item increment [item increment ...]
+func (s *Server) handleTopKIncrBy(args []string) string {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.INCRBY' command")
+	}
+
+	items, increments, err := parseSketchIncrements(args[1:], "ERR TopK: Cannot parse number")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	for _, increment := range increments {
+		if increment > store.MaxTopKIncrement {
+			return protocol.EncodeError(fmt.Sprintf("ERR TopK: increment must be less than or equal to %d", store.MaxTopKIncrement))
+		}
+	}
+	expelled, err := s.store.TopKIncrBy(args[0], items, increments)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeExpelled(expelled)
+}
+
+// TOPK.QUERY key item [item ...]
+func (s *Server) handleTopKQuery(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.QUERY' command")
+	}
+
+	found, err := s.store.TopKQuery(args[0], args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBoolArray(found)
+}
+
+// TOPK.LIST key [WITHCOUNT]
+func (s *Server) handleTopKList(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.LIST' command")
+	}
+
+	withCount := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "WITHCOUNT") {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		withCount = true
+	}
+	items, err := s.store.TopKList(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	if withCount {
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(items)*2))
+	} else {
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(items)))
+	}
+	for _, item := range items {
+		response.WriteString(encodeBulk(item.Item))
+		if withCount {
+			response.WriteString(protocol.EncodeInteger(int(item.Count)))
+		}
+	}
+	return response.String()
+}
+
+// TOPK.INFO key
+func (s *Server) handleTopKInfo(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TOPK.INFO' command")
+	}
+
+	info, err := s.store.TopKInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	response.WriteString("*8\r\n")
+	response.WriteString(encodeBulk("k"))
+	response.WriteString(protocol.EncodeInteger(int(info.K)))
+	response.WriteString(encodeBulk("width"))
+	response.WriteString(protocol.EncodeInteger(int(info.Width)))
+	response.WriteString(encodeBulk("depth"))
+	response.WriteString(protocol.EncodeInteger(int(info.Depth)))
+	response.WriteString(encodeBulk("decay"))
+	response.WriteString(encodeBulk(strconv.FormatFloat(info.Decay, 'f', -1, 64)))
+	return response.String()
+}
+
+// TDIGEST.CREATE key [COMPRESSION compression]
+func (s *Server) handleTDigestCreate(args []string) string {
+	if len(args) != 1 && len(args) != 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.CREATE' command")
+	}
+
+	compression := float64(store.DefaultTDigestCompression)
+	if len(args) == 3 {
+		if !strings.EqualFold(args[1], "COMPRESSION") {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		var err error
+		if compression, err = parseTDigestCompression(args[2]); err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+	}
+
+	if err := s.store.TDigestCreate(args[0], compression); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TDIGEST.ADD key value [value ...]
+func (s *Server) handleTDigestAdd(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.ADD' command")
+	}
+
+	values, err := parseTDigestValues(args[1:], "ERR T-Digest: error parsing val parameter")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if err := s.store.TDigestAdd(args[0], values); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TDIGEST.QUANTILE key quantile [quantile ...]
+func (s *Server) handleTDigestQuantile(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.QUANTILE' command")
+	}
+
+	fractions, err := parseTDigestValues(args[1:], "ERR T-Digest: error parsing quantile")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	for _, q := range fractions {
+		if q < 0 || q > 1 {
+			return protocol.EncodeError("ERR T-Digest: quantile should be in [0,1]")
+		}
+	}
+	values, err := s.store.TDigestQuantiles(args[0], fractions)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeFloatArray(values)
+}
+
+// TDIGEST.CDF key value [value ...]
+func (s *Server) handleTDigestCDF(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.CDF' command")
+	}
+
+	values, err := parseTDigestValues(args[1:], "ERR T-Digest: error parsing cdf")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	fractions, err := s.store.TDigestCDF(args[0], values)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeFloatArray(fractions)
+}
+
+// TDIGEST.MERGE destination numkeys source [source ...] [COMPRESSION compression] [OVERRIDE]
+func (s *Server) handleTDigestMerge(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.MERGE' command")
+	}
+
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 || 2+numKeys > len(args) {
+		return protocol.EncodeError("ERR T-Digest: error parsing numkeys")
+	}
+	var compression float64
+	override := false
+	for i := 2 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COMPRESSION":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			if compression, err = parseTDigestCompression(args[i+1]); err != nil {
+				return protocol.EncodeError(err.Error())
+			}
+			i++
+		case "OVERRIDE":
+			override = true
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+
+	if err := s.store.TDigestMerge(args[0], args[2:2+numKeys], compression, override); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TDIGEST.MIN key / TDIGEST.MAX key
+func (s *Server) handleTDigestMinMax(command string, args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+	}
+
+	lo, hi, err := s.store.TDigestMinMax(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if command == "TDIGEST.MIN" {
+		return encodeBulk(store.FormatAggregateNumber(lo))
+	}
+	return encodeBulk(store.FormatAggregateNumber(hi))
+}
+
+// TDIGEST.RESET key
+func (s *Server) handleTDigestReset(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.RESET' command")
+	}
+	if err := s.store.TDigestReset(args[0]); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TDIGEST.INFO key
+func (s *Server) handleTDigestInfo(args []string) string {
+	if len(args) != 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TDIGEST.INFO' command")
+	}
+
+	info, err := s.store.TDigestInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"Compression", int64(info.Compression)},
+		{"Capacity", info.Capacity},
+		{"Merged nodes", info.MergedNodes},
+		{"Unmerged nodes", info.UnmergedNodes},
+		{"Merged weight", int64(info.MergedWeight)},
+		{"Unmerged weight", int64(info.UnmergedWeight)},
+		{"Observations", int64(info.Observations)},
+		{"Total compressions", info.Compressions},
+		{"Memory usage", info.MemoryUsage},
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(fields)*2))
+	for _, field := range fields {
+		response.WriteString(encodeBulk(field.name))
+		response.WriteString(protocol.EncodeInteger(int(field.value)))
+	}
+	return response.String()
+}
+
+// parseSketchIncrements parses alternating items and non-negative
+// increments
+func parseSketchIncrements(args []string, message string) ([]string, []int64, error) {
+	items := make([]string, 0, len(args)/2)
+	increments := make([]int64, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("%s", message)
+		}
+		items = append(items, args[i])
+		increments = append(increments, n)
+	}
+	return items, increments, nil
+}
+
+func parseTDigestValues(args []string, message string) ([]float64, error) {
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%s", message)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func parseTDigestCompression(value string) (float64, error) {
+	compression, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || compression <= 0 {
+		return 0, fmt.Errorf("ERR T-Digest: compression parameter needs to be a positive integer")
+	}
+	return float64(compression), nil
+}
+
+func encodeIntArray(values []int64) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		response.WriteString(protocol.EncodeInteger(int(v)))
+	}
+	return response.String()
+}
+
+func encodeFloatArray(values []float64) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		response.WriteString(encodeBulk(store.FormatAggregateNumber(v)))
+	}
+	return response.String()
+}
+
+func encodeExpelled(expelled []*string) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(expelled)))
+	for _, item := range expelled {
+		if item == nil {
+			response.WriteString(protocol.EncodeNull())
+		} else {
+			response.WriteString(encodeBulk(*item))
+		}
+	}
+	return response.String()
+}
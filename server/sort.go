@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"keyra/protocol"
+	"keyra/store"
+)
+
+// SORT key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA] [STORE destination]
+func (s *Server) handleSort(args []string) string {
+	return s.sortCommand("sort", args, false)
+}
+
+// SORT_RO key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA]
+func (s *Server) handleSortRO(args []string) string {
+	return s.sortCommand("sort_ro", args, true)
+}
+
+func (s *Server) sortCommand(name string, args []string, readOnly bool) string {
+	if len(args) < 1 {
+		return protocol.EncodeError(fmt.Sprintf("wrong number of arguments for '%s' command", name))
+	}
+
+	key := args[0]
+	opts := store.SortOptions{}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ASC":
+			opts.Desc = false
+		case "DESC":
+			opts.Desc = true
+		case "ALPHA":
+			opts.Alpha = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			count, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return protocol.EncodeError("value is not an integer or out of range")
+			}
+			opts.Offset, opts.Count, opts.HasLimit = offset, count, true
+			i += 2
+		case "BY":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			opts.By = args[i+1]
+			i++
+		case "GET":
+			if i+1 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			opts.Gets = append(opts.Gets, args[i+1])
+			i++
+		case "STORE":
+			if readOnly || i+1 >= len(args) {
+				return protocol.EncodeError("syntax error")
+			}
+			opts.Store = args[i+1]
+			i++
+		default:
+			return protocol.EncodeError("syntax error")
+		}
+	}
+
+	values, count, err := s.store.Sort(key, opts)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	if opts.Store != "" {
+		s.propagateToAOF("SORT", args)
+		return protocol.EncodeInteger(count)
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, value := range values {
+		if value == nil {
+			result.WriteString(protocol.EncodeNull())
+		} else {
+			result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(*value), *value))
+		}
+	}
+	return result.String()
+}
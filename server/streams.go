@@ -2,14 +2,17 @@ package server
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"keyra/protocol"
 	"keyra/store"
 )
 
-// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold] [LIMIT count] *|id field value [field value ...]
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
 func (s *Server) handleXAdd(args []string) string {
 	if len(args) < 4 {
 		return protocol.EncodeError("ERR wrong number of arguments for 'xadd' command")
@@ -18,58 +21,24 @@ func (s *Server) handleXAdd(args []string) string {
 	key := args[0]
 	idx := 1
 
-	var maxLen int64 = 0
-	approximate := false
+	noMkStream := false
+	var trim store.TrimOptions
 
 	// Parse options
 	for idx < len(args) {
 		arg := strings.ToUpper(args[idx])
 		switch arg {
 		case "NOMKSTREAM":
+			noMkStream = true
 			idx++
-			// Check if stream exists
-			if !s.store.Exists(key) {
-				return protocol.EncodeNull()
+		case "MAXLEN", "MINID":
+			if trim.Strategy != "" {
+				return protocol.EncodeError("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
 			}
-		case "MAXLEN":
-			idx++
-			if idx >= len(args) {
-				return protocol.EncodeError("ERR syntax error")
-			}
-			// Check for ~ or =
-			nextArg := args[idx]
-			if nextArg == "~" {
-				approximate = true
-				idx++
-				if idx >= len(args) {
-					return protocol.EncodeError("ERR syntax error")
-				}
-				nextArg = args[idx]
-			} else if nextArg == "=" {
-				idx++
-				if idx >= len(args) {
-					return protocol.EncodeError("ERR syntax error")
-				}
-				nextArg = args[idx]
-			}
-			var err error
-			maxLen, err = strconv.ParseInt(nextArg, 10, 64)
-			if err != nil {
-				return protocol.EncodeError("ERR value is not an integer or out of range")
-			}
-			idx++
-		case "MINID":
-			// Skip MINID for now
-			idx++
-			if idx < len(args) && (args[idx] == "~" || args[idx] == "=") {
-				idx++
+			var errMsg string
+			if trim, idx, errMsg = parseTrimOptions(args, idx); errMsg != "" {
+				return protocol.EncodeError(errMsg)
 			}
-			if idx < len(args) {
-				idx++
-			}
-		case "LIMIT":
-			// Skip LIMIT for now
-			idx += 2
 		default:
 			// This should be the ID
 			goto parseID
@@ -81,6 +50,7 @@ parseID:
 		return protocol.EncodeError("ERR wrong number of arguments for 'xadd' command")
 	}
 
+	idIdx := idx
 	id := args[idx]
 	idx++
 
@@ -89,26 +59,81 @@ parseID:
 		return protocol.EncodeError("ERR wrong number of arguments for 'xadd' command")
 	}
 
-	fields := make(map[string]string)
-	for idx < len(args) {
-		field := args[idx]
-		value := args[idx+1]
-		fields[field] = value
-		idx += 2
-	}
-
+	fields := args[idx:]
 	if len(fields) == 0 {
 		return protocol.EncodeError("ERR wrong number of arguments for 'xadd' command")
 	}
 
-	entryID, err := s.store.XAdd(key, id, fields, maxLen, approximate)
+	if noMkStream && !s.store.Exists(key) {
+		return protocol.EncodeNull()
+	}
+
+	entryID, err := s.store.XAdd(key, id, fields, trim)
 	if err != nil {
 		return protocol.EncodeError(err.Error())
 	}
+	s.signalKeyReady(key)
+
+	// Log the generated ID so that replaying the AOF recreates the same entry
+	logged := append([]string{}, args...)
+	logged[idIdx] = entryID
+	s.propagateToAOF("XADD", logged)
 
 	return protocol.EncodeBulkString(entryID)
 }
 
+// parseTrimOptions parses "MAXLEN|MINID [=|~] threshold [LIMIT count]"
+// starting at args[idx] and returns the index following it
+func parseTrimOptions(args []string, idx int) (store.TrimOptions, int, string) {
+	trim := store.TrimOptions{Strategy: strings.ToUpper(args[idx])}
+	idx++
+
+	if idx < len(args) && (args[idx] == "~" || args[idx] == "=") {
+		trim.Approximate = args[idx] == "~"
+		idx++
+	}
+	if idx >= len(args) {
+		return trim, idx, "ERR syntax error"
+	}
+
+	if trim.Strategy == "MAXLEN" {
+		maxLen, err := strconv.ParseInt(args[idx], 10, 64)
+		if err != nil {
+			return trim, idx, "ERR value is not an integer or out of range"
+		}
+		if maxLen < 0 {
+			return trim, idx, "ERR The MAXLEN argument must be >= 0."
+		}
+		trim.MaxLen = maxLen
+	} else {
+		trim.MinID = args[idx]
+	}
+	idx++
+
+	if trim.Approximate {
+		trim.Limit = 100 * 100
+	}
+	if idx < len(args) && strings.ToUpper(args[idx]) == "LIMIT" {
+		if idx+1 >= len(args) {
+			return trim, idx, "ERR syntax error"
+		}
+		limit, err := strconv.ParseInt(args[idx+1], 10, 64)
+		if err != nil {
+			return trim, idx, "ERR value is not an integer or out of range"
+		}
+		if limit < 0 {
+			return trim, idx, "ERR The LIMIT argument must be >= 0."
+		}
+		if !trim.Approximate {
+			return trim, idx, "ERR syntax error, LIMIT cannot be used without the special ~ option"
+		}
+		trim.Limit = limit
+		idx += 2
+	}
+
+	return trim, idx, ""
+}
+
 // XLEN key
 func (s *Server) handleXLen(args []string) string {
 	if len(args) != 1 {
@@ -126,15 +151,20 @@ func (s *Server) handleXRange(args []string) string {
 	}
 
 	key := args[0]
-	start := args[1]
-	end := args[2]
+	start, err := store.NormalizeStreamRange(args[1], false)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	end, err := store.NormalizeStreamRange(args[2], true)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
 	var count int64 = 0
 
 	if len(args) > 3 {
 		if len(args) != 5 || strings.ToUpper(args[3]) != "COUNT" {
 			return protocol.EncodeError("ERR syntax error")
 		}
-		var err error
 		count, err = strconv.ParseInt(args[4], 10, 64)
 		if err != nil {
 			return protocol.EncodeError("ERR value is not an integer or out of range")
@@ -152,15 +182,20 @@ func (s *Server) handleXRevRange(args []string) string {
 	}
 
 	key := args[0]
-	end := args[1]
-	start := args[2]
+	end, err := store.NormalizeStreamRange(args[1], true)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	start, err := store.NormalizeStreamRange(args[2], false)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
 	var count int64 = 0
 
 	if len(args) > 3 {
 		if len(args) != 5 || strings.ToUpper(args[3]) != "COUNT" {
 			return protocol.EncodeError("ERR syntax error")
 		}
-		var err error
 		count, err = strconv.ParseInt(args[4], 10, 64)
 		if err != nil {
 			return protocol.EncodeError("ERR value is not an integer or out of range")
@@ -172,12 +207,13 @@ func (s *Server) handleXRevRange(args []string) string {
 }
 
 // XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
-func (s *Server) handleXRead(args []string) string {
+func (s *Server) handleXRead(args []string, connKey string) string {
 	if len(args) < 3 {
 		return protocol.EncodeError("ERR wrong number of arguments for 'xread' command")
 	}
 
 	var count int64 = 0
+	var block int64 = -1
 	idx := 0
 
 	// Parse options
@@ -196,8 +232,12 @@ func (s *Server) handleXRead(args []string) string {
 			}
 			idx++
 		case "BLOCK":
-			// Skip BLOCK for now (would require async handling)
-			idx += 2
+			idx++
+			var errMsg string
+			if block, errMsg = parseBlockTimeout(args, idx); errMsg != "" {
+				return protocol.EncodeError(errMsg)
+			}
+			idx++
 		case "STREAMS":
 			idx++
 			goto parseStreams
@@ -216,16 +256,45 @@ parseStreams:
 
 	numStreams := len(remaining) / 2
 	keys := remaining[:numStreams]
-	ids := remaining[numStreams:]
 
-	result := s.store.XRead(keys, ids, count)
+	// "$" refers to the last entry at the time of the call, also when blocking
+	ids, err := s.store.XResolveLastIDs(keys, remaining[numStreams:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var result map[string][]store.StreamEntry
+	try := func() bool {
+		result = s.store.XRead(keys, ids, count)
+		return len(result) > 0
+	}
+	if block < 0 {
+		try()
+	} else {
+		s.blockOn(connKey, keys, time.Duration(block)*time.Millisecond, try)
+	}
 	if len(result) == 0 {
-		return protocol.EncodeNull()
+		return "*-1\r\n"
 	}
 
 	return encodeXReadResult(keys, result)
 }
 
+// parseBlockTimeout parses the milliseconds argument of BLOCK at args[idx]
+func parseBlockTimeout(args []string, idx int) (int64, string) {
+	if idx >= len(args) {
+		return 0, "ERR syntax error"
+	}
+	block, err := strconv.ParseInt(args[idx], 10, 64)
+	if err != nil {
+		return 0, "ERR timeout is not an integer or out of range"
+	}
+	if block < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return block, ""
+}
+
 // XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
 func (s *Server) handleXTrim(args []string) string {
 	if len(args) < 3 {
@@ -234,37 +303,23 @@ func (s *Server) handleXTrim(args []string) string {
 
 	key := args[0]
 	strategy := strings.ToUpper(args[1])
-	
 	if strategy != "MAXLEN" && strategy != "MINID" {
 		return protocol.EncodeError("ERR syntax error")
 	}
 
-	idx := 2
-	approximate := false
-
-	if args[idx] == "~" {
-		approximate = true
-		idx++
-	} else if args[idx] == "=" {
-		idx++
+	trim, idx, errMsg := parseTrimOptions(args, 1)
+	if errMsg != "" {
+		return protocol.EncodeError(errMsg)
 	}
-
-	if idx >= len(args) {
+	if idx != len(args) {
 		return protocol.EncodeError("ERR syntax error")
 	}
 
-	threshold, err := strconv.ParseInt(args[idx], 10, 64)
+	deleted, err := s.store.XTrim(key, trim)
 	if err != nil {
-		return protocol.EncodeError("ERR value is not an integer or out of range")
-	}
-
-	if strategy == "MAXLEN" {
-		deleted := s.store.XTrim(key, threshold, approximate)
-		return protocol.EncodeInteger(int(deleted))
+		return protocol.EncodeError(err.Error())
 	}
-
-	// MINID not fully implemented
-	return protocol.EncodeInteger(0)
+	return protocol.EncodeInteger(int(deleted))
 }
 
 // XDEL key id [id ...]
@@ -276,10 +331,48 @@ func (s *Server) handleXDel(args []string) string {
 	key := args[0]
 	ids := args[1:]
 
-	deleted := s.store.XDel(key, ids)
+	deleted, err := s.store.XDel(key, ids)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
 	return protocol.EncodeInteger(int(deleted))
 }
 
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+func (s *Server) handleXSetID(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xsetid' command")
+	}
+
+	entriesAdded := int64(-1)
+	maxDeletedID := ""
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "ENTRIESADDED":
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return protocol.EncodeError("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return protocol.EncodeError("ERR entries_added must be positive")
+			}
+			entriesAdded = n
+		case "MAXDELETEDID":
+			maxDeletedID = args[i+1]
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+
+	if err := s.store.XSetID(args[0], args[1], entriesAdded, maxDeletedID); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
 // XINFO [CONSUMERS key groupname] [GROUPS key] [STREAM key] [HELP]
 func (s *Server) handleXInfo(args []string) string {
 	if len(args) < 1 {
@@ -293,23 +386,52 @@ func (s *Server) handleXInfo(args []string) string {
 		if len(args) < 2 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xinfo stream' command")
 		}
-		info, ok := s.store.XInfoStream(args[1])
-		if !ok {
-			return protocol.EncodeError("ERR no such key")
+		full := false
+		count := int64(10)
+		if len(args) > 2 {
+			if strings.ToUpper(args[2]) != "FULL" || (len(args) != 3 && len(args) != 5) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			full = true
+			if len(args) == 5 {
+				if strings.ToUpper(args[3]) != "COUNT" {
+					return protocol.EncodeError("ERR syntax error")
+				}
+				n, err := strconv.ParseInt(args[4], 10, 64)
+				if err != nil {
+					return protocol.EncodeError("ERR value is not an integer or out of range")
+				}
+				if n >= 0 {
+					count = n
+				}
+			}
+		}
+		info, err := s.store.XInfoStream(args[1], full, count)
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		if full {
+			return encodeStreamInfoFull(info)
 		}
 		return encodeStreamInfo(info)
 	case "GROUPS":
-		if len(args) < 2 {
+		if len(args) != 2 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xinfo groups' command")
 		}
-		// Return empty array for now
-		return "*0\r\n"
+		groups, err := s.store.XInfoGroups(args[1])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		return encodeXInfoGroups(groups)
 	case "CONSUMERS":
-		if len(args) < 3 {
+		if len(args) != 3 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xinfo consumers' command")
 		}
-		// Return empty array for now
-		return "*0\r\n"
+		consumers, err := s.store.XInfoConsumers(args[1], args[2])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		return encodeXInfoConsumers(consumers)
 	case "HELP":
 		return encodeXInfoHelp()
 	default:
@@ -338,14 +460,28 @@ func (s *Server) handleXGroup(args []string) string {
 		group := args[2]
 		id := args[3]
 		mkstream := false
+		entriesRead := store.InvalidEntriesRead
 
 		for i := 4; i < len(args); i++ {
-			if strings.ToUpper(args[i]) == "MKSTREAM" {
+			switch strings.ToUpper(args[i]) {
+			case "MKSTREAM":
 				mkstream = true
+			case "ENTRIESREAD":
+				if i+1 >= len(args) {
+					return protocol.EncodeError("ERR syntax error")
+				}
+				n, errMsg := parseEntriesRead(args[i+1])
+				if errMsg != "" {
+					return protocol.EncodeError(errMsg)
+				}
+				entriesRead = n
+				i++
+			default:
+				return protocol.EncodeError("ERR syntax error")
 			}
 		}
 
-		err := s.store.XGroupCreate(key, group, id, mkstream)
+		err := s.store.XGroupCreate(key, group, id, mkstream, entriesRead)
 		if err != nil {
 			return protocol.EncodeError(err.Error())
 		}
@@ -368,22 +504,46 @@ func (s *Server) handleXGroup(args []string) string {
 		return protocol.EncodeInteger(0)
 
 	case "CREATECONSUMER":
-		if len(args) < 4 {
+		if len(args) != 4 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xgroup createconsumer' command")
 		}
-		// Simplified implementation
-		return protocol.EncodeInteger(1)
+		created, err := s.store.XGroupCreateConsumer(args[1], args[2], args[3])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		if created {
+			return protocol.EncodeInteger(1)
+		}
+		return protocol.EncodeInteger(0)
 
 	case "DELCONSUMER":
-		if len(args) < 4 {
+		if len(args) != 4 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xgroup delconsumer' command")
 		}
-		return protocol.EncodeInteger(0)
+		pending, err := s.store.XGroupDelConsumer(args[1], args[2], args[3])
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		return protocol.EncodeInteger(int(pending))
 
 	case "SETID":
-		if len(args) < 4 {
+		if len(args) != 4 && len(args) != 6 {
 			return protocol.EncodeError("ERR wrong number of arguments for 'xgroup setid' command")
 		}
+		entriesRead := store.InvalidEntriesRead
+		if len(args) == 6 {
+			if strings.ToUpper(args[4]) != "ENTRIESREAD" {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			n, errMsg := parseEntriesRead(args[5])
+			if errMsg != "" {
+				return protocol.EncodeError(errMsg)
+			}
+			entriesRead = n
+		}
+		if err := s.store.XGroupSetID(args[1], args[2], args[3], entriesRead); err != nil {
+			return protocol.EncodeError(err.Error())
+		}
 		return protocol.EncodeSimpleString("OK")
 
 	case "HELP":
@@ -394,8 +554,400 @@ func (s *Server) handleXGroup(args []string) string {
 	}
 }
 
+func parseEntriesRead(arg string) (int64, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+	if n < 0 && n != store.InvalidEntriesRead {
+		return 0, "ERR value for ENTRIESREAD must be positive or -1"
+	}
+	return n, ""
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func (s *Server) handleXReadGroup(args []string, connKey string) string {
+	if len(args) < 6 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xreadgroup' command")
+	}
+
+	var group, consumer string
+	var count int64 = 0
+	var block int64 = -1
+	noack := false
+	idx := 0
+
+	for idx < len(args) {
+		arg := strings.ToUpper(args[idx])
+		switch arg {
+		case "GROUP":
+			if idx+2 >= len(args) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			group, consumer = args[idx+1], args[idx+2]
+			idx += 3
+		case "COUNT":
+			idx++
+			if idx >= len(args) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			var err error
+			count, err = strconv.ParseInt(args[idx], 10, 64)
+			if err != nil {
+				return protocol.EncodeError("ERR value is not an integer or out of range")
+			}
+			idx++
+		case "BLOCK":
+			idx++
+			var errMsg string
+			if block, errMsg = parseBlockTimeout(args, idx); errMsg != "" {
+				return protocol.EncodeError(errMsg)
+			}
+			idx++
+		case "NOACK":
+			noack = true
+			idx++
+		case "STREAMS":
+			idx++
+			goto parseStreams
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+
+	return protocol.EncodeError("ERR syntax error, STREAMS is required")
+
+parseStreams:
+	if group == "" {
+		return protocol.EncodeError("ERR Missing GROUP option for XREADGROUP")
+	}
+
+	remaining := args[idx:]
+	if len(remaining) == 0 || len(remaining)%2 != 0 {
+		return protocol.EncodeError("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified")
+	}
+
+	numStreams := len(remaining) / 2
+	keys := remaining[:numStreams]
+	ids := remaining[numStreams:]
+
+	var result map[string][]store.StreamEntry
+	var err error
+	retry := false
+	try := func() bool {
+		result, err = s.store.XReadGroup(group, consumer, keys, ids, count, noack)
+		if err != nil && retry {
+			err = s.xreadGroupUnblockedError(keys)
+		}
+		retry = true
+		return err != nil || len(result) > 0
+	}
+	if block < 0 {
+		try()
+	} else {
+		s.blockOn(connKey, keys, time.Duration(block)*time.Millisecond, try)
+	}
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if len(result) == 0 {
+		return "*-1\r\n"
+	}
+
+	return encodeXReadResult(keys, result)
+}
+
+// xreadGroupUnblockedError is the error a blocked XREADGROUP fails with
+// once a stream or the group it reads was removed while it waited
+func (s *Server) xreadGroupUnblockedError(keys []string) error {
+	for _, key := range keys {
+		if s.store.GetType(key) != store.StreamType {
+			return fmt.Errorf("UNBLOCKED the stream key no longer exists")
+		}
+	}
+	return fmt.Errorf("UNBLOCKED the consumer group this client was blocked on no longer exists")
+}
+
+// XACK key group id [id ...]
+func (s *Server) handleXAck(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xack' command")
+	}
+
+	acked, err := s.store.XAck(args[0], args[1], args[2:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeInteger(int(acked))
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (s *Server) handleXPending(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xpending' command")
+	}
+
+	key, group := args[0], args[1]
+
+	if len(args) == 2 {
+		pending, err := s.store.XPending(key, group, store.StreamID{}, store.MaxStreamID, -1, "", 0)
+		if err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+		return encodeXPendingSummary(pending)
+	}
+
+	idx := 2
+	var minIdle time.Duration
+	if strings.ToUpper(args[idx]) == "IDLE" {
+		if idx+1 >= len(args) {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		idle, err := strconv.ParseInt(args[idx+1], 10, 64)
+		if err != nil {
+			return protocol.EncodeError("ERR value is not an integer or out of range")
+		}
+		minIdle = time.Duration(idle) * time.Millisecond
+		idx += 2
+	}
+
+	if len(args)-idx != 3 && len(args)-idx != 4 {
+		return protocol.EncodeError("ERR syntax error")
+	}
+
+	start, err := store.NormalizeStreamRange(args[idx], false)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	end, err := store.NormalizeStreamRange(args[idx+1], true)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	count, err := strconv.ParseInt(args[idx+2], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("ERR value is not an integer or out of range")
+	}
+	if count < 0 {
+		count = 0
+	}
+	consumer := ""
+	if len(args)-idx == 4 {
+		consumer = args[idx+3]
+	}
+
+	pending, err := s.store.XPending(key, group, start, end, count, consumer, minIdle)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	now := time.Now()
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(pending)))
+	for _, entry := range pending {
+		result.WriteString("*4\r\n")
+		result.WriteString(protocol.EncodeBulkString(entry.EntryID.String()))
+		result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(entry.ConsumerName), entry.ConsumerName))
+		result.WriteString(protocol.EncodeInteger(int(now.Sub(entry.DeliveryTime).Milliseconds())))
+		result.WriteString(protocol.EncodeInteger(int(entry.DeliveryCount)))
+	}
+	return result.String()
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func (s *Server) handleXClaim(args []string) string {
+	if len(args) < 5 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xclaim' command")
+	}
+
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+
+	idx := 4
+	var ids []string
+	for ; idx < len(args); idx++ {
+		switch strings.ToUpper(args[idx]) {
+		case "IDLE", "TIME", "RETRYCOUNT", "FORCE", "JUSTID", "LASTID":
+		default:
+			ids = append(ids, args[idx])
+			continue
+		}
+		break
+	}
+
+	opts := store.ClaimOptions{RetryCount: -1}
+	for ; idx < len(args); idx++ {
+		option := strings.ToUpper(args[idx])
+		switch option {
+		case "FORCE":
+			opts.Force = true
+		case "JUSTID":
+			opts.JustID = true
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+			if idx+1 >= len(args) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			idx++
+			if option == "LASTID" {
+				opts.LastID = args[idx]
+				continue
+			}
+			value, err := strconv.ParseInt(args[idx], 10, 64)
+			if err != nil {
+				return protocol.EncodeError(fmt.Sprintf("ERR Invalid %s option argument for XCLAIM", option))
+			}
+			switch option {
+			case "IDLE":
+				opts.DeliveryTime = time.Now().Add(-time.Duration(value) * time.Millisecond)
+			case "TIME":
+				opts.DeliveryTime = time.UnixMilli(value)
+			case "RETRYCOUNT":
+				opts.RetryCount = value
+			}
+		default:
+			return protocol.EncodeError(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[idx]))
+		}
+	}
+
+	result, err := s.store.XClaim(key, group, consumer, time.Duration(minIdle)*time.Millisecond, ids, opts)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	s.propagateClaims(key, group, consumer, result)
+
+	if opts.JustID {
+		return encodeClaimedIDs(result.Entries)
+	}
+	return encodeStreamEntries(result.Entries)
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (s *Server) handleXAutoClaim(args []string) string {
+	if len(args) < 5 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'xautoclaim' command")
+	}
+
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return protocol.EncodeError("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	start, err := store.NormalizeStreamRange(args[4], false)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var count int64 = 100
+	justID := false
+	for idx := 5; idx < len(args); idx++ {
+		switch strings.ToUpper(args[idx]) {
+		case "COUNT":
+			if idx+1 >= len(args) {
+				return protocol.EncodeError("ERR syntax error")
+			}
+			idx++
+			count, err = strconv.ParseInt(args[idx], 10, 64)
+			if err != nil || count < 1 || count > math.MaxInt64/10 {
+				return protocol.EncodeError("ERR COUNT must be > 0")
+			}
+		case "JUSTID":
+			justID = true
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+
+	result, err := s.store.XAutoClaim(key, group, consumer, time.Duration(minIdle)*time.Millisecond, start, count, justID)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	s.propagateClaims(key, group, consumer, result)
+
+	var resp strings.Builder
+	resp.WriteString("*3\r\n")
+	resp.WriteString(protocol.EncodeBulkString(result.Cursor.String()))
+	if justID {
+		resp.WriteString(encodeClaimedIDs(result.Entries))
+	} else {
+		resp.WriteString(encodeStreamEntries(result.Entries))
+	}
+	resp.WriteString(protocol.EncodeStringArray(streamIDStrings(result.Deleted)))
+	return resp.String()
+}
+
+// propagateClaims logs claimed entries as forced XCLAIMs with an absolute
+// delivery time and count, and dropped entries as XACKs, so replaying the
+// AOF does not depend on idle times
+func (s *Server) propagateClaims(key, group, consumer string, result *store.ClaimResult) {
+	for _, claimed := range result.Claimed {
+		s.propagateToAOF("XCLAIM", []string{key, group, consumer, "0", claimed.EntryID.String(),
+			"TIME", strconv.FormatInt(claimed.DeliveryTime.UnixMilli(), 10),
+			"RETRYCOUNT", strconv.FormatInt(claimed.DeliveryCount, 10),
+			"FORCE", "JUSTID", "LASTID", result.LastDeliveredID.String()})
+	}
+	if len(result.Deleted) > 0 {
+		s.propagateToAOF("XACK", append([]string{key, group}, streamIDStrings(result.Deleted)...))
+	}
+}
+
 // Helper functions
 
+func encodeClaimedIDs(entries []store.StreamEntry) string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID.String()
+	}
+	return protocol.EncodeStringArray(ids)
+}
+
+func streamIDStrings(ids []store.StreamID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strs
+}
+
+func encodeXPendingSummary(pending []store.PendingEntry) string {
+	if len(pending) == 0 {
+		return "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"
+	}
+
+	counts := make(map[string]int)
+	var consumers []string
+	for _, entry := range pending {
+		if counts[entry.ConsumerName] == 0 {
+			consumers = append(consumers, entry.ConsumerName)
+		}
+		counts[entry.ConsumerName]++
+	}
+	sort.Strings(consumers)
+
+	minID := pending[0].EntryID.String()
+	maxID := pending[len(pending)-1].EntryID.String()
+
+	var result strings.Builder
+	result.WriteString("*4\r\n")
+	result.WriteString(protocol.EncodeInteger(len(pending)))
+	result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(minID), minID))
+	result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(maxID), maxID))
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(consumers)))
+	for _, name := range consumers {
+		result.WriteString(protocol.EncodeStringArray([]string{name, strconv.Itoa(counts[name])}))
+	}
+	return result.String()
+}
+
 func encodeStreamEntries(entries []store.StreamEntry) string {
 	if len(entries) == 0 {
 		return "*0\r\n"
@@ -405,22 +957,31 @@ func encodeStreamEntries(entries []store.StreamEntry) string {
 	result.WriteString(fmt.Sprintf("*%d\r\n", len(entries)))
 
 	for _, entry := range entries {
-		// Each entry is [id, [field, value, ...]]
-		result.WriteString("*2\r\n")
-		result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(entry.ID), entry.ID))
-
-		// Fields array
-		fieldCount := len(entry.Fields) * 2
-		result.WriteString(fmt.Sprintf("*%d\r\n", fieldCount))
-		for field, value := range entry.Fields {
-			result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(field), field))
-			result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
-		}
+		result.WriteString(encodeStreamEntry(entry))
 	}
 
 	return result.String()
 }
 
+func encodeStreamEntry(entry store.StreamEntry) string {
+	// Each entry is [id, [field, value, ...]]
+	var result strings.Builder
+	result.WriteString("*2\r\n")
+	id := entry.ID.String()
+	result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(id), id))
+
+	// Fields array, null for entries deleted while still pending
+	if entry.Fields == nil {
+		result.WriteString("*-1\r\n")
+		return result.String()
+	}
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(entry.Fields)))
+	for _, field := range entry.Fields {
+		result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(field), field))
+	}
+	return result.String()
+}
+
 func encodeXReadResult(keys []string, result map[string][]store.StreamEntry) string {
 	// Count non-empty results
 	count := 0
@@ -448,58 +1009,170 @@ func encodeXReadResult(keys []string, result map[string][]store.StreamEntry) str
 	return resp.String()
 }
 
-func encodeStreamInfo(info map[string]interface{}) string {
-	// Simplified info encoding
+func encodeStreamInfo(info *store.StreamInfo) string {
 	var result strings.Builder
-	result.WriteString("*14\r\n")
-
-	// length
-	result.WriteString("$6\r\nlength\r\n")
-	length := info["length"].(int64)
-	result.WriteString(fmt.Sprintf(":%d\r\n", length))
-
-	// radix-tree-keys
-	result.WriteString("$15\r\nradix-tree-keys\r\n")
-	result.WriteString(":1\r\n")
-
-	// radix-tree-nodes
-	result.WriteString("$16\r\nradix-tree-nodes\r\n")
-	result.WriteString(":2\r\n")
-
-	// last-generated-id
-	result.WriteString("$17\r\nlast-generated-id\r\n")
-	lastID := info["last-generated-id"].(string)
-	if lastID == "" {
-		lastID = "0-0"
-	}
-	result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(lastID), lastID))
-
-	// groups
-	result.WriteString("$6\r\ngroups\r\n")
-	groups := info["groups"].(int64)
-	result.WriteString(fmt.Sprintf(":%d\r\n", groups))
-
-	// first-entry
-	result.WriteString("$11\r\nfirst-entry\r\n")
-	if firstEntry := info["first-entry"]; firstEntry != nil {
-		entry := firstEntry.(store.StreamEntry)
-		result.WriteString(encodeStreamEntries([]store.StreamEntry{entry}))
+	result.WriteString("*20\r\n")
+	writeStreamInfoHeader(&result, info)
+
+	result.WriteString(protocol.EncodeBulkString("groups"))
+	result.WriteString(protocol.EncodeInteger(int(info.GroupCount)))
+
+	result.WriteString(protocol.EncodeBulkString("first-entry"))
+	if len(info.Entries) > 0 {
+		result.WriteString(encodeStreamEntry(info.Entries[0]))
+	} else {
+		result.WriteString("$-1\r\n")
+	}
+
+	result.WriteString(protocol.EncodeBulkString("last-entry"))
+	if len(info.Entries) > 0 {
+		result.WriteString(encodeStreamEntry(info.Entries[len(info.Entries)-1]))
 	} else {
 		result.WriteString("$-1\r\n")
 	}
 
-	// last-entry
-	result.WriteString("$10\r\nlast-entry\r\n")
-	if lastEntry := info["last-entry"]; lastEntry != nil {
-		entry := lastEntry.(store.StreamEntry)
-		result.WriteString(encodeStreamEntries([]store.StreamEntry{entry}))
+	return result.String()
+}
+
+func encodeStreamInfoFull(info *store.StreamInfo) string {
+	var result strings.Builder
+	result.WriteString("*18\r\n")
+	writeStreamInfoHeader(&result, info)
+
+	result.WriteString(protocol.EncodeBulkString("entries"))
+	result.WriteString(encodeStreamEntries(info.Entries))
+
+	result.WriteString(protocol.EncodeBulkString("groups"))
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(info.Groups)))
+	for _, group := range info.Groups {
+		result.WriteString("*14\r\n")
+		result.WriteString(protocol.EncodeBulkString("name"))
+		result.WriteString(protocol.EncodeBulkString(group.Name))
+		result.WriteString(protocol.EncodeBulkString("last-delivered-id"))
+		result.WriteString(encodeStreamID(group.LastDeliveredID))
+		writeGroupCounters(&result, group)
+		result.WriteString(protocol.EncodeBulkString("pel-count"))
+		result.WriteString(protocol.EncodeInteger(int(group.PendingCount)))
+
+		result.WriteString(protocol.EncodeBulkString("pending"))
+		result.WriteString(fmt.Sprintf("*%d\r\n", len(group.Pending)))
+		for _, p := range group.Pending {
+			result.WriteString("*4\r\n")
+			result.WriteString(protocol.EncodeBulkString(p.EntryID.String()))
+			result.WriteString(protocol.EncodeBulkString(p.ConsumerName))
+			result.WriteString(protocol.EncodeInteger(int(p.DeliveryTime.UnixMilli())))
+			result.WriteString(protocol.EncodeInteger(int(p.DeliveryCount)))
+		}
+
+		result.WriteString(protocol.EncodeBulkString("consumers"))
+		result.WriteString(fmt.Sprintf("*%d\r\n", len(group.Consumers)))
+		for _, c := range group.Consumers {
+			result.WriteString("*10\r\n")
+			result.WriteString(protocol.EncodeBulkString("name"))
+			result.WriteString(protocol.EncodeBulkString(c.Name))
+			result.WriteString(protocol.EncodeBulkString("seen-time"))
+			result.WriteString(protocol.EncodeInteger(int(c.SeenTime.UnixMilli())))
+			result.WriteString(protocol.EncodeBulkString("active-time"))
+			if c.ActiveTime.IsZero() {
+				result.WriteString(protocol.EncodeInteger(-1))
+			} else {
+				result.WriteString(protocol.EncodeInteger(int(c.ActiveTime.UnixMilli())))
+			}
+			result.WriteString(protocol.EncodeBulkString("pel-count"))
+			result.WriteString(protocol.EncodeInteger(int(c.PendingCount)))
+
+			result.WriteString(protocol.EncodeBulkString("pending"))
+			result.WriteString(fmt.Sprintf("*%d\r\n", len(c.Pending)))
+			for _, p := range c.Pending {
+				result.WriteString("*3\r\n")
+				result.WriteString(protocol.EncodeBulkString(p.EntryID.String()))
+				result.WriteString(protocol.EncodeInteger(int(p.DeliveryTime.UnixMilli())))
+				result.WriteString(protocol.EncodeInteger(int(p.DeliveryCount)))
+			}
+		}
+	}
+
+	return result.String()
+}
+
+func writeStreamInfoHeader(result *strings.Builder, info *store.StreamInfo) {
+	result.WriteString(protocol.EncodeBulkString("length"))
+	result.WriteString(protocol.EncodeInteger(int(info.Length)))
+	result.WriteString(protocol.EncodeBulkString("radix-tree-keys"))
+	result.WriteString(protocol.EncodeInteger(int(info.RadixTreeKeys)))
+	result.WriteString(protocol.EncodeBulkString("radix-tree-nodes"))
+	result.WriteString(protocol.EncodeInteger(int(info.RadixTreeNodes)))
+	result.WriteString(protocol.EncodeBulkString("last-generated-id"))
+	result.WriteString(encodeStreamID(info.LastGeneratedID))
+	result.WriteString(protocol.EncodeBulkString("max-deleted-entry-id"))
+	result.WriteString(encodeStreamID(info.MaxDeletedID))
+	result.WriteString(protocol.EncodeBulkString("entries-added"))
+	result.WriteString(protocol.EncodeInteger(int(info.EntriesAdded)))
+	result.WriteString(protocol.EncodeBulkString("recorded-first-entry-id"))
+	result.WriteString(encodeStreamID(info.FirstID))
+}
+
+// writeGroupCounters writes entries-read and lag, which are nil when they
+// can't be determined
+func writeGroupCounters(result *strings.Builder, group store.StreamGroupInfo) {
+	result.WriteString(protocol.EncodeBulkString("entries-read"))
+	if group.EntriesRead == store.InvalidEntriesRead {
+		result.WriteString("$-1\r\n")
 	} else {
+		result.WriteString(protocol.EncodeInteger(int(group.EntriesRead)))
+	}
+	result.WriteString(protocol.EncodeBulkString("lag"))
+	if group.Lag < 0 {
 		result.WriteString("$-1\r\n")
+	} else {
+		result.WriteString(protocol.EncodeInteger(int(group.Lag)))
+	}
+}
+
+func encodeXInfoGroups(groups []store.StreamGroupInfo) string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(groups)))
+	for _, group := range groups {
+		result.WriteString("*12\r\n")
+		result.WriteString(protocol.EncodeBulkString("name"))
+		result.WriteString(protocol.EncodeBulkString(group.Name))
+		result.WriteString(protocol.EncodeBulkString("consumers"))
+		result.WriteString(protocol.EncodeInteger(int(group.ConsumerCount)))
+		result.WriteString(protocol.EncodeBulkString("pending"))
+		result.WriteString(protocol.EncodeInteger(int(group.PendingCount)))
+		result.WriteString(protocol.EncodeBulkString("last-delivered-id"))
+		result.WriteString(encodeStreamID(group.LastDeliveredID))
+		writeGroupCounters(&result, group)
 	}
+	return result.String()
+}
 
+func encodeXInfoConsumers(consumers []store.StreamConsumerInfo) string {
+	now := time.Now()
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(consumers)))
+	for _, c := range consumers {
+		result.WriteString("*8\r\n")
+		result.WriteString(protocol.EncodeBulkString("name"))
+		result.WriteString(protocol.EncodeBulkString(c.Name))
+		result.WriteString(protocol.EncodeBulkString("pending"))
+		result.WriteString(protocol.EncodeInteger(int(c.PendingCount)))
+		result.WriteString(protocol.EncodeBulkString("idle"))
+		result.WriteString(protocol.EncodeInteger(int(max(0, now.Sub(c.SeenTime).Milliseconds()))))
+		result.WriteString(protocol.EncodeBulkString("inactive"))
+		if c.ActiveTime.IsZero() {
+			result.WriteString(protocol.EncodeInteger(-1))
+		} else {
+			result.WriteString(protocol.EncodeInteger(int(max(0, now.Sub(c.ActiveTime).Milliseconds()))))
+		}
+	}
 	return result.String()
 }
 
+func encodeStreamID(id store.StreamID) string {
+	return protocol.EncodeBulkString(id.String())
+}
+
 func encodeXInfoHelp() string {
 	help := []string{
 		"XINFO <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
@@ -0,0 +1,730 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"keyra/protocol"
+	"keyra/store"
+)
+
+// tsArgs holds the options shared by the commands that create or alter a
+// series
+type tsArgs struct {
+	opts           store.TimeSeriesOptions
+	onDuplicate    string
+	timestamp      string
+	timestampIndex int
+}
+
+// parseTSArgs parses RETENTION, ENCODING, CHUNK_SIZE, DUPLICATE_POLICY and
+// LABELS, plus ON_DUPLICATE for TS.ADD and TIMESTAMP for TS.INCRBY and
+// TS.DECRBY
+func parseTSArgs(command string, args []string) (*tsArgs, error) {
+	parsed := &tsArgs{timestampIndex: -1}
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if option == "UNCOMPRESSED" {
+			continue
+		}
+		if option == "LABELS" {
+			pairs := args[i+1:]
+			if len(pairs)%2 != 0 {
+				return nil, fmt.Errorf("ERR TSDB: wrong number of arguments for LABELS")
+			}
+			parsed.opts.Labels = []store.TimeSeriesLabel{}
+			for j := 0; j < len(pairs); j += 2 {
+				parsed.opts.Labels = append(parsed.opts.Labels, store.TimeSeriesLabel{Name: pairs[j], Value: pairs[j+1]})
+			}
+			parsed.opts.SetLabels = true
+			break
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+		value := args[i+1]
+		switch {
+		case option == "RETENTION":
+			retention, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || retention < 0 {
+				return nil, fmt.Errorf("ERR TSDB: invalid RETENTION value")
+			}
+			parsed.opts.Retention = retention
+			parsed.opts.SetRetention = true
+		case option == "ENCODING":
+			if !strings.EqualFold(value, "COMPRESSED") && !strings.EqualFold(value, "UNCOMPRESSED") {
+				return nil, fmt.Errorf("ERR TSDB: unknown ENCODING parameter")
+			}
+		case option == "CHUNK_SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 48 || size > 1048576 || size%8 != 0 {
+				return nil, fmt.Errorf("ERR TSDB: CHUNK_SIZE value must be a multiple of 8 in the range [48 .. 1048576]")
+			}
+			parsed.opts.ChunkSize = size
+			parsed.opts.SetChunkSize = true
+		case option == "DUPLICATE_POLICY":
+			policy, err := store.ParseTimeSeriesPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			parsed.opts.DuplicatePolicy = policy
+		case option == "ON_DUPLICATE" && command == "TS.ADD":
+			policy, err := store.ParseTimeSeriesPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			parsed.onDuplicate = policy
+		case option == "TIMESTAMP" && (command == "TS.INCRBY" || command == "TS.DECRBY"):
+			parsed.timestamp = value
+			parsed.timestampIndex = i
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+		i++
+	}
+	return parsed, nil
+}
+
+// parseTSTimestamp parses a sample timestamp, where * is the current time
+func parseTSTimestamp(value string) (int64, error) {
+	if value == "*" {
+		return time.Now().UnixMilli(), nil
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, fmt.Errorf("ERR TSDB: invalid timestamp, must be a nonnegative integer")
+	}
+	return ts, nil
+}
+
+// parseTSBound parses the start or end of a range, where - and + are the
+// earliest and latest possible timestamps
+func parseTSBound(value, name string) (int64, error) {
+	switch value {
+	case "-":
+		return 0, nil
+	case "+":
+		return math.MaxInt64, nil
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, fmt.Errorf("ERR TSDB: invalid %s", name)
+	}
+	return ts, nil
+}
+
+func parseTSValue(value string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("ERR TSDB: invalid value")
+	}
+	return v, nil
+}
+
+// TS.CREATE key [RETENTION ms] [ENCODING COMPRESSED|UNCOMPRESSED] [CHUNK_SIZE size] [DUPLICATE_POLICY policy] [LABELS label value ...]
+func (s *Server) handleTSCreate(args []string) string {
+	if len(args) < 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.CREATE' command")
+	}
+
+	parsed, err := parseTSArgs("TS.CREATE", args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if err := s.store.TSCreate(args[0], parsed.opts); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TS.ALTER key [RETENTION ms] [CHUNK_SIZE size] [DUPLICATE_POLICY policy] [LABELS label value ...]
+func (s *Server) handleTSAlter(args []string) string {
+	if len(args) < 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.ALTER' command")
+	}
+
+	parsed, err := parseTSArgs("TS.ALTER", args[1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if err := s.store.TSAlter(args[0], parsed.opts); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TS.ADD key timestamp|* value [RETENTION ms] [ENCODING enc] [CHUNK_SIZE size] [DUPLICATE_POLICY policy] [ON_DUPLICATE policy] [LABELS label value ...]
+func (s *Server) handleTSAdd(args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.ADD' command")
+	}
+
+	timestamp, err := parseTSTimestamp(args[1])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	value, err := parseTSValue(args[2])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	parsed, err := parseTSArgs("TS.ADD", args[3:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	added, err := s.store.TSAdd(args[0], timestamp, value, parsed.onDuplicate, &parsed.opts)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	logged := append([]string{}, args...)
+	logged[1] = strconv.FormatInt(added, 10)
+	s.propagateToAOF("TS.ADD", logged)
+	return protocol.EncodeInteger(int(added))
+}
+
+// TS.MADD key timestamp value [key timestamp value ...]
+func (s *Server) handleTSMAdd(args []string) string {
+	if len(args) < 3 || len(args)%3 != 0 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.MADD' command")
+	}
+
+	var logged []string
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(args)/3))
+	for i := 0; i < len(args); i += 3 {
+		timestamp, err := parseTSTimestamp(args[i+1])
+		if err != nil {
+			response.WriteString(protocol.EncodeError(err.Error()))
+			continue
+		}
+		value, err := parseTSValue(args[i+2])
+		if err != nil {
+			response.WriteString(protocol.EncodeError(err.Error()))
+			continue
+		}
+		added, err := s.store.TSAdd(args[i], timestamp, value, "", nil)
+		if err != nil {
+			response.WriteString(protocol.EncodeError(err.Error()))
+			continue
+		}
+		logged = append(logged, args[i], strconv.FormatInt(added, 10), args[i+2])
+		response.WriteString(protocol.EncodeInteger(int(added)))
+	}
+
+	if len(logged) > 0 {
+		s.propagateToAOF("TS.MADD", logged)
+	}
+	return response.String()
+}
+
+// TS.INCRBY / TS.DECRBY key value [TIMESTAMP timestamp] [RETENTION ms] [UNCOMPRESSED] [CHUNK_SIZE size] [DUPLICATE_POLICY policy] [LABELS label value ...]
+func (s *Server) handleTSIncrBy(command string, args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+	}
+
+	delta, err := parseTSValue(args[1])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if command == "TS.DECRBY" {
+		delta = -delta
+	}
+	parsed, err := parseTSArgs(command, args[2:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	timestamp := time.Now().UnixMilli()
+	if parsed.timestampIndex >= 0 {
+		if timestamp, err = parseTSTimestamp(parsed.timestamp); err != nil {
+			return protocol.EncodeError(err.Error())
+		}
+	}
+
+	added, err := s.store.TSIncrBy(args[0], timestamp, delta, parsed.opts)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	logged := []string{args[0], args[1], "TIMESTAMP", strconv.FormatInt(added, 10)}
+	for i, arg := range args[2:] {
+		if parsed.timestampIndex < 0 || (i != parsed.timestampIndex && i != parsed.timestampIndex+1) {
+			logged = append(logged, arg)
+		}
+	}
+	s.propagateToAOF(command, logged)
+	return protocol.EncodeInteger(int(added))
+}
+
+// TS.DEL key fromTimestamp toTimestamp
+func (s *Server) handleTSDel(args []string) string {
+	if len(args) != 3 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.DEL' command")
+	}
+
+	from, err := parseTSBound(args[1], "fromTimestamp")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	to, err := parseTSBound(args[2], "toTimestamp")
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	removed, err := s.store.TSDel(args[0], from, to)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeInteger(removed)
+}
+
+// TS.GET key [LATEST]
+func (s *Server) handleTSGet(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.GET' command")
+	}
+
+	latest := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "LATEST") {
+			return protocol.EncodeError("ERR syntax error")
+		}
+		latest = true
+	}
+	sample, err := s.store.TSGet(args[0], latest)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	if sample == nil {
+		return "*0\r\n"
+	}
+	return encodeTSSample(*sample)
+}
+
+// TS.RANGE / TS.REVRANGE key fromTimestamp toTimestamp [LATEST] [FILTER_BY_TS ts ...] [FILTER_BY_VALUE min max] [COUNT count] [[ALIGN align] AGGREGATION aggregator bucketDuration [BUCKETTIMESTAMP bt] [EMPTY]]
+func (s *Server) handleTSRange(command string, args []string) string {
+	if len(args) < 3 {
+		return protocol.EncodeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+	}
+
+	query, err := parseTSQuery(args[1], args[2], args[3:], false)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	query.Reverse = command == "TS.REVRANGE"
+
+	samples, err := s.store.TSRange(args[0], query.TimeSeriesQuery)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeTSSamples(samples)
+}
+
+// TS.MRANGE / TS.MREVRANGE fromTimestamp toTimestamp [LATEST] [FILTER_BY_TS ts ...] [FILTER_BY_VALUE min max] [WITHLABELS | SELECTED_LABELS label ...] [COUNT count] [[ALIGN align] AGGREGATION aggregator bucketDuration [BUCKETTIMESTAMP bt] [EMPTY]] FILTER filter ... [GROUPBY label REDUCE reducer]
+func (s *Server) handleTSMRange(command string, args []string) string {
+	if len(args) < 4 {
+		return protocol.EncodeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+	}
+
+	query, err := parseTSQuery(args[0], args[1], args[2:], true)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	query.Reverse = command == "TS.MREVRANGE"
+
+	results := s.store.TSMRange(query.filters, query.TimeSeriesQuery)
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(results)))
+	for _, result := range results {
+		response.WriteString("*3\r\n")
+		response.WriteString(encodeBulk(result.Key))
+		if query.GroupBy != "" {
+			response.WriteString(encodeTSLabels(result.Labels, true, nil))
+		} else {
+			response.WriteString(encodeTSLabels(result.Labels, query.withLabels, query.selectedLabels))
+		}
+		response.WriteString(encodeTSSamples(result.Samples))
+	}
+	return response.String()
+}
+
+// TS.MGET [LATEST] [WITHLABELS | SELECTED_LABELS label ...] FILTER filter ...
+func (s *Server) handleTSMGet(args []string) string {
+	if len(args) < 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.MGET' command")
+	}
+
+	latest, withLabels := false, false
+	var selected []string
+	i := 0
+	for ; i < len(args) && !strings.EqualFold(args[i], "FILTER"); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LATEST":
+			latest = true
+		case "WITHLABELS":
+			withLabels = true
+		case "SELECTED_LABELS":
+			for i+1 < len(args) && !strings.EqualFold(args[i+1], "FILTER") {
+				selected = append(selected, args[i+1])
+				i++
+			}
+			if len(selected) == 0 {
+				return protocol.EncodeError("ERR TSDB: SELECTED_LABELS requires at least one label")
+			}
+		default:
+			return protocol.EncodeError("ERR syntax error")
+		}
+	}
+	if withLabels && selected != nil {
+		return protocol.EncodeError("ERR TSDB: cannot accept WITHLABELS and SELECT_LABELS together")
+	}
+	if i >= len(args) {
+		return protocol.EncodeError("ERR TSDB: missing FILTER argument")
+	}
+	filters, err := store.ParseTimeSeriesFilters(args[i+1:])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	results := s.store.TSMGet(filters, latest)
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(results)))
+	for _, result := range results {
+		response.WriteString("*3\r\n")
+		response.WriteString(encodeBulk(result.Key))
+		response.WriteString(encodeTSLabels(result.Labels, withLabels, selected))
+		if len(result.Samples) == 0 {
+			response.WriteString("*0\r\n")
+		} else {
+			response.WriteString(encodeTSSample(result.Samples[0]))
+		}
+	}
+	return response.String()
+}
+
+// TS.QUERYINDEX filter ...
+func (s *Server) handleTSQueryIndex(args []string) string {
+	if len(args) < 1 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.QUERYINDEX' command")
+	}
+
+	filters, err := store.ParseTimeSeriesFilters(args)
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return encodeBulkArray(s.store.TSQueryIndex(filters))
+}
+
+// TS.INFO key [DEBUG]
+func (s *Server) handleTSInfo(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.INFO' command")
+	}
+	if len(args) == 2 && !strings.EqualFold(args[1], "DEBUG") {
+		return protocol.EncodeError("ERR syntax error")
+	}
+
+	info, err := s.store.TSInfo(args[0])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+
+	var response strings.Builder
+	response.WriteString("*24\r\n")
+	response.WriteString(encodeBulk("totalSamples"))
+	response.WriteString(protocol.EncodeInteger(info.TotalSamples))
+	response.WriteString(encodeBulk("memoryUsage"))
+	response.WriteString(protocol.EncodeInteger(info.MemoryUsage))
+	response.WriteString(encodeBulk("firstTimestamp"))
+	response.WriteString(protocol.EncodeInteger(int(info.FirstTimestamp)))
+	response.WriteString(encodeBulk("lastTimestamp"))
+	response.WriteString(protocol.EncodeInteger(int(info.LastTimestamp)))
+	response.WriteString(encodeBulk("retentionTime"))
+	response.WriteString(protocol.EncodeInteger(int(info.Retention)))
+	response.WriteString(encodeBulk("chunkCount"))
+	response.WriteString(protocol.EncodeInteger(int(info.ChunkCount)))
+	response.WriteString(encodeBulk("chunkSize"))
+	response.WriteString(protocol.EncodeInteger(int(info.ChunkSize)))
+	response.WriteString(encodeBulk("chunkType"))
+	response.WriteString(encodeBulk("compressed"))
+	response.WriteString(encodeBulk("duplicatePolicy"))
+	response.WriteString(encodeBulk(strings.ToLower(info.DuplicatePolicy)))
+	response.WriteString(encodeBulk("labels"))
+	response.WriteString(encodeTSLabels(info.Labels, true, nil))
+	response.WriteString(encodeBulk("sourceKey"))
+	if info.SourceKey == "" {
+		response.WriteString(protocol.EncodeNull())
+	} else {
+		response.WriteString(encodeBulk(info.SourceKey))
+	}
+	response.WriteString(encodeBulk("rules"))
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(info.Rules)))
+	for _, rule := range info.Rules {
+		response.WriteString("*4\r\n")
+		response.WriteString(encodeBulk(rule.DestKey))
+		response.WriteString(protocol.EncodeInteger(int(rule.Bucket)))
+		response.WriteString(encodeBulk(strings.ToUpper(rule.Aggregation)))
+		response.WriteString(protocol.EncodeInteger(int(rule.Align)))
+	}
+	return response.String()
+}
+
+// TS.CREATERULE sourceKey destKey AGGREGATION aggregator bucketDuration [alignTimestamp]
+func (s *Server) handleTSCreateRule(args []string) string {
+	if len(args) < 5 || len(args) > 6 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.CREATERULE' command")
+	}
+	if !strings.EqualFold(args[2], "AGGREGATION") {
+		return protocol.EncodeError("ERR syntax error")
+	}
+
+	aggregation, err := store.ParseTimeSeriesAggregation(args[3])
+	if err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	bucket, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || bucket <= 0 {
+		return protocol.EncodeError("ERR TSDB: bucketDuration must be greater than zero")
+	}
+	var align int64
+	if len(args) == 6 {
+		if align, err = strconv.ParseInt(args[5], 10, 64); err != nil || align < 0 {
+			return protocol.EncodeError("ERR TSDB: invalid alignTimestamp")
+		}
+	}
+
+	if err := s.store.TSCreateRule(args[0], args[1], aggregation, bucket, align); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// TS.DELETERULE sourceKey destKey
+func (s *Server) handleTSDeleteRule(args []string) string {
+	if len(args) != 2 {
+		return protocol.EncodeError("ERR wrong number of arguments for 'TS.DELETERULE' command")
+	}
+	if err := s.store.TSDeleteRule(args[0], args[1]); err != nil {
+		return protocol.EncodeError(err.Error())
+	}
+	return protocol.EncodeSimpleString("OK")
+}
+
+// tsQuery is a parsed range query along with the TS.MRANGE options
+type tsQuery struct {
+	store.TimeSeriesQuery
+	withLabels     bool
+	selectedLabels []string
+	filters        []store.TimeSeriesFilter
+}
+
+var tsQueryOptions = map[string]bool{
+	"LATEST": true, "FILTER_BY_TS": true, "FILTER_BY_VALUE": true, "WITHLABELS": true,
+	"SELECTED_LABELS": true, "COUNT": true, "ALIGN": true, "AGGREGATION": true,
+	"BUCKETTIMESTAMP": true, "EMPTY": true, "FILTER": true, "GROUPBY": true,
+}
+
+func parseTSQuery(fromArg, toArg string, args []string, multi bool) (*tsQuery, error) {
+	from, err := parseTSBound(fromArg, "fromTimestamp")
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTSBound(toArg, "toTimestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	query := &tsQuery{TimeSeriesQuery: store.TimeSeriesQuery{From: from, To: to, BucketTimestamp: "start"}}
+	align := ""
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if !multi && (option == "WITHLABELS" || option == "SELECTED_LABELS" || option == "FILTER" || option == "GROUPBY") {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+		switch option {
+		case "LATEST":
+			query.Latest = true
+		case "EMPTY":
+			query.Empty = true
+		case "WITHLABELS":
+			query.withLabels = true
+		case "FILTER_BY_TS":
+			query.FilterByTS = []int64{}
+			for i+1 < len(args) {
+				ts, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					break
+				}
+				query.FilterByTS = append(query.FilterByTS, ts)
+				i++
+			}
+			if len(query.FilterByTS) == 0 {
+				return nil, fmt.Errorf("ERR TSDB: FILTER_BY_TS one or more arguments are missing")
+			}
+		case "FILTER_BY_VALUE":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR TSDB: FILTER_BY_VALUE one or more arguments are missing")
+			}
+			minValue, err1 := strconv.ParseFloat(args[i+1], 64)
+			maxValue, err2 := strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("ERR TSDB: wrong value for FILTER_BY_VALUE")
+			}
+			query.FilterByValue, query.MinValue, query.MaxValue = true, minValue, maxValue
+			i += 2
+		case "SELECTED_LABELS":
+			query.selectedLabels = []string{}
+			for i+1 < len(args) && !tsQueryOptions[strings.ToUpper(args[i+1])] {
+				query.selectedLabels = append(query.selectedLabels, args[i+1])
+				i++
+			}
+			if len(query.selectedLabels) == 0 {
+				return nil, fmt.Errorf("ERR TSDB: SELECTED_LABELS requires at least one label")
+			}
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR TSDB: COUNT argument is missing")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				return nil, fmt.Errorf("ERR TSDB: Invalid COUNT value")
+			}
+			query.Count = count
+			i++
+		case "ALIGN":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR TSDB: ALIGN argument is missing")
+			}
+			align = args[i+1]
+			i++
+		case "AGGREGATION":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR TSDB: AGGREGATION one or more arguments are missing")
+			}
+			aggregation, err := store.ParseTimeSeriesAggregation(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			bucket, err := strconv.ParseInt(args[i+2], 10, 64)
+			if err != nil || bucket <= 0 {
+				return nil, fmt.Errorf("ERR TSDB: bucketDuration must be greater than zero")
+			}
+			query.Aggregation, query.Bucket = aggregation, bucket
+			i += 2
+		case "BUCKETTIMESTAMP":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR TSDB: BUCKETTIMESTAMP argument is missing")
+			}
+			switch strings.ToLower(args[i+1]) {
+			case "-", "start":
+				query.BucketTimestamp = "start"
+			case "+", "end":
+				query.BucketTimestamp = "end"
+			case "~", "mid":
+				query.BucketTimestamp = "mid"
+			default:
+				return nil, fmt.Errorf("ERR TSDB: unknown BUCKETTIMESTAMP parameter")
+			}
+			i++
+		case "FILTER":
+			end := i + 1
+			for end < len(args) && !strings.EqualFold(args[end], "GROUPBY") {
+				end++
+			}
+			if query.filters, err = store.ParseTimeSeriesFilters(args[i+1 : end]); err != nil {
+				return nil, err
+			}
+			i = end - 1
+		case "GROUPBY":
+			if i+3 >= len(args) || !strings.EqualFold(args[i+2], "REDUCE") {
+				return nil, fmt.Errorf("ERR TSDB: GROUPBY requires a label and REDUCE reducer")
+			}
+			reducer, err := store.ParseTimeSeriesAggregation(args[i+3])
+			if err != nil {
+				return nil, fmt.Errorf("ERR TSDB: invalid reducer")
+			}
+			query.GroupBy, query.Reducer = args[i+1], reducer
+			i += 3
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	if query.withLabels && query.selectedLabels != nil {
+		return nil, fmt.Errorf("ERR TSDB: cannot accept WITHLABELS and SELECT_LABELS together")
+	}
+	if multi && query.filters == nil {
+		return nil, fmt.Errorf("ERR TSDB: missing FILTER argument")
+	}
+	if align != "" {
+		if query.Aggregation == "" {
+			return nil, fmt.Errorf("ERR TSDB: ALIGN parameter can only be used with AGGREGATION")
+		}
+		switch strings.ToLower(align) {
+		case "-", "start":
+			query.Align = from
+		case "+", "end":
+			query.Align = to
+		default:
+			if query.Align, err = strconv.ParseInt(align, 10, 64); err != nil {
+				return nil, fmt.Errorf("ERR TSDB: unknown ALIGN parameter")
+			}
+		}
+	}
+	if query.Aggregation == "" && (query.Empty || query.BucketTimestamp != "start") {
+		return nil, fmt.Errorf("ERR TSDB: EMPTY and BUCKETTIMESTAMP can only be used with AGGREGATION")
+	}
+	return query, nil
+}
+
+func formatTSValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func encodeTSSample(sample store.TimeSeriesSample) string {
+	return "*2\r\n" + protocol.EncodeInteger(int(sample.Timestamp)) + encodeBulk(formatTSValue(sample.Value))
+}
+
+func encodeTSSamples(samples []store.TimeSeriesSample) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(samples)))
+	for _, sample := range samples {
+		response.WriteString(encodeTSSample(sample))
+	}
+	return response.String()
+}
+
+// encodeTSLabels encodes label pairs: all of them with withLabels, the
+// selected ones with null values for missing labels, or none
+func encodeTSLabels(labels []store.TimeSeriesLabel, withLabels bool, selected []string) string {
+	var response strings.Builder
+	switch {
+	case withLabels:
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(labels)))
+		for _, label := range labels {
+			response.WriteString(encodeBulkArray([]string{label.Name, label.Value}))
+		}
+	case selected != nil:
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(selected)))
+		for _, name := range selected {
+			response.WriteString("*2\r\n")
+			response.WriteString(encodeBulk(name))
+			value := protocol.EncodeNull()
+			for _, label := range labels {
+				if label.Name == name {
+					value = encodeBulk(label.Value)
+					break
+				}
+			}
+			response.WriteString(value)
+		}
+	default:
+		response.WriteString("*0\r\n")
+	}
+	return response.String()
+}
@@ -52,7 +52,7 @@ func (tc *TransactionContext) QueueCommand(command string, args []string) {
 	if tc.State == InTransaction {
 		tc.Queue = append(tc.Queue, QueuedCommand{
 			Command: command,
-			Args:    args,
+			Args:    append([]string(nil), args...),
 		})
 	}
 }
@@ -250,6 +250,18 @@ func (s *Server) executeCommandWithoutTransactionCheck(command string, args []st
 		return s.handlePTTL(args)
 	case "RANDOMKEY":
 		return s.handleRandomKey(args)
+	case "OBJECT":
+		return s.handleObject(args)
+	case "SORT":
+		return s.handleSort(args)
+	case "SORT_RO":
+		return s.handleSortRO(args)
+	case "DUMP":
+		return s.handleDump(args)
+	case "RESTORE":
+		return s.handleRestore(args)
+	case "MIGRATE":
+		return s.handleMigrate(args)
 	case "LPUSH":
 		return s.handleLPush(args)
 	case "RPUSH":
@@ -271,9 +283,9 @@ func (s *Server) executeCommandWithoutTransactionCheck(command string, args []st
 	case "LINSERT":
 		return s.handleLInsert(args)
 	case "BLPOP":
-		return s.handleBLPop(args)
+		return s.handleBLPop(args, "")
 	case "BRPOP":
-		return s.handleBRPop(args)
+		return s.handleBRPop(args, "")
 	case "HSET":
 		return s.handleHSet(args)
 	case "HGET":
@@ -302,6 +314,30 @@ func (s *Server) executeCommandWithoutTransactionCheck(command string, args []st
 		return s.handleHSetNX(args)
 	case "HSCAN":
 		return s.handleHScan(args)
+	case "HEXPIRE":
+		return s.handleHExpire(args)
+	case "HPEXPIRE":
+		return s.handleHPExpire(args)
+	case "HEXPIREAT":
+		return s.handleHExpireAt(args)
+	case "HPEXPIREAT":
+		return s.handleHPExpireAt(args)
+	case "HTTL":
+		return s.handleHTTL(args)
+	case "HPTTL":
+		return s.handleHPTTL(args)
+	case "HEXPIRETIME":
+		return s.handleHExpireTime(args)
+	case "HPEXPIRETIME":
+		return s.handleHPExpireTime(args)
+	case "HPERSIST":
+		return s.handleHPersist(args)
+	case "HGETDEL":
+		return s.handleHGetDel(args)
+	case "HGETEX":
+		return s.handleHGetEx(args)
+	case "HSETEX":
+		return s.handleHSetEx(args)
 	case "HSTRLEN":
 		return s.handleHStrLen(args)
 	case "HRANDFIELD":
@@ -334,6 +370,12 @@ func (s *Server) executeCommandWithoutTransactionCheck(command string, args []st
 		return s.handleSDiffStore(args)
 	case "SMOVE":
 		return s.handleSMove(args)
+	case "SMISMEMBER":
+		return s.handleSMIsMember(args)
+	case "SINTERCARD":
+		return s.handleSInterCard(args)
+	case "SSCAN":
+		return s.handleSScan(args)
 	case "ZADD":
 		return s.handleZAdd(args)
 	case "ZREM":
@@ -388,6 +430,8 @@ func (s *Server) executeCommandWithoutTransactionCheck(command string, args []st
 		return s.handleSlowlog(args)
 	case "PUBLISH":
 		return s.handlePublish(args)
+	case "SPUBLISH":
+		return s.handleSPublish(args)
 	case "PUBSUB":
 		return s.handlePubSub(args)
 	default:
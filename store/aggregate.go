@@ -0,0 +1,669 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AggregateRequest is a parsed FT.AGGREGATE pipeline. Steps run in the
+// order they were given.
+type AggregateRequest struct {
+	steps  []aggregateStep
+	params map[string]string
+}
+
+// AggregateResult is the reply of FT.AGGREGATE
+type AggregateResult struct {
+	Total int
+	Rows  []AggregateRow
+}
+
+// AggregateRow is one result row. Values are nil, float64, string or
+// []interface{} for TOLIST.
+type AggregateRow struct {
+	Names  []string
+	Values []interface{}
+}
+
+type aggregateStep interface {
+	run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error)
+}
+
+// aggregateRow holds the properties of a row. Rows that still stand for a
+// document keep its key so properties can be loaded on first use.
+type aggregateRow struct {
+	key    string
+	names  []string
+	values map[string]interface{}
+}
+
+type aggregateContext struct {
+	db    *Database
+	idx   *searchIndex
+	total int
+}
+
+type aggregateLoad struct {
+	all    bool
+	fields []SearchReturnField
+}
+
+type aggregateGroup struct {
+	properties []string
+	reducers   []aggregateReducer
+}
+
+type aggregateReducer struct {
+	function string
+	property string
+	alias    string
+}
+
+type aggregateSort struct {
+	keys []aggregateSortKey
+	max  int
+}
+
+type aggregateSortKey struct {
+	property string
+	desc     bool
+}
+
+type aggregateApply struct {
+	expr  aggregateExpr
+	alias string
+}
+
+type aggregateFilter struct {
+	expr aggregateExpr
+}
+
+type aggregateLimit struct {
+	offset int
+	num    int
+}
+
+// ParseAggregateRequest parses the FT.AGGREGATE arguments that follow the
+// index name and query
+func ParseAggregateRequest(args []string) (*AggregateRequest, error) {
+	req := &AggregateRequest{}
+
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "VERBATIM":
+		case "DIALECT", "TIMEOUT":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR %s requires an argument", option)
+			}
+			i++
+		case "LOAD":
+			if i+1 < len(args) && args[i+1] == "*" {
+				req.steps = append(req.steps, aggregateLoad{all: true})
+				i++
+				continue
+			}
+			fields, err := aggregateArgs(args, i, "LOAD")
+			if err != nil {
+				return nil, err
+			}
+			load := aggregateLoad{}
+			for j := 0; j < len(fields); j++ {
+				field := SearchReturnField{Identifier: fields[j], Name: strings.TrimPrefix(fields[j], "@")}
+				if j+2 < len(fields) && strings.EqualFold(fields[j+1], "AS") {
+					field.Name = fields[j+2]
+					j += 2
+				}
+				load.fields = append(load.fields, field)
+			}
+			req.steps = append(req.steps, load)
+			i += 1 + len(fields)
+		case "GROUPBY":
+			properties, err := aggregateArgs(args, i, "GROUPBY")
+			if err != nil {
+				return nil, err
+			}
+			group := aggregateGroup{}
+			for _, property := range properties {
+				group.properties = append(group.properties, strings.TrimPrefix(property, "@"))
+			}
+			i += 1 + len(properties)
+			for i+1 < len(args) && strings.EqualFold(args[i+1], "REDUCE") {
+				if i+2 >= len(args) {
+					return nil, fmt.Errorf("ERR Bad arguments for REDUCE: missing function name")
+				}
+				function := strings.ToUpper(args[i+2])
+				reduceArgs, err := aggregateArgs(args, i+2, "REDUCE")
+				if err != nil {
+					return nil, err
+				}
+				i += 3 + len(reduceArgs)
+				reducer, err := newAggregateReducer(function, reduceArgs)
+				if err != nil {
+					return nil, err
+				}
+				if i+2 < len(args) && strings.EqualFold(args[i+1], "AS") {
+					reducer.alias = args[i+2]
+					i += 2
+				}
+				group.reducers = append(group.reducers, reducer)
+			}
+			req.steps = append(req.steps, group)
+		case "SORTBY":
+			tokens, err := aggregateArgs(args, i, "SORTBY")
+			if err != nil {
+				return nil, err
+			}
+			step := aggregateSort{}
+			for j := 0; j < len(tokens); j++ {
+				key := aggregateSortKey{property: strings.TrimPrefix(tokens[j], "@")}
+				if j+1 < len(tokens) {
+					switch strings.ToUpper(tokens[j+1]) {
+					case "ASC":
+						j++
+					case "DESC":
+						key.desc = true
+						j++
+					}
+				}
+				step.keys = append(step.keys, key)
+			}
+			i += 1 + len(tokens)
+			if i+2 < len(args) && strings.EqualFold(args[i+1], "MAX") {
+				limit, err := strconv.Atoi(args[i+2])
+				if err != nil || limit < 0 {
+					return nil, fmt.Errorf("ERR Bad arguments for SORTBY: MAX is not a valid non-negative integer")
+				}
+				step.max = limit
+				i += 2
+			}
+			req.steps = append(req.steps, step)
+		case "APPLY":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR APPLY requires an expression")
+			}
+			expr, err := parseAggregateExpr(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			step := aggregateApply{expr: expr, alias: args[i+1]}
+			i++
+			if i+2 < len(args) && strings.EqualFold(args[i+1], "AS") {
+				step.alias = args[i+2]
+				i += 2
+			}
+			req.steps = append(req.steps, step)
+		case "FILTER":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR FILTER requires an expression")
+			}
+			expr, err := parseAggregateExpr(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			req.steps = append(req.steps, aggregateFilter{expr: expr})
+			i++
+		case "PARAMS":
+			values, err := aggregateArgs(args, i, "PARAMS")
+			if err != nil || len(values)%2 != 0 {
+				return nil, fmt.Errorf("ERR Bad arguments for PARAMS: Expected an even number of arguments")
+			}
+			req.params = make(map[string]string, len(values)/2)
+			for j := 0; j < len(values); j += 2 {
+				req.params[values[j]] = values[j+1]
+			}
+			i += 1 + len(values)
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR LIMIT requires two arguments")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			num, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil || offset < 0 || num < 0 {
+				return nil, fmt.Errorf("ERR LIMIT argument is not a valid non-negative integer")
+			}
+			req.steps = append(req.steps, aggregateLimit{offset: offset, num: num})
+			i += 2
+		default:
+			return nil, fmt.Errorf("ERR Unknown argument `%s`", args[i])
+		}
+	}
+
+	return req, nil
+}
+
+// aggregateArgs reads the count at args[i+1] and returns the arguments it
+// covers
+func aggregateArgs(args []string, i int, option string) ([]string, error) {
+	if i+1 >= len(args) {
+		return nil, fmt.Errorf("ERR Bad arguments for %s: Expected an argument count", option)
+	}
+	count, err := strconv.Atoi(args[i+1])
+	if err != nil || count < 0 || i+2+count > len(args) {
+		return nil, fmt.Errorf("ERR Bad arguments for %s: Expected an argument count", option)
+	}
+	return args[i+2 : i+2+count], nil
+}
+
+func newAggregateReducer(function string, args []string) (aggregateReducer, error) {
+	reducer := aggregateReducer{function: function}
+	switch function {
+	case "COUNT":
+		if len(args) != 0 {
+			return reducer, fmt.Errorf("ERR Bad arguments for COUNT: expected 0 arguments")
+		}
+	case "SUM", "AVG", "MIN", "MAX", "COUNT_DISTINCT", "TOLIST":
+		if len(args) != 1 {
+			return reducer, fmt.Errorf("ERR Bad arguments for %s: expected 1 argument", function)
+		}
+		reducer.property = strings.TrimPrefix(args[0], "@")
+	default:
+		return reducer, fmt.Errorf("ERR Unknown reducer function '%s'", function)
+	}
+	reducer.alias = "__generated_alias" + strings.ToLower(function) + reducer.property
+	return reducer, nil
+}
+
+// Aggregate runs a query against an index and feeds the matching documents
+// through the pipeline
+func (s *Store) Aggregate(name, query string, req *AggregateRequest) (*AggregateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	idx, exists := db.indexes[name]
+	if !exists {
+		return nil, ErrSearchUnknownIndex
+	}
+
+	node, err := parseSearchQuery(idx, query, req.params)
+	if err != nil {
+		return nil, err
+	}
+
+	s.expireSearchDocs(db, idx)
+	matches := node.eval(idx)
+	docs := make([]*searchDoc, 0, len(matches))
+	for key := range matches {
+		docs = append(docs, idx.docs[key])
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].id < docs[j].id })
+
+	knn, isKNN := node.(searchKNN)
+	rows := make([]*aggregateRow, len(docs))
+	for i, doc := range docs {
+		rows[i] = &aggregateRow{key: doc.key, values: make(map[string]interface{})}
+		if isKNN {
+			rows[i].set(knn.alias, matches[doc.key])
+		}
+	}
+
+	c := &aggregateContext{db: db, idx: idx, total: -1}
+	for _, step := range req.steps {
+		if rows, err = step.run(c, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &AggregateResult{Total: len(rows), Rows: make([]AggregateRow, len(rows))}
+	if c.total >= 0 {
+		result.Total = c.total
+	}
+	for i, row := range rows {
+		values := make([]interface{}, len(row.names))
+		for j, name := range row.names {
+			values[j] = row.values[name]
+		}
+		result.Rows[i] = AggregateRow{Names: row.names, Values: values}
+	}
+	return result, nil
+}
+
+func (r *aggregateRow) set(name string, value interface{}) {
+	if _, exists := r.values[name]; !exists {
+		r.names = append(r.names, name)
+	}
+	r.values[name] = value
+}
+
+// property returns a row property, loading it from the document when the
+// row still stands for one
+func (c *aggregateContext) property(row *aggregateRow, name string) (interface{}, error) {
+	name = strings.TrimPrefix(name, "@")
+	if value, ok := row.values[name]; ok {
+		return value, nil
+	}
+	if row.key == "" {
+		return nil, fmt.Errorf("ERR Property `%s` not loaded nor in schema", name)
+	}
+	value := c.load(row.key, name)
+	if value != nil {
+		row.set(name, value)
+	}
+	return value, nil
+}
+
+// load reads an attribute, hash field or JSONPath from a document. Values
+// of NUMERIC attributes are returned as numbers.
+func (c *aggregateContext) load(key, identifier string) interface{} {
+	if identifier == "__key" {
+		return key
+	}
+	value, exists := c.db.data[key]
+	if !exists {
+		return nil
+	}
+
+	numeric := false
+	if i := c.idx.fieldIndex(identifier); i >= 0 {
+		identifier = c.idx.def.Fields[i].Identifier
+		numeric = c.idx.def.Fields[i].Type == SearchNumeric
+	}
+
+	var hash map[string]string
+	if value.Type == HashType {
+		hash = value.Hash()
+	}
+	text, ok := searchDocumentValue(value, hash, identifier)
+	if !ok {
+		return nil
+	}
+	if numeric {
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return number
+		}
+	}
+	return text
+}
+
+func (step aggregateLoad) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	for _, row := range rows {
+		if row.key == "" {
+			continue
+		}
+		if step.all {
+			if value, exists := c.db.data[row.key]; exists {
+				fields := c.idx.loadFields(value, nil, nil)
+				for i := 0; i+1 < len(fields); i += 2 {
+					row.set(fields[i], fields[i+1])
+				}
+			}
+			continue
+		}
+		for _, field := range step.fields {
+			if value := c.load(row.key, strings.TrimPrefix(field.Identifier, "@")); value != nil {
+				row.set(field.Name, value)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func (step aggregateGroup) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	type group struct {
+		values []interface{}
+		rows   []*aggregateRow
+	}
+	groups := make(map[string]*group)
+	var order []*group
+
+	for _, row := range rows {
+		values := make([]interface{}, len(step.properties))
+		var key strings.Builder
+		for i, property := range step.properties {
+			value, err := c.property(row, property)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+			key.WriteString(aggregateGroupKey(value))
+			key.WriteByte(0)
+		}
+		g, exists := groups[key.String()]
+		if !exists {
+			g = &group{values: values}
+			groups[key.String()] = g
+			order = append(order, g)
+		}
+		g.rows = append(g.rows, row)
+	}
+
+	result := make([]*aggregateRow, 0, len(order))
+	for _, g := range order {
+		row := &aggregateRow{values: make(map[string]interface{})}
+		for i, property := range step.properties {
+			row.set(property, g.values[i])
+		}
+		for _, reducer := range step.reducers {
+			value, err := reducer.reduce(c, g.rows)
+			if err != nil {
+				return nil, err
+			}
+			row.set(reducer.alias, value)
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func aggregateGroupKey(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "n"
+	case float64:
+		return "f" + FormatAggregateNumber(value)
+	case string:
+		return "s" + value
+	}
+	return "l" + aggregateString(value)
+}
+
+func (r aggregateReducer) reduce(c *aggregateContext, rows []*aggregateRow) (interface{}, error) {
+	if r.function == "COUNT" {
+		return float64(len(rows)), nil
+	}
+
+	values := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		value, err := c.property(row, r.property)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values = append(values, value)
+		}
+	}
+
+	switch r.function {
+	case "COUNT_DISTINCT", "TOLIST":
+		seen := make(map[string]bool)
+		var distinct []interface{}
+		for _, value := range values {
+			if key := aggregateGroupKey(value); !seen[key] {
+				seen[key] = true
+				distinct = append(distinct, value)
+			}
+		}
+		if r.function == "COUNT_DISTINCT" {
+			return float64(len(distinct)), nil
+		}
+		if distinct == nil {
+			distinct = []interface{}{}
+		}
+		return distinct, nil
+	}
+
+	sum, count := 0.0, 0
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		number, ok := aggregateNumber(value)
+		if !ok {
+			continue
+		}
+		sum += number
+		count++
+		minimum = math.Min(minimum, number)
+		maximum = math.Max(maximum, number)
+	}
+
+	switch r.function {
+	case "SUM":
+		return sum, nil
+	case "AVG":
+		if count == 0 {
+			return 0.0, nil
+		}
+		return sum / float64(count), nil
+	case "MIN":
+		return minimum, nil
+	}
+	return maximum, nil
+}
+
+func (step aggregateSort) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	type sortable struct {
+		row    *aggregateRow
+		values []interface{}
+	}
+	items := make([]sortable, len(rows))
+	for i, row := range rows {
+		items[i] = sortable{row: row, values: make([]interface{}, len(step.keys))}
+		for j, key := range step.keys {
+			value, err := c.property(row, key.property)
+			if err != nil {
+				return nil, err
+			}
+			items[i].values[j] = value
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		for k, key := range step.keys {
+			a, b := items[i].values[k], items[j].values[k]
+			if (a == nil) != (b == nil) {
+				return a != nil
+			}
+			if a == nil {
+				continue
+			}
+			if cmp := compareAggregateValues(a, b); cmp != 0 {
+				if key.desc {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	if step.max > 0 && len(items) > step.max {
+		c.total = len(items)
+		items = items[:step.max]
+	}
+	result := make([]*aggregateRow, len(items))
+	for i, item := range items {
+		result[i] = item.row
+	}
+	return result, nil
+}
+
+func (step aggregateApply) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	for _, row := range rows {
+		row.set(step.alias, step.expr.eval(c, row))
+	}
+	return rows, nil
+}
+
+func (step aggregateFilter) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	result := rows[:0]
+	for _, row := range rows {
+		if aggregateTruthy(step.expr.eval(c, row)) {
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+func (step aggregateLimit) run(c *aggregateContext, rows []*aggregateRow) ([]*aggregateRow, error) {
+	c.total = len(rows)
+	start := min(step.offset, len(rows))
+	end := min(start+step.num, len(rows))
+	return rows[start:end], nil
+}
+
+// compareAggregateValues orders two non-nil values. Numbers compare
+// numerically with numeric strings and sort before other strings.
+func compareAggregateValues(a, b interface{}) int {
+	an, aok := aggregateNumber(a)
+	bn, bok := aggregateNumber(b)
+	_, aString := a.(string)
+	_, bString := b.(string)
+	switch {
+	case aok && bok && !(aString && bString):
+		return cmpOrdered(an, bn)
+	case aok && !aString && !bok:
+		return -1
+	case bok && !bString && !aok:
+		return 1
+	}
+	return strings.Compare(aggregateString(a), aggregateString(b))
+}
+
+// aggregateNumber converts a value to a number, parsing strings
+func aggregateNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// aggregateString formats a value as text
+func aggregateString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return FormatAggregateNumber(value)
+	case string:
+		return value
+	case []interface{}:
+		parts := make([]string, len(value))
+		for i, item := range value {
+			parts[i] = aggregateString(item)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+func aggregateTruthy(value interface{}) bool {
+	switch value := value.(type) {
+	case float64:
+		return value != 0 && !math.IsNaN(value)
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) > 0
+	}
+	return false
+}
+
+// FormatAggregateNumber formats a number the way FT.AGGREGATE replies
+// with it
+func FormatAggregateNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,593 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// aggregateExpr is a parsed APPLY or FILTER expression
+type aggregateExpr interface {
+	eval(c *aggregateContext, row *aggregateRow) interface{}
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+type exprProperty struct {
+	name string
+}
+
+type exprUnary struct {
+	op      byte
+	operand aggregateExpr
+}
+
+type exprBinary struct {
+	op          string
+	left, right aggregateExpr
+}
+
+type exprCall struct {
+	function aggregateFunction
+	args     []aggregateExpr
+}
+
+type aggregateFunction struct {
+	minArgs int
+	maxArgs int
+	call    func(args []interface{}) interface{}
+}
+
+func (e exprLiteral) eval(*aggregateContext, *aggregateRow) interface{} {
+	return e.value
+}
+
+func (e exprProperty) eval(c *aggregateContext, row *aggregateRow) interface{} {
+	value, _ := c.property(row, e.name)
+	return value
+}
+
+func (e exprUnary) eval(c *aggregateContext, row *aggregateRow) interface{} {
+	value := e.operand.eval(c, row)
+	if e.op == '!' {
+		return aggregateBool(!aggregateTruthy(value))
+	}
+	if number, ok := aggregateNumber(value); ok {
+		return -number
+	}
+	return nil
+}
+
+func (e exprBinary) eval(c *aggregateContext, row *aggregateRow) interface{} {
+	switch e.op {
+	case "&&":
+		return aggregateBool(aggregateTruthy(e.left.eval(c, row)) && aggregateTruthy(e.right.eval(c, row)))
+	case "||":
+		return aggregateBool(aggregateTruthy(e.left.eval(c, row)) || aggregateTruthy(e.right.eval(c, row)))
+	}
+
+	left, right := e.left.eval(c, row), e.right.eval(c, row)
+	switch e.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if left == nil || right == nil {
+			bothNil := left == nil && right == nil
+			switch e.op {
+			case "!=":
+				return aggregateBool(!bothNil)
+			case "==", "<=", ">=":
+				return aggregateBool(bothNil)
+			}
+			return aggregateBool(false)
+		}
+		cmp := compareAggregateValues(left, right)
+		switch e.op {
+		case "==":
+			return aggregateBool(cmp == 0)
+		case "!=":
+			return aggregateBool(cmp != 0)
+		case "<":
+			return aggregateBool(cmp < 0)
+		case "<=":
+			return aggregateBool(cmp <= 0)
+		case ">":
+			return aggregateBool(cmp > 0)
+		}
+		return aggregateBool(cmp >= 0)
+	}
+
+	a, aok := aggregateNumber(left)
+	b, bok := aggregateNumber(right)
+	if !aok || !bok {
+		return nil
+	}
+	switch e.op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return math.Mod(a, b)
+	}
+	return math.Pow(a, b)
+}
+
+func (e exprCall) eval(c *aggregateContext, row *aggregateRow) interface{} {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		args[i] = arg.eval(c, row)
+	}
+	return e.function.call(args)
+}
+
+func aggregateBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+	"^": 7,
+}
+
+type exprParser struct {
+	text string
+	pos  int
+}
+
+func parseAggregateExpr(text string) (aggregateExpr, error) {
+	p := &exprParser{text: text}
+	expr, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.text) {
+		return nil, p.syntaxError()
+	}
+	return expr, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.text) && isSearchSpace(p.text[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) syntaxError() error {
+	if p.pos >= len(p.text) {
+		return fmt.Errorf("ERR Syntax error at offset %d near end of expression", p.pos)
+	}
+	return fmt.Errorf("ERR Syntax error at offset %d near %s", p.pos, p.text[p.pos:])
+}
+
+func (p *exprParser) peekOperator() string {
+	p.skipSpaces()
+	rest := p.text[p.pos:]
+	for _, op := range []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "^"} {
+		if strings.HasPrefix(rest, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// parseBinary parses operators binding at least as tightly as minPrec. All
+// operators are left associative except ^.
+func (p *exprParser) parseBinary(minPrec int) (aggregateExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOperator()
+		prec, ok := exprPrecedence[op]
+		if !ok || prec < minPrec {
+			return left, nil
+		}
+		p.pos += len(op)
+		next := prec + 1
+		if op == "^" {
+			next = prec
+		}
+		right, err := p.parseBinary(next)
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (aggregateExpr, error) {
+	p.skipSpaces()
+	if p.pos < len(p.text) && (p.text[p.pos] == '-' || p.text[p.pos] == '!') {
+		op := p.text[p.pos]
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (aggregateExpr, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.text) {
+		return nil, p.syntaxError()
+	}
+
+	switch c := p.text[p.pos]; {
+	case c == '(':
+		p.pos++
+		expr, err := p.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos >= len(p.text) || p.text[p.pos] != ')' {
+			return nil, p.syntaxError()
+		}
+		p.pos++
+		return expr, nil
+	case c == '@':
+		p.pos++
+		name := p.parseName()
+		if name == "" {
+			return nil, p.syntaxError()
+		}
+		return exprProperty{name: name}, nil
+	case c == '"' || c == '\'':
+		return p.parseString(c)
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case unicode.IsLetter(rune(c)):
+		return p.parseCall()
+	}
+	return nil, p.syntaxError()
+}
+
+func (p *exprParser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := rune(p.text[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '.' && c != '$' {
+			break
+		}
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+func (p *exprParser) parseString(quote byte) (aggregateExpr, error) {
+	start := p.pos
+	p.pos++
+	var text strings.Builder
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return exprLiteral{value: text.String()}, nil
+		case c == '\\' && p.pos+1 < len(p.text):
+			text.WriteByte(p.text[p.pos+1])
+			p.pos += 2
+		default:
+			text.WriteByte(c)
+			p.pos++
+		}
+	}
+	p.pos = start
+	return nil, p.syntaxError()
+}
+
+func (p *exprParser) parseNumber() (aggregateExpr, error) {
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if c == 'e' || c == 'E' {
+			p.pos++
+			if p.pos < len(p.text) && (p.text[p.pos] == '+' || p.text[p.pos] == '-') {
+				p.pos++
+			}
+			continue
+		}
+		if c != '.' && (c < '0' || c > '9') {
+			break
+		}
+		p.pos++
+	}
+	number, err := parseSearchNumber(p.text[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+	return exprLiteral{value: number}, nil
+}
+
+func (p *exprParser) parseCall() (aggregateExpr, error) {
+	start := p.pos
+	name := strings.ToLower(p.parseName())
+	p.skipSpaces()
+	if p.pos >= len(p.text) || p.text[p.pos] != '(' {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+	function, exists := aggregateFunctions[name]
+	if !exists {
+		return nil, fmt.Errorf("ERR Unknown function name '%s'", name)
+	}
+	p.pos++
+
+	var args []aggregateExpr
+	p.skipSpaces()
+	if p.pos < len(p.text) && p.text[p.pos] == ')' {
+		p.pos++
+	} else {
+		for {
+			arg, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			p.skipSpaces()
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+				continue
+			}
+			if p.pos < len(p.text) && p.text[p.pos] == ')' {
+				p.pos++
+				break
+			}
+			return nil, p.syntaxError()
+		}
+	}
+
+	if len(args) < function.minArgs || len(args) > function.maxArgs {
+		return nil, fmt.Errorf("ERR Invalid number of arguments for function '%s'", name)
+	}
+	return exprCall{function: function, args: args}, nil
+}
+
+var aggregateFunctions = map[string]aggregateFunction{
+	"upper":      {1, 1, stringFunction(strings.ToUpper)},
+	"lower":      {1, 1, stringFunction(strings.ToLower)},
+	"strlen":     {1, 1, exprStrlen},
+	"substr":     {3, 3, exprSubstr},
+	"startswith": {2, 2, exprStartsWith},
+	"contains":   {2, 2, exprContains},
+	"split":      {1, 3, exprSplit},
+	"format":     {1, math.MaxInt, exprFormat},
+	"exists":     {1, 1, exprExists},
+	"abs":        {1, 1, numberFunction(math.Abs)},
+	"ceil":       {1, 1, numberFunction(math.Ceil)},
+	"floor":      {1, 1, numberFunction(math.Floor)},
+	"sqrt":       {1, 1, numberFunction(math.Sqrt)},
+	"log":        {1, 1, numberFunction(math.Log)},
+	"log2":       {1, 1, numberFunction(math.Log2)},
+	"exp":        {1, 1, numberFunction(math.Exp)},
+	"timefmt":    {1, 2, exprTimeFormat},
+	"parsetime":  {2, 2, exprParseTime},
+	"minute":     {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Truncate(time.Minute).Unix()) })},
+	"hour":       {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Truncate(time.Hour).Unix()) })},
+	"day":        {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Truncate(24 * time.Hour).Unix()) })},
+	"month": {1, 1, timeFunction(func(t time.Time) float64 {
+		return float64(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix())
+	})},
+	"dayofweek":   {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Weekday()) })},
+	"dayofmonth":  {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Day()) })},
+	"dayofyear":   {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.YearDay() - 1) })},
+	"monthofyear": {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Month() - 1) })},
+	"year":        {1, 1, timeFunction(func(t time.Time) float64 { return float64(t.Year()) })},
+}
+
+func stringFunction(fn func(string) string) func([]interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if args[0] == nil {
+			return nil
+		}
+		return fn(aggregateString(args[0]))
+	}
+}
+
+func numberFunction(fn func(float64) float64) func([]interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		number, ok := aggregateNumber(args[0])
+		if !ok {
+			return nil
+		}
+		return fn(number)
+	}
+}
+
+// timeFunction applies fn to a UNIX timestamp in seconds, read as UTC
+func timeFunction(fn func(time.Time) float64) func([]interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		seconds, ok := aggregateNumber(args[0])
+		if !ok {
+			return nil
+		}
+		return fn(time.Unix(int64(seconds), 0).UTC())
+	}
+}
+
+func exprStrlen(args []interface{}) interface{} {
+	if args[0] == nil {
+		return nil
+	}
+	return float64(len(aggregateString(args[0])))
+}
+
+// exprSubstr returns count bytes from offset; a negative count stops that
+// many bytes before the end
+func exprSubstr(args []interface{}) interface{} {
+	if args[0] == nil {
+		return nil
+	}
+	text := aggregateString(args[0])
+	offset, ok1 := aggregateNumber(args[1])
+	count, ok2 := aggregateNumber(args[2])
+	if !ok1 || !ok2 {
+		return nil
+	}
+	start := min(max(int(offset), 0), len(text))
+	end := len(text)
+	if count >= 0 {
+		end = min(start+int(count), len(text))
+	} else {
+		end = max(len(text)+int(count)+1, start)
+	}
+	return text[start:end]
+}
+
+func exprStartsWith(args []interface{}) interface{} {
+	return aggregateBool(strings.HasPrefix(aggregateString(args[0]), aggregateString(args[1])))
+}
+
+// exprContains returns how many times the second string occurs in the first
+func exprContains(args []interface{}) interface{} {
+	text, sub := aggregateString(args[0]), aggregateString(args[1])
+	if sub == "" {
+		return aggregateBool(args[0] != nil)
+	}
+	return float64(strings.Count(text, sub))
+}
+
+// exprSplit splits a string on any of the separator characters and trims
+// the strip characters from every part
+func exprSplit(args []interface{}) interface{} {
+	if args[0] == nil {
+		return nil
+	}
+	separators, strip := ",", " "
+	if len(args) > 1 {
+		separators = aggregateString(args[1])
+	}
+	if len(args) > 2 {
+		strip = aggregateString(args[2])
+	}
+	parts := strings.FieldsFunc(aggregateString(args[0]), func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	})
+	result := make([]interface{}, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.Trim(part, strip); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// exprFormat substitutes %s placeholders with the remaining arguments
+func exprFormat(args []interface{}) interface{} {
+	format := aggregateString(args[0])
+	var text strings.Builder
+	next := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			text.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 's':
+			if next < len(args) {
+				if args[next] == nil {
+					text.WriteString("(null)")
+				} else {
+					text.WriteString(aggregateString(args[next]))
+				}
+				next++
+			}
+		case '%':
+			text.WriteByte('%')
+		default:
+			text.WriteByte('%')
+			text.WriteByte(format[i])
+		}
+	}
+	return text.String()
+}
+
+func exprExists(args []interface{}) interface{} {
+	return aggregateBool(args[0] != nil)
+}
+
+// exprTimeFormat formats a UNIX timestamp with a strftime format
+func exprTimeFormat(args []interface{}) interface{} {
+	seconds, ok := aggregateNumber(args[0])
+	if !ok {
+		return nil
+	}
+	format := "%FT%TZ"
+	if len(args) > 1 {
+		format = aggregateString(args[1])
+	}
+	return time.Unix(int64(seconds), 0).UTC().Format(strftimeLayout(format))
+}
+
+// exprParseTime parses a string with a strftime format into a UNIX timestamp
+func exprParseTime(args []interface{}) interface{} {
+	t, err := time.Parse(strftimeLayout(aggregateString(args[1])), aggregateString(args[0]))
+	if err != nil {
+		return nil
+	}
+	return float64(t.Unix())
+}
+
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'j': "002",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'Z': "MST",
+	'z': "-0700",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// strftimeLayout converts a strftime format into a Go time layout
+func strftimeLayout(format string) string {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] == '%' && i+1 < len(format) {
+			if directive, ok := strftimeDirectives[format[i+1]]; ok {
+				layout.WriteString(directive)
+				i++
+				continue
+			}
+		}
+		layout.WriteByte(format[i])
+	}
+	return layout.String()
+}
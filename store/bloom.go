@@ -0,0 +1,282 @@
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"keyra/persistence"
+)
+
+// BloomFilter is a scalable bloom filter. When the newest sub-filter
+// reaches its capacity a larger one with a tighter error rate is stacked on
+// top, unless the filter is non-scaling.
+type BloomFilter struct {
+	Filters    []*bloomLayer
+	ErrorRate  float64
+	Expansion  int64
+	NonScaling bool
+}
+
+type bloomLayer struct {
+	bits      []byte
+	numBits   uint64
+	hashes    int
+	capacity  int64
+	count     int64
+	errorRate float64
+}
+
+// BloomInfo describes a bloom filter for BF.INFO
+type BloomInfo struct {
+	Capacity  int64
+	Size      int64
+	Filters   int64
+	Items     int64
+	Expansion int64
+}
+
+// Defaults for filters created implicitly by BF.ADD and BF.MADD
+const (
+	DefaultBloomErrorRate = 0.01
+	DefaultBloomCapacity  = 100
+	DefaultBloomExpansion = 2
+)
+
+// Limits on BF.RESERVE, so neither the first sub-filter nor the ones it
+// scales into can exceed MaxBloomCapacity items
+const (
+	MaxBloomCapacity  = 1 << 30
+	MaxBloomExpansion = 32768
+)
+
+// bloomTightening is the factor applied to the error rate of every new
+// sub-filter so the compound rate stays below the requested one
+const bloomTightening = 0.5
+
+func BloomValue(bf *BloomFilter) *RedisValue {
+	return &RedisValue{Type: BloomType, Value: bf}
+}
+
+func (rv *RedisValue) Bloom() *BloomFilter {
+	if rv.Type != BloomType {
+		panic("value is not a bloom filter")
+	}
+	return rv.Value.(*BloomFilter)
+}
+
+// NewBloomFilter creates a filter holding capacity items at errorRate
+// before it scales
+func NewBloomFilter(errorRate float64, capacity, expansion int64, nonScaling bool) *BloomFilter {
+	bf := &BloomFilter{ErrorRate: errorRate, Expansion: expansion, NonScaling: nonScaling}
+	bf.Filters = []*bloomLayer{newBloomLayer(capacity, errorRate)}
+	return bf
+}
+
+func newBloomLayer(capacity int64, errorRate float64) *bloomLayer {
+	bitsPerEntry := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	numBits := uint64(math.Ceil(float64(capacity) * bitsPerEntry))
+	numBits = max(64, (numBits+63)/64*64)
+	return &bloomLayer{
+		bits:      make([]byte, numBits/8),
+		numBits:   numBits,
+		hashes:    max(1, int(math.Ceil(math.Ln2*bitsPerEntry))),
+		capacity:  capacity,
+		errorRate: errorRate,
+	}
+}
+
+// bloomHash returns the two hashes combined into the bit positions of item
+func bloomHash(item string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	h1 := h.Sum64()
+	h.Write([]byte{0xff})
+	return h1, h.Sum64() | 1
+}
+
+func (l *bloomLayer) test(h1, h2 uint64) bool {
+	for i := 0; i < l.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.numBits
+		if l.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLayer) set(h1, h2 uint64) {
+	for i := 0; i < l.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.numBits
+		l.bits[bit/8] |= 1 << (bit % 8)
+	}
+	l.count++
+}
+
+// Exists reports whether item may have been added
+func (bf *BloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHash(item)
+	for _, layer := range bf.Filters {
+		if layer.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds item, reporting false when it may already have been added
+func (bf *BloomFilter) Add(item string) (bool, error) {
+	h1, h2 := bloomHash(item)
+	for _, layer := range bf.Filters {
+		if layer.test(h1, h2) {
+			return false, nil
+		}
+	}
+
+	top := bf.Filters[len(bf.Filters)-1]
+	if top.count >= top.capacity {
+		if bf.NonScaling {
+			return false, fmt.Errorf("ERR non scaling filter is full")
+		}
+		if top.capacity > MaxBloomCapacity/bf.Expansion {
+			return false, fmt.Errorf("ERR filter cannot expand beyond %d items", MaxBloomCapacity)
+		}
+		top = newBloomLayer(top.capacity*bf.Expansion, top.errorRate*bloomTightening)
+		bf.Filters = append(bf.Filters, top)
+	}
+	top.set(h1, h2)
+	return true, nil
+}
+
+func (bf *BloomFilter) info() BloomInfo {
+	info := BloomInfo{Filters: int64(len(bf.Filters)), Expansion: bf.Expansion}
+	for _, layer := range bf.Filters {
+		info.Capacity += layer.capacity
+		info.Items += layer.count
+		info.Size += int64(len(layer.bits)) + 48
+	}
+	if bf.NonScaling {
+		info.Expansion = 0
+	}
+	return info
+}
+
+// BFReserve creates an empty bloom filter
+func (s *Store) BFReserve(key string, errorRate float64, capacity, expansion int64, nonScaling bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR item exists")
+	}
+	s.setKey(db, key, BloomValue(NewBloomFilter(errorRate, capacity, expansion, nonScaling)))
+	return nil
+}
+
+// BFAdd adds items to a bloom filter, creating it with the defaults when
+// it doesn't exist. Each result is true when the item was newly added, or
+// the error that kept it out.
+func (s *Store) BFAdd(key string, items []string) ([]bool, []error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	var bf *BloomFilter
+	if value, exists := db.data[key]; exists {
+		if value.Type != BloomType {
+			return nil, nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		bf = value.Bloom()
+	} else {
+		bf = NewBloomFilter(DefaultBloomErrorRate, DefaultBloomCapacity, DefaultBloomExpansion, false)
+		s.setKey(db, key, BloomValue(bf))
+	}
+
+	added := make([]bool, len(items))
+	errs := make([]error, len(items))
+	for i, item := range items {
+		added[i], errs[i] = bf.Add(item)
+	}
+	return added, errs, nil
+}
+
+// BFExists reports for each item whether it may be in the filter
+func (s *Store) BFExists(key string, items []string) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	result := make([]bool, len(items))
+	value, exists := db.data[key]
+	if !exists || s.isExpired(key) {
+		return result, nil
+	}
+	if value.Type != BloomType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	for i, item := range items {
+		result[i] = value.Bloom().Exists(item)
+	}
+	return result, nil
+}
+
+// BFInfo describes a bloom filter
+func (s *Store) BFInfo(key string) (*BloomInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	if !exists || s.isExpired(key) {
+		return nil, fmt.Errorf("ERR not found")
+	}
+	if value.Type != BloomType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	info := value.Bloom().info()
+	return &info, nil
+}
+
+func serializeBloom(bf *BloomFilter) *persistence.BloomData {
+	data := &persistence.BloomData{
+		ErrorRate:  bf.ErrorRate,
+		Expansion:  bf.Expansion,
+		NonScaling: bf.NonScaling,
+		Filters:    make([]persistence.BloomLayer, len(bf.Filters)),
+	}
+	for i, layer := range bf.Filters {
+		data.Filters[i] = persistence.BloomLayer{
+			Bits:      append([]byte(nil), layer.bits...),
+			NumBits:   layer.numBits,
+			Hashes:    layer.hashes,
+			Capacity:  layer.capacity,
+			Count:     layer.count,
+			ErrorRate: layer.errorRate,
+		}
+	}
+	return data
+}
+
+func deserializeBloom(data *persistence.BloomData) (*BloomFilter, bool) {
+	if len(data.Filters) == 0 {
+		return nil, false
+	}
+	bf := &BloomFilter{ErrorRate: data.ErrorRate, Expansion: data.Expansion, NonScaling: data.NonScaling}
+	for _, layer := range data.Filters {
+		if layer.NumBits == 0 || uint64(len(layer.Bits))*8 < layer.NumBits || layer.Hashes <= 0 {
+			return nil, false
+		}
+		bf.Filters = append(bf.Filters, &bloomLayer{
+			bits:      append([]byte(nil), layer.Bits...),
+			numBits:   layer.NumBits,
+			hashes:    layer.Hashes,
+			capacity:  layer.Capacity,
+			count:     layer.Count,
+			errorRate: layer.ErrorRate,
+		})
+	}
+	return bf, true
+}
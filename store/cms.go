@@ -0,0 +1,258 @@
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"keyra/persistence"
+)
+
+// CountMinSketch estimates item frequencies in Depth rows of Width
+// counters. An estimate is the smallest counter the item maps to, so it
+// never undercounts.
+type CountMinSketch struct {
+	Width    int64
+	Depth    int64
+	Count    int64
+	Counters []int64 // Depth rows of Width counters
+}
+
+// CMSInfo describes a sketch for CMS.INFO
+type CMSInfo struct {
+	Width int64
+	Depth int64
+	Count int64
+}
+
+func CMSValue(cms *CountMinSketch) *RedisValue {
+	return &RedisValue{Type: CMSType, Value: cms}
+}
+
+func (rv *RedisValue) CMS() *CountMinSketch {
+	if rv.Type != CMSType {
+		panic("value is not a count-min sketch")
+	}
+	return rv.Value.(*CountMinSketch)
+}
+
+// MaxSketchCounters bounds width*depth of a count-min sketch or top-k, so
+// a single command cannot allocate an unbounded table
+const MaxSketchCounters = 1 << 24
+
+// ValidSketchDimensions reports whether width and depth are positive and
+// their product stays within MaxSketchCounters
+func ValidSketchDimensions(width, depth int64) bool {
+	return width > 0 && depth > 0 && width <= MaxSketchCounters/depth
+}
+
+func NewCountMinSketch(width, depth int64) *CountMinSketch {
+	return &CountMinSketch{Width: width, Depth: depth, Counters: make([]int64, width*depth)}
+}
+
+// CMSDimensions returns the width and depth keeping the overestimate
+// within errorRate of the total count with the given probability
+func CMSDimensions(errorRate, probability float64) (int64, int64) {
+	width := min(math.Ceil(2/errorRate), MaxSketchCounters+1)
+	depth := min(math.Ceil(math.Log10(probability)/math.Log10(0.5)), MaxSketchCounters+1)
+	return int64(width), max(1, int64(depth))
+}
+
+// sketchHash returns the two hashes combined into the per-row positions of
+// item, shared by the count-min sketch and top-k
+func sketchHash(item string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	h1 := h.Sum64()
+	h.Write([]byte{0x9e})
+	return h1, h.Sum64() | 1
+}
+
+func (cms *CountMinSketch) index(row int64, h1, h2 uint64) int64 {
+	return row*cms.Width + int64((h1+uint64(row)*h2)%uint64(cms.Width))
+}
+
+// IncrBy adds increment to the counters of item, returning its new
+// estimate
+func (cms *CountMinSketch) IncrBy(item string, increment int64) int64 {
+	h1, h2 := sketchHash(item)
+	estimate := int64(math.MaxInt64)
+	for row := int64(0); row < cms.Depth; row++ {
+		i := cms.index(row, h1, h2)
+		cms.Counters[i] += increment
+		estimate = min(estimate, cms.Counters[i])
+	}
+	cms.Count += increment
+	return estimate
+}
+
+// Query returns the estimated count of item
+func (cms *CountMinSketch) Query(item string) int64 {
+	h1, h2 := sketchHash(item)
+	estimate := int64(math.MaxInt64)
+	for row := int64(0); row < cms.Depth; row++ {
+		estimate = min(estimate, cms.Counters[cms.index(row, h1, h2)])
+	}
+	return estimate
+}
+
+// CMSInit creates an empty sketch
+func (s *Store) CMSInit(key string, width, depth int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR CMS: key already exists")
+	}
+	s.setKey(db, key, CMSValue(NewCountMinSketch(width, depth)))
+	return nil
+}
+
+// CMSIncrBy adds the increments to their items, returning the new
+// estimates
+func (s *Store) CMSIncrBy(key string, items []string, increments []int64) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	cms, err := lookupCMS(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if cms.overflows(items, increments) {
+		return nil, fmt.Errorf("ERR CMS: INCRBY overflow")
+	}
+	result := make([]int64, len(items))
+	for i, item := range items {
+		result[i] = cms.IncrBy(item, increments[i])
+	}
+	return result, nil
+}
+
+// overflows reports whether adding the increments would overflow a counter
+// or the total count, so INCRBY can fail before changing anything
+func (cms *CountMinSketch) overflows(items []string, increments []int64) bool {
+	pending := make(map[int64]int64)
+	var total int64
+	for i, item := range items {
+		if total > math.MaxInt64-cms.Count-increments[i] {
+			return true
+		}
+		total += increments[i]
+		h1, h2 := sketchHash(item)
+		for row := int64(0); row < cms.Depth; row++ {
+			j := cms.index(row, h1, h2)
+			if cms.Counters[j]+pending[j] > math.MaxInt64-increments[i] {
+				return true
+			}
+			pending[j] += increments[i]
+		}
+	}
+	return false
+}
+
+// CMSQuery returns the estimated counts of items
+func (s *Store) CMSQuery(key string, items []string) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR CMS: key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	cms, err := lookupCMS(db, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]int64, len(items))
+	for i, item := range items {
+		result[i] = cms.Query(item)
+	}
+	return result, nil
+}
+
+// CMSMerge overwrites dest with the weighted sum of the source sketches,
+// which must all share its dimensions
+func (s *Store) CMSMerge(dest string, sources []string, weights []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(dest)
+	db := s.getCurrentDB()
+
+	target, err := lookupCMS(db, dest)
+	if err != nil {
+		return err
+	}
+	sketches := make([]*CountMinSketch, len(sources))
+	for i, source := range sources {
+		s.cleanupExpired(source)
+		if sketches[i], err = lookupCMS(db, source); err != nil {
+			return err
+		}
+		if sketches[i].Width != target.Width || sketches[i].Depth != target.Depth {
+			return fmt.Errorf("ERR CMS: width/depth is not equal")
+		}
+	}
+
+	counters := make([]int64, len(target.Counters))
+	var count int64
+	for i, sketch := range sketches {
+		for j, c := range sketch.Counters {
+			counters[j] += c * weights[i]
+		}
+		count += sketch.Count * weights[i]
+	}
+	target.Counters, target.Count = counters, count
+	return nil
+}
+
+// CMSInfo describes a sketch
+func (s *Store) CMSInfo(key string) (*CMSInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR CMS: key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	cms, err := lookupCMS(db, key)
+	if err != nil {
+		return nil, err
+	}
+	return &CMSInfo{Width: cms.Width, Depth: cms.Depth, Count: cms.Count}, nil
+}
+
+func lookupCMS(db *Database, key string) (*CountMinSketch, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERR CMS: key does not exist")
+	}
+	if value.Type != CMSType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.CMS(), nil
+}
+
+func serializeCMS(cms *CountMinSketch) *persistence.CMSData {
+	return &persistence.CMSData{
+		Width:    cms.Width,
+		Depth:    cms.Depth,
+		Count:    cms.Count,
+		Counters: append([]int64(nil), cms.Counters...),
+	}
+}
+
+func deserializeCMS(data *persistence.CMSData) (*CountMinSketch, bool) {
+	if data.Width <= 0 || data.Depth <= 0 || int64(len(data.Counters)) != data.Width*data.Depth {
+		return nil, false
+	}
+	return &CountMinSketch{
+		Width:    data.Width,
+		Depth:    data.Depth,
+		Count:    data.Count,
+		Counters: append([]int64(nil), data.Counters...),
+	}, true
+}
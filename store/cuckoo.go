@@ -0,0 +1,376 @@
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"keyra/persistence"
+)
+
+// CuckooFilter stores 8-bit fingerprints in buckets of BucketSize slots.
+// Every item has two candidate buckets; when both are full, resident
+// fingerprints are moved to their alternate bucket for up to MaxIterations
+// steps before a larger sub-filter is added.
+type CuckooFilter struct {
+	Filters       []*cuckooLayer
+	BucketSize    int
+	MaxIterations int
+	Expansion     int64
+	Inserted      int64
+	Deleted       int64
+}
+
+type cuckooLayer struct {
+	numBuckets uint64
+	slots      []byte // numBuckets*bucketSize fingerprints, 0 for an empty slot
+}
+
+// CuckooInfo describes a cuckoo filter for CF.INFO
+type CuckooInfo struct {
+	Size          int64
+	Buckets       int64
+	Filters       int64
+	Inserted      int64
+	Deleted       int64
+	BucketSize    int64
+	Expansion     int64
+	MaxIterations int64
+}
+
+// Defaults for filters created implicitly by CF.ADD and CF.ADDNX
+const (
+	DefaultCuckooCapacity      = 1024
+	DefaultCuckooBucketSize    = 2
+	DefaultCuckooMaxIterations = 20
+	DefaultCuckooExpansion     = 1
+)
+
+func CuckooValue(cf *CuckooFilter) *RedisValue {
+	return &RedisValue{Type: CuckooType, Value: cf}
+}
+
+func (rv *RedisValue) Cuckoo() *CuckooFilter {
+	if rv.Type != CuckooType {
+		panic("value is not a cuckoo filter")
+	}
+	return rv.Value.(*CuckooFilter)
+}
+
+// NewCuckooFilter creates a filter with room for about capacity items
+func NewCuckooFilter(capacity int64, bucketSize, maxIterations int, expansion int64) *CuckooFilter {
+	cf := &CuckooFilter{BucketSize: bucketSize, MaxIterations: maxIterations, Expansion: expansion}
+	buckets := uint64(capacity+int64(bucketSize)-1) / uint64(bucketSize)
+	cf.Filters = []*cuckooLayer{cf.newLayer(buckets)}
+	return cf
+}
+
+// newLayer allocates a sub-filter, rounding the bucket count up to a power
+// of two so alternate buckets can be found with an XOR
+func (cf *CuckooFilter) newLayer(buckets uint64) *cuckooLayer {
+	n := uint64(1)
+	for n < buckets {
+		n <<= 1
+	}
+	return &cuckooLayer{numBuckets: n, slots: make([]byte, n*uint64(cf.BucketSize))}
+}
+
+// cuckooHash returns the hash locating item and its non-zero fingerprint
+func cuckooHash(item string) (uint64, byte) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	sum := h.Sum64()
+	return sum, byte(sum>>56)%255 + 1
+}
+
+func cuckooAltHash(fp byte) uint64 {
+	return uint64(fp) * 0x5bd1e995
+}
+
+func (l *cuckooLayer) buckets(hash uint64, fp byte) (uint64, uint64) {
+	mask := l.numBuckets - 1
+	i1 := hash & mask
+	return i1, (i1 ^ cuckooAltHash(fp)) & mask
+}
+
+func (l *cuckooLayer) bucket(cf *CuckooFilter, i uint64) []byte {
+	start := i * uint64(cf.BucketSize)
+	return l.slots[start : start+uint64(cf.BucketSize)]
+}
+
+func (l *cuckooLayer) insertInto(cf *CuckooFilter, i uint64, fp byte) bool {
+	bucket := l.bucket(cf, i)
+	for j, slot := range bucket {
+		if slot == 0 {
+			bucket[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// insert places fp in one of its buckets, relocating resident fingerprints
+// when both are full. Relocations are undone when no free slot turns up.
+// Victims are picked round-robin so replaying the same inserts rebuilds
+// the same filter.
+func (l *cuckooLayer) insert(cf *CuckooFilter, hash uint64, fp byte) bool {
+	i1, i2 := l.buckets(hash, fp)
+	if l.insertInto(cf, i1, fp) || l.insertInto(cf, i2, fp) {
+		return true
+	}
+
+	type move struct {
+		bucket uint64
+		slot   int
+	}
+	var moves []move
+	i := i2
+	current := fp
+	for n := 0; n < cf.MaxIterations; n++ {
+		slot := n % cf.BucketSize
+		bucket := l.bucket(cf, i)
+		current, bucket[slot] = bucket[slot], current
+		moves = append(moves, move{i, slot})
+		i = (i ^ cuckooAltHash(current)) & (l.numBuckets - 1)
+		if l.insertInto(cf, i, current) {
+			return true
+		}
+	}
+
+	for n := len(moves) - 1; n >= 0; n-- {
+		bucket := l.bucket(cf, moves[n].bucket)
+		current, bucket[moves[n].slot] = bucket[moves[n].slot], current
+	}
+	return false
+}
+
+func (l *cuckooLayer) count(cf *CuckooFilter, hash uint64, fp byte) int64 {
+	i1, i2 := l.buckets(hash, fp)
+	var n int64
+	for _, slot := range l.bucket(cf, i1) {
+		if slot == fp {
+			n++
+		}
+	}
+	if i2 != i1 {
+		for _, slot := range l.bucket(cf, i2) {
+			if slot == fp {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (l *cuckooLayer) remove(cf *CuckooFilter, hash uint64, fp byte) bool {
+	i1, i2 := l.buckets(hash, fp)
+	for _, i := range []uint64{i1, i2} {
+		bucket := l.bucket(cf, i)
+		for j, slot := range bucket {
+			if slot == fp {
+				bucket[j] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add inserts item, adding a larger sub-filter when the current ones are
+// full
+func (cf *CuckooFilter) Add(item string) error {
+	hash, fp := cuckooHash(item)
+	for _, layer := range cf.Filters {
+		if layer.insert(cf, hash, fp) {
+			cf.Inserted++
+			return nil
+		}
+	}
+	if cf.Expansion == 0 {
+		return fmt.Errorf("ERR Filter is full")
+	}
+	top := cf.Filters[len(cf.Filters)-1]
+	layer := cf.newLayer(top.numBuckets * uint64(cf.Expansion))
+	cf.Filters = append(cf.Filters, layer)
+	layer.insert(cf, hash, fp)
+	cf.Inserted++
+	return nil
+}
+
+// Count returns how many times the fingerprint of item is stored
+func (cf *CuckooFilter) Count(item string) int64 {
+	hash, fp := cuckooHash(item)
+	var n int64
+	for _, layer := range cf.Filters {
+		n += layer.count(cf, hash, fp)
+	}
+	return n
+}
+
+// Delete removes one copy of the fingerprint of item
+func (cf *CuckooFilter) Delete(item string) bool {
+	hash, fp := cuckooHash(item)
+	for i := len(cf.Filters) - 1; i >= 0; i-- {
+		if cf.Filters[i].remove(cf, hash, fp) {
+			cf.Inserted--
+			cf.Deleted++
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *CuckooFilter) info() CuckooInfo {
+	info := CuckooInfo{
+		Filters:       int64(len(cf.Filters)),
+		Inserted:      cf.Inserted,
+		Deleted:       cf.Deleted,
+		BucketSize:    int64(cf.BucketSize),
+		Expansion:     cf.Expansion,
+		MaxIterations: int64(cf.MaxIterations),
+	}
+	for _, layer := range cf.Filters {
+		info.Buckets += int64(layer.numBuckets)
+		info.Size += int64(len(layer.slots)) + 16
+	}
+	return info
+}
+
+// CFReserve creates an empty cuckoo filter
+func (s *Store) CFReserve(key string, capacity int64, bucketSize, maxIterations int, expansion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR item exists")
+	}
+	s.setKey(db, key, CuckooValue(NewCuckooFilter(capacity, bucketSize, maxIterations, expansion)))
+	return nil
+}
+
+// CFAdd adds item to a cuckoo filter, creating it with the defaults when it
+// doesn't exist. With nx the item is only added when it isn't already
+// present, and the result reports whether it was added.
+func (s *Store) CFAdd(key, item string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	var cf *CuckooFilter
+	if value, exists := db.data[key]; exists {
+		if value.Type != CuckooType {
+			return false, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		cf = value.Cuckoo()
+	} else {
+		cf = NewCuckooFilter(DefaultCuckooCapacity, DefaultCuckooBucketSize, DefaultCuckooMaxIterations, DefaultCuckooExpansion)
+		s.setKey(db, key, CuckooValue(cf))
+	}
+
+	if nx && cf.Count(item) > 0 {
+		return false, nil
+	}
+	if err := cf.Add(item); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CFCount returns how many times item may have been added to a cuckoo
+// filter
+func (s *Store) CFCount(key string, items []string) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	result := make([]int64, len(items))
+	value, exists := db.data[key]
+	if !exists || s.isExpired(key) {
+		return result, nil
+	}
+	if value.Type != CuckooType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	for i, item := range items {
+		result[i] = value.Cuckoo().Count(item)
+	}
+	return result, nil
+}
+
+// CFDel removes one occurrence of item from a cuckoo filter
+func (s *Store) CFDel(key, item string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	if !exists {
+		return false, fmt.Errorf("ERR not found")
+	}
+	if value.Type != CuckooType {
+		return false, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.Cuckoo().Delete(item), nil
+}
+
+// CFInfo describes a cuckoo filter
+func (s *Store) CFInfo(key string) (*CuckooInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	if !exists || s.isExpired(key) {
+		return nil, fmt.Errorf("ERR not found")
+	}
+	if value.Type != CuckooType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	info := value.Cuckoo().info()
+	return &info, nil
+}
+
+func serializeCuckoo(cf *CuckooFilter) *persistence.CuckooData {
+	data := &persistence.CuckooData{
+		BucketSize:    cf.BucketSize,
+		MaxIterations: cf.MaxIterations,
+		Expansion:     cf.Expansion,
+		Inserted:      cf.Inserted,
+		Deleted:       cf.Deleted,
+		Filters:       make([]persistence.CuckooLayer, len(cf.Filters)),
+	}
+	for i, layer := range cf.Filters {
+		data.Filters[i] = persistence.CuckooLayer{
+			NumBuckets: layer.numBuckets,
+			Slots:      append([]byte(nil), layer.slots...),
+		}
+	}
+	return data
+}
+
+func deserializeCuckoo(data *persistence.CuckooData) (*CuckooFilter, bool) {
+	if len(data.Filters) == 0 || data.BucketSize <= 0 || data.MaxIterations <= 0 {
+		return nil, false
+	}
+	cf := &CuckooFilter{
+		BucketSize:    data.BucketSize,
+		MaxIterations: data.MaxIterations,
+		Expansion:     data.Expansion,
+		Inserted:      data.Inserted,
+		Deleted:       data.Deleted,
+	}
+	for _, layer := range data.Filters {
+		n := layer.NumBuckets
+		if n == 0 || n&(n-1) != 0 || uint64(len(layer.Slots)) != n*uint64(data.BucketSize) {
+			return nil, false
+		}
+		cf.Filters = append(cf.Filters, &cuckooLayer{
+			numBuckets: n,
+			slots:      append([]byte(nil), layer.Slots...),
+		})
+	}
+	return cf, true
+}
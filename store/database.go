@@ -43,7 +43,10 @@ func (s *Store) Move(key string, destDB int) bool {
 	}
 	
 	// Move the key
-	targetDB.data[key] = value
+	s.setKey(targetDB, key, value)
+	if len(value.fieldExpiration) > 0 {
+		targetDB.hashFieldTTLKeys[key] = true
+	}
 	if expTime, hasExp := sourceDB.expiration[key]; hasExp {
 		targetDB.expiration[key] = expTime
 	}
@@ -51,6 +54,11 @@ func (s *Store) Move(key string, destDB int) bool {
 	// Remove from source
 	delete(sourceDB.data, key)
 	delete(sourceDB.expiration, key)
+	delete(sourceDB.hashFieldTTLKeys, key)
+	s.indexKey(sourceDB, key)
+	s.indexKey(targetDB, key)
+	s.notify(sourceDB, GenericEvent, "move_from", key)
+	s.notify(targetDB, GenericEvent, "move_to", key)
 	
 	return true
 }
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"keyra/persistence"
+)
+
+var ErrBusyKey = errors.New("BUSYKEY Target key name already exists.")
+
+// Dump serializes the value stored at key using the DUMP payload format
+func (s *Store) Dump(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.isExpired(key) {
+		return nil, false, nil
+	}
+	db := s.getCurrentDB()
+	value, exists := db.data[key]
+	if !exists {
+		return nil, false, nil
+	}
+
+	payload, err := persistence.EncodeDump(serializeValue(value))
+	if err != nil {
+		return nil, false, err
+	}
+	return payload, true, nil
+}
+
+// Restore creates key from a DUMP payload. A zero expireAt means no
+// expiration; an expireAt in the past removes the key instead of creating it.
+func (s *Store) Restore(key string, payload []byte, expireAt time.Time, replace bool) error {
+	sv, err := persistence.DecodeDump(payload)
+	if err != nil {
+		return err
+	}
+	value, ok := deserializeValue(sv)
+	if !ok {
+		return persistence.ErrDumpFormat
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists && !replace {
+		return ErrBusyKey
+	}
+
+	if !expireAt.IsZero() && !expireAt.After(time.Now()) {
+		if _, exists := db.data[key]; exists {
+			s.removeKey(db, key)
+		}
+		return nil
+	}
+
+	delete(db.expiration, key)
+	s.setKey(db, key, s.compactValue(value))
+	if len(value.fieldExpiration) > 0 {
+		db.hashFieldTTLKeys[key] = true
+	}
+	if !expireAt.IsZero() {
+		db.expiration[key] = expireAt
+	}
+	s.indexKey(db, key)
+	s.notify(db, GenericEvent, "restore", key)
+	return nil
+}
@@ -0,0 +1,541 @@
+package store
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Object encodings as reported by OBJECT ENCODING
+const (
+	EncodingInt       = "int"
+	EncodingEmbstr    = "embstr"
+	EncodingRaw       = "raw"
+	EncodingListpack  = "listpack"
+	EncodingQuicklist = "quicklist"
+	EncodingIntset    = "intset"
+	EncodingHashtable = "hashtable"
+	EncodingSkiplist  = "skiplist"
+	EncodingStream    = "stream"
+)
+
+const (
+	embstrMaxLen       = 44
+	listMaxListpackLen = 8192
+)
+
+// EncodingConfig holds the thresholds below which collections use a
+// compact encoding
+type EncodingConfig struct {
+	HashMaxListpackEntries int
+	HashMaxListpackValue   int
+	SetMaxIntsetEntries    int
+	SetMaxListpackEntries  int
+	SetMaxListpackValue    int
+	ZSetMaxListpackEntries int
+	ZSetMaxListpackValue   int
+}
+
+func DefaultEncodingConfig() EncodingConfig {
+	return EncodingConfig{
+		HashMaxListpackEntries: 128,
+		HashMaxListpackValue:   64,
+		SetMaxIntsetEntries:    512,
+		SetMaxListpackEntries:  128,
+		SetMaxListpackValue:    64,
+		ZSetMaxListpackEntries: 128,
+		ZSetMaxListpackValue:   64,
+	}
+}
+
+func (s *Store) SetEncodingConfig(config EncodingConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = config
+}
+
+func (s *Store) GetEncodingConfig() EncodingConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.encoding
+}
+
+// listpack is a contiguous sequence of length-prefixed strings. Hashes store
+// alternating field/value entries, sets store one entry per member.
+type listpack []byte
+
+func (lp listpack) push(entry string) listpack {
+	lp = binary.AppendUvarint(lp, uint64(len(entry)))
+	return append(lp, entry...)
+}
+
+func (lp listpack) forEach(fn func(entry string)) {
+	for i := 0; i < len(lp); {
+		var entry []byte
+		entry, i = lp.next(i)
+		fn(string(entry))
+	}
+}
+
+// next returns the entry starting at offset i and the offset of the one
+// after it, without copying the entry
+func (lp listpack) next(i int) ([]byte, int) {
+	n, size := binary.Uvarint(lp[i:])
+	i += size
+	return lp[i : i+int(n)], i + int(n)
+}
+
+// count returns the number of entries
+func (lp listpack) count() int {
+	count := 0
+	for i := 0; i < len(lp); count++ {
+		_, i = lp.next(i)
+	}
+	return count
+}
+
+// index returns the offset of the first entry equal to target, stepping
+// over stride entries at a time, or -1 when there is none
+func (lp listpack) index(target string, stride int) int {
+	for i := 0; i < len(lp); {
+		start := i
+		entry, next := lp.next(i)
+		if string(entry) == target {
+			return start
+		}
+		i = next
+		for n := 1; n < stride && i < len(lp); n++ {
+			_, i = lp.next(i)
+		}
+	}
+	return -1
+}
+
+// intset is a sorted array of integers used for small sets whose members
+// are all canonical 64-bit integers
+type intset []int64
+
+func parseIntsetMember(member string) (int64, bool) {
+	v, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != member {
+		return 0, false
+	}
+	return v, true
+}
+
+func (set intset) contains(v int64) bool {
+	i := sort.Search(len(set), func(i int) bool { return set[i] >= v })
+	return i < len(set) && set[i] == v
+}
+
+// hashField looks up a single field, reading a listpack in place instead
+// of decoding it into a map
+func (rv *RedisValue) hashField(field string) (string, bool) {
+	lp, ok := rv.Value.(listpack)
+	if !ok {
+		fieldValue, exists := rv.Hash()[field]
+		return fieldValue, exists
+	}
+	i := lp.index(field, 2)
+	if i < 0 {
+		return "", false
+	}
+	_, i = lp.next(i)
+	fieldValue, _ := lp.next(i)
+	return string(fieldValue), true
+}
+
+// hashLen returns the number of fields without decoding a listpack
+func (rv *RedisValue) hashLen() int {
+	if lp, ok := rv.Value.(listpack); ok {
+		return lp.count() / 2
+	}
+	return len(rv.Hash())
+}
+
+// setContains reports membership by searching an intset or listpack in
+// place instead of decoding it into a map
+func (rv *RedisValue) setContains(member string) bool {
+	switch set := rv.Value.(type) {
+	case intset:
+		v, ok := parseIntsetMember(member)
+		return ok && set.contains(v)
+	case listpack:
+		return set.index(member, 1) >= 0
+	}
+	return rv.Set()[member]
+}
+
+// setLen returns the number of members without decoding the encoding
+func (rv *RedisValue) setLen() int {
+	switch set := rv.Value.(type) {
+	case intset:
+		return len(set)
+	case listpack:
+		return set.count()
+	}
+	return len(rv.Set())
+}
+
+// hashSet sets field in place and reports whether it is new. A listpack is
+// edited where it stands and only converted to a hashtable once the field
+// or value is too long or it would hold too many fields.
+func (s *Store) hashSet(rv *RedisValue, field, value string) bool {
+	if lp, ok := rv.Value.(listpack); ok {
+		fits := len(field) <= s.encoding.HashMaxListpackValue && len(value) <= s.encoding.HashMaxListpackValue
+		i := lp.index(field, 2)
+		switch {
+		case i >= 0 && fits:
+			_, start := lp.next(i)
+			_, end := lp.next(start)
+			rv.Value = slices.Replace(lp, start, end, listpack(nil).push(value)...)
+			return false
+		case i < 0 && fits && lp.count()/2 < s.encoding.HashMaxListpackEntries:
+			rv.Value = lp.push(field).push(value)
+			return true
+		}
+		rv.Value = rv.Hash()
+	}
+	hash := rv.Hash()
+	_, exists := hash[field]
+	hash[field] = value
+	return !exists
+}
+
+// hashDelete removes field and its expiration in place, reporting whether
+// it existed
+func (rv *RedisValue) hashDelete(field string) bool {
+	if lp, ok := rv.Value.(listpack); ok {
+		i := lp.index(field, 2)
+		if i < 0 {
+			return false
+		}
+		_, end := lp.next(i)
+		_, end = lp.next(end)
+		rv.Value = slices.Delete(lp, i, end)
+	} else {
+		hash := rv.Hash()
+		if _, exists := hash[field]; !exists {
+			return false
+		}
+		delete(hash, field)
+	}
+	rv.clearFieldExpiration(field)
+	return true
+}
+
+// setAdd adds member in place and reports whether it is new. An intset or
+// listpack is edited where it stands and only converted once the member
+// does not fit it or it would hold too many members.
+func (s *Store) setAdd(rv *RedisValue, member string) bool {
+	switch set := rv.Value.(type) {
+	case intset:
+		v, isInt := parseIntsetMember(member)
+		if isInt {
+			i, found := slices.BinarySearch(set, v)
+			if found {
+				return false
+			}
+			if len(set) < s.encoding.SetMaxIntsetEntries {
+				rv.Value = slices.Insert(set, i, v)
+				rv.scanOrder = nil
+				return true
+			}
+		}
+		members := rv.Set()
+		members[member] = true
+		rv.Value = s.setValue(members, rv).Value
+	case listpack:
+		if set.index(member, 1) >= 0 {
+			return false
+		}
+		if len(member) <= s.encoding.SetMaxListpackValue && set.count() < s.encoding.SetMaxListpackEntries {
+			rv.Value = set.push(member)
+		} else {
+			members := rv.Set()
+			members[member] = true
+			rv.Value = members
+		}
+	default:
+		members := rv.Set()
+		if members[member] {
+			return false
+		}
+		members[member] = true
+	}
+	rv.scanOrder = nil
+	return true
+}
+
+// setRemove deletes member in place, reporting whether it was present
+func (rv *RedisValue) setRemove(member string) bool {
+	switch set := rv.Value.(type) {
+	case intset:
+		v, isInt := parseIntsetMember(member)
+		if !isInt {
+			return false
+		}
+		i, found := slices.BinarySearch(set, v)
+		if !found {
+			return false
+		}
+		rv.Value = slices.Delete(set, i, i+1)
+	case listpack:
+		i := set.index(member, 1)
+		if i < 0 {
+			return false
+		}
+		_, end := set.next(i)
+		rv.Value = slices.Delete(set, i, end)
+	default:
+		members := rv.Set()
+		if !members[member] {
+			return false
+		}
+		delete(members, member)
+	}
+	rv.scanOrder = nil
+	return true
+}
+
+// scanMember is a set member with the hash SSCAN orders it by
+type scanMember struct {
+	hash   uint64
+	member string
+}
+
+// setScanOrder returns the members sorted by their scan hash, cached on
+// the value until the set changes
+func (rv *RedisValue) setScanOrder() []scanMember {
+	if rv.scanOrder != nil {
+		return rv.scanOrder
+	}
+	set := rv.Set()
+	order := make([]scanMember, 0, len(set))
+	for member := range set {
+		order = append(order, scanMember{hash: scanHash(member), member: member})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].hash != order[j].hash {
+			return order[i].hash < order[j].hash
+		}
+		return order[i].member < order[j].member
+	})
+	rv.scanOrder = order
+	return order
+}
+
+// scanHash maps a member to a scan cursor. It is kept to 63 bits so that
+// cursors stay positive integers, and 0 is left for the start of a scan.
+func scanHash(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	return max(1, h.Sum64()>>1)
+}
+
+const (
+	rankCompact = iota
+	rankListpack
+	rankHashtable
+)
+
+func encodingRank(value *RedisValue) int {
+	if value == nil || (value.Type != HashType && value.Type != SetType) {
+		return rankCompact
+	}
+	switch value.Value.(type) {
+	case intset:
+		return rankCompact
+	case listpack:
+		return rankListpack
+	default:
+		return rankHashtable
+	}
+}
+
+// hashValue builds a hash value in the most compact encoding the thresholds
+// allow. Encodings only ever grow, so a hash that was already converted to a
+// hashtable (prev) stays one.
+// Field expirations of prev carry over for fields that are still present.
+func (s *Store) hashValue(hash map[string]string, prev *RedisValue) *RedisValue {
+	value := s.encodeHash(hash, encodingRank(prev))
+	if prev != nil && prev.Type == HashType {
+		for field, at := range prev.fieldExpiration {
+			if _, exists := hash[field]; !exists {
+				continue
+			}
+			if value.fieldExpiration == nil {
+				value.fieldExpiration = make(map[string]time.Time)
+			}
+			value.fieldExpiration[field] = at
+		}
+	}
+	return value
+}
+
+func (s *Store) encodeHash(hash map[string]string, rank int) *RedisValue {
+	if rank == rankHashtable || len(hash) > s.encoding.HashMaxListpackEntries {
+		return HashValue(hash)
+	}
+	for field, value := range hash {
+		if len(field) > s.encoding.HashMaxListpackValue || len(value) > s.encoding.HashMaxListpackValue {
+			return HashValue(hash)
+		}
+	}
+
+	var lp listpack
+	for field, value := range hash {
+		lp = lp.push(field).push(value)
+	}
+	return &RedisValue{Type: HashType, Value: lp}
+}
+
+// setValue builds a set value using an intset, listpack or hashtable
+// depending on its members and the thresholds. Like hashValue it never
+// downgrades the encoding of prev.
+func (s *Store) setValue(set map[string]bool, prev *RedisValue) *RedisValue {
+	rank := encodingRank(prev)
+
+	if rank == rankCompact && len(set) <= s.encoding.SetMaxIntsetEntries {
+		ints := make(intset, 0, len(set))
+		for member := range set {
+			v, ok := parseIntsetMember(member)
+			if !ok {
+				break
+			}
+			ints = append(ints, v)
+		}
+		if len(ints) == len(set) {
+			sort.Slice(ints, func(i, j int) bool { return ints[i] < ints[j] })
+			return &RedisValue{Type: SetType, Value: ints}
+		}
+	}
+
+	if rank == rankHashtable || len(set) > s.encoding.SetMaxListpackEntries {
+		return SetValue(set)
+	}
+	for member := range set {
+		if len(member) > s.encoding.SetMaxListpackValue {
+			return SetValue(set)
+		}
+	}
+
+	var lp listpack
+	for member := range set {
+		lp = lp.push(member)
+	}
+	return &RedisValue{Type: SetType, Value: lp}
+}
+
+// newZSet returns an empty sorted set, listpack-encoded unless compact
+// zsets are disabled
+func (s *Store) newZSet() *ZSet {
+	if s.encoding.ZSetMaxListpackEntries <= 0 {
+		return newZSet()
+	}
+	return &ZSet{Sorted: make([]ZSetMember, 0)}
+}
+
+// convertZSet upgrades a listpack-encoded sorted set to a skiplist once it
+// exceeds the thresholds
+func (s *Store) convertZSet(zs *ZSet) {
+	if zs.Members != nil {
+		return
+	}
+
+	convert := len(zs.Sorted) > s.encoding.ZSetMaxListpackEntries
+	for _, m := range zs.Sorted {
+		if convert {
+			break
+		}
+		convert = len(m.Member) > s.encoding.ZSetMaxListpackValue
+	}
+	if !convert {
+		return
+	}
+
+	zs.Members = make(map[string]float64, len(zs.Sorted))
+	for _, m := range zs.Sorted {
+		zs.Members[m.Member] = m.Score
+	}
+}
+
+// compactValue re-encodes a freshly loaded value using the compact
+// encodings where the thresholds allow
+func (s *Store) compactValue(value *RedisValue) *RedisValue {
+	switch value.Type {
+	case HashType:
+		compact := s.encodeHash(value.Hash(), rankCompact)
+		compact.fieldExpiration = value.fieldExpiration
+		return compact
+	case SetType:
+		return s.setValue(value.Set(), nil)
+	case ZSetType:
+		zs := value.ZSet()
+		if len(zs.Sorted) <= s.encoding.ZSetMaxListpackEntries {
+			compact := &ZSet{Sorted: zs.Sorted}
+			s.convertZSet(compact)
+			return ZSetValue(compact)
+		}
+	}
+	return value
+}
+
+// Encoding reports the internal encoding of the value
+func (rv *RedisValue) Encoding() string {
+	switch rv.Type {
+	case StringType:
+		str := rv.String()
+		if _, ok := parseIntsetMember(str); ok {
+			return EncodingInt
+		}
+		if len(str) <= embstrMaxLen {
+			return EncodingEmbstr
+		}
+		return EncodingRaw
+	case ListType:
+		size := 0
+		for _, element := range rv.List() {
+			size += len(element)
+		}
+		if size <= listMaxListpackLen {
+			return EncodingListpack
+		}
+		return EncodingQuicklist
+	case HashType, SetType:
+		switch rv.Value.(type) {
+		case intset:
+			return EncodingIntset
+		case listpack:
+			return EncodingListpack
+		default:
+			return EncodingHashtable
+		}
+	case ZSetType:
+		if rv.ZSet().Members == nil {
+			return EncodingListpack
+		}
+		return EncodingSkiplist
+	case StreamType:
+		return EncodingStream
+	default:
+		return EncodingRaw
+	}
+}
+
+// ObjectEncoding returns the encoding of the value stored at key
+func (s *Store) ObjectEncoding(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return "", false
+	}
+	value, exists := s.getCurrentDB().data[key]
+	if !exists {
+		return "", false
+	}
+	return value.Encoding(), true
+}
@@ -7,23 +7,15 @@ import (
 func (s *Store) Expire(key string, seconds int) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	db := s.getCurrentDB()
-	if _, exists := db.data[key]; !exists {
-		return false
-	}
-	db.expiration[key] = time.Now().Add(time.Duration(seconds) * time.Second)
-	return true
+	s.cleanupExpired(key)
+	return s.setExpiration(s.getCurrentDB(), key, time.Now().Add(time.Duration(seconds) * time.Second))
 }
 
 func (s *Store) ExpireAt(key string, timestamp int64) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	db := s.getCurrentDB()
-	if _, exists := db.data[key]; !exists {
-		return false
-	}
-	db.expiration[key] = time.Unix(timestamp, 0)
-	return true
+	s.cleanupExpired(key)
+	return s.setExpiration(s.getCurrentDB(), key, time.Unix(timestamp, 0))
 }
 
 func (s *Store) TTL(key string) int {
@@ -47,23 +39,15 @@ func (s *Store) TTL(key string) int {
 func (s *Store) PExpire(key string, milliseconds int) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	db := s.getCurrentDB()
-	if _, exists := db.data[key]; !exists {
-		return false
-	}
-	db.expiration[key] = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
-	return true
+	s.cleanupExpired(key)
+	return s.setExpiration(s.getCurrentDB(), key, time.Now().Add(time.Duration(milliseconds) * time.Millisecond))
 }
 
 func (s *Store) PExpireAt(key string, timestampMs int64) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	db := s.getCurrentDB()
-	if _, exists := db.data[key]; !exists {
-		return false
-	}
-	db.expiration[key] = time.Unix(0, timestampMs*int64(time.Millisecond))
-	return true
+	s.cleanupExpired(key)
+	return s.setExpiration(s.getCurrentDB(), key, time.Unix(0, timestampMs*int64(time.Millisecond)))
 }
 
 func (s *Store) PTTL(key string) int {
@@ -83,3 +67,47 @@ func (s *Store) PTTL(key string) int {
 	}
 	return -1
 }
+
+// setExpiration makes key expire at the given time, deleting it right away
+// when that time has already passed
+func (s *Store) setExpiration(db *Database, key string, at time.Time) bool {
+	if _, exists := db.data[key]; !exists {
+		return false
+	}
+	if !at.After(time.Now()) {
+		s.removeKey(db, key)
+		return true
+	}
+	db.expiration[key] = at
+	s.notify(db, GenericEvent, "expire", key)
+	return true
+}
+
+// ActiveExpireKeys removes expired keys across all databases, examining at
+// most limit keys with an expiration per database
+func (s *Store) ActiveExpireKeys(limit int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	currentDB := s.currentDB
+	defer func() { s.currentDB = currentDB }()
+
+	removed := 0
+	for dbIdx, db := range s.databases {
+		s.currentDB = dbIdx
+
+		checked := 0
+		for key := range db.expiration {
+			if checked >= limit {
+				break
+			}
+			checked++
+
+			if s.isExpired(key) {
+				s.cleanupExpired(key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,103 @@
+package store
+
+// GlobMatch reports whether str matches the Redis-style glob pattern.
+// Supported syntax: '*' (any sequence), '?' (any byte), '[abc]', '[^abc]',
+// '[a-z]' and backslash escapes. Matching is iterative and only ever
+// backtracks to the most recent '*', so it runs in O(len(pattern)*len(str))
+// even for pathological patterns such as "a*a*a*a*b".
+func GlobMatch(pattern, str string) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0
+
+	for s < len(str) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starS = p, s
+				continue
+			}
+			if next, ok := globMatchOne(pattern, p, str[s]); ok {
+				p = next
+				s++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, s = starP, starS
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchOne matches a single pattern token starting at p against c and
+// returns the index of the following token.
+func globMatchOne(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '\\':
+		if p+1 < len(pattern) {
+			return p + 2, pattern[p+1] == c
+		}
+		return p + 1, c == '\\'
+	case '[':
+		return globMatchClass(pattern, p+1, c)
+	default:
+		return p + 1, pattern[p] == c
+	}
+}
+
+// globMatchClass matches c against the character class whose body starts at
+// p (just past the opening '['). An unterminated class extends to the end of
+// the pattern, mirroring Redis.
+func globMatchClass(pattern string, p int, c byte) (int, bool) {
+	negate := false
+	if p < len(pattern) && pattern[p] == '^' {
+		negate = true
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			if pattern[p+1] == c {
+				matched = true
+			}
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			p += 3
+		default:
+			if pattern[p] == c {
+				matched = true
+			}
+			p++
+		}
+	}
+	if p < len(pattern) {
+		p++
+	}
+
+	if negate {
+		matched = !matched
+	}
+	return p, matched
+}
@@ -1,119 +1,116 @@
 package store
 
 import (
+	"slices"
 	"strconv"
+	"time"
 )
 
 func (s *Store) HSet(key, field, value string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	redisValue, exists := db.data[key]
 	if !exists {
 		hashMap := make(map[string]string)
 		hashMap[field] = value
-		db.data[key] = HashValue(hashMap)
+		s.setKey(db, key, s.hashValue(hashMap, redisValue))
+		s.notify(db, HashEvent, "hset", key)
 		return true
 	} else if redisValue.Type != HashType {
 		return false
 	}
 	
-	hash := redisValue.Hash()
-	_, fieldExists := hash[field]
-	newHash := make(map[string]string)
-	for k, v := range hash {
-		newHash[k] = v
-	}
-	newHash[field] = value
-	db.data[key] = HashValue(newHash)
-	return !fieldExists
+	added := s.hashSet(redisValue, field, value)
+	redisValue.clearFieldExpiration(field)
+	s.notify(db, HashEvent, "hset", key)
+	return added
 }
 
 func (s *Store) HGet(key, field string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return "", false
 	}
 	
-	fieldValue, fieldExists := value.Hash()[field]
-	return fieldValue, fieldExists
+	return value.hashField(field)
 }
 
 func (s *Store) HDel(key string, fields ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	value, exists := db.data[key]
 	if !exists || value.Type != HashType {
 		return 0
 	}
 	
-	hash := value.Hash()
 	count := 0
-	newHash := make(map[string]string)
-	for k, v := range hash {
-		newHash[k] = v
-	}
-	
 	for _, field := range fields {
-		if _, exists := newHash[field]; exists {
-			delete(newHash, field)
+		if value.hashDelete(field) {
 			count++
 		}
 	}
 	
-	if len(newHash) == 0 {
-		delete(db.data, key)
-	} else {
-		db.data[key] = HashValue(newHash)
+	if count == 0 {
+		return 0
+	}
+	
+	s.notify(db, HashEvent, "hdel", key)
+	if value.hashLen() == 0 {
+		s.removeKey(db, key)
 	}
 	
 	return count
 }
 
 func (s *Store) HExists(key, field string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return false
 	}
 	
-	_, fieldExists := value.Hash()[field]
+	_, fieldExists := value.hashField(field)
 	return fieldExists
 }
 
 func (s *Store) HLen(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return 0
 	}
 	
-	return len(value.Hash())
+	return value.hashLen()
 }
 
 func (s *Store) HKeys(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return []string{}
 	}
@@ -127,12 +124,12 @@ func (s *Store) HKeys(key string) []string {
 }
 
 func (s *Store) HVals(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return []string{}
 	}
@@ -146,12 +143,12 @@ func (s *Store) HVals(key string) []string {
 }
 
 func (s *Store) HGetAll(key string) map[string]string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		return make(map[string]string)
 	}
@@ -167,20 +164,22 @@ func (s *Store) HGetAll(key string) map[string]string {
 func (s *Store) HIncrBy(key, field string, increment int) (int, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	value, exists := db.data[key]
 	if !exists {
 		newHash := make(map[string]string)
 		newHash[field] = strconv.Itoa(increment)
-		db.data[key] = HashValue(newHash)
+		s.setKey(db, key, s.hashValue(newHash, value))
+		s.notify(db, HashEvent, "hincrby", key)
 		return increment, true
 	} else if value.Type != HashType {
 		return 0, false
 	}
 	
-	hash := value.Hash()
-	currentStr, fieldExists := hash[field]
+	currentStr, fieldExists := value.hashField(field)
 	current := 0
 	
 	if fieldExists {
@@ -192,12 +191,8 @@ func (s *Store) HIncrBy(key, field string, increment int) (int, bool) {
 	}
 	
 	newValue := current + increment
-	newHash := make(map[string]string)
-	for k, v := range hash {
-		newHash[k] = v
-	}
-	newHash[field] = strconv.Itoa(newValue)
-	db.data[key] = HashValue(newHash)
+	s.hashSet(value, field, strconv.Itoa(newValue))
+	s.notify(db, HashEvent, "hincrby", key)
 	
 	return newValue, true
 }
@@ -205,20 +200,22 @@ func (s *Store) HIncrBy(key, field string, increment int) (int, bool) {
 func (s *Store) HIncrByFloat(key, field string, increment float64) (float64, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	value, exists := db.data[key]
 	if !exists {
 		newHash := make(map[string]string)
 		newHash[field] = strconv.FormatFloat(increment, 'f', -1, 64)
-		db.data[key] = HashValue(newHash)
+		s.setKey(db, key, s.hashValue(newHash, value))
+		s.notify(db, HashEvent, "hincrbyfloat", key)
 		return increment, true
 	} else if value.Type != HashType {
 		return 0, false
 	}
 	
-	hash := value.Hash()
-	currentStr, fieldExists := hash[field]
+	currentStr, fieldExists := value.hashField(field)
 	current := 0.0
 	
 	if fieldExists {
@@ -230,60 +227,61 @@ func (s *Store) HIncrByFloat(key, field string, increment float64) (float64, boo
 	}
 	
 	newValue := current + increment
-	newHash := make(map[string]string)
-	for k, v := range hash {
-		newHash[k] = v
-	}
-	newHash[field] = strconv.FormatFloat(newValue, 'f', -1, 64)
-	db.data[key] = HashValue(newHash)
+	s.hashSet(value, field, strconv.FormatFloat(newValue, 'f', -1, 64))
+	s.notify(db, HashEvent, "hincrbyfloat", key)
 	
 	return newValue, true
 }
 
-func (s *Store) HMSet(key string, fieldValues map[string]string) bool {
+// HMSet sets the given fields, returning how many of them are new. The
+// second result is false when key holds a non-hash value.
+func (s *Store) HMSet(key string, fieldValues map[string]string) (int, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	value, exists := db.data[key]
-	var hash map[string]string
+	added := 0
 	
 	if !exists {
-		hash = make(map[string]string)
+		hash := make(map[string]string, len(fieldValues))
+		for field, val := range fieldValues {
+			hash[field] = val
+		}
+		added = len(hash)
+		s.setKey(db, key, s.hashValue(hash, nil))
 	} else if value.Type != HashType {
-		return false
+		return 0, false
 	} else {
-		existingHash := value.Hash()
-		hash = make(map[string]string)
-		for k, v := range existingHash {
-			hash[k] = v
+		for field, val := range fieldValues {
+			if s.hashSet(value, field, val) {
+				added++
+			}
+			value.clearFieldExpiration(field)
 		}
 	}
 	
-	for field, val := range fieldValues {
-		hash[field] = val
-	}
-	
-	db.data[key] = HashValue(hash)
-	return true
+	s.notify(db, HashEvent, "hset", key)
+	return added, true
 }
 
 func (s *Store) HMGet(key string, fields ...string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != HashType {
 		result := make([]string, len(fields))
 		return result
 	}
 	
-	hash := value.Hash()
 	result := make([]string, len(fields))
 	for i, field := range fields {
-		if val, ok := hash[field]; ok {
+		if val, ok := value.hashField(field); ok {
 			result[i] = val
 		}
 	}
@@ -294,28 +292,492 @@ func (s *Store) HMGet(key string, fields ...string) []string {
 func (s *Store) HSetNX(key, field, value string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 	
 	redisValue, exists := db.data[key]
 	if !exists {
 		newHash := make(map[string]string)
 		newHash[field] = value
-		db.data[key] = HashValue(newHash)
+		s.setKey(db, key, s.hashValue(newHash, redisValue))
+		s.notify(db, HashEvent, "hset", key)
 		return true
 	} else if redisValue.Type != HashType {
 		return false
 	}
 	
-	hash := redisValue.Hash()
-	if _, fieldExists := hash[field]; fieldExists {
+	if _, fieldExists := redisValue.hashField(field); fieldExists {
 		return false
 	}
 	
+	s.hashSet(redisValue, field, value)
+	s.notify(db, HashEvent, "hset", key)
+	return true
+}
+// Per-field expiration replies, shared by HEXPIRE, HPERSIST and HTTL
+const (
+	HashFieldMissing    = -2
+	HashFieldNoTTL      = -1
+	HashFieldNotSet     = 0
+	HashFieldTTLSet     = 1
+	HashFieldTTLRemoved = 1
+	HashFieldExpiredNow = 2
+)
+
+func (rv *RedisValue) clearFieldExpiration(field string) {
+	delete(rv.fieldExpiration, field)
+	if len(rv.fieldExpiration) == 0 {
+		rv.fieldExpiration = nil
+	}
+}
+
+func (rv *RedisValue) setFieldExpiration(field string, at time.Time) {
+	if rv.fieldExpiration == nil {
+		rv.fieldExpiration = make(map[string]time.Time)
+	}
+	rv.fieldExpiration[field] = at
+}
+
+// expireHashFields lazily removes expired fields of the hash at key,
+// deleting the key once no fields remain
+func (s *Store) expireHashFields(db *Database, key string) {
+	value, exists := db.data[key]
+	if !exists || value.Type != HashType || len(value.fieldExpiration) == 0 {
+		return
+	}
+
+	now := time.Now()
+	expired := false
+	for _, at := range value.fieldExpiration {
+		if !at.After(now) {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return
+	}
+
 	newHash := make(map[string]string)
+	for field, fieldValue := range value.Hash() {
+		if at, ok := value.fieldExpiration[field]; ok && !at.After(now) {
+			continue
+		}
+		newHash[field] = fieldValue
+	}
+
+	s.replaceHash(db, key, newHash, value, "hexpired")
+}
+
+// replaceHash stores newHash at key carrying the field expirations of prev,
+// or deletes the key when the hash is empty, raising events on it
+func (s *Store) replaceHash(db *Database, key string, newHash map[string]string, prev *RedisValue, events ...string) *RedisValue {
+	if len(newHash) == 0 {
+		if prev != nil {
+			for _, event := range events {
+				s.notify(db, HashEvent, event, key)
+			}
+			s.removeKey(db, key)
+		}
+		return nil
+	}
+	value := s.hashValue(newHash, prev)
+	s.setKey(db, key, value)
+	s.indexKey(db, key)
+	for _, event := range events {
+		s.notify(db, HashEvent, event, key)
+	}
+	return value
+}
+
+func copyHash(hash map[string]string) map[string]string {
+	newHash := make(map[string]string, len(hash))
 	for k, v := range hash {
 		newHash[k] = v
 	}
-	newHash[field] = value
-	db.data[key] = HashValue(newHash)
-	return true
-}
\ No newline at end of file
+	return newHash
+}
+
+// HExpireAt sets the expiration of each field. condition is one of "", NX,
+// XX, GT or LT. A time that is not in the future deletes the field. The
+// second result is false when key holds a non-hash value.
+func (s *Store) HExpireAt(key string, at time.Time, condition string, fields ...string) ([]int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	results := make([]int, len(fields))
+	value, exists := db.data[key]
+	if !exists {
+		for i := range results {
+			results[i] = HashFieldMissing
+		}
+		return results, true
+	}
+	if value.Type != HashType {
+		return nil, false
+	}
+
+	newHash := copyHash(value.Hash())
+	expirations := make(map[string]time.Time)
+	for field, fieldAt := range value.fieldExpiration {
+		expirations[field] = fieldAt
+	}
+
+	deleteNow := !at.After(time.Now())
+	changed := false
+	for i, field := range fields {
+		if _, ok := newHash[field]; !ok {
+			results[i] = HashFieldMissing
+			continue
+		}
+
+		current, hasTTL := expirations[field]
+		allowed := true
+		switch condition {
+		case "NX":
+			allowed = !hasTTL
+		case "XX":
+			allowed = hasTTL
+		case "GT":
+			allowed = hasTTL && at.After(current)
+		case "LT":
+			allowed = !hasTTL || at.Before(current)
+		}
+		if !allowed {
+			results[i] = HashFieldNotSet
+			continue
+		}
+
+		changed = true
+		if deleteNow {
+			delete(newHash, field)
+			delete(expirations, field)
+			results[i] = HashFieldExpiredNow
+			continue
+		}
+		expirations[field] = at
+		results[i] = HashFieldTTLSet
+	}
+
+	if !changed {
+		return results, true
+	}
+
+	event := "hexpire"
+	if deleteNow {
+		event = "hexpired"
+	}
+	newValue := s.replaceHash(db, key, newHash, value, event)
+	if newValue != nil {
+		newValue.fieldExpiration = nil
+		for field, fieldAt := range expirations {
+			if _, ok := newHash[field]; ok {
+				newValue.setFieldExpiration(field, fieldAt)
+			}
+		}
+		if len(newValue.fieldExpiration) > 0 {
+			db.hashFieldTTLKeys[key] = true
+		}
+	}
+	return results, true
+}
+
+// HPersist removes the expiration of each field
+func (s *Store) HPersist(key string, fields ...string) ([]int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	results := make([]int, len(fields))
+	value, exists := db.data[key]
+	if !exists {
+		for i := range results {
+			results[i] = HashFieldMissing
+		}
+		return results, true
+	}
+	if value.Type != HashType {
+		return nil, false
+	}
+
+	hash := value.Hash()
+	var persisted []string
+	for i, field := range fields {
+		if _, ok := hash[field]; !ok {
+			results[i] = HashFieldMissing
+			continue
+		}
+		if _, hasTTL := value.fieldExpiration[field]; !hasTTL {
+			results[i] = HashFieldNoTTL
+			continue
+		}
+		persisted = append(persisted, field)
+		results[i] = HashFieldTTLRemoved
+	}
+
+	if len(persisted) > 0 {
+		newValue := s.hashValue(copyHash(hash), value)
+		for _, field := range persisted {
+			newValue.clearFieldExpiration(field)
+		}
+		db.data[key] = newValue
+		s.notify(db, HashEvent, "hpersist", key)
+	}
+	return results, true
+}
+
+// HFieldExpirations returns the expiration time of each field. found[i] is
+// false when the field does not exist and a zero time means it has no TTL.
+func (s *Store) HFieldExpirations(key string, fields ...string) ([]time.Time, []bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	expirations := make([]time.Time, len(fields))
+	found := make([]bool, len(fields))
+	value, exists := db.data[key]
+	if !exists {
+		return expirations, found, true
+	}
+	if value.Type != HashType {
+		return nil, nil, false
+	}
+
+	for i, field := range fields {
+		if _, ok := value.hashField(field); ok {
+			found[i] = true
+			expirations[i] = value.fieldExpiration[field]
+		}
+	}
+	return expirations, found, true
+}
+
+// HashFieldExpirations returns all field expirations of the hash at key
+func (s *Store) HashFieldExpirations(key string) map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	if !exists || value.Type != HashType {
+		return nil
+	}
+	result := make(map[string]time.Time, len(value.fieldExpiration))
+	for field, at := range value.fieldExpiration {
+		result[field] = at
+	}
+	return result
+}
+
+// HGetDel returns the values of the given fields and deletes them
+func (s *Store) HGetDel(key string, fields ...string) ([]string, []bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	values := make([]string, len(fields))
+	found := make([]bool, len(fields))
+	value, exists := db.data[key]
+	if !exists {
+		return values, found, true
+	}
+	if value.Type != HashType {
+		return nil, nil, false
+	}
+
+	newHash := copyHash(value.Hash())
+	deleted := false
+	for i, field := range fields {
+		if fieldValue, ok := newHash[field]; ok {
+			values[i], found[i] = fieldValue, true
+			delete(newHash, field)
+			deleted = true
+		}
+	}
+
+	if deleted {
+		s.replaceHash(db, key, newHash, value, "hdel")
+	}
+	return values, found, true
+}
+
+// HGetEx returns the values of the given fields and updates their
+// expiration. When persist is set the TTLs are removed; otherwise a
+// non-zero at becomes the new expiration, deleting the fields if it is not
+// in the future.
+func (s *Store) HGetEx(key string, at time.Time, persist bool, fields ...string) ([]string, []bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	values := make([]string, len(fields))
+	found := make([]bool, len(fields))
+	value, exists := db.data[key]
+	if !exists {
+		return values, found, true
+	}
+	if value.Type != HashType {
+		return nil, nil, false
+	}
+
+	hash := value.Hash()
+	for i, field := range fields {
+		values[i], found[i] = hash[field]
+	}
+	if !persist && at.IsZero() {
+		return values, found, true
+	}
+
+	newHash := copyHash(hash)
+	deleteNow := !persist && !at.After(time.Now())
+	if deleteNow {
+		for i, field := range fields {
+			if found[i] {
+				delete(newHash, field)
+			}
+		}
+	}
+
+	var events []string
+	if slices.Contains(found, true) {
+		switch {
+		case persist:
+			events = append(events, "hpersist")
+		case deleteNow:
+			events = append(events, "hexpired")
+		default:
+			events = append(events, "hexpire")
+		}
+	}
+	newValue := s.replaceHash(db, key, newHash, value, events...)
+	if newValue == nil || deleteNow {
+		return values, found, true
+	}
+	for i, field := range fields {
+		if !found[i] {
+			continue
+		}
+		if persist {
+			newValue.clearFieldExpiration(field)
+		} else {
+			newValue.setFieldExpiration(field, at)
+		}
+	}
+	if len(newValue.fieldExpiration) > 0 {
+		db.hashFieldTTLKeys[key] = true
+	}
+	return values, found, true
+}
+
+// HSetEx sets the given field/value pairs. condition is "", FNX (only if no
+// field exists) or FXX (only if every field exists). A non-zero at sets the
+// expiration of every field, keepTTL retains existing expirations and
+// otherwise the fields become persistent. The first result reports whether
+// the fields were set; the second is false for a non-hash value.
+func (s *Store) HSetEx(key string, fieldValues []string, condition string, at time.Time, keepTTL bool) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	var hash map[string]string
+	if !exists {
+		hash = make(map[string]string)
+	} else if value.Type != HashType {
+		return false, false
+	} else {
+		hash = copyHash(value.Hash())
+	}
+
+	for i := 0; i < len(fieldValues); i += 2 {
+		_, fieldExists := hash[fieldValues[i]]
+		if (condition == "FNX" && fieldExists) || (condition == "FXX" && !fieldExists) {
+			return false, true
+		}
+	}
+
+	deleteNow := !at.IsZero() && !at.After(time.Now())
+	for i := 0; i < len(fieldValues); i += 2 {
+		if deleteNow {
+			delete(hash, fieldValues[i])
+		} else {
+			hash[fieldValues[i]] = fieldValues[i+1]
+		}
+	}
+
+	events := []string{"hset"}
+	switch {
+	case deleteNow:
+		events = append(events, "hexpired")
+	case !at.IsZero():
+		events = append(events, "hexpire")
+	}
+	newValue := s.replaceHash(db, key, hash, value, events...)
+	if newValue == nil || deleteNow {
+		return true, true
+	}
+	for i := 0; i < len(fieldValues); i += 2 {
+		switch {
+		case !at.IsZero():
+			newValue.setFieldExpiration(fieldValues[i], at)
+		case !keepTTL:
+			newValue.clearFieldExpiration(fieldValues[i])
+		}
+	}
+	if len(newValue.fieldExpiration) > 0 {
+		db.hashFieldTTLKeys[key] = true
+	}
+	return true, true
+}
+
+// ActiveExpireHashFields removes expired hash fields across all databases,
+// examining at most limit tracked keys per database
+func (s *Store) ActiveExpireHashFields(limit int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	currentDB := s.currentDB
+	defer func() { s.currentDB = currentDB }()
+
+	removed := 0
+	for dbIdx, db := range s.databases {
+		if len(db.hashFieldTTLKeys) == 0 {
+			continue
+		}
+		s.currentDB = dbIdx
+
+		checked := 0
+		for key := range db.hashFieldTTLKeys {
+			if checked >= limit {
+				break
+			}
+			checked++
+
+			before, exists := db.data[key]
+			if !exists || before.Type != HashType || len(before.fieldExpiration) == 0 {
+				delete(db.hashFieldTTLKeys, key)
+				continue
+			}
+			s.cleanupExpired(key)
+			after, exists := db.data[key]
+			if !exists {
+				removed += len(before.Hash())
+				continue
+			}
+			removed += len(before.Hash()) - len(after.Hash())
+			if len(after.fieldExpiration) == 0 {
+				delete(db.hashFieldTTLKeys, key)
+			}
+		}
+	}
+	return removed
+}
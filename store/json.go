@@ -1,863 +1,1544 @@
 package store
 
 import (
-	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
-// JSONSet sets a JSON value at the specified path
-// If path is "$" or ".", sets the root value
-func (s *Store) JSONSet(key, path string, value interface{}) bool {
+// JSON commands evaluate their path against the document and apply to every
+// matched location. Results hold one entry per match, nil where the command
+// does not apply to the matched value. A nil result slice means the key does
+// not exist. Documents are modified in place; values handed out are copies.
+
+// JSONSet sets a JSON value at every location matched by the path
+// If path is "$" or ".", sets the root value. With nx the path must not
+// exist yet, with xx it must.
+func (s *Store) JSONSet(key, path string, value *JSONNode, nx, xx bool) (bool, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 
-	// Normalize path
-	path = normalizePath(path)
-
-	if path == "$" || path == "." {
-		// Setting root value
-		db.data[key] = JSONValue(value)
-		return true
-	}
-
-	// Get existing value or create new object
-	existing, exists := db.data[key]
-	var root interface{}
-	if exists && existing.Type == JSONType {
-		root = deepCopy(existing.JSON())
-	} else if !exists {
-		root = make(map[string]interface{})
-	} else {
-		return false // Wrong type
+	root, exists, err := jsonDocument(db, key)
+	if err != nil {
+		return false, err
 	}
 
-	// Set value at path
-	if setAtPath(root, path, value) {
-		db.data[key] = JSONValue(root)
-		return true
+	root, set, err := p.set(root, exists, func(*JSONNode) *JSONNode {
+		return value.Clone()
+	}, nx, xx)
+	if err != nil || !set {
+		return false, err
 	}
-	return false
+	s.setKey(db, key, JSONValue(root))
+	return true, nil
 }
 
-// JSONGet gets a JSON value at the specified path
-func (s *Store) JSONGet(key string, paths ...string) (interface{}, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.cleanupExpired(key)
-	db := s.getCurrentDB()
+// JSONSetArgs is one key, path and value triplet of JSON.MSET
+type JSONSetArgs struct {
+	Key   string
+	Path  string
+	Value *JSONNode
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return nil, false
+// JSONMSet sets every triplet atomically. The documents are updated on
+// copies so nothing is stored if any of them fails.
+func (s *Store) JSONMSet(sets []JSONSetArgs) error {
+	paths := make([]*jsonPath, len(sets))
+	for i, set := range sets {
+		p, err := compileJSONPath(set.Path)
+		if err != nil {
+			return err
+		}
+		paths[i] = p
 	}
 
-	root := value.JSON()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
 
-	if len(paths) == 0 || (len(paths) == 1 && (paths[0] == "$" || paths[0] == ".")) {
-		return root, true
+	type document struct {
+		root   *JSONNode
+		exists bool
 	}
+	staged := make(map[string]*document)
+	var order []string
 
-	// Handle multiple paths
-	if len(paths) == 1 {
-		path := normalizePath(paths[0])
-		return getAtPath(root, path)
+	for i, set := range sets {
+		doc, ok := staged[set.Key]
+		if !ok {
+			s.cleanupExpired(set.Key)
+			root, exists, err := jsonDocument(db, set.Key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				root = root.Clone()
+			}
+			doc = &document{root: root, exists: exists}
+			staged[set.Key] = doc
+			order = append(order, set.Key)
+		}
+
+		value := set.Value
+		root, ok, err := paths[i].set(doc.root, doc.exists, func(*JSONNode) *JSONNode {
+			return value.Clone()
+		}, false, false)
+		if err != nil {
+			return err
+		}
+		if ok {
+			doc.root, doc.exists = root, true
+		}
 	}
 
-	// Multiple paths - return map of results
-	results := make(map[string]interface{})
-	for _, path := range paths {
-		path = normalizePath(path)
-		if val, ok := getAtPath(root, path); ok {
-			results[path] = val
+	for _, key := range order {
+		if doc := staged[key]; doc.exists {
+			s.setKey(db, key, JSONValue(doc.root))
+			s.indexKey(db, key)
 		}
 	}
-	return results, true
+	return nil
 }
 
-// JSONDel deletes a value at the specified path
-func (s *Store) JSONDel(key string, path string) int {
+// JSONMerge applies an RFC 7386 merge patch to every location matched by
+// the path. A null patch deletes the matched values.
+func (s *Store) JSONMerge(key, path string, patch *JSONNode) (bool, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0
+	root, exists, err := jsonDocument(db, key)
+	if err != nil {
+		return false, err
 	}
 
-	path = normalizePath(path)
-
-	if path == "$" || path == "." {
-		delete(db.data, key)
-		return 1
+	if patch.Kind == JSONNull {
+		if !exists {
+			return false, nil
+		}
+		if len(p.steps) == 0 {
+			s.removeKey(db, key)
+			return true, nil
+		}
+		p.remove(root)
+		return true, nil
 	}
 
-	root := deepCopy(value.JSON())
-	if deleteAtPath(root, path) {
-		db.data[key] = JSONValue(root)
-		return 1
+	root, set, err := p.set(root, exists, func(target *JSONNode) *JSONNode {
+		return mergePatch(target, patch)
+	}, false, false)
+	if err != nil || !set {
+		return false, err
 	}
-	return 0
+	s.setKey(db, key, JSONValue(root))
+	return true, nil
 }
 
-// JSONType returns the type of the value at the path
-func (s *Store) JSONType(key string, path string) string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// JSONGet returns copies of the values matched by each path
+func (s *Store) JSONGet(key string, paths ...string) ([][]*JSONNode, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	compiled := make([]*jsonPath, len(paths))
+	for i, path := range paths {
+		p, err := compileJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = p
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return ""
+	root, exists, err := jsonDocument(db, key)
+	if err != nil || !exists {
+		return nil, err
 	}
 
-	path = normalizePath(path)
-	val, ok := getAtPath(value.JSON(), path)
-	if !ok {
-		return ""
+	results := make([][]*JSONNode, len(compiled))
+	for i, p := range compiled {
+		results[i] = []*JSONNode{}
+		for _, match := range p.eval(root) {
+			results[i] = append(results[i], match.node.Clone())
+		}
 	}
-
-	return getJSONType(val)
+	return results, nil
 }
 
-// JSONNumIncrBy increments a number at the path
-func (s *Store) JSONNumIncrBy(key, path string, increment float64) (float64, bool) {
+// JSONDel deletes the values matched by the path and returns how many were
+// removed
+func (s *Store) JSONDel(key string, path string) (int, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
+	root, exists, err := jsonDocument(db, key)
+	if err != nil || !exists {
+		return 0, err
 	}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
-
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
+	if len(p.steps) == 0 {
+		s.removeKey(db, key)
+		return 1, nil
 	}
+	return p.remove(root), nil
+}
 
-	num, ok := toFloat64(val)
-	if !ok {
-		return 0, false
-	}
+// JSONType returns the type of each matched value
+func (s *Store) JSONType(key string, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		return getJSONType(node)
+	})
+}
 
-	newVal := num + increment
-	if setAtPath(root, path, newVal) {
-		db.data[key] = JSONValue(root)
-		return newVal, true
-	}
-	return 0, false
+// JSONNumIncrBy increments every matched number and returns the new values.
+// Integers stay integers unless the increment is a float or they overflow.
+func (s *Store) JSONNumIncrBy(key, path string, increment *JSONNode) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		return updateNumber(node, increment, func(a, b int64) (int64, bool) {
+			sum := a + b
+			return sum, (sum > a) == (b > 0)
+		}, func(a, b float64) float64 { return a + b })
+	})
 }
 
-// JSONNumMultBy multiplies a number at the path
-func (s *Store) JSONNumMultBy(key, path string, multiplier float64) (float64, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	db := s.getCurrentDB()
+// JSONNumMultBy multiplies every matched number and returns the new values
+func (s *Store) JSONNumMultBy(key, path string, multiplier *JSONNode) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		return updateNumber(node, multiplier, func(a, b int64) (int64, bool) {
+			if a == 0 || b == 0 {
+				return 0, true
+			}
+			product := a * b
+			return product, product/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+		}, func(a, b float64) float64 { return a * b })
+	})
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
-	}
+// JSONStrAppend appends to every matched string and returns the new lengths
+func (s *Store) JSONStrAppend(key, path, appendStr string) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONString {
+			return nil, nil, nil
+		}
+		str := node.Str + appendStr
+		return len(str), &JSONNode{Kind: JSONString, Str: str}, nil
+	})
+}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
+// JSONStrLen returns the length of every matched string
+func (s *Store) JSONStrLen(key, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		if node.Kind == JSONString {
+			return len(node.Str)
+		}
+		return nil
+	})
+}
 
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
-	}
+// JSONArrAppend appends values to every matched array
+func (s *Store) JSONArrAppend(key, path string, values ...*JSONNode) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONArray {
+			return nil, nil, nil
+		}
+		for _, v := range values {
+			node.Items = append(node.Items, v.Clone())
+		}
+		return len(node.Items), nil, nil
+	})
+}
 
-	num, ok := toFloat64(val)
-	if !ok {
-		return 0, false
-	}
+// JSONArrLen returns the length of every matched array
+func (s *Store) JSONArrLen(key, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		if node.Kind == JSONArray {
+			return len(node.Items)
+		}
+		return nil
+	})
+}
 
-	newVal := num * multiplier
-	if setAtPath(root, path, newVal) {
-		db.data[key] = JSONValue(root)
-		return newVal, true
-	}
-	return 0, false
+// JSONArrPop removes an element from every matched array and returns the
+// removed elements encoded as JSON
+func (s *Store) JSONArrPop(key, path string, index int) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONArray || len(node.Items) == 0 {
+			return nil, nil, nil
+		}
+
+		i := index
+		if i < 0 {
+			i = len(node.Items) + i
+		}
+		if i < 0 || i >= len(node.Items) {
+			i = len(node.Items) - 1
+		}
+
+		popped := node.Items[i].String()
+		node.Items = append(node.Items[:i], node.Items[i+1:]...)
+		return popped, nil, nil
+	})
 }
 
-// JSONStrAppend appends to a string at the path
-func (s *Store) JSONStrAppend(key, path, appendStr string) (int, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	db := s.getCurrentDB()
+// JSONArrIndex finds the index of a value in every matched array, searching
+// from start up to but excluding stop, where a stop of 0 means the end
+func (s *Store) JSONArrIndex(key, path string, value *JSONNode, start, stop int) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		if node.Kind != JSONArray {
+			return nil
+		}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
-	}
+		length := len(node.Items)
+		from, to := start, stop
+		if from < 0 {
+			from += length
+		}
+		if to <= 0 {
+			to += length
+		}
+		from = max(0, min(from, length))
+		to = max(0, min(to, length))
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
+		for i := from; i < to; i++ {
+			if node.Items[i].Equal(value) {
+				return i
+			}
+		}
+		return -1
+	})
+}
 
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
-	}
+// JSONArrInsert inserts values at an index in every matched array
+func (s *Store) JSONArrInsert(key, path string, index int, values ...*JSONNode) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONArray {
+			return nil, nil, nil
+		}
 
-	str, ok := val.(string)
-	if !ok {
-		return 0, false
-	}
+		i := index
+		if i < 0 {
+			i = len(node.Items) + i + 1
+		}
+		i = max(0, min(i, len(node.Items)))
 
-	newStr := str + appendStr
-	if setAtPath(root, path, newStr) {
-		db.data[key] = JSONValue(root)
-		return len(newStr), true
-	}
-	return 0, false
+		items := make([]*JSONNode, 0, len(node.Items)+len(values))
+		items = append(items, node.Items[:i]...)
+		for _, v := range values {
+			items = append(items, v.Clone())
+		}
+		node.Items = append(items, node.Items[i:]...)
+		return len(node.Items), nil, nil
+	})
 }
 
-// JSONStrLen returns the length of a string at the path
-func (s *Store) JSONStrLen(key, path string) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.cleanupExpired(key)
-	db := s.getCurrentDB()
+// JSONArrTrim trims every matched array to the specified range
+func (s *Store) JSONArrTrim(key, path string, start, stop int) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONArray {
+			return nil, nil, nil
+		}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
-	}
+		length := len(node.Items)
+		from, to := start, stop
+		if from < 0 {
+			from = length + from
+		}
+		if to < 0 {
+			to = length + to
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to >= length {
+			to = length - 1
+		}
+		if from > to || from >= length {
+			node.Items = nil
+			return 0, nil, nil
+		}
 
-	path = normalizePath(path)
-	val, ok := getAtPath(value.JSON(), path)
-	if !ok {
-		return 0, false
-	}
+		node.Items = append([]*JSONNode(nil), node.Items[from:to+1]...)
+		return len(node.Items), nil, nil
+	})
+}
 
-	str, ok := val.(string)
-	if !ok {
-		return 0, false
-	}
+// JSONObjKeys returns the keys of every matched object
+func (s *Store) JSONObjKeys(key, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		if node.Kind != JSONObject {
+			return nil
+		}
+		return append([]string{}, node.Keys...)
+	})
+}
 
-	return len(str), true
+// JSONObjLen returns the number of keys in every matched object
+func (s *Store) JSONObjLen(key, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		if node.Kind == JSONObject {
+			return len(node.Keys)
+		}
+		return nil
+	})
 }
 
-// JSONArrAppend appends values to an array at the path
-func (s *Store) JSONArrAppend(key, path string, values ...interface{}) (int, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	db := s.getCurrentDB()
+// JSONToggle flips every matched boolean and returns the new values
+func (s *Store) JSONToggle(key, path string) ([]interface{}, error) {
+	return s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		if node.Kind != JSONBool {
+			return nil, nil, nil
+		}
+		return !node.Bool, &JSONNode{Kind: JSONBool, Bool: !node.Bool}, nil
+	})
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
+// JSONClear empties every matched array and object and sets every matched
+// number to 0, returning how many values were cleared
+func (s *Store) JSONClear(key, path string) (int, error) {
+	results, err := s.updateJSON(key, path, func(node *JSONNode) (interface{}, *JSONNode, error) {
+		switch node.Kind {
+		case JSONArray, JSONObject:
+			node.Clear()
+			return true, nil, nil
+		case JSONInt, JSONFloat:
+			return true, &JSONNode{Kind: JSONInt}, nil
+		}
+		return nil, nil, nil
+	})
+
+	cleared := 0
+	for _, result := range results {
+		if result != nil {
+			cleared++
+		}
 	}
+	return cleared, err
+}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
+// JSONDebugMemory returns the estimated size in bytes of every matched value
+func (s *Store) JSONDebugMemory(key, path string) ([]interface{}, error) {
+	return s.readJSON(key, path, func(node *JSONNode) interface{} {
+		return jsonMemoryUsage(node)
+	})
+}
 
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
-	}
+// Helper functions
 
-	arr, ok := val.([]interface{})
-	if !ok {
-		return 0, false
+// jsonDocument returns the document stored at key
+func jsonDocument(db *Database, key string) (*JSONNode, bool, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, false, nil
 	}
-
-	arr = append(arr, values...)
-	if setAtPath(root, path, arr) {
-		db.data[key] = JSONValue(root)
-		return len(arr), true
+	if value.Type != JSONType {
+		return nil, false, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
-	return 0, false
+	return value.JSON(), true, nil
 }
 
-// JSONArrLen returns the length of an array at the path
-func (s *Store) JSONArrLen(key, path string) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// readJSON calls fn for every value matched by the path and collects the
+// results
+func (s *Store) readJSON(key, path string, fn func(node *JSONNode) interface{}) ([]interface{}, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
+	root, exists, err := jsonDocument(db, key)
+	if err != nil || !exists {
+		return nil, err
 	}
 
-	path = normalizePath(path)
-	val, ok := getAtPath(value.JSON(), path)
-	if !ok {
-		return 0, false
+	matches := p.eval(root)
+	results := make([]interface{}, len(matches))
+	for i, match := range matches {
+		results[i] = fn(match.node)
 	}
+	return results, nil
+}
 
-	arr, ok := val.([]interface{})
-	if !ok {
-		return 0, false
+// updateJSON calls fn for every value matched by the path. A nil result
+// means the command does not apply to the value. fn either modifies the
+// value in place, which it must only do once it cannot fail, or returns a
+// replacement; replacements are stored once fn succeeded for every match.
+func (s *Store) updateJSON(key, path string, fn func(node *JSONNode) (interface{}, *JSONNode, error)) ([]interface{}, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
 	}
 
-	return len(arr), true
-}
-
-// JSONArrPop removes and returns an element from an array
-func (s *Store) JSONArrPop(key, path string, index int) (interface{}, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.indexKey(db, key)
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return nil, false
+	root, exists, err := jsonDocument(db, key)
+	if err != nil || !exists {
+		return nil, err
 	}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
-
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return nil, false
+	matches := p.eval(root)
+	results := make([]interface{}, len(matches))
+	replacements := make([]*JSONNode, len(matches))
+	for i, match := range matches {
+		result, replacement, err := fn(match.node)
+		if err != nil {
+			return nil, err
+		}
+		results[i], replacements[i] = result, replacement
 	}
 
-	arr, ok := val.([]interface{})
-	if !ok || len(arr) == 0 {
-		return nil, false
+	for i, replacement := range replacements {
+		if replacement != nil {
+			root = matches[i].loc.set(root, replacement)
+		}
 	}
+	db.data[key].Value = root
+	return results, nil
+}
 
-	// Handle negative index
-	if index < 0 {
-		index = len(arr) + index
-	}
-	if index < 0 || index >= len(arr) {
-		index = len(arr) - 1 // Default to last element
+// updateNumber applies an arithmetic operation to a number. Two integers
+// give an integer unless the integer operation reports an overflow.
+func updateNumber(node, operand *JSONNode, intOp func(a, b int64) (int64, bool), floatOp func(a, b float64) float64) (interface{}, *JSONNode, error) {
+	if !node.IsNumber() {
+		return nil, nil, nil
 	}
 
-	popped := arr[index]
-	newArr := append(arr[:index], arr[index+1:]...)
+	if node.Kind == JSONInt && operand.Kind == JSONInt {
+		if n, ok := intOp(node.Int, operand.Int); ok {
+			result := &JSONNode{Kind: JSONInt, Int: n}
+			return result, result, nil
+		}
+	}
 
-	if setAtPath(root, path, newArr) {
-		db.data[key] = JSONValue(root)
-		return popped, true
+	f := floatOp(node.Number(), operand.Number())
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, nil, fmt.Errorf("ERR result is not a number or infinity")
 	}
-	return nil, false
+	result := &JSONNode{Kind: JSONFloat, Float: f}
+	return result, result, nil
 }
 
-// JSONArrIndex finds the index of a value in an array
-func (s *Store) JSONArrIndex(key, path string, value interface{}) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.cleanupExpired(key)
-	db := s.getCurrentDB()
+// jsonLocation addresses a value inside a document as a sequence of object
+// keys and array indexes
+type jsonLocation []interface{}
 
-	val, exists := db.data[key]
-	if !exists || val.Type != JSONType {
-		return -1, false
+func (loc jsonLocation) child(step interface{}) jsonLocation {
+	child := make(jsonLocation, len(loc)+1)
+	copy(child, loc)
+	child[len(loc)] = step
+	return child
+}
+
+func (loc jsonLocation) get(root *JSONNode) (*JSONNode, bool) {
+	current := root
+	for _, step := range loc {
+		switch current.Kind {
+		case JSONObject:
+			key, ok := step.(string)
+			if !ok {
+				return nil, false
+			}
+			if current, ok = current.Get(key); !ok {
+				return nil, false
+			}
+		case JSONArray:
+			index, ok := step.(int)
+			if !ok || index >= len(current.Items) {
+				return nil, false
+			}
+			current = current.Items[index]
+		default:
+			return nil, false
+		}
 	}
+	return current, true
+}
 
-	path = normalizePath(path)
-	arrVal, ok := getAtPath(val.JSON(), path)
+// set replaces the value at the location and returns the possibly new root
+func (loc jsonLocation) set(root, value *JSONNode) *JSONNode {
+	if len(loc) == 0 {
+		return value
+	}
+	parent, ok := loc[:len(loc)-1].get(root)
 	if !ok {
-		return -1, false
+		return root
 	}
+	switch parent.Kind {
+	case JSONObject:
+		if key, ok := loc[len(loc)-1].(string); ok {
+			parent.Set(key, value)
+		}
+	case JSONArray:
+		if index, ok := loc[len(loc)-1].(int); ok && index < len(parent.Items) {
+			parent.Items[index] = value
+		}
+	}
+	return root
+}
 
-	arr, ok := arrVal.([]interface{})
+// remove deletes the value at the location
+func (loc jsonLocation) remove(root *JSONNode) bool {
+	parent, ok := loc[:len(loc)-1].get(root)
 	if !ok {
-		return -1, false
+		return false
+	}
+	switch parent.Kind {
+	case JSONObject:
+		key, ok := loc[len(loc)-1].(string)
+		return ok && parent.Delete(key)
+	case JSONArray:
+		index, ok := loc[len(loc)-1].(int)
+		if !ok || index >= len(parent.Items) {
+			return false
+		}
+		parent.Items = append(parent.Items[:index], parent.Items[index+1:]...)
+		return true
 	}
+	return false
+}
 
-	// Compare values
-	valueJSON, _ := json.Marshal(value)
-	for i, item := range arr {
-		itemJSON, _ := json.Marshal(item)
-		if string(valueJSON) == string(itemJSON) {
-			return i, true
+// compare orders locations so that array indexes sort by position and a
+// location sorts before the locations within it
+func (loc jsonLocation) compare(other jsonLocation) int {
+	for i := 0; i < len(loc) && i < len(other); i++ {
+		switch a := loc[i].(type) {
+		case string:
+			b, _ := other[i].(string)
+			if c := strings.Compare(a, b); c != 0 {
+				return c
+			}
+		case int:
+			b, _ := other[i].(int)
+			if a != b {
+				if a < b {
+					return -1
+				}
+				return 1
+			}
 		}
 	}
+	return len(loc) - len(other)
+}
 
-	return -1, true
+// within reports whether loc lies inside the value at ancestor
+func (loc jsonLocation) within(ancestor jsonLocation) bool {
+	return len(ancestor) < len(loc) && ancestor.compare(loc[:len(ancestor)]) == 0
 }
 
-// JSONArrInsert inserts values at an index in an array
-func (s *Store) JSONArrInsert(key, path string, index int, values ...interface{}) (int, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	db := s.getCurrentDB()
+// jsonPath is a compiled JSONPath expression. Paths starting with "$" follow
+// JSONPath semantics and return every match; any other path is a legacy path
+// whose commands reply with a single result.
+type jsonPath struct {
+	legacy bool
+	steps  []jsonStep
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
-	}
+// jsonStep applies its selectors to the current nodes, or with descend set
+// to the current nodes and all their descendants
+type jsonStep struct {
+	descend   bool
+	selectors []jsonSelector
+}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
+type jsonSelectorKind int
 
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
-	}
+const (
+	selectKey jsonSelectorKind = iota
+	selectIndex
+	selectWildcard
+	selectSlice
+	selectFilter
+)
 
-	arr, ok := val.([]interface{})
-	if !ok {
-		return 0, false
-	}
+type jsonSelector struct {
+	kind   jsonSelectorKind
+	key    string
+	index  int
+	start  *int
+	end    *int
+	step   *int
+	filter jsonExpr
+}
 
-	// Handle negative index
-	if index < 0 {
-		index = len(arr) + index + 1
-	}
-	if index < 0 {
-		index = 0
-	}
-	if index > len(arr) {
-		index = len(arr)
-	}
+// jsonMatch is a value matched by a path together with its location
+type jsonMatch struct {
+	loc  jsonLocation
+	node *JSONNode
+}
 
-	// Insert values at index
-	newArr := make([]interface{}, 0, len(arr)+len(values))
-	newArr = append(newArr, arr[:index]...)
-	newArr = append(newArr, values...)
-	newArr = append(newArr, arr[index:]...)
+// IsLegacyJSONPath reports whether a path uses the legacy syntax, whose
+// commands reply with a single result instead of an array of matches
+func IsLegacyJSONPath(path string) bool {
+	return !strings.HasPrefix(path, "$")
+}
 
-	if setAtPath(root, path, newArr) {
-		db.data[key] = JSONValue(root)
-		return len(newArr), true
-	}
-	return 0, false
+func compileJSONPath(path string) (*jsonPath, error) {
+	p := &jsonPath{legacy: IsLegacyJSONPath(path)}
+	expr := path
+	switch {
+	case !p.legacy:
+		expr = path[1:]
+	case path == "" || path == ".":
+		expr = ""
+	case !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "["):
+		expr = "." + path
+	}
+
+	parser := &jsonPathParser{input: expr}
+	steps, err := parser.parseSteps(false)
+	if err != nil || parser.pos < len(expr) {
+		return nil, fmt.Errorf("ERR invalid JSONPath '%s'", path)
+	}
+	p.steps = steps
+	return p, nil
 }
 
-// JSONArrTrim trims an array to the specified range
-func (s *Store) JSONArrTrim(key, path string, start, stop int) (int, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	db := s.getCurrentDB()
+// eval returns the matched values in document order
+func (p *jsonPath) eval(root *JSONNode) []jsonMatch {
+	return evalSteps(p.steps, []jsonMatch{{node: root}}, root)
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
+// set replaces every matched value with fn applied to it, creating the path
+// when it matches nothing, and returns the new root and whether anything was
+// set. With nx the path must not match anything, with xx it must.
+func (p *jsonPath) set(root *JSONNode, exists bool, fn func(*JSONNode) *JSONNode, nx, xx bool) (*JSONNode, bool, error) {
+	if len(p.steps) == 0 {
+		if (nx && exists) || (xx && !exists) {
+			return root, false, nil
+		}
+		return fn(root), true, nil
 	}
 
-	path = normalizePath(path)
-	root := deepCopy(value.JSON())
-
-	val, ok := getAtPath(root, path)
-	if !ok {
-		return 0, false
+	if !exists {
+		if xx {
+			return root, false, nil
+		}
+		if !p.legacy {
+			return root, false, fmt.Errorf("ERR new objects must be created at the root")
+		}
+		root = &JSONNode{Kind: JSONObject}
 	}
 
-	arr, ok := val.([]interface{})
-	if !ok {
-		return 0, false
+	matches := p.eval(root)
+	if len(matches) > 0 {
+		if nx {
+			return root, false, nil
+		}
+		for _, match := range matches {
+			root = match.loc.set(root, fn(match.node))
+		}
+		return root, true, nil
 	}
 
-	length := len(arr)
-	if start < 0 {
-		start = length + start
-	}
-	if stop < 0 {
-		stop = length + stop
-	}
-	if start < 0 {
-		start = 0
+	if xx {
+		return root, false, nil
 	}
-	if stop >= length {
-		stop = length - 1
+	locs := p.creatable(root)
+	for _, loc := range locs {
+		root = loc.set(root, fn(nil))
 	}
-	if start > stop || start >= length {
-		newArr := []interface{}{}
-		if setAtPath(root, path, newArr) {
-			db.data[key] = JSONValue(root)
-			return 0, true
+	return root, len(locs) > 0, nil
+}
+
+// remove deletes every matched value, skipping values nested in another
+// match, and returns how many values were deleted
+func (p *jsonPath) remove(root *JSONNode) int {
+	matches := p.eval(root)
+	locs := make([]jsonLocation, len(matches))
+	for i, match := range matches {
+		locs[i] = match.loc
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		return locs[i].compare(locs[j]) < 0
+	})
+
+	var outermost []jsonLocation
+	for _, loc := range locs {
+		if n := len(outermost); n > 0 && (loc.compare(outermost[n-1]) == 0 || loc.within(outermost[n-1])) {
+			continue
 		}
-		return 0, false
+		outermost = append(outermost, loc)
 	}
 
-	newArr := arr[start : stop+1]
-	if setAtPath(root, path, newArr) {
-		db.data[key] = JSONValue(root)
-		return len(newArr), true
+	deleted := 0
+	for i := len(outermost) - 1; i >= 0; i-- {
+		if outermost[i].remove(root) {
+			deleted++
+		}
 	}
-	return 0, false
+	return deleted
 }
 
-// JSONObjKeys returns the keys of an object at the path
-func (s *Store) JSONObjKeys(key, path string) ([]string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.cleanupExpired(key)
-	db := s.getCurrentDB()
+// creatable returns the locations a path that matches nothing can be created
+// at: a new key under every object matched by the rest of the path. Legacy
+// paths made of plain keys also get their missing parent objects created.
+func (p *jsonPath) creatable(root *JSONNode) []jsonLocation {
+	last := p.steps[len(p.steps)-1]
+	if last.descend || len(last.selectors) != 1 || last.selectors[0].kind != selectKey {
+		return nil
+	}
+	key := last.selectors[0].key
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return nil, false
+	if p.legacy && p.plainKeys() {
+		current := root
+		if current.Kind != JSONObject {
+			return nil
+		}
+		loc := jsonLocation{}
+		for _, step := range p.steps[:len(p.steps)-1] {
+			name := step.selectors[0].key
+			next, exists := current.Get(name)
+			if !exists {
+				next = &JSONNode{Kind: JSONObject}
+				current.Set(name, next)
+			}
+			if next.Kind != JSONObject {
+				return nil
+			}
+			current = next
+			loc = loc.child(name)
+		}
+		return []jsonLocation{loc.child(key)}
 	}
 
-	path = normalizePath(path)
-	val, ok := getAtPath(value.JSON(), path)
-	if !ok {
-		return nil, false
+	var locs []jsonLocation
+	for _, match := range evalSteps(p.steps[:len(p.steps)-1], []jsonMatch{{node: root}}, root) {
+		if match.node.Kind == JSONObject {
+			locs = append(locs, match.loc.child(key))
+		}
 	}
+	return locs
+}
 
-	obj, ok := val.(map[string]interface{})
-	if !ok {
-		return nil, false
+func (p *jsonPath) plainKeys() bool {
+	for _, step := range p.steps {
+		if step.descend || len(step.selectors) != 1 || step.selectors[0].kind != selectKey {
+			return false
+		}
 	}
+	return true
+}
 
-	keys := make([]string, 0, len(obj))
-	for k := range obj {
-		keys = append(keys, k)
+func evalSteps(steps []jsonStep, matches []jsonMatch, root *JSONNode) []jsonMatch {
+	for _, step := range steps {
+		var next []jsonMatch
+		for _, match := range matches {
+			if step.descend {
+				descendants(match, func(m jsonMatch) {
+					next = step.apply(m, root, next)
+				})
+			} else {
+				next = step.apply(match, root, next)
+			}
+		}
+		matches = next
 	}
-	return keys, true
+	return matches
 }
 
-// JSONObjLen returns the number of keys in an object at the path
-func (s *Store) JSONObjLen(key, path string) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.cleanupExpired(key)
-	db := s.getCurrentDB()
+// descendants calls fn for match and every value nested inside it in
+// document order
+func descendants(match jsonMatch, fn func(jsonMatch)) {
+	fn(match)
+	forEachChild(match, func(child jsonMatch) {
+		descendants(child, fn)
+	})
+}
 
-	value, exists := db.data[key]
-	if !exists || value.Type != JSONType {
-		return 0, false
+func forEachChild(match jsonMatch, fn func(jsonMatch)) {
+	switch match.node.Kind {
+	case JSONObject:
+		for i, key := range match.node.Keys {
+			fn(jsonMatch{loc: match.loc.child(key), node: match.node.Items[i]})
+		}
+	case JSONArray:
+		for i, item := range match.node.Items {
+			fn(jsonMatch{loc: match.loc.child(i), node: item})
+		}
 	}
+}
 
-	path = normalizePath(path)
-	val, ok := getAtPath(value.JSON(), path)
-	if !ok {
-		return 0, false
+func (step jsonStep) apply(match jsonMatch, root *JSONNode, out []jsonMatch) []jsonMatch {
+	for _, sel := range step.selectors {
+		out = sel.apply(match, root, out)
+	}
+	return out
+}
+
+func (sel jsonSelector) apply(match jsonMatch, root *JSONNode, out []jsonMatch) []jsonMatch {
+	node := match.node
+	switch sel.kind {
+	case selectKey:
+		if node.Kind == JSONObject {
+			if value, exists := node.Get(sel.key); exists {
+				out = append(out, jsonMatch{loc: match.loc.child(sel.key), node: value})
+			}
+		}
+	case selectIndex:
+		if node.Kind == JSONArray {
+			i := sel.index
+			if i < 0 {
+				i += len(node.Items)
+			}
+			if i >= 0 && i < len(node.Items) {
+				out = append(out, jsonMatch{loc: match.loc.child(i), node: node.Items[i]})
+			}
+		}
+	case selectWildcard:
+		forEachChild(match, func(child jsonMatch) {
+			out = append(out, child)
+		})
+	case selectSlice:
+		if node.Kind == JSONArray {
+			for _, i := range sel.sliceIndexes(len(node.Items)) {
+				out = append(out, jsonMatch{loc: match.loc.child(i), node: node.Items[i]})
+			}
+		}
+	case selectFilter:
+		forEachChild(match, func(child jsonMatch) {
+			if sel.filter.test(child.node, root) {
+				out = append(out, child)
+			}
+		})
 	}
+	return out
+}
 
-	obj, ok := val.(map[string]interface{})
-	if !ok {
-		return 0, false
+// sliceIndexes returns the indexes selected by start:end:step in an array of
+// the given length
+func (sel jsonSelector) sliceIndexes(length int) []int {
+	step := 1
+	if sel.step != nil {
+		step = *sel.step
+	}
+	if step == 0 {
+		return nil
 	}
 
-	return len(obj), true
-}
+	normalize := func(i int) int {
+		if i < 0 {
+			return length + i
+		}
+		return i
+	}
 
-// Helper functions
+	var indexes []int
+	if step > 0 {
+		lower, upper := 0, length
+		if sel.start != nil {
+			lower = max(0, min(normalize(*sel.start), length))
+		}
+		if sel.end != nil {
+			upper = max(0, min(normalize(*sel.end), length))
+		}
+		for i := lower; i < upper; i += step {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
 
-func normalizePath(path string) string {
-	if path == "" || path == "." {
-		return "$"
+	upper, lower := length-1, -1
+	if sel.start != nil {
+		upper = max(-1, min(normalize(*sel.start), length-1))
 	}
-	// Convert dot notation to JSONPath
-	if !strings.HasPrefix(path, "$") && !strings.HasPrefix(path, ".") {
-		path = "$." + path
+	if sel.end != nil {
+		lower = max(-1, min(normalize(*sel.end), length-1))
 	}
-	if strings.HasPrefix(path, ".") {
-		path = "$" + path
+	for i := upper; i > lower; i += step {
+		indexes = append(indexes, i)
 	}
-	return path
+	return indexes
 }
 
-func getAtPath(root interface{}, path string) (interface{}, bool) {
-	if path == "$" || path == "." {
-		return root, true
-	}
+// jsonExpr is a filter expression tested against the current value @
+type jsonExpr interface {
+	test(current, root *JSONNode) bool
+}
 
-	// Parse path - remove $ prefix
-	path = strings.TrimPrefix(path, "$")
-	path = strings.TrimPrefix(path, ".")
+type jsonOr struct{ left, right jsonExpr }
 
-	parts := parsePath(path)
-	current := root
+func (e jsonOr) test(current, root *JSONNode) bool {
+	return e.left.test(current, root) || e.right.test(current, root)
+}
 
-	for _, part := range parts {
-		if part == "" {
-			continue
-		}
+type jsonAnd struct{ left, right jsonExpr }
 
-		// Check for array index
-		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
-			indexStr := part[1 : len(part)-1]
-			index, err := strconv.Atoi(indexStr)
-			if err != nil {
-				return nil, false
-			}
+func (e jsonAnd) test(current, root *JSONNode) bool {
+	return e.left.test(current, root) && e.right.test(current, root)
+}
 
-			arr, ok := current.([]interface{})
-			if !ok {
-				return nil, false
-			}
+type jsonNot struct{ expr jsonExpr }
 
-			if index < 0 {
-				index = len(arr) + index
-			}
-			if index < 0 || index >= len(arr) {
-				return nil, false
-			}
-			current = arr[index]
-		} else {
-			obj, ok := current.(map[string]interface{})
-			if !ok {
-				return nil, false
+func (e jsonNot) test(current, root *JSONNode) bool {
+	return !e.expr.test(current, root)
+}
+
+// jsonExists tests that a path matches something, or that a literal is
+// neither false nor null
+type jsonExists struct{ operand jsonOperand }
+
+func (e jsonExists) test(current, root *JSONNode) bool {
+	value, ok := e.operand.resolve(current, root)
+	if e.operand.path {
+		return ok
+	}
+	return value.Kind != JSONNull && !(value.Kind == JSONBool && !value.Bool)
+}
+
+type jsonCompare struct {
+	op          string
+	left, right jsonOperand
+	pattern     *regexp.Regexp
+}
+
+func (e jsonCompare) test(current, root *JSONNode) bool {
+	a, aok := e.left.resolve(current, root)
+	b, bok := e.right.resolve(current, root)
+	if !aok || !bok {
+		bothMissing := !aok && !bok
+		switch e.op {
+		case "==", "<=", ">=":
+			return bothMissing
+		case "!=":
+			return !bothMissing
+		}
+		return false
+	}
+
+	switch e.op {
+	case "==":
+		return a.Equal(b)
+	case "!=":
+		return !a.Equal(b)
+	case "=~":
+		if a.Kind != JSONString {
+			return false
+		}
+		pattern := e.pattern
+		if pattern == nil {
+			if b.Kind != JSONString {
+				return false
 			}
-			val, exists := obj[part]
-			if !exists {
-				return nil, false
+			var err error
+			if pattern, err = regexp.Compile(b.Str); err != nil {
+				return false
 			}
-			current = val
 		}
+		return pattern.MatchString(a.Str)
 	}
 
-	return current, true
+	cmp, ok := jsonOrder(a, b)
+	if !ok {
+		return (e.op == "<=" || e.op == ">=") && a.Equal(b)
+	}
+	switch e.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
 }
 
-func setAtPath(root interface{}, path string, value interface{}) bool {
-	if path == "$" || path == "." {
-		return false // Can't set root this way
+// jsonOperand is either a literal or a path relative to @ or $ resolving to
+// its first match
+type jsonOperand struct {
+	literal  *JSONNode
+	path     bool
+	relative bool
+	steps    []jsonStep
+}
+
+func (o jsonOperand) resolve(current, root *JSONNode) (*JSONNode, bool) {
+	if !o.path {
+		return o.literal, true
+	}
+	start := root
+	if o.relative {
+		start = current
+	}
+	matches := evalSteps(o.steps, []jsonMatch{{node: start}}, root)
+	if len(matches) == 0 {
+		return nil, false
 	}
+	return matches[0].node, true
+}
 
-	path = strings.TrimPrefix(path, "$")
-	path = strings.TrimPrefix(path, ".")
+// jsonOrder compares two numbers or two strings
+func jsonOrder(a, b *JSONNode) (int, bool) {
+	switch {
+	case a.Kind == JSONInt && b.Kind == JSONInt:
+		return cmpOrdered(a.Int, b.Int), true
+	case a.IsNumber() && b.IsNumber():
+		return cmpOrdered(a.Number(), b.Number()), true
+	case a.Kind == JSONString && b.Kind == JSONString:
+		return strings.Compare(a.Str, b.Str), true
+	}
+	return 0, false
+}
 
-	parts := parsePath(path)
-	if len(parts) == 0 {
-		return false
+func cmpOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
+	return 0
+}
 
-	// Navigate to parent
-	current := root
-	for i := 0; i < len(parts)-1; i++ {
-		part := parts[i]
-		if part == "" {
-			continue
-		}
+type jsonPathParser struct {
+	input string
+	pos   int
+}
 
-		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
-			indexStr := part[1 : len(part)-1]
-			index, err := strconv.Atoi(indexStr)
-			if err != nil {
-				return false
-			}
+func (p *jsonPathParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
 
-			arr, ok := current.([]interface{})
-			if !ok {
-				return false
-			}
+func (p *jsonPathParser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
 
-			if index < 0 {
-				index = len(arr) + index
+func (p *jsonPathParser) consume(token string) bool {
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *jsonPathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("ERR invalid JSONPath at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// parseSteps parses dot and bracket segments until the input or, inside a
+// filter, the path operand ends
+func (p *jsonPathParser) parseSteps(inFilter bool) ([]jsonStep, error) {
+	var steps []jsonStep
+	for {
+		var step jsonStep
+		switch {
+		case p.consume(".."):
+			step.descend = true
+			if p.peek() == '[' {
+				sels, err := p.parseBracket()
+				if err != nil {
+					return nil, err
+				}
+				step.selectors = sels
+			} else {
+				sel, err := p.parseDotSelector()
+				if err != nil {
+					return nil, err
+				}
+				step.selectors = []jsonSelector{sel}
 			}
-			if index < 0 || index >= len(arr) {
-				return false
+		case p.consume("."):
+			sel, err := p.parseDotSelector()
+			if err != nil {
+				return nil, err
 			}
-			current = arr[index]
-		} else {
-			obj, ok := current.(map[string]interface{})
-			if !ok {
-				return false
+			step.selectors = []jsonSelector{sel}
+		case p.peek() == '[':
+			sels, err := p.parseBracket()
+			if err != nil {
+				return nil, err
 			}
-			if _, exists := obj[part]; !exists {
-				// Create intermediate object
-				obj[part] = make(map[string]interface{})
+			step.selectors = sels
+		default:
+			if !inFilter && p.pos < len(p.input) {
+				return nil, p.errorf("unexpected '%c'", p.peek())
 			}
-			current = obj[part]
+			return steps, nil
 		}
+		steps = append(steps, step)
 	}
+}
 
-	// Set the final value
-	lastPart := parts[len(parts)-1]
+func (p *jsonPathParser) parseDotSelector() (jsonSelector, error) {
+	if p.consume("*") {
+		return jsonSelector{kind: selectWildcard}, nil
+	}
+	start := p.pos
+	for p.pos < len(p.input) && strings.IndexByte(".[]()<>=!&|,'\" \t\r\n", p.input[p.pos]) < 0 {
+		p.pos++
+	}
+	if p.pos == start {
+		return jsonSelector{}, p.errorf("expected a member name")
+	}
+	return jsonSelector{kind: selectKey, key: p.input[start:p.pos]}, nil
+}
 
-	if strings.HasPrefix(lastPart, "[") && strings.HasSuffix(lastPart, "]") {
-		indexStr := lastPart[1 : len(lastPart)-1]
-		index, err := strconv.Atoi(indexStr)
+func (p *jsonPathParser) parseBracket() ([]jsonSelector, error) {
+	p.pos++
+	var sels []jsonSelector
+	for {
+		p.skipSpaces()
+		sel, err := p.parseSelector()
 		if err != nil {
-			return false
+			return nil, err
 		}
-
-		arr, ok := current.([]interface{})
-		if !ok {
-			return false
+		sels = append(sels, sel)
+		p.skipSpaces()
+		switch {
+		case p.consume(","):
+		case p.consume("]"):
+			return sels, nil
+		default:
+			return nil, p.errorf("expected ',' or ']'")
 		}
+	}
+}
 
-		if index < 0 {
-			index = len(arr) + index
+func (p *jsonPathParser) parseSelector() (jsonSelector, error) {
+	switch c := p.peek(); {
+	case c == '*':
+		p.pos++
+		return jsonSelector{kind: selectWildcard}, nil
+	case c == '\'' || c == '"':
+		key, err := p.parseString()
+		if err != nil {
+			return jsonSelector{}, err
 		}
-		if index < 0 || index >= len(arr) {
-			return false
+		return jsonSelector{kind: selectKey, key: key}, nil
+	case c == '?':
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return jsonSelector{}, err
 		}
-		arr[index] = value
-	} else {
-		obj, ok := current.(map[string]interface{})
-		if !ok {
-			return false
+		return jsonSelector{kind: selectFilter, filter: expr}, nil
+	}
+
+	start, err := p.parseOptionalInt()
+	if err != nil {
+		return jsonSelector{}, err
+	}
+	p.skipSpaces()
+	if !p.consume(":") {
+		if start == nil {
+			return jsonSelector{}, p.errorf("expected a selector")
 		}
-		obj[lastPart] = value
+		return jsonSelector{kind: selectIndex, index: *start}, nil
 	}
 
-	return true
+	sel := jsonSelector{kind: selectSlice, start: start}
+	if sel.end, err = p.parseOptionalInt(); err != nil {
+		return jsonSelector{}, err
+	}
+	p.skipSpaces()
+	if p.consume(":") {
+		if sel.step, err = p.parseOptionalInt(); err != nil {
+			return jsonSelector{}, err
+		}
+	}
+	return sel, nil
 }
 
-func deleteAtPath(root interface{}, path string) bool {
-	if path == "$" || path == "." {
-		return false
+func (p *jsonPathParser) parseOptionalInt() (*int, error) {
+	p.skipSpaces()
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
 	}
-
-	path = strings.TrimPrefix(path, "$")
-	path = strings.TrimPrefix(path, ".")
-
-	parts := parsePath(path)
-	if len(parts) == 0 {
-		return false
+	for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, nil
 	}
+	n, err := strconv.Atoi(p.input[start:p.pos])
+	if err != nil {
+		return nil, p.errorf("invalid integer '%s'", p.input[start:p.pos])
+	}
+	return &n, nil
+}
 
-	// Navigate to parent
-	current := root
-	for i := 0; i < len(parts)-1; i++ {
-		part := parts[i]
-		if part == "" {
-			continue
+func (p *jsonPathParser) parseString() (string, error) {
+	quote := p.input[p.pos]
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return sb.String(), nil
+		case c != '\\':
+			sb.WriteByte(c)
+		case p.pos >= len(p.input):
+			return "", p.errorf("unterminated string")
+		default:
+			esc := p.input[p.pos]
+			p.pos++
+			switch esc {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if p.pos+4 > len(p.input) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.input[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				sb.WriteByte(esc)
+			}
 		}
+	}
+	return "", p.errorf("unterminated string")
+}
 
-		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
-			indexStr := part[1 : len(part)-1]
-			index, err := strconv.Atoi(indexStr)
-			if err != nil {
-				return false
-			}
+func (p *jsonPathParser) parseOr() (jsonExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = jsonOr{left, right}
+	}
+}
 
-			arr, ok := current.([]interface{})
-			if !ok {
-				return false
-			}
+func (p *jsonPathParser) parseAnd() (jsonExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("&&") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = jsonAnd{left, right}
+	}
+}
 
-			if index < 0 {
-				index = len(arr) + index
-			}
-			if index < 0 || index >= len(arr) {
-				return false
-			}
-			current = arr[index]
-		} else {
-			obj, ok := current.(map[string]interface{})
-			if !ok {
-				return false
-			}
-			val, exists := obj[part]
-			if !exists {
-				return false
-			}
-			current = val
+func (p *jsonPathParser) parseUnary() (jsonExpr, error) {
+	p.skipSpaces()
+	if p.peek() == '!' && !strings.HasPrefix(p.input[p.pos:], "!=") {
+		p.pos++
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return jsonNot{expr}, nil
+	}
+	if p.consume("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if !p.consume(")") {
+			return nil, p.errorf("expected ')'")
 		}
+		return expr, nil
 	}
+	return p.parseComparison()
+}
 
-	// Delete the final value
-	lastPart := parts[len(parts)-1]
+func (p *jsonPathParser) parseComparison() (jsonExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
 
-	if strings.HasPrefix(lastPart, "[") && strings.HasSuffix(lastPart, "]") {
-		// Can't delete array element with this simple implementation
-		return false
+	op := ""
+	for _, candidate := range []string{"==", "!=", "<=", ">=", "=~", "<", ">"} {
+		if p.consume(candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return jsonExists{left}, nil
 	}
 
-	obj, ok := current.(map[string]interface{})
-	if !ok {
-		return false
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
 	}
-	if _, exists := obj[lastPart]; !exists {
-		return false
+	cmp := jsonCompare{op: op, left: left, right: right}
+	if op == "=~" && !right.path {
+		if right.literal.Kind != JSONString {
+			return nil, p.errorf("regular expression must be a string")
+		}
+		if cmp.pattern, err = regexp.Compile(right.literal.Str); err != nil {
+			return nil, p.errorf("invalid regular expression")
+		}
 	}
-	delete(obj, lastPart)
-	return true
+	return cmp, nil
 }
 
-func parsePath(path string) []string {
-	var parts []string
-	var current strings.Builder
-	inBracket := false
-
-	for _, ch := range path {
-		switch ch {
-		case '.':
-			if !inBracket {
-				if current.Len() > 0 {
-					parts = append(parts, current.String())
-					current.Reset()
-				}
-			} else {
-				current.WriteRune(ch)
-			}
-		case '[':
-			if current.Len() > 0 {
-				parts = append(parts, current.String())
-				current.Reset()
-			}
-			current.WriteRune(ch)
-			inBracket = true
-		case ']':
-			current.WriteRune(ch)
-			parts = append(parts, current.String())
-			current.Reset()
-			inBracket = false
-		default:
-			current.WriteRune(ch)
+func (p *jsonPathParser) parseOperand() (jsonOperand, error) {
+	p.skipSpaces()
+	switch c := p.peek(); {
+	case c == '@' || c == '$':
+		p.pos++
+		steps, err := p.parseSteps(true)
+		if err != nil {
+			return jsonOperand{}, err
+		}
+		return jsonOperand{path: true, relative: c == '@', steps: steps}, nil
+	case c == '\'' || c == '"':
+		str, err := p.parseString()
+		if err != nil {
+			return jsonOperand{}, err
+		}
+		return jsonOperand{literal: &JSONNode{Kind: JSONString, Str: str}}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE+-", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		num, err := parseJSONNumber(p.input[start:p.pos])
+		if err != nil {
+			return jsonOperand{}, p.errorf("invalid number '%s'", p.input[start:p.pos])
 		}
+		return jsonOperand{literal: num}, nil
 	}
 
-	if current.Len() > 0 {
-		parts = append(parts, current.String())
+	for word, literal := range map[string]*JSONNode{
+		"true":  {Kind: JSONBool, Bool: true},
+		"false": {Kind: JSONBool},
+		"null":  {Kind: JSONNull},
+	} {
+		if p.consume(word) {
+			return jsonOperand{literal: literal}, nil
+		}
 	}
-
-	return parts
+	return jsonOperand{}, p.errorf("expected an operand")
 }
 
-func deepCopy(v interface{}) interface{} {
-	if v == nil {
-		return nil
+// mergePatch applies an RFC 7386 merge patch to target, which may be
+// modified in place
+func mergePatch(target, patch *JSONNode) *JSONNode {
+	if patch.Kind != JSONObject {
+		return patch.Clone()
 	}
 
-	switch val := v.(type) {
-	case map[string]interface{}:
-		result := make(map[string]interface{})
-		for k, v := range val {
-			result[k] = deepCopy(v)
+	if target == nil || target.Kind != JSONObject {
+		target = &JSONNode{Kind: JSONObject}
+	}
+	for i, key := range patch.Keys {
+		value := patch.Items[i]
+		if value.Kind == JSONNull {
+			target.Delete(key)
+			continue
 		}
-		return result
-	case []interface{}:
-		result := make([]interface{}, len(val))
-		for i, v := range val {
-			result[i] = deepCopy(v)
+		existing, _ := target.Get(key)
+		target.Set(key, mergePatch(existing, value))
+	}
+	return target
+}
+
+// jsonMemoryUsage estimates the bytes held by a value: the node itself plus
+// the contents of its string, keys and items
+func jsonMemoryUsage(node *JSONNode) int {
+	size := int(unsafe.Sizeof(JSONNode{}))
+	switch node.Kind {
+	case JSONString:
+		size += len(node.Str)
+	case JSONArray, JSONObject:
+		size += cap(node.Items) * int(unsafe.Sizeof(node))
+		for i, item := range node.Items {
+			size += jsonMemoryUsage(item)
+			if node.Kind == JSONObject {
+				size += int(unsafe.Sizeof("")) + len(node.Keys[i])
+			}
 		}
-		return result
-	default:
-		return v
 	}
+	return size
 }
 
-func getJSONType(v interface{}) string {
-	if v == nil {
+func getJSONType(node *JSONNode) string {
+	switch node.Kind {
+	case JSONNull:
 		return "null"
-	}
-	switch v.(type) {
-	case bool:
+	case JSONBool:
 		return "boolean"
-	case float64, int, int64:
+	case JSONInt:
+		return "integer"
+	case JSONFloat:
 		return "number"
-	case string:
+	case JSONString:
 		return "string"
-	case []interface{}:
+	case JSONArray:
 		return "array"
-	case map[string]interface{}:
+	case JSONObject:
 		return "object"
-	default:
-		return "unknown"
 	}
+	return "unknown"
 }
-
-func toFloat64(v interface{}) (float64, bool) {
-	switch val := v.(type) {
-	case float64:
-		return val, true
-	case int:
-		return float64(val), true
-	case int64:
-		return float64(val), true
-	default:
-		return 0, false
-	}
-}
-
@@ -0,0 +1,488 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// JSONKind is the type of a JSON node
+type JSONKind uint8
+
+const (
+	JSONNull JSONKind = iota
+	JSONBool
+	JSONInt
+	JSONFloat
+	JSONString
+	JSONArray
+	JSONObject
+)
+
+// jsonIndexThreshold is the number of object members above which lookups go
+// through a name index instead of a linear scan
+const jsonIndexThreshold = 16
+
+// JSONNode is a JSON value. Integers and floats are kept apart so integers
+// keep their full int64 precision. Arrays hold their elements in Items;
+// objects hold their member names in Keys, in insertion order, with the
+// values at the same positions in Items.
+type JSONNode struct {
+	Kind  JSONKind
+	Bool  bool
+	Int   int64
+	Float float64
+	Str   string
+	Keys  []string
+	Items []*JSONNode
+
+	index map[string]int
+}
+
+// ParseJSON parses JSON text into a node tree
+func ParseJSON(text string) (*JSONNode, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+
+	node, err := parseJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("ERR invalid JSON value")
+	}
+	return node, nil
+}
+
+func parseJSONValue(dec *json.Decoder) (*JSONNode, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, errors.New("ERR invalid JSON value")
+	}
+
+	switch t := token.(type) {
+	case nil:
+		return &JSONNode{Kind: JSONNull}, nil
+	case bool:
+		return &JSONNode{Kind: JSONBool, Bool: t}, nil
+	case string:
+		return &JSONNode{Kind: JSONString, Str: t}, nil
+	case json.Number:
+		return parseJSONNumber(string(t))
+	case json.Delim:
+		node := &JSONNode{Kind: JSONArray}
+		if t == '{' {
+			node.Kind = JSONObject
+		}
+		for dec.More() {
+			var key string
+			if node.Kind == JSONObject {
+				keyToken, err := dec.Token()
+				if err != nil {
+					return nil, errors.New("ERR invalid JSON value")
+				}
+				key, _ = keyToken.(string)
+			}
+			item, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			if node.Kind == JSONObject {
+				node.Set(key, item)
+			} else {
+				node.Items = append(node.Items, item)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, errors.New("ERR invalid JSON value")
+		}
+		return node, nil
+	}
+	return nil, errors.New("ERR invalid JSON value")
+}
+
+// parseJSONNumber keeps numbers without a fraction or exponent as integers
+// unless they overflow int64
+func parseJSONNumber(text string) (*JSONNode, error) {
+	if !strings.ContainsAny(text, ".eE") {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return &JSONNode{Kind: JSONInt, Int: n}, nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, errors.New("ERR invalid JSON value")
+	}
+	return &JSONNode{Kind: JSONFloat, Float: f}, nil
+}
+
+// IsNumber reports whether the node is an integer or a float
+func (n *JSONNode) IsNumber() bool {
+	return n.Kind == JSONInt || n.Kind == JSONFloat
+}
+
+// Number returns the value of a numeric node as a float
+func (n *JSONNode) Number() float64 {
+	if n.Kind == JSONInt {
+		return float64(n.Int)
+	}
+	return n.Float
+}
+
+// Get returns the value of an object member
+func (n *JSONNode) Get(key string) (*JSONNode, bool) {
+	i := n.keyIndex(key)
+	if i < 0 {
+		return nil, false
+	}
+	return n.Items[i], true
+}
+
+// Set replaces an object member or appends it if it does not exist
+func (n *JSONNode) Set(key string, value *JSONNode) {
+	if i := n.keyIndex(key); i >= 0 {
+		n.Items[i] = value
+		return
+	}
+	n.Keys = append(n.Keys, key)
+	n.Items = append(n.Items, value)
+	if n.index != nil {
+		n.index[key] = len(n.Keys) - 1
+	} else if len(n.Keys) > jsonIndexThreshold {
+		n.reindex()
+	}
+}
+
+// Delete removes an object member
+func (n *JSONNode) Delete(key string) bool {
+	i := n.keyIndex(key)
+	if i < 0 {
+		return false
+	}
+	n.Keys = append(n.Keys[:i], n.Keys[i+1:]...)
+	n.Items = append(n.Items[:i], n.Items[i+1:]...)
+	if n.index != nil {
+		n.reindex()
+	}
+	return true
+}
+
+// Clear removes all elements or members
+func (n *JSONNode) Clear() {
+	n.Keys, n.Items, n.index = nil, nil, nil
+}
+
+func (n *JSONNode) keyIndex(key string) int {
+	if n.index != nil {
+		if i, ok := n.index[key]; ok {
+			return i
+		}
+		return -1
+	}
+	for i, k := range n.Keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (n *JSONNode) reindex() {
+	if len(n.Keys) <= jsonIndexThreshold {
+		n.index = nil
+		return
+	}
+	n.index = make(map[string]int, len(n.Keys))
+	for i, k := range n.Keys {
+		n.index[k] = i
+	}
+}
+
+// Clone returns a deep copy of the node
+func (n *JSONNode) Clone() *JSONNode {
+	clone := *n
+	if n.Keys != nil {
+		clone.Keys = append([]string(nil), n.Keys...)
+	}
+	if n.Items != nil {
+		clone.Items = make([]*JSONNode, len(n.Items))
+		for i, item := range n.Items {
+			clone.Items[i] = item.Clone()
+		}
+	}
+	if n.index != nil {
+		clone.index = make(map[string]int, len(n.index))
+		for k, i := range n.index {
+			clone.index[k] = i
+		}
+	}
+	return &clone
+}
+
+// Equal reports whether two nodes hold the same value, comparing integers
+// and floats by numeric value
+func (n *JSONNode) Equal(other *JSONNode) bool {
+	if n.IsNumber() && other.IsNumber() {
+		if n.Kind == JSONInt && other.Kind == JSONInt {
+			return n.Int == other.Int
+		}
+		return n.Number() == other.Number()
+	}
+	if n.Kind != other.Kind {
+		return false
+	}
+
+	switch n.Kind {
+	case JSONBool:
+		return n.Bool == other.Bool
+	case JSONString:
+		return n.Str == other.Str
+	case JSONArray:
+		if len(n.Items) != len(other.Items) {
+			return false
+		}
+		for i, item := range n.Items {
+			if !item.Equal(other.Items[i]) {
+				return false
+			}
+		}
+	case JSONObject:
+		if len(n.Keys) != len(other.Keys) {
+			return false
+		}
+		for i, key := range n.Keys {
+			value, ok := other.Get(key)
+			if !ok || !n.Items[i].Equal(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String returns the node as JSON text
+func (n *JSONNode) String() string {
+	return string(n.AppendJSON(nil))
+}
+
+// MarshalJSON implements json.Marshaler
+func (n *JSONNode) MarshalJSON() ([]byte, error) {
+	return n.AppendJSON(nil), nil
+}
+
+// AppendJSON appends the node as JSON text to buf. Floats always carry a
+// fraction or exponent so they parse back as floats.
+func (n *JSONNode) AppendJSON(buf []byte) []byte {
+	switch n.Kind {
+	case JSONNull:
+		return append(buf, "null"...)
+	case JSONBool:
+		return strconv.AppendBool(buf, n.Bool)
+	case JSONInt:
+		return strconv.AppendInt(buf, n.Int, 10)
+	case JSONFloat:
+		start := len(buf)
+		buf = strconv.AppendFloat(buf, n.Float, 'g', -1, 64)
+		if !bytes.ContainsAny(buf[start:], ".eEnN") {
+			buf = append(buf, ".0"...)
+		}
+		return buf
+	case JSONString:
+		return appendJSONString(buf, n.Str)
+	case JSONArray:
+		buf = append(buf, '[')
+		for i, item := range n.Items {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = item.AppendJSON(buf)
+		}
+		return append(buf, ']')
+	case JSONObject:
+		buf = append(buf, '{')
+		for i, key := range n.Keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			buf = n.Items[i].AppendJSON(buf)
+		}
+		return append(buf, '}')
+	}
+	return buf
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
+
+// jsonBinaryVersion starts every binary encoded document. It can never start
+// JSON text, which lets snapshots written as text still be read.
+const jsonBinaryVersion = 0x01
+
+// encodeJSONNode returns the compact binary encoding of a document: a kind
+// byte per node followed by a bool byte, a varint integer, the eight bytes
+// of a float, or a length prefixed string, array or object
+func encodeJSONNode(n *JSONNode) []byte {
+	return n.appendBinary([]byte{jsonBinaryVersion})
+}
+
+func (n *JSONNode) appendBinary(buf []byte) []byte {
+	buf = append(buf, byte(n.Kind))
+	switch n.Kind {
+	case JSONBool:
+		if n.Bool {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case JSONInt:
+		return binary.AppendVarint(buf, n.Int)
+	case JSONFloat:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(n.Float))
+	case JSONString:
+		buf = binary.AppendUvarint(buf, uint64(len(n.Str)))
+		return append(buf, n.Str...)
+	case JSONArray:
+		buf = binary.AppendUvarint(buf, uint64(len(n.Items)))
+		for _, item := range n.Items {
+			buf = item.appendBinary(buf)
+		}
+	case JSONObject:
+		buf = binary.AppendUvarint(buf, uint64(len(n.Keys)))
+		for i, key := range n.Keys {
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+			buf = n.Items[i].appendBinary(buf)
+		}
+	}
+	return buf
+}
+
+// decodeJSONNode decodes a document stored either in the binary encoding or
+// as JSON text
+func decodeJSONNode(data []byte) (*JSONNode, error) {
+	if len(data) == 0 || data[0] != jsonBinaryVersion {
+		return ParseJSON(string(data))
+	}
+	d := &jsonDecoder{data: data[1:]}
+	node, err := d.node()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) != 0 {
+		return nil, errJSONEncoding
+	}
+	return node, nil
+}
+
+var errJSONEncoding = errors.New("ERR invalid JSON encoding")
+
+type jsonDecoder struct {
+	data []byte
+}
+
+func (d *jsonDecoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, errJSONEncoding
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func (d *jsonDecoder) string() (string, error) {
+	length, err := d.uvarint()
+	if err != nil || length > uint64(len(d.data)) {
+		return "", errJSONEncoding
+	}
+	s := string(d.data[:length])
+	d.data = d.data[length:]
+	return s, nil
+}
+
+func (d *jsonDecoder) node() (*JSONNode, error) {
+	if len(d.data) == 0 {
+		return nil, errJSONEncoding
+	}
+	node := &JSONNode{Kind: JSONKind(d.data[0])}
+	d.data = d.data[1:]
+
+	switch node.Kind {
+	case JSONNull:
+	case JSONBool:
+		if len(d.data) == 0 {
+			return nil, errJSONEncoding
+		}
+		node.Bool = d.data[0] != 0
+		d.data = d.data[1:]
+	case JSONInt:
+		v, n := binary.Varint(d.data)
+		if n <= 0 {
+			return nil, errJSONEncoding
+		}
+		node.Int = v
+		d.data = d.data[n:]
+	case JSONFloat:
+		if len(d.data) < 8 {
+			return nil, errJSONEncoding
+		}
+		node.Float = math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+		d.data = d.data[8:]
+	case JSONString:
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		node.Str = s
+	case JSONArray, JSONObject:
+		count, err := d.uvarint()
+		if err != nil || count > uint64(len(d.data)) {
+			return nil, errJSONEncoding
+		}
+		for i := uint64(0); i < count; i++ {
+			var key string
+			if node.Kind == JSONObject {
+				if key, err = d.string(); err != nil {
+					return nil, err
+				}
+			}
+			item, err := d.node()
+			if err != nil {
+				return nil, err
+			}
+			if node.Kind == JSONObject {
+				node.Set(key, item)
+			} else {
+				node.Items = append(node.Items, item)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ERR unknown JSON node kind %d", node.Kind)
+	}
+	return node, nil
+}
@@ -7,23 +7,25 @@ import (
 func (s *Store) LPush(key string, values ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
-	if !exists {
-		db.data[key] = ListValue(values)
-		return len(values)
-	} else if value.Type != ListType {
-		return -1
+	var oldList []string
+	if exists {
+		if value.Type != ListType {
+			return -1
+		}
+		oldList = value.List()
 	}
 	
-	oldList := value.List()
 	newList := make([]string, 0, len(oldList)+len(values))
 	for i := len(values) - 1; i >= 0; i-- {
 		newList = append(newList, values[i])
 	}
 	newList = append(newList, oldList...)
-	db.data[key] = ListValue(newList)
+	s.setKey(db, key, ListValue(newList))
+	s.notify(db, ListEvent, "lpush", key)
 	
 	return len(newList)
 }
@@ -31,11 +33,13 @@ func (s *Store) LPush(key string, values ...string) int {
 func (s *Store) RPush(key string, values ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
 	if !exists {
-		db.data[key] = ListValue(values)
+		s.setKey(db, key, ListValue(append([]string(nil), values...)))
+		s.notify(db, ListEvent, "rpush", key)
 		return len(values)
 	} else if value.Type != ListType {
 		return -1
@@ -44,6 +48,7 @@ func (s *Store) RPush(key string, values ...string) int {
 	oldList := value.List()
 	newList := append(oldList, values...)
 	db.data[key] = ListValue(newList)
+	s.notify(db, ListEvent, "rpush", key)
 	return len(newList)
 }
 
@@ -65,8 +70,9 @@ func (s *Store) LPop(key string) (string, bool) {
 	
 	result := list[0]
 	newList := list[1:]
+	s.notify(db, ListEvent, "lpop", key)
 	if len(newList) == 0 {
-		delete(db.data, key)
+		s.removeKey(db, key)
 	} else {
 		db.data[key] = ListValue(newList)
 	}
@@ -93,8 +99,9 @@ func (s *Store) RPop(key string) (string, bool) {
 	lastIndex := len(list) - 1
 	result := list[lastIndex]
 	newList := list[:lastIndex]
+	s.notify(db, ListEvent, "rpop", key)
 	if len(newList) == 0 {
-		delete(db.data, key)
+		s.removeKey(db, key)
 	} else {
 		db.data[key] = ListValue(newList)
 	}
@@ -103,12 +110,12 @@ func (s *Store) RPop(key string) (string, bool) {
 }
 
 func (s *Store) LLen(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ListType {
 		return 0
 	}
@@ -117,12 +124,12 @@ func (s *Store) LLen(key string) int {
 }
 
 func (s *Store) LRange(key string, start, stop int) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ListType {
 		return []string{}
 	}
@@ -154,12 +161,12 @@ func (s *Store) LRange(key string, start, stop int) []string {
 }
 
 func (s *Store) LIndex(key string, index int) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ListType {
 		return "", false
 	}
@@ -204,12 +211,14 @@ func (s *Store) LSet(key string, index int, value string) bool {
 	copy(newList, list)
 	newList[index] = value
 	db.data[key] = ListValue(newList)
+	s.notify(db, ListEvent, "lset", key)
 	return true
 }
 
 func (s *Store) LTrim(key string, start, stop int) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
@@ -231,7 +240,8 @@ func (s *Store) LTrim(key string, start, stop int) bool {
 		start = 0
 	}
 	if start >= length || stop < start {
-		delete(db.data, key)
+		s.notify(db, ListEvent, "ltrim", key)
+		s.removeKey(db, key)
 		return true
 	}
 	if stop >= length {
@@ -240,12 +250,14 @@ func (s *Store) LTrim(key string, start, stop int) bool {
 	
 	newList := list[start : stop+1]
 	db.data[key] = ListValue(newList)
+	s.notify(db, ListEvent, "ltrim", key)
 	return true
 }
 
 func (s *Store) LInsert(key, where, pivot, value string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	redisValue, exists := db.data[key]
@@ -268,6 +280,7 @@ func (s *Store) LInsert(key, where, pivot, value string) int {
 				newList = append(newList, list[i+1:]...)
 			}
 			db.data[key] = ListValue(newList)
+			s.notify(db, ListEvent, "linsert", key)
 			return len(newList)
 		}
 	}
@@ -288,8 +301,9 @@ func (s *Store) BLPop(keys []string, timeout int) (string, string, bool) {
 			if len(list) > 0 {
 				result := list[0]
 				newList := list[1:]
+				s.notify(db, ListEvent, "lpop", key)
 				if len(newList) == 0 {
-					delete(db.data, key)
+					s.removeKey(db, key)
 				} else {
 					db.data[key] = ListValue(newList)
 				}
@@ -315,8 +329,9 @@ func (s *Store) BRPop(keys []string, timeout int) (string, string, bool) {
 				lastIndex := len(list) - 1
 				result := list[lastIndex]
 				newList := list[:lastIndex]
+				s.notify(db, ListEvent, "rpop", key)
 				if len(newList) == 0 {
-					delete(db.data, key)
+					s.removeKey(db, key)
 				} else {
 					db.data[key] = ListValue(newList)
 				}
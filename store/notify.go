@@ -0,0 +1,72 @@
+package store
+
+// KeyspaceEventClass is the notify-keyspace-events flag selecting an event
+type KeyspaceEventClass byte
+
+const (
+	GenericEvent KeyspaceEventClass = 'g'
+	StringEvent  KeyspaceEventClass = '$'
+	ListEvent    KeyspaceEventClass = 'l'
+	SetEvent     KeyspaceEventClass = 's'
+	HashEvent    KeyspaceEventClass = 'h'
+	ZSetEvent    KeyspaceEventClass = 'z'
+	StreamEvent  KeyspaceEventClass = 't'
+	ExpiredEvent KeyspaceEventClass = 'x'
+	EvictedEvent KeyspaceEventClass = 'e'
+	KeyMissEvent KeyspaceEventClass = 'm'
+	NewKeyEvent  KeyspaceEventClass = 'n'
+)
+
+// KeyspaceNotifier receives the events raised on keys. It runs with the
+// store locked, so it must not call back into the store.
+type KeyspaceNotifier func(class KeyspaceEventClass, event string, db int, key string)
+
+func (s *Store) SetKeyspaceNotifier(notifier KeyspaceNotifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifier = notifier
+}
+
+func (s *Store) notify(db *Database, class KeyspaceEventClass, event, key string) {
+	if s.notifier == nil {
+		return
+	}
+	s.notifier(class, event, s.dbIndex(db), key)
+}
+
+// dbIndex finds the number db is selected by, which SWAPDB may change
+func (s *Store) dbIndex(db *Database) int {
+	for i, candidate := range s.databases {
+		if candidate == db {
+			return i
+		}
+	}
+	return s.currentDB
+}
+
+// setKey stores value at key, raising a new event when key did not exist
+func (s *Store) setKey(db *Database, key string, value *RedisValue) {
+	if _, exists := db.data[key]; !exists {
+		s.notify(db, NewKeyEvent, "new", key)
+	}
+	db.data[key] = value
+}
+
+// removeKey deletes a key a command emptied or removed, raising a del event
+func (s *Store) removeKey(db *Database, key string) {
+	delete(db.data, key)
+	delete(db.expiration, key)
+	delete(db.hashFieldTTLKeys, key)
+	s.indexKey(db, key)
+	s.notify(db, GenericEvent, "del", key)
+}
+
+// lookupRead finds key for a command reading it, raising a keymiss event
+// when it does not exist
+func (s *Store) lookupRead(db *Database, key string) (*RedisValue, bool) {
+	value, exists := db.data[key]
+	if !exists {
+		s.notify(db, KeyMissEvent, "keymiss", key)
+	}
+	return value, exists
+}
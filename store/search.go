@@ -0,0 +1,988 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Search indexes cover the HASH or JSON documents whose keys start with one
+// of their prefixes. They live in the database they were created in and are
+// updated synchronously by every command that changes a covered key.
+
+type SearchFieldType int
+
+const (
+	SearchText SearchFieldType = iota
+	SearchTag
+	SearchNumeric
+	SearchGeo
+	SearchVector
+)
+
+func (t SearchFieldType) String() string {
+	switch t {
+	case SearchText:
+		return "TEXT"
+	case SearchTag:
+		return "TAG"
+	case SearchNumeric:
+		return "NUMERIC"
+	case SearchGeo:
+		return "GEO"
+	case SearchVector:
+		return "VECTOR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// SearchField is one attribute of an index schema
+type SearchField struct {
+	Identifier    string // hash field or JSONPath the value is read from
+	Name          string // attribute name used in queries
+	Type          SearchFieldType
+	Weight        float64
+	Separator     string
+	CaseSensitive bool
+	Sortable      bool
+	NoIndex       bool
+	Vector        *SearchVectorParams
+}
+
+// SearchDefinition describes an index as given to FT.CREATE
+type SearchDefinition struct {
+	Name            string
+	On              DataType
+	Prefixes        []string
+	Stopwords       []string
+	CustomStopwords bool
+	Fields          []SearchField
+}
+
+var (
+	ErrSearchIndexExists  = errors.New("ERR Index already exists")
+	ErrSearchUnknownIndex = errors.New("ERR Unknown Index name")
+)
+
+var defaultSearchStopwords = []string{
+	"a", "is", "the", "an", "and", "are", "as", "at", "be", "but", "by", "for",
+	"if", "in", "into", "it", "no", "not", "of", "on", "or", "such", "that",
+	"their", "then", "there", "these", "they", "this", "to", "was", "will", "with",
+}
+
+// ParseSearchDefinition parses the arguments of FT.CREATE
+func ParseSearchDefinition(args []string) (*SearchDefinition, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'FT.CREATE' command")
+	}
+	def := &SearchDefinition{Name: args[0], On: HashType}
+
+	count := func(i int, option string) (int, error) {
+		if i+1 >= len(args) {
+			return 0, fmt.Errorf("ERR Bad arguments for %s: Expected an argument", option)
+		}
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil || n < 0 || i+1+n >= len(args) {
+			return 0, fmt.Errorf("ERR Bad arguments for %s: Value is not a valid count", option)
+		}
+		return n, nil
+	}
+
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ON":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR Bad arguments for ON: Expected an argument")
+			}
+			i++
+			switch strings.ToUpper(args[i]) {
+			case "HASH":
+				def.On = HashType
+			case "JSON":
+				def.On = JSONType
+			default:
+				return nil, fmt.Errorf("ERR Invalid ON type '%s'", args[i])
+			}
+		case "PREFIX":
+			n, err := count(i, "PREFIX")
+			if err != nil {
+				return nil, err
+			}
+			def.Prefixes = append(def.Prefixes, args[i+2:i+2+n]...)
+			i += 1 + n
+		case "STOPWORDS":
+			n, err := count(i, "STOPWORDS")
+			if err != nil {
+				return nil, err
+			}
+			def.CustomStopwords = true
+			for _, word := range args[i+2 : i+2+n] {
+				def.Stopwords = append(def.Stopwords, strings.ToLower(word))
+			}
+			i += 1 + n
+		case "SCHEMA":
+			fields, err := parseSearchSchema(args[i+1:], def.On)
+			if err != nil {
+				return nil, err
+			}
+			def.Fields = fields
+			return def, nil
+		default:
+			return nil, fmt.Errorf("ERR Unknown argument `%s`", args[i])
+		}
+	}
+	return nil, fmt.Errorf("ERR No schema found")
+}
+
+func parseSearchSchema(args []string, on DataType) ([]SearchField, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR Fields arguments are missing")
+	}
+
+	var fields []SearchField
+	for i := 0; i < len(args); {
+		field := SearchField{Identifier: args[i], Name: args[i], Weight: 1, Separator: ","}
+		if on == JSONType {
+			if _, err := compileJSONPath(field.Identifier); err != nil {
+				return nil, fmt.Errorf("ERR Invalid JSONPath '%s'", field.Identifier)
+			}
+		}
+		i++
+		if i+1 < len(args) && strings.EqualFold(args[i], "AS") {
+			field.Name = args[i+1]
+			i += 2
+		}
+		if i >= len(args) {
+			return nil, fmt.Errorf("ERR Field `%s` is missing a type", field.Name)
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "TEXT":
+			field.Type = SearchText
+		case "TAG":
+			field.Type = SearchTag
+		case "NUMERIC":
+			field.Type = SearchNumeric
+		case "GEO":
+			field.Type = SearchGeo
+		case "VECTOR":
+			field.Type = SearchVector
+			params, next, err := parseSearchVector(args, i+1, field.Name)
+			if err != nil {
+				return nil, err
+			}
+			field.Vector = params
+			i = next - 1
+		default:
+			return nil, fmt.Errorf("ERR Invalid field type for field `%s`", field.Name)
+		}
+		i++
+
+	options:
+		for i < len(args) && field.Type != SearchVector {
+			switch strings.ToUpper(args[i]) {
+			case "SORTABLE":
+				field.Sortable = true
+				if i+1 < len(args) && strings.EqualFold(args[i+1], "UNF") {
+					i++
+				}
+			case "NOINDEX":
+				field.NoIndex = true
+			case "NOSTEM":
+				if field.Type != SearchText {
+					break options
+				}
+			case "WEIGHT":
+				if field.Type != SearchText {
+					break options
+				}
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("ERR Bad arguments for WEIGHT: Expected an argument")
+				}
+				weight, err := strconv.ParseFloat(args[i+1], 64)
+				if err != nil || weight < 0 {
+					return nil, fmt.Errorf("ERR Bad arguments for WEIGHT: Could not convert argument to expected type")
+				}
+				field.Weight = weight
+				i++
+			case "SEPARATOR":
+				if field.Type != SearchTag {
+					break options
+				}
+				if i+1 >= len(args) || len(args[i+1]) != 1 {
+					return nil, fmt.Errorf("ERR Tag separator must be a single character")
+				}
+				field.Separator = args[i+1]
+				i++
+			case "CASESENSITIVE":
+				if field.Type != SearchTag {
+					break options
+				}
+				field.CaseSensitive = true
+			default:
+				break options
+			}
+			i++
+		}
+
+		for _, existing := range fields {
+			if existing.Name == field.Name {
+				return nil, fmt.Errorf("ERR Duplicate field in schema - %s", field.Name)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Args returns the FT.CREATE arguments recreating the index
+func (def *SearchDefinition) Args() []string {
+	args := []string{def.Name, "ON", "HASH"}
+	if def.On == JSONType {
+		args[2] = "JSON"
+	}
+	if len(def.Prefixes) > 0 {
+		args = append(args, "PREFIX", strconv.Itoa(len(def.Prefixes)))
+		args = append(args, def.Prefixes...)
+	}
+	if def.CustomStopwords {
+		args = append(args, "STOPWORDS", strconv.Itoa(len(def.Stopwords)))
+		args = append(args, def.Stopwords...)
+	}
+
+	args = append(args, "SCHEMA")
+	for _, field := range def.Fields {
+		args = append(args, field.Identifier)
+		if field.Name != field.Identifier {
+			args = append(args, "AS", field.Name)
+		}
+		args = append(args, field.Type.String())
+		switch field.Type {
+		case SearchText:
+			if field.Weight != 1 {
+				args = append(args, "WEIGHT", strconv.FormatFloat(field.Weight, 'f', -1, 64))
+			}
+		case SearchTag:
+			if field.Separator != "," {
+				args = append(args, "SEPARATOR", field.Separator)
+			}
+			if field.CaseSensitive {
+				args = append(args, "CASESENSITIVE")
+			}
+		case SearchVector:
+			args = append(args, field.Vector.args()...)
+		}
+		if field.Sortable {
+			args = append(args, "SORTABLE")
+		}
+		if field.NoIndex {
+			args = append(args, "NOINDEX")
+		}
+	}
+	return args
+}
+
+// searchIndex holds the inverted index of one search definition
+type searchIndex struct {
+	def       *SearchDefinition
+	paths     []*jsonPath
+	stopwords map[string]bool
+	docs      map[string]*searchDoc
+	terms     map[string]map[string]*searchPosting // term -> key -> posting
+	tags      []map[string]map[string]bool         // field -> tag -> keys
+	graphs    []*hnswGraph                         // field -> HNSW graph
+	nextID    uint64
+	failures  int
+}
+
+// searchDoc holds what an index extracted from one document
+type searchDoc struct {
+	id      uint64
+	key     string
+	terms   map[string]*searchPosting
+	tags    map[int][]string
+	numbers map[int][]float64
+	points  map[int][]searchPoint
+	vectors map[int][]float64
+	sortKey map[int]string
+}
+
+// searchPosting records where a term occurs in a document, as token
+// positions per field
+type searchPosting struct {
+	positions map[int][]int
+}
+
+type searchPoint struct {
+	lon, lat float64
+}
+
+func newSearchIndex(def *SearchDefinition) *searchIndex {
+	idx := &searchIndex{
+		def:       def,
+		paths:     make([]*jsonPath, len(def.Fields)),
+		stopwords: make(map[string]bool),
+		docs:      make(map[string]*searchDoc),
+		terms:     make(map[string]map[string]*searchPosting),
+		tags:      make([]map[string]map[string]bool, len(def.Fields)),
+		graphs:    make([]*hnswGraph, len(def.Fields)),
+	}
+	stopwords := defaultSearchStopwords
+	if def.CustomStopwords {
+		stopwords = def.Stopwords
+	}
+	for _, word := range stopwords {
+		idx.stopwords[word] = true
+	}
+	for i, field := range def.Fields {
+		if def.On == JSONType {
+			idx.paths[i], _ = compileJSONPath(field.Identifier)
+		}
+		if field.Type == SearchTag {
+			idx.tags[i] = make(map[string]map[string]bool)
+		}
+		if field.Type == SearchVector && field.Vector.Algorithm == "HNSW" {
+			idx.graphs[i] = newHNSWGraph(field.Vector)
+		}
+	}
+	return idx
+}
+
+// covers reports whether the index is interested in key
+func (idx *searchIndex) covers(key string) bool {
+	if len(idx.def.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range idx.def.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValues returns the values of field i in a document. ok is false when
+// a value has the wrong type for the field, which fails the whole document.
+func (idx *searchIndex) fieldValues(i int, value *RedisValue, hash map[string]string) ([]string, bool) {
+	field := idx.def.Fields[i]
+	if value.Type == HashType {
+		v, exists := hash[field.Identifier]
+		if !exists {
+			return nil, true
+		}
+		return []string{v}, true
+	}
+
+	var values []string
+	var add func(node *JSONNode, nested bool) bool
+	add = func(node *JSONNode, nested bool) bool {
+		switch node.Kind {
+		case JSONNull:
+			return true
+		case JSONString:
+			if field.Type == SearchNumeric {
+				return false
+			}
+			values = append(values, node.Str)
+		case JSONInt, JSONFloat:
+			if field.Type != SearchNumeric {
+				return false
+			}
+			values = append(values, node.String())
+		case JSONBool:
+			if field.Type != SearchTag {
+				return false
+			}
+			values = append(values, strconv.FormatBool(node.Bool))
+		case JSONArray:
+			if nested || field.Type == SearchGeo {
+				return false
+			}
+			for _, item := range node.Items {
+				if !add(item, true) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+
+	for _, match := range idx.paths[i].eval(value.JSON()) {
+		if !add(match.node, false) {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// add indexes a document, replacing any earlier version of it
+func (idx *searchIndex) add(key string, value *RedisValue) {
+	doc := &searchDoc{
+		key:     key,
+		terms:   make(map[string]*searchPosting),
+		tags:    make(map[int][]string),
+		numbers: make(map[int][]float64),
+		points:  make(map[int][]searchPoint),
+		vectors: make(map[int][]float64),
+		sortKey: make(map[int]string),
+	}
+
+	var hash map[string]string
+	if value.Type == HashType {
+		hash = value.Hash()
+	}
+
+	for i, field := range idx.def.Fields {
+		if field.Type == SearchVector {
+			vector, ok := idx.vectorValue(i, value, hash)
+			if !ok {
+				idx.failures++
+				return
+			}
+			if vector != nil {
+				doc.vectors[i] = vector
+			}
+			continue
+		}
+
+		values, ok := idx.fieldValues(i, value, hash)
+		if !ok {
+			idx.failures++
+			return
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		switch field.Type {
+		case SearchText:
+			doc.sortKey[i] = strings.ToLower(values[0])
+			if field.NoIndex {
+				continue
+			}
+			position := 0
+			for _, v := range values {
+				for _, token := range tokenizeSearchText(v) {
+					if idx.stopwords[token] {
+						continue
+					}
+					posting, exists := doc.terms[token]
+					if !exists {
+						posting = &searchPosting{positions: make(map[int][]int)}
+						doc.terms[token] = posting
+					}
+					posting.positions[i] = append(posting.positions[i], position)
+					position++
+				}
+			}
+		case SearchTag:
+			var tags []string
+			for _, v := range values {
+				for _, tag := range strings.Split(v, field.Separator) {
+					if tag = strings.TrimSpace(tag); tag == "" {
+						continue
+					}
+					if !field.CaseSensitive {
+						tag = strings.ToLower(tag)
+					}
+					tags = append(tags, tag)
+				}
+			}
+			if len(tags) > 0 {
+				doc.sortKey[i] = tags[0]
+			}
+			if !field.NoIndex {
+				doc.tags[i] = tags
+			}
+		case SearchNumeric:
+			for _, v := range values {
+				n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil {
+					idx.failures++
+					return
+				}
+				doc.numbers[i] = append(doc.numbers[i], n)
+			}
+		case SearchGeo:
+			for _, v := range values {
+				point, ok := parseSearchPoint(v)
+				if !ok {
+					idx.failures++
+					return
+				}
+				doc.points[i] = append(doc.points[i], point)
+			}
+		}
+	}
+
+	idx.nextID++
+	doc.id = idx.nextID
+	idx.docs[key] = doc
+	for term, posting := range doc.terms {
+		postings, exists := idx.terms[term]
+		if !exists {
+			postings = make(map[string]*searchPosting)
+			idx.terms[term] = postings
+		}
+		postings[key] = posting
+	}
+	for i, tags := range doc.tags {
+		for _, tag := range tags {
+			keys, exists := idx.tags[i][tag]
+			if !exists {
+				keys = make(map[string]bool)
+				idx.tags[i][tag] = keys
+			}
+			keys[key] = true
+		}
+	}
+	for i, vector := range doc.vectors {
+		if idx.graphs[i] != nil {
+			idx.graphs[i].insert(key, vector)
+		}
+	}
+}
+
+// remove drops a document from the index
+func (idx *searchIndex) remove(key string) {
+	doc, exists := idx.docs[key]
+	if !exists {
+		return
+	}
+	delete(idx.docs, key)
+	for term := range doc.terms {
+		delete(idx.terms[term], key)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+	for i, tags := range doc.tags {
+		for _, tag := range tags {
+			delete(idx.tags[i][tag], key)
+			if len(idx.tags[i][tag]) == 0 {
+				delete(idx.tags[i], tag)
+			}
+		}
+	}
+	for i := range doc.vectors {
+		if idx.graphs[i] != nil {
+			idx.graphs[i].remove(key)
+		}
+	}
+}
+
+// update brings the index in line with the current value of key
+func (idx *searchIndex) update(db *Database, key string) {
+	idx.remove(key)
+	value, exists := db.data[key]
+	if exists && value.Type == idx.def.On && idx.covers(key) {
+		idx.add(key, value)
+	}
+}
+
+// indexKey updates every index of db after key was written or removed
+func (s *Store) indexKey(db *Database, key string) {
+	for _, idx := range db.indexes {
+		idx.update(db, key)
+	}
+}
+
+// buildSearchIndex creates an index over the documents already in db
+func buildSearchIndex(db *Database, def *SearchDefinition) *searchIndex {
+	idx := newSearchIndex(def)
+	keys := make([]string, 0, len(db.data))
+	for key := range db.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		idx.update(db, key)
+	}
+	return idx
+}
+
+// tokenizeSearchText splits text into lowercase terms on punctuation and
+// whitespace
+func tokenizeSearchText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// parseSearchPoint parses a "lon,lat" coordinate pair
+func parseSearchPoint(text string) (searchPoint, bool) {
+	lonText, latText, found := strings.Cut(text, ",")
+	if !found {
+		return searchPoint{}, false
+	}
+	lon, err1 := strconv.ParseFloat(strings.TrimSpace(lonText), 64)
+	lat, err2 := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	if err1 != nil || err2 != nil || lon < -180 || lon > 180 || lat < -85.05112878 || lat > 85.05112878 {
+		return searchPoint{}, false
+	}
+	return searchPoint{lon: lon, lat: lat}, true
+}
+
+// distance returns the great-circle distance in meters between two points
+func (p searchPoint) distance(other searchPoint) float64 {
+	const earthRadius = 6372797.560856
+	lat1, lat2 := p.lat*math.Pi/180, other.lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.lon - p.lon) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// CreateSearchIndex creates an index and indexes the existing documents
+func (s *Store) CreateSearchIndex(def *SearchDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	if _, exists := db.indexes[def.Name]; exists {
+		return ErrSearchIndexExists
+	}
+	db.indexes[def.Name] = buildSearchIndex(db, def)
+	return nil
+}
+
+// DropSearchIndex removes an index, and with deleteDocs the documents it
+// covers
+func (s *Store) DropSearchIndex(name string, deleteDocs bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	idx, exists := db.indexes[name]
+	if !exists {
+		return ErrSearchUnknownIndex
+	}
+	delete(db.indexes, name)
+
+	if deleteDocs {
+		for key := range idx.docs {
+			s.removeKey(db, key)
+		}
+	}
+	return nil
+}
+
+// SearchIndexNames returns the names of the indexes in the current database
+func (s *Store) SearchIndexNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	names := make([]string, 0, len(db.indexes))
+	for name := range db.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SearchIndexDefinitions returns the definitions of the indexes in the
+// current database
+func (s *Store) SearchIndexDefinitions() []*SearchDefinition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return searchDefinitions(s.getCurrentDB())
+}
+
+func searchDefinitions(db *Database) []*SearchDefinition {
+	defs := make([]*SearchDefinition, 0, len(db.indexes))
+	for _, idx := range db.indexes {
+		defs = append(defs, idx.def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
+
+// SearchIndexInfo describes an index for FT.INFO
+type SearchIndexInfo struct {
+	Definition       *SearchDefinition
+	NumDocs          int
+	MaxDocID         uint64
+	NumTerms         int
+	NumRecords       int
+	IndexingFailures int
+}
+
+// SearchIndexInfo returns statistics about an index
+func (s *Store) SearchIndexInfo(name string) (*SearchIndexInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	idx, exists := db.indexes[name]
+	if !exists {
+		return nil, ErrSearchUnknownIndex
+	}
+
+	info := &SearchIndexInfo{
+		Definition:       idx.def,
+		NumDocs:          len(idx.docs),
+		MaxDocID:         idx.nextID,
+		NumTerms:         len(idx.terms),
+		IndexingFailures: idx.failures,
+	}
+	for _, postings := range idx.terms {
+		info.NumRecords += len(postings)
+	}
+	for _, tags := range idx.tags {
+		for _, keys := range tags {
+			info.NumRecords += len(keys)
+		}
+	}
+	return info, nil
+}
+
+// SearchOptions controls how FT.SEARCH builds its reply
+type SearchOptions struct {
+	NoContent  bool
+	WithScores bool
+	Offset     int
+	Limit      int
+	SortBy     string
+	SortDesc   bool
+	Return     []SearchReturnField // nil returns the whole document
+	Params     map[string]string   // values of $name query parameters
+}
+
+// SearchReturnField is a field requested with RETURN, read from an
+// attribute, hash field or JSONPath and reported under Name
+type SearchReturnField struct {
+	Identifier string
+	Name       string
+}
+
+// SearchResult is the reply of FT.SEARCH
+type SearchResult struct {
+	Total int
+	Hits  []SearchHit
+}
+
+// SearchHit is a matched document. Fields alternates names and values.
+type SearchHit struct {
+	Key    string
+	Score  float64
+	Fields []string
+}
+
+// Search runs a query against an index
+func (s *Store) Search(name, query string, opts SearchOptions) (*SearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	idx, exists := db.indexes[name]
+	if !exists {
+		return nil, ErrSearchUnknownIndex
+	}
+
+	node, err := parseSearchQuery(idx, query, opts.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	knn, isKNN := node.(searchKNN)
+	byDistance := isKNN && (opts.SortBy == "" || strings.TrimPrefix(opts.SortBy, "@") == knn.alias)
+	sortField := -1
+	if opts.SortBy != "" && !byDistance {
+		if sortField = idx.fieldIndex(opts.SortBy); sortField < 0 {
+			return nil, fmt.Errorf("ERR Property `%s` not loaded nor in schema", opts.SortBy)
+		}
+	}
+
+	s.expireSearchDocs(db, idx)
+	matches := node.eval(idx)
+	docs := make([]*searchDoc, 0, len(matches))
+	for key := range matches {
+		docs = append(docs, idx.docs[key])
+	}
+	order := matches
+	if byDistance && !opts.SortDesc {
+		order = make(map[string]float64, len(matches))
+		for key, distance := range matches {
+			order[key] = -distance
+		}
+	}
+	sortSearchDocs(docs, order, sortField, opts.SortDesc)
+
+	result := &SearchResult{Total: len(docs)}
+	start := min(max(opts.Offset, 0), len(docs))
+	end := min(start+max(opts.Limit, 0), len(docs))
+	for _, doc := range docs[start:end] {
+		hit := SearchHit{Key: doc.key, Score: matches[doc.key]}
+		if !opts.NoContent {
+			var computed map[string]string
+			if isKNN {
+				computed = map[string]string{knn.alias: strconv.FormatFloat(matches[doc.key], 'g', 12, 64)}
+			}
+			hit.Fields = idx.loadFields(db.data[doc.key], opts.Return, computed)
+		}
+		result.Hits = append(result.Hits, hit)
+	}
+	return result, nil
+}
+
+// expireSearchDocs removes indexed documents whose key or hash fields have
+// expired so queries never see them
+func (s *Store) expireSearchDocs(db *Database, idx *searchIndex) {
+	var expiring []string
+	for key := range idx.docs {
+		if _, ok := db.expiration[key]; ok || db.hashFieldTTLKeys[key] {
+			expiring = append(expiring, key)
+		}
+	}
+	for _, key := range expiring {
+		s.cleanupExpired(key)
+	}
+}
+
+func (idx *searchIndex) fieldIndex(name string) int {
+	name = strings.TrimPrefix(name, "@")
+	for i, field := range idx.def.Fields {
+		if field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortSearchDocs orders documents by descending score, or by a field with
+// missing values last, breaking ties by indexing order
+func sortSearchDocs(docs []*searchDoc, scores map[string]float64, field int, desc bool) {
+	sort.Slice(docs, func(i, j int) bool {
+		a, b := docs[i], docs[j]
+		if field >= 0 {
+			av, aok := searchSortValue(a, field)
+			bv, bok := searchSortValue(b, field)
+			if aok != bok {
+				return aok
+			}
+			if c := compareSearchValues(av, bv); aok && c != 0 {
+				if desc {
+					return c > 0
+				}
+				return c < 0
+			}
+		} else if scores[a.key] != scores[b.key] {
+			return scores[a.key] > scores[b.key]
+		}
+		return a.id < b.id
+	})
+}
+
+// searchSortValue returns the value a document sorts by for a field
+func searchSortValue(doc *searchDoc, field int) (interface{}, bool) {
+	if numbers := doc.numbers[field]; len(numbers) > 0 {
+		return numbers[0], true
+	}
+	if key, ok := doc.sortKey[field]; ok {
+		return key, true
+	}
+	return nil, false
+}
+
+// compareSearchValues orders two sort values of the same field
+func compareSearchValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmpOrdered(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+	return 0
+}
+
+// loadFields returns the fields of a document as alternating names and
+// values: every hash field, the whole JSON document as "$", or the
+// requested fields. Computed values such as KNN distances come first.
+func (idx *searchIndex) loadFields(value *RedisValue, fields []SearchReturnField, computed map[string]string) []string {
+	var hash map[string]string
+	if value.Type == HashType {
+		hash = value.Hash()
+	}
+
+	if fields == nil {
+		result := make([]string, 0, len(computed)*2+len(hash)*2)
+		for _, name := range sortedKeys(computed) {
+			result = append(result, name, computed[name])
+		}
+		if value.Type == JSONType {
+			return append(result, "$", value.JSON().String())
+		}
+		for _, name := range sortedKeys(hash) {
+			result = append(result, name, hash[name])
+		}
+		return result
+	}
+
+	result := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		if v, ok := computed[strings.TrimPrefix(field.Identifier, "@")]; ok {
+			result = append(result, field.Name, v)
+			continue
+		}
+		identifier := field.Identifier
+		if i := idx.fieldIndex(identifier); i >= 0 {
+			identifier = idx.def.Fields[i].Identifier
+		}
+		if v, ok := searchDocumentValue(value, hash, identifier); ok {
+			result = append(result, field.Name, v)
+		}
+	}
+	return result
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// searchDocumentValue reads a hash field or a JSONPath from a document.
+// A single JSON string is returned as is, other JSON values as JSON text.
+func searchDocumentValue(value *RedisValue, hash map[string]string, identifier string) (string, bool) {
+	if value.Type == HashType {
+		v, ok := hash[identifier]
+		return v, ok
+	}
+
+	p, err := compileJSONPath(identifier)
+	if err != nil {
+		return "", false
+	}
+	matches := p.eval(value.JSON())
+	switch {
+	case len(matches) == 0:
+		return "", false
+	case len(matches) == 1 && matches[0].node.Kind == JSONString:
+		return matches[0].node.Str, true
+	case len(matches) == 1:
+		return matches[0].node.String(), true
+	}
+	nodes := &JSONNode{Kind: JSONArray, Items: make([]*JSONNode, len(matches))}
+	for i, match := range matches {
+		nodes.Items[i] = match.node
+	}
+	return nodes.String(), true
+}
@@ -0,0 +1,707 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A search query is parsed into a tree of searchNodes. Evaluating a node
+// returns the keys of the matching documents with their scores.
+
+type searchNode interface {
+	eval(idx *searchIndex) map[string]float64
+}
+
+// searchAll matches every document
+type searchAll struct{}
+
+func (searchAll) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64, len(idx.docs))
+	for key := range idx.docs {
+		result[key] = 0
+	}
+	return result
+}
+
+// searchNone matches nothing, e.g. a query made of stopwords only
+type searchNone struct{}
+
+func (searchNone) eval(*searchIndex) map[string]float64 {
+	return map[string]float64{}
+}
+
+// searchIntersect matches documents matching every required node. Optional
+// nodes only add to the score.
+type searchIntersect struct {
+	nodes    []searchNode
+	optional []searchNode
+}
+
+func (n searchIntersect) eval(idx *searchIndex) map[string]float64 {
+	var result map[string]float64
+	for _, node := range n.nodes {
+		matches := node.eval(idx)
+		if result == nil {
+			result = matches
+			continue
+		}
+		for key, score := range result {
+			if other, ok := matches[key]; ok {
+				result[key] = score + other
+			} else {
+				delete(result, key)
+			}
+		}
+	}
+	if result == nil {
+		result = searchAll{}.eval(idx)
+	}
+	for _, node := range n.optional {
+		for key, score := range node.eval(idx) {
+			if current, ok := result[key]; ok {
+				result[key] = current + score
+			}
+		}
+	}
+	return result
+}
+
+// searchUnion matches documents matching any node
+type searchUnion struct {
+	nodes []searchNode
+}
+
+func (n searchUnion) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	for _, node := range n.nodes {
+		for key, score := range node.eval(idx) {
+			result[key] += score
+		}
+	}
+	return result
+}
+
+// searchNot matches documents not matching its node
+type searchNot struct {
+	node searchNode
+}
+
+func (n searchNot) eval(idx *searchIndex) map[string]float64 {
+	excluded := n.node.eval(idx)
+	result := make(map[string]float64)
+	for key := range idx.docs {
+		if _, ok := excluded[key]; !ok {
+			result[key] = 0
+		}
+	}
+	return result
+}
+
+// searchTerms matches documents containing the terms, adjacent and in
+// order when phrase is set, in any of the fields. nil fields means every
+// TEXT field.
+type searchTerms struct {
+	terms  []string
+	fields []int
+	phrase bool
+}
+
+func (n searchTerms) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	first := idx.terms[n.terms[0]]
+	for key := range first {
+		score := 0.0
+		matched := true
+		for _, term := range n.terms {
+			s, ok := idx.termScore(term, key, n.fields)
+			if !ok {
+				matched = false
+				break
+			}
+			score += s
+		}
+		if matched && (!n.phrase || idx.adjacent(n.terms, key, n.fields)) {
+			result[key] = score
+		}
+	}
+	return result
+}
+
+// searchPrefix matches documents containing a term starting with prefix
+type searchPrefix struct {
+	prefix string
+	fields []int
+}
+
+func (n searchPrefix) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	for term, postings := range idx.terms {
+		if !strings.HasPrefix(term, n.prefix) {
+			continue
+		}
+		for key := range postings {
+			if score, ok := idx.termScore(term, key, n.fields); ok {
+				result[key] += score
+			}
+		}
+	}
+	return result
+}
+
+// searchTags matches documents having any of the tags in a TAG field
+type searchTags struct {
+	field    int
+	tags     []string
+	prefixes []string
+}
+
+func (n searchTags) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	for _, tag := range n.tags {
+		for key := range idx.tags[n.field][tag] {
+			result[key] = 1
+		}
+	}
+	for _, prefix := range n.prefixes {
+		for tag, keys := range idx.tags[n.field] {
+			if strings.HasPrefix(tag, prefix) {
+				for key := range keys {
+					result[key] = 1
+				}
+			}
+		}
+	}
+	return result
+}
+
+// searchRange matches documents with a number of a NUMERIC field in range
+type searchRange struct {
+	field                      int
+	min, max                   float64
+	exclusiveMin, exclusiveMax bool
+}
+
+func (n searchRange) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	for key, doc := range idx.docs {
+		for _, v := range doc.numbers[n.field] {
+			if (v > n.min || (!n.exclusiveMin && v == n.min)) && (v < n.max || (!n.exclusiveMax && v == n.max)) {
+				result[key] = 1
+				break
+			}
+		}
+	}
+	return result
+}
+
+// searchRadius matches documents with a point of a GEO field within radius
+// meters of center
+type searchRadius struct {
+	field  int
+	center searchPoint
+	radius float64
+}
+
+func (n searchRadius) eval(idx *searchIndex) map[string]float64 {
+	result := make(map[string]float64)
+	for key, doc := range idx.docs {
+		for _, point := range doc.points[n.field] {
+			if point.distance(n.center) <= n.radius {
+				result[key] = 1
+				break
+			}
+		}
+	}
+	return result
+}
+
+// termScore scores a term in a document with TF-IDF, weighting each
+// occurrence by the weight of its field
+func (idx *searchIndex) termScore(term, key string, fields []int) (float64, bool) {
+	posting, ok := idx.terms[term][key]
+	if !ok {
+		return 0, false
+	}
+
+	frequency := 0.0
+	for field, positions := range posting.positions {
+		if fields == nil || containsInt(fields, field) {
+			frequency += float64(len(positions)) * idx.def.Fields[field].Weight
+		}
+	}
+	if frequency == 0 {
+		return 0, false
+	}
+	idf := math.Log(1 + float64(len(idx.docs))/float64(len(idx.terms[term])))
+	return frequency * idf, true
+}
+
+// adjacent reports whether the terms appear one after another in one field
+func (idx *searchIndex) adjacent(terms []string, key string, fields []int) bool {
+	first := idx.terms[terms[0]][key]
+	for field, positions := range first.positions {
+		if fields != nil && !containsInt(fields, field) {
+			continue
+		}
+		for _, start := range positions {
+			found := true
+			for offset, term := range terms[1:] {
+				if !containsInt(idx.terms[term][key].positions[field], start+offset+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// searchQueryParser parses the query syntax:
+//
+//	hello world        documents containing both terms
+//	hello | world      documents containing either term
+//	-hello             documents not containing the term
+//	~hello             optional term, only adds to the score
+//	"hello world"      exact phrase
+//	hel*               prefix
+//	@title:hello       term in a TEXT field, also @a|b:(...)
+//	@tags:{a | b*}     TAG values
+//	@price:[10 (20]    NUMERIC range, ( for exclusive bounds, -inf/+inf
+//	@loc:[lon lat r m] GEO radius in m, km, mi or ft
+//	*                  every document
+//
+// A whole query may be followed by =>[KNN k @field $vector] to return the
+// k nearest of its matches.
+type searchQueryParser struct {
+	idx    *searchIndex
+	input  string
+	pos    int
+	params map[string]string
+}
+
+func parseSearchQuery(idx *searchIndex, query string, params map[string]string) (searchNode, error) {
+	p := &searchQueryParser{idx: idx, input: query, params: params}
+	node, err := p.parseUnion(nil)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.atKNN() {
+		p.pos += 2
+		if node, err = p.parseKNN(node); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+	}
+	if p.pos < len(p.input) {
+		return nil, p.syntaxError()
+	}
+	return node, nil
+}
+
+func (p *searchQueryParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// atKNN reports whether the input continues with the => of a KNN clause
+func (p *searchQueryParser) atKNN() bool {
+	return strings.HasPrefix(p.input[p.pos:], "=>")
+}
+
+func (p *searchQueryParser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *searchQueryParser) syntaxError() error {
+	if p.pos >= len(p.input) {
+		return fmt.Errorf("ERR Syntax error at offset %d near end of query", p.pos)
+	}
+	return fmt.Errorf("ERR Syntax error at offset %d near %s", p.pos, p.input[p.pos:])
+}
+
+func (p *searchQueryParser) parseUnion(fields []int) (searchNode, error) {
+	node, err := p.parseIntersect(fields)
+	if err != nil {
+		return nil, err
+	}
+	union := searchUnion{nodes: []searchNode{node}}
+	for {
+		p.skipSpaces()
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+		node, err := p.parseIntersect(fields)
+		if err != nil {
+			return nil, err
+		}
+		union.nodes = append(union.nodes, node)
+	}
+	if len(union.nodes) == 1 {
+		return union.nodes[0], nil
+	}
+	return union, nil
+}
+
+func (p *searchQueryParser) parseIntersect(fields []int) (searchNode, error) {
+	var intersect searchIntersect
+	parsed := false
+	for {
+		p.skipSpaces()
+		if c := p.peek(); c == 0 || c == ')' || c == '|' || p.atKNN() {
+			break
+		}
+		optional := false
+		if p.peek() == '~' {
+			optional = true
+			p.pos++
+		}
+		node, err := p.parseUnary(fields)
+		if err != nil {
+			return nil, err
+		}
+		parsed = true
+		switch {
+		case node == nil:
+		case optional:
+			intersect.optional = append(intersect.optional, node)
+		default:
+			intersect.nodes = append(intersect.nodes, node)
+		}
+	}
+
+	switch {
+	case !parsed:
+		return nil, p.syntaxError()
+	case len(intersect.nodes) == 0 && len(intersect.optional) == 0:
+		return searchNone{}, nil
+	case len(intersect.nodes) == 1 && len(intersect.optional) == 0:
+		return intersect.nodes[0], nil
+	}
+	return intersect, nil
+}
+
+// parseUnary returns a nil node for a term that is a stopword
+func (p *searchQueryParser) parseUnary(fields []int) (searchNode, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		node, err := p.parseUnary(fields)
+		if err != nil || node == nil {
+			return node, err
+		}
+		return searchNot{node}, nil
+	case '@':
+		return p.parseField()
+	}
+	return p.parseAtom(fields)
+}
+
+// parseField parses @name:expression, or @a|b:expression for TEXT fields
+func (p *searchQueryParser) parseField() (searchNode, error) {
+	p.pos++
+	var fields []int
+	for {
+		start := p.pos
+		for p.pos < len(p.input) && strings.IndexByte(":|", p.input[p.pos]) < 0 && !isSearchSpace(p.input[p.pos]) {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		i := p.idx.fieldIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf("ERR Unknown field '%s'", name)
+		}
+		fields = append(fields, i)
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != ':' {
+		return nil, p.syntaxError()
+	}
+	p.pos++
+	p.skipSpaces()
+
+	field := p.idx.def.Fields[fields[0]]
+	if len(fields) > 1 || field.Type == SearchText {
+		for _, i := range fields {
+			if p.idx.def.Fields[i].Type != SearchText {
+				return nil, p.syntaxError()
+			}
+		}
+		if p.peek() == '-' {
+			p.pos++
+			node, err := p.parseAtom(fields)
+			if err != nil || node == nil {
+				return node, err
+			}
+			return searchNot{node}, nil
+		}
+		return p.parseAtom(fields)
+	}
+
+	var node searchNode
+	var err error
+	switch field.Type {
+	case SearchTag:
+		node, err = p.parseTags(fields[0])
+	case SearchNumeric:
+		node, err = p.parseRange(fields[0])
+	case SearchGeo:
+		node, err = p.parseRadius(fields[0])
+	case SearchVector:
+		return nil, fmt.Errorf("ERR Vector field `%s` can only be queried with KNN", field.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if field.NoIndex {
+		return searchNone{}, nil
+	}
+	return node, nil
+}
+
+func (p *searchQueryParser) parseAtom(fields []int) (searchNode, error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		node, err := p.parseUnion(fields)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.peek() != ')' {
+			return nil, p.syntaxError()
+		}
+		p.pos++
+		return node, nil
+	case '"':
+		return p.parsePhrase(fields)
+	case '*':
+		p.pos++
+		return searchAll{}, nil
+	}
+
+	start := p.pos
+	word := p.parseWord()
+	if word == "" {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+	if p.peek() == '*' {
+		p.pos++
+		return searchPrefix{prefix: strings.ToLower(word), fields: fields}, nil
+	}
+
+	terms := p.filterStopwords(tokenizeSearchText(word))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	nodes := make([]searchNode, len(terms))
+	for i, term := range terms {
+		nodes[i] = searchTerms{terms: []string{term}, fields: fields}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return searchIntersect{nodes: nodes}, nil
+}
+
+// parseWord reads a term, honoring backslash escapes
+func (p *searchQueryParser) parseWord() string {
+	var sb strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '\\' && p.pos+1 < len(p.input) {
+			sb.WriteByte(p.input[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if isSearchSpace(c) || strings.IndexByte("()|{}[]\"@*~:-", c) >= 0 || p.atKNN() {
+			break
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+	return sb.String()
+}
+
+func (p *searchQueryParser) parsePhrase(fields []int) (searchNode, error) {
+	p.pos++
+	end := strings.IndexByte(p.input[p.pos:], '"')
+	if end < 0 {
+		return nil, p.syntaxError()
+	}
+	terms := p.filterStopwords(tokenizeSearchText(p.input[p.pos : p.pos+end]))
+	p.pos += end + 1
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return searchTerms{terms: terms, fields: fields, phrase: true}, nil
+}
+
+func (p *searchQueryParser) parseTags(field int) (searchNode, error) {
+	if p.peek() != '{' {
+		return nil, p.syntaxError()
+	}
+	p.pos++
+
+	node := searchTags{field: field}
+	caseSensitive := p.idx.def.Fields[field].CaseSensitive
+	for {
+		var sb strings.Builder
+		prefix := false
+		for p.pos < len(p.input) && p.input[p.pos] != '|' && p.input[p.pos] != '}' {
+			c := p.input[p.pos]
+			switch {
+			case c == '\\' && p.pos+1 < len(p.input):
+				sb.WriteByte(p.input[p.pos+1])
+				p.pos++
+			case c == '*' && (p.pos+1 >= len(p.input) || strings.IndexByte("|} \t", p.input[p.pos+1]) >= 0):
+				prefix = true
+			default:
+				sb.WriteByte(c)
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			return nil, p.syntaxError()
+		}
+
+		tag := strings.TrimSpace(sb.String())
+		if !caseSensitive {
+			tag = strings.ToLower(tag)
+		}
+		if tag == "" {
+			return nil, p.syntaxError()
+		}
+		if prefix {
+			node.prefixes = append(node.prefixes, tag)
+		} else {
+			node.tags = append(node.tags, tag)
+		}
+
+		c := p.input[p.pos]
+		p.pos++
+		if c == '}' {
+			return node, nil
+		}
+	}
+}
+
+// parseBracket returns the whitespace separated tokens between [ and ]
+func (p *searchQueryParser) parseBracket() ([]string, error) {
+	if p.peek() != '[' {
+		return nil, p.syntaxError()
+	}
+	end := strings.IndexByte(p.input[p.pos:], ']')
+	if end < 0 {
+		return nil, p.syntaxError()
+	}
+	tokens := strings.Fields(strings.ReplaceAll(p.input[p.pos+1:p.pos+end], ",", " "))
+	p.pos += end + 1
+	return tokens, nil
+}
+
+func (p *searchQueryParser) parseRange(field int) (searchNode, error) {
+	start := p.pos
+	tokens, err := p.parseBracket()
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) != 2 {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+
+	node := searchRange{field: field}
+	bounds := []*float64{&node.min, &node.max}
+	exclusive := []*bool{&node.exclusiveMin, &node.exclusiveMax}
+	for i, token := range tokens {
+		if strings.HasPrefix(token, "(") {
+			*exclusive[i] = true
+			token = token[1:]
+		}
+		v, err := parseSearchNumber(token)
+		if err != nil {
+			p.pos = start
+			return nil, p.syntaxError()
+		}
+		*bounds[i] = v
+	}
+	return node, nil
+}
+
+func (p *searchQueryParser) parseRadius(field int) (searchNode, error) {
+	start := p.pos
+	tokens, err := p.parseBracket()
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) != 4 {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+
+	lon, err1 := strconv.ParseFloat(tokens[0], 64)
+	lat, err2 := strconv.ParseFloat(tokens[1], 64)
+	radius, err3 := strconv.ParseFloat(tokens[2], 64)
+	unit, ok := searchDistanceUnits[strings.ToLower(tokens[3])]
+	if err1 != nil || err2 != nil || err3 != nil || !ok || radius < 0 {
+		p.pos = start
+		return nil, p.syntaxError()
+	}
+	return searchRadius{field: field, center: searchPoint{lon: lon, lat: lat}, radius: radius * unit}, nil
+}
+
+var searchDistanceUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.34,
+	"ft": 0.3048,
+}
+
+// parseSearchNumber parses a numeric bound, accepting inf, +inf and -inf
+func parseSearchNumber(text string) (float64, error) {
+	switch strings.ToLower(text) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func (p *searchQueryParser) filterStopwords(terms []string) []string {
+	kept := terms[:0]
+	for _, term := range terms {
+		if !p.idx.stopwords[term] {
+			kept = append(kept, term)
+		}
+	}
+	return kept
+}
+
+func isSearchSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,518 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SearchVectorParams configures a VECTOR attribute
+type SearchVectorParams struct {
+	Algorithm      string // FLAT or HNSW
+	Type           string // FLOAT32 or FLOAT64
+	Dim            int
+	Metric         string // L2, IP or COSINE
+	M              int
+	EFConstruction int
+	EFRuntime      int
+}
+
+// parseSearchVector parses "FLAT|HNSW count name value ..." starting at
+// args[i] and returns the index of the first argument after it
+func parseSearchVector(args []string, i int, name string) (*SearchVectorParams, int, error) {
+	if i+1 >= len(args) {
+		return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity algorithm in field `%s`", name)
+	}
+	params := &SearchVectorParams{Algorithm: strings.ToUpper(args[i]), M: 16, EFConstruction: 200, EFRuntime: 10}
+	if params.Algorithm != "FLAT" && params.Algorithm != "HNSW" {
+		return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity algorithm in field `%s`: unknown algorithm '%s'", name, args[i])
+	}
+	count, err := strconv.Atoi(args[i+1])
+	if err != nil || count < 0 || count%2 != 0 || i+2+count > len(args) {
+		return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity %s argument count in field `%s`", params.Algorithm, name)
+	}
+
+	for j := i + 2; j < i+2+count; j += 2 {
+		option, value := strings.ToUpper(args[j]), args[j+1]
+		switch option {
+		case "TYPE":
+			params.Type = strings.ToUpper(value)
+			if params.Type != "FLOAT32" && params.Type != "FLOAT64" {
+				return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity TYPE in field `%s`: unsupported type '%s'", name, value)
+			}
+		case "DISTANCE_METRIC":
+			params.Metric = strings.ToUpper(value)
+			if _, ok := vectorMetrics[params.Metric]; !ok {
+				return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity DISTANCE_METRIC in field `%s`: unknown metric '%s'", name, value)
+			}
+		case "DIM", "M", "EF_CONSTRUCTION", "EF_RUNTIME", "INITIAL_CAP", "BLOCK_SIZE":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity %s in field `%s`: must be a positive integer", option, name)
+			}
+			switch option {
+			case "DIM":
+				params.Dim = n
+			case "M":
+				params.M = n
+			case "EF_CONSTRUCTION":
+				params.EFConstruction = n
+			case "EF_RUNTIME":
+				params.EFRuntime = n
+			}
+		case "EPSILON":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity EPSILON in field `%s`", name)
+			}
+		default:
+			return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity %s in field `%s`: unknown argument '%s'", params.Algorithm, name, args[j])
+		}
+		if params.Algorithm == "FLAT" && (option == "M" || option == "EF_CONSTRUCTION" || option == "EF_RUNTIME" || option == "EPSILON") {
+			return nil, 0, fmt.Errorf("ERR Bad arguments for vector similarity FLAT in field `%s`: unknown argument '%s'", name, args[j])
+		}
+	}
+
+	if params.Type == "" || params.Dim == 0 || params.Metric == "" {
+		return nil, 0, fmt.Errorf("ERR Missing mandatory parameter: cannot create %s index without specifying TYPE, DIM and DISTANCE_METRIC in field `%s`", params.Algorithm, name)
+	}
+	return params, i + 2 + count, nil
+}
+
+// args returns the FT.CREATE arguments that follow VECTOR
+func (params *SearchVectorParams) args() []string {
+	attrs := []string{"TYPE", params.Type, "DIM", strconv.Itoa(params.Dim), "DISTANCE_METRIC", params.Metric}
+	if params.Algorithm == "HNSW" {
+		attrs = append(attrs,
+			"M", strconv.Itoa(params.M),
+			"EF_CONSTRUCTION", strconv.Itoa(params.EFConstruction),
+			"EF_RUNTIME", strconv.Itoa(params.EFRuntime))
+	}
+	return append([]string{params.Algorithm, strconv.Itoa(len(attrs))}, attrs...)
+}
+
+// blobSize returns the size in bytes of a vector blob
+func (params *SearchVectorParams) blobSize() int {
+	if params.Type == "FLOAT64" {
+		return params.Dim * 8
+	}
+	return params.Dim * 4
+}
+
+// decodeSearchVector reads a blob of little-endian FLOAT32 or FLOAT64 values
+func decodeSearchVector(blob string, params *SearchVectorParams) ([]float64, bool) {
+	if len(blob) != params.blobSize() {
+		return nil, false
+	}
+	size := len(blob) / params.Dim
+	vector := make([]float64, params.Dim)
+	for i := range vector {
+		chunk := []byte(blob[i*size : (i+1)*size])
+		if size == 4 {
+			vector[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(chunk)))
+		} else {
+			vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(chunk))
+		}
+	}
+	return vector, true
+}
+
+// vectorValue reads the vector of field i from a document: a blob in a hash
+// field, or an array of numbers in JSON. ok is false for a malformed value.
+func (idx *searchIndex) vectorValue(i int, value *RedisValue, hash map[string]string) ([]float64, bool) {
+	params := idx.def.Fields[i].Vector
+	if value.Type == HashType {
+		blob, exists := hash[idx.def.Fields[i].Identifier]
+		if !exists {
+			return nil, true
+		}
+		return decodeSearchVector(blob, params)
+	}
+
+	matches := idx.paths[i].eval(value.JSON())
+	if len(matches) == 0 {
+		return nil, true
+	}
+	node := matches[0].node
+	if len(matches) > 1 || node.Kind != JSONArray || len(node.Items) != params.Dim {
+		return nil, false
+	}
+	vector := make([]float64, params.Dim)
+	for j, item := range node.Items {
+		switch item.Kind {
+		case JSONInt, JSONFloat:
+			vector[j], _ = strconv.ParseFloat(item.String(), 64)
+		default:
+			return nil, false
+		}
+	}
+	return vector, true
+}
+
+var vectorMetrics = map[string]func(a, b []float64) float64{
+	"L2":     vectorL2,
+	"IP":     vectorIP,
+	"COSINE": vectorCosine,
+}
+
+// vectorL2 returns the squared euclidean distance
+func vectorL2(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum
+}
+
+func vectorIP(a, b []float64) float64 {
+	dot := 0.0
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot
+}
+
+func vectorCosine(a, b []float64) float64 {
+	dot, normA, normB := 0.0, 0.0, 0.0
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(normA*normB)
+}
+
+// hnswGraph is a hierarchical navigable small world graph over the vectors
+// of one HNSW attribute
+type hnswGraph struct {
+	params   *SearchVectorParams
+	distance func(a, b []float64) float64
+	nodes    map[string]*hnswNode
+	entry    *hnswNode
+	levelMul float64
+	rng      *rand.Rand
+}
+
+type hnswNode struct {
+	key       string
+	vector    []float64
+	neighbors [][]*hnswNode // per level, level 0 first
+}
+
+type hnswCandidate struct {
+	node     *hnswNode
+	distance float64
+}
+
+func newHNSWGraph(params *SearchVectorParams) *hnswGraph {
+	return &hnswGraph{
+		params:   params,
+		distance: vectorMetrics[params.Metric],
+		nodes:    make(map[string]*hnswNode),
+		levelMul: 1 / math.Log(float64(max(params.M, 2))),
+		rng:      rand.New(rand.NewSource(1)),
+	}
+}
+
+func (g *hnswGraph) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * g.params.M
+	}
+	return g.params.M
+}
+
+func (g *hnswGraph) insert(key string, vector []float64) {
+	level := int(-math.Log(1-g.rng.Float64()) * g.levelMul)
+	node := &hnswNode{key: key, vector: vector, neighbors: make([][]*hnswNode, level+1)}
+	g.nodes[key] = node
+	if g.entry == nil {
+		g.entry = node
+		return
+	}
+
+	top := len(g.entry.neighbors) - 1
+	entry := []hnswCandidate{{g.entry, g.distance(vector, g.entry.vector)}}
+	for l := top; l > level; l-- {
+		entry = g.searchLayer(vector, entry, 1, l)
+	}
+	for l := min(level, top); l >= 0; l-- {
+		candidates := g.searchLayer(vector, entry, g.params.EFConstruction, l)
+		for _, c := range candidates[:min(g.params.M, len(candidates))] {
+			node.neighbors[l] = append(node.neighbors[l], c.node)
+			c.node.neighbors[l] = append(c.node.neighbors[l], node)
+			if len(c.node.neighbors[l]) > g.maxNeighbors(l) {
+				g.prune(c.node, l)
+			}
+		}
+		entry = candidates
+	}
+	if level > top {
+		g.entry = node
+	}
+}
+
+// prune keeps the closest neighbors of node at a level
+func (g *hnswGraph) prune(node *hnswNode, level int) {
+	neighbors := node.neighbors[level]
+	sort.SliceStable(neighbors, func(i, j int) bool {
+		return g.distance(node.vector, neighbors[i].vector) < g.distance(node.vector, neighbors[j].vector)
+	})
+	node.neighbors[level] = neighbors[:g.maxNeighbors(level)]
+}
+
+// remove unlinks a node and reconnects its former neighbors with each other
+func (g *hnswGraph) remove(key string) {
+	node, exists := g.nodes[key]
+	if !exists {
+		return
+	}
+	delete(g.nodes, key)
+
+	for l, neighbors := range node.neighbors {
+		for _, neighbor := range neighbors {
+			kept := neighbor.neighbors[l][:0]
+			for _, n := range neighbor.neighbors[l] {
+				if n != node {
+					kept = append(kept, n)
+				}
+			}
+			neighbor.neighbors[l] = kept
+		}
+		for _, neighbor := range neighbors {
+			for _, candidate := range neighbors {
+				if candidate == neighbor || len(neighbor.neighbors[l]) >= g.maxNeighbors(l) || hnswLinked(neighbor, candidate, l) {
+					continue
+				}
+				neighbor.neighbors[l] = append(neighbor.neighbors[l], candidate)
+			}
+		}
+	}
+
+	if g.entry == node {
+		g.entry = nil
+		for _, n := range g.nodes {
+			if g.entry == nil || len(n.neighbors) > len(g.entry.neighbors) || (len(n.neighbors) == len(g.entry.neighbors) && n.key < g.entry.key) {
+				g.entry = n
+			}
+		}
+	}
+}
+
+func hnswLinked(a, b *hnswNode, level int) bool {
+	for _, n := range a.neighbors[level] {
+		if n == b {
+			return true
+		}
+	}
+	return false
+}
+
+// searchLayer returns up to ef nodes of a level closest to vector, nearest
+// first. Links to removed nodes are skipped.
+func (g *hnswGraph) searchLayer(vector []float64, entry []hnswCandidate, ef, level int) []hnswCandidate {
+	visited := make(map[*hnswNode]bool)
+	var results []hnswCandidate
+	candidates := make([]hnswCandidate, 0, len(entry))
+	for _, c := range entry {
+		if !visited[c.node] {
+			visited[c.node] = true
+			candidates = append(candidates, c)
+			results = insertCandidate(results, c, ef)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	for len(candidates) > 0 {
+		current := candidates[0]
+		candidates = candidates[1:]
+		if len(results) >= ef && current.distance > results[len(results)-1].distance {
+			break
+		}
+		if level >= len(current.node.neighbors) {
+			continue
+		}
+		for _, neighbor := range current.node.neighbors[level] {
+			if visited[neighbor] || g.nodes[neighbor.key] != neighbor {
+				continue
+			}
+			visited[neighbor] = true
+			c := hnswCandidate{neighbor, g.distance(vector, neighbor.vector)}
+			if len(results) < ef || c.distance < results[len(results)-1].distance {
+				candidates = insertCandidate(candidates, c, math.MaxInt)
+				results = insertCandidate(results, c, ef)
+			}
+		}
+	}
+	return results
+}
+
+// insertCandidate inserts c into a list sorted by distance, keeping at most
+// limit entries
+func insertCandidate(list []hnswCandidate, c hnswCandidate, limit int) []hnswCandidate {
+	i := sort.Search(len(list), func(i int) bool { return list[i].distance > c.distance })
+	if i >= limit {
+		return list
+	}
+	list = append(list, hnswCandidate{})
+	copy(list[i+1:], list[i:])
+	list[i] = c
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// knn returns the k nearest nodes to vector
+func (g *hnswGraph) knn(vector []float64, k, ef int) []hnswCandidate {
+	if g.entry == nil || k <= 0 {
+		return nil
+	}
+	entry := []hnswCandidate{{g.entry, g.distance(vector, g.entry.vector)}}
+	for l := len(g.entry.neighbors) - 1; l > 0; l-- {
+		entry = g.searchLayer(vector, entry, 1, l)
+	}
+	results := g.searchLayer(vector, entry, max(ef, k), 0)
+	return results[:min(k, len(results))]
+}
+
+// searchKNN matches the k documents nearest to a vector among those matching
+// a filter. Its scores are distances, lower is nearer.
+type searchKNN struct {
+	filter    searchNode
+	field     int
+	k         int
+	vector    []float64
+	efRuntime int
+	alias     string
+}
+
+func (n searchKNN) eval(idx *searchIndex) map[string]float64 {
+	params := idx.def.Fields[n.field].Vector
+	result := make(map[string]float64)
+
+	if _, all := n.filter.(searchAll); all && idx.graphs[n.field] != nil {
+		ef := params.EFRuntime
+		if n.efRuntime > 0 {
+			ef = n.efRuntime
+		}
+		for _, c := range idx.graphs[n.field].knn(n.vector, n.k, ef) {
+			result[c.node.key] = c.distance
+		}
+		return result
+	}
+
+	distance := vectorMetrics[params.Metric]
+	var nearest []hnswCandidate
+	for key := range n.filter.eval(idx) {
+		doc := idx.docs[key]
+		vector, ok := doc.vectors[n.field]
+		if !ok {
+			continue
+		}
+		c := hnswCandidate{&hnswNode{key: key}, distance(n.vector, vector)}
+		i := sort.Search(len(nearest), func(i int) bool {
+			if nearest[i].distance != c.distance {
+				return nearest[i].distance > c.distance
+			}
+			return idx.docs[nearest[i].node.key].id > doc.id
+		})
+		if i < n.k {
+			nearest = append(nearest, hnswCandidate{})
+			copy(nearest[i+1:], nearest[i:])
+			nearest[i] = c
+			nearest = nearest[:min(len(nearest), n.k)]
+		}
+	}
+	for _, c := range nearest {
+		result[c.node.key] = c.distance
+	}
+	return result
+}
+
+// parseKNN parses "[KNN k @field $vector [EF_RUNTIME n] [AS alias]]" after
+// the => that follows a filter
+func (p *searchQueryParser) parseKNN(filter searchNode) (searchNode, error) {
+	p.skipSpaces()
+	if p.peek() != '[' {
+		return nil, p.syntaxError()
+	}
+	p.pos++
+	end := strings.IndexByte(p.input[p.pos:], ']')
+	if end < 0 {
+		return nil, p.syntaxError()
+	}
+	tokens := strings.Fields(p.input[p.pos : p.pos+end])
+	p.pos += end + 1
+
+	if len(tokens) < 4 || !strings.EqualFold(tokens[0], "KNN") {
+		return nil, fmt.Errorf("ERR Syntax error: expected KNN k @field $vector")
+	}
+	node := searchKNN{filter: filter}
+
+	k, err := strconv.Atoi(p.param(tokens[1]))
+	if err != nil || k < 0 {
+		return nil, fmt.Errorf("ERR Invalid KNN value `%s`", tokens[1])
+	}
+	node.k = k
+
+	if !strings.HasPrefix(tokens[2], "@") {
+		return nil, fmt.Errorf("ERR Syntax error: expected @field after KNN")
+	}
+	if node.field = p.idx.fieldIndex(tokens[2]); node.field < 0 {
+		return nil, fmt.Errorf("ERR Unknown field '%s'", strings.TrimPrefix(tokens[2], "@"))
+	}
+	field := p.idx.def.Fields[node.field]
+	if field.Type != SearchVector {
+		return nil, fmt.Errorf("ERR Expected a VECTOR field at `%s`", field.Name)
+	}
+	node.alias = "__" + field.Name + "_score"
+
+	if !strings.HasPrefix(tokens[3], "$") {
+		return nil, fmt.Errorf("ERR Syntax error: the query vector must be a parameter")
+	}
+	blob, exists := p.params[tokens[3][1:]]
+	if !exists {
+		return nil, fmt.Errorf("ERR No such parameter `%s`", tokens[3][1:])
+	}
+	vector, ok := decodeSearchVector(blob, field.Vector)
+	if !ok {
+		return nil, fmt.Errorf("ERR Error parsing vector similarity query: query vector blob size (%d) does not match index's expected size (%d).", len(blob), field.Vector.blobSize())
+	}
+	node.vector = vector
+
+	for i := 4; i < len(tokens); i += 2 {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("ERR Syntax error: missing value for `%s`", tokens[i])
+		}
+		switch strings.ToUpper(tokens[i]) {
+		case "EF_RUNTIME":
+			ef, err := strconv.Atoi(p.param(tokens[i+1]))
+			if err != nil || ef <= 0 {
+				return nil, fmt.Errorf("ERR Invalid EF_RUNTIME value `%s`", tokens[i+1])
+			}
+			node.efRuntime = ef
+		case "AS":
+			node.alias = tokens[i+1]
+		default:
+			return nil, fmt.Errorf("ERR Unknown attribute `%s` in KNN query", tokens[i])
+		}
+	}
+	return node, nil
+}
+
+// param resolves a $name query parameter, returning other tokens unchanged
+func (p *searchQueryParser) param(token string) string {
+	if strings.HasPrefix(token, "$") {
+		if value, exists := p.params[token[1:]]; exists {
+			return value
+		}
+	}
+	return token
+}
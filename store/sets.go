@@ -2,43 +2,49 @@ package store
 
 import (
 	"math/rand"
+	"sort"
 )
 
 func (s *Store) SAdd(key string, members ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
-	var set map[string]bool
+	count := 0
 	
 	if !exists {
-		set = make(map[string]bool)
+		set := make(map[string]bool)
+		for _, member := range members {
+			set[member] = true
+		}
+		count = len(set)
+		if count > 0 {
+			s.setKey(db, key, s.setValue(set, nil))
+		}
 	} else if value.Type != SetType {
 		return 0
 	} else {
-		existingSet := value.Set()
-		set = make(map[string]bool)
-		for k, v := range existingSet {
-			set[k] = v
+		for _, member := range members {
+			if s.setAdd(value, member) {
+				count++
+			}
 		}
 	}
 	
-	count := 0
-	for _, member := range members {
-		if !set[member] {
-			set[member] = true
-			count++
-		}
+	if count == 0 {
+		return 0
 	}
 	
-	db.data[key] = SetValue(set)
+	s.notify(db, SetEvent, "sadd", key)
 	return count
 }
 
 func (s *Store) SRem(key string, members ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
@@ -46,50 +52,46 @@ func (s *Store) SRem(key string, members ...string) int {
 		return 0
 	}
 	
-	set := value.Set()
-	newSet := make(map[string]bool)
-	for k, v := range set {
-		newSet[k] = v
-	}
-	
 	count := 0
 	for _, member := range members {
-		if newSet[member] {
-			delete(newSet, member)
+		if value.setRemove(member) {
 			count++
 		}
 	}
 	
-	if len(newSet) == 0 {
-		delete(db.data, key)
-	} else {
-		db.data[key] = SetValue(newSet)
+	if count == 0 {
+		return 0
+	}
+	
+	s.notify(db, SetEvent, "srem", key)
+	if value.setLen() == 0 {
+		s.removeKey(db, key)
 	}
 	
 	return count
 }
 
 func (s *Store) SIsMember(key, member string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != SetType {
 		return false
 	}
 	
-	return value.Set()[member]
+	return value.setContains(member)
 }
 
 func (s *Store) SMembers(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != SetType {
 		return []string{}
 	}
@@ -103,23 +105,84 @@ func (s *Store) SMembers(key string) []string {
 	return members
 }
 
+// SScan returns at least count members, or the rest of the set, starting
+// at cursor and the cursor to continue from, 0 once the set is exhausted.
+// Members are walked in the order of their hashes and a cursor is the hash
+// to resume from, so members present for the whole iteration are returned
+// however the set changes in between.
+func (s *Store) SScan(key string, cursor uint64, count int) ([]string, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	value, exists := s.lookupRead(db, key)
+	if !exists {
+		return nil, 0, true
+	}
+	if value.Type != SetType {
+		return nil, 0, false
+	}
+
+	order := value.setScanOrder()
+	i := sort.Search(len(order), func(i int) bool { return order[i].hash >= cursor })
+	end := min(i+count, len(order))
+	// Members sharing a hash go in the same page so the cursor can pass them
+	for end > i && end < len(order) && order[end].hash == order[end-1].hash {
+		end++
+	}
+
+	page := make([]string, 0, end-i)
+	for _, m := range order[i:end] {
+		page = append(page, m.member)
+	}
+	if end == len(order) {
+		return page, 0, true
+	}
+	return page, order[end].hash, true
+}
+
 func (s *Store) SCard(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != SetType {
 		return 0
 	}
 	
-	return len(value.Set())
+	return value.setLen()
+}
+
+func (s *Store) SMIsMember(key string, members ...string) ([]bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+	
+	result := make([]bool, len(members))
+	value, exists := s.lookupRead(db, key)
+	if !exists {
+		return result, true
+	}
+	if value.Type != SetType {
+		return nil, false
+	}
+	
+	for i, member := range members {
+		result[i] = value.setContains(member)
+	}
+	
+	return result, true
 }
 
+// SPop removes and returns count distinct members chosen uniformly at random
 func (s *Store) SPop(key string, count int) []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
@@ -132,50 +195,44 @@ func (s *Store) SPop(key string, count int) []string {
 		return []string{}
 	}
 	
-	if count >= len(set) {
-		members := make([]string, 0, len(set))
-		for member := range set {
-			members = append(members, member)
-		}
-		delete(db.data, key)
-		return members
-	}
-	
 	members := make([]string, 0, len(set))
 	for member := range set {
 		members = append(members, member)
 	}
 	
-	result := make([]string, count)
-	newSet := make(map[string]bool)
-	for k, v := range set {
-		newSet[k] = v
+	s.notify(db, SetEvent, "spop", key)
+	if count >= len(members) {
+		s.removeKey(db, key)
+		return members
 	}
 	
+	// Partial Fisher-Yates shuffle: the first count slots become the sample
 	for i := 0; i < count; i++ {
-		idx := rand.Intn(len(members))
-		result[i] = members[idx]
-		delete(newSet, members[idx])
-		members = append(members[:idx], members[idx+1:]...)
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	result := members[:count]
+	for _, member := range result {
+		value.setRemove(member)
 	}
-	
-	db.data[key] = SetValue(newSet)
 	return result
 }
 
+// SRandMember returns up to count distinct random members. A negative count
+// returns exactly -count members that may repeat.
 func (s *Store) SRandMember(key string, count int) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != SetType {
 		return []string{}
 	}
 	
 	set := value.Set()
-	if count <= 0 || len(set) == 0 {
+	if count == 0 || len(set) == 0 {
 		return []string{}
 	}
 	
@@ -184,27 +241,92 @@ func (s *Store) SRandMember(key string, count int) []string {
 		members = append(members, member)
 	}
 	
-	if count >= len(members) {
-		return members
+	if count < 0 {
+		result := make([]string, -count)
+		for i := range result {
+			result[i] = members[rand.Intn(len(members))]
+		}
+		return result
 	}
 	
-	result := make([]string, count)
+	if count > len(members) {
+		count = len(members)
+	}
 	for i := 0; i < count; i++ {
-		result[i] = members[rand.Intn(len(members))]
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
 	}
 	
-	return result
+	return members[:count]
+}
+
+// SInterCard returns the cardinality of the intersection of the given sets,
+// stopping early once limit is reached (0 means unlimited). It reports false
+// when any of the keys holds another type.
+func (s *Store) SInterCard(limit int, keys ...string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+	
+	sets := make([]*RedisValue, 0, len(keys))
+	missing := false
+	for _, key := range keys {
+		s.cleanupExpired(key)
+		value, exists := db.data[key]
+		if !exists {
+			missing = true
+			continue
+		}
+		if value.Type != SetType {
+			return 0, false
+		}
+		sets = append(sets, value)
+	}
+	if missing || len(sets) == 0 {
+		return 0, true
+	}
+	
+	smallest := 0
+	for i, set := range sets {
+		if set.setLen() < sets[smallest].setLen() {
+			smallest = i
+		}
+	}
+	
+	count := 0
+	for member := range sets[smallest].Set() {
+		inAll := true
+		for i, set := range sets {
+			if i != smallest && !set.setContains(member) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			count++
+			if limit > 0 && count >= limit {
+				break
+			}
+		}
+	}
+	
+	return count, true
 }
 
 func (s *Store) SInter(keys ...string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sInter(keys...)
+}
+
+func (s *Store) sInter(keys ...string) []string {
 	db := s.getCurrentDB()
 	
 	if len(keys) == 0 {
 		return []string{}
 	}
 	
+	s.cleanupExpired(keys[0])
 	firstValue, exists := db.data[keys[0]]
 	if !exists || firstValue.Type != SetType {
 		return []string{}
@@ -222,9 +344,8 @@ func (s *Store) SInter(keys ...string) []string {
 			return []string{}
 		}
 		
-		set := value.Set()
 		for member := range result {
-			if !set[member] {
+			if !value.setContains(member) {
 				delete(result, member)
 			}
 		}
@@ -243,8 +364,12 @@ func (s *Store) SInter(keys ...string) []string {
 }
 
 func (s *Store) SUnion(keys ...string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sUnion(keys...)
+}
+
+func (s *Store) sUnion(keys ...string) []string {
 	db := s.getCurrentDB()
 	
 	result := make(map[string]bool)
@@ -268,14 +393,19 @@ func (s *Store) SUnion(keys ...string) []string {
 }
 
 func (s *Store) SDiff(keys ...string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sDiff(keys...)
+}
+
+func (s *Store) sDiff(keys ...string) []string {
 	db := s.getCurrentDB()
 	
 	if len(keys) == 0 {
 		return []string{}
 	}
 	
+	s.cleanupExpired(keys[0])
 	firstValue, exists := db.data[keys[0]]
 	if !exists || firstValue.Type != SetType {
 		return []string{}
@@ -309,14 +439,8 @@ func (s *Store) SInterStore(destination string, keys ...string) int {
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 	
-	members := s.SInter(keys...)
-	newSet := make(map[string]bool)
-	for _, member := range members {
-		newSet[member] = true
-	}
-	
-	db.data[destination] = SetValue(newSet)
-	return len(newSet)
+	members := s.sInter(keys...)
+	return s.storeSet(db, destination, members, "sinterstore")
 }
 
 func (s *Store) SUnionStore(destination string, keys ...string) int {
@@ -324,14 +448,8 @@ func (s *Store) SUnionStore(destination string, keys ...string) int {
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 	
-	members := s.SUnion(keys...)
-	newSet := make(map[string]bool)
-	for _, member := range members {
-		newSet[member] = true
-	}
-	
-	db.data[destination] = SetValue(newSet)
-	return len(newSet)
+	members := s.sUnion(keys...)
+	return s.storeSet(db, destination, members, "sunionstore")
 }
 
 func (s *Store) SDiffStore(destination string, keys ...string) int {
@@ -339,19 +457,15 @@ func (s *Store) SDiffStore(destination string, keys ...string) int {
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 	
-	members := s.SDiff(keys...)
-	newSet := make(map[string]bool)
-	for _, member := range members {
-		newSet[member] = true
-	}
-	
-	db.data[destination] = SetValue(newSet)
-	return len(newSet)
+	members := s.sDiff(keys...)
+	return s.storeSet(db, destination, members, "sdiffstore")
 }
 
 func (s *Store) SMove(source, destination, member string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(source)
+	s.cleanupExpired(destination)
 	db := s.getCurrentDB()
 	
 	sourceValue, exists := db.data[source]
@@ -359,38 +473,53 @@ func (s *Store) SMove(source, destination, member string) bool {
 		return false
 	}
 	
-	sourceSet := sourceValue.Set()
-	if !sourceSet[member] {
+	if !sourceValue.setContains(member) {
 		return false
 	}
-	
-	newSourceSet := make(map[string]bool)
-	for k, v := range sourceSet {
-		newSourceSet[k] = v
+	if source == destination {
+		return true
 	}
-	delete(newSourceSet, member)
 	
-	if len(newSourceSet) == 0 {
-		delete(db.data, source)
-	} else {
-		db.data[source] = SetValue(newSourceSet)
+	sourceValue.setRemove(member)
+	s.notify(db, SetEvent, "srem", source)
+	if sourceValue.setLen() == 0 {
+		s.removeKey(db, source)
 	}
 	
 	destValue, destExists := db.data[destination]
-	var destSet map[string]bool
+	added := true
 	
 	if !destExists || destValue.Type != SetType {
-		destSet = make(map[string]bool)
+		s.setKey(db, destination, s.setValue(map[string]bool{member: true}, nil))
 	} else {
-		existingDestSet := destValue.Set()
-		destSet = make(map[string]bool)
-		for k, v := range existingDestSet {
-			destSet[k] = v
-		}
+		added = s.setAdd(destValue, member)
 	}
 	
-	destSet[member] = true
-	db.data[destination] = SetValue(destSet)
+	if added {
+		s.notify(db, SetEvent, "sadd", destination)
+	}
 	
 	return true
-}
\ No newline at end of file
+}
+
+// storeSet replaces destination with a set of members and raises event,
+// removing the key when the result is empty
+func (s *Store) storeSet(db *Database, destination string, members []string, event string) int {
+	if len(members) == 0 {
+		if _, exists := db.data[destination]; exists {
+			s.removeKey(db, destination)
+		}
+		return 0
+	}
+	
+	newSet := make(map[string]bool, len(members))
+	for _, member := range members {
+		newSet[member] = true
+	}
+	
+	delete(db.expiration, destination)
+	s.setKey(db, destination, s.setValue(newSet, nil))
+	s.indexKey(db, destination)
+	s.notify(db, SetEvent, event, destination)
+	return len(newSet)
+}
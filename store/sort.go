@@ -0,0 +1,214 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortOptions describes a SORT / SORT_RO invocation
+type SortOptions struct {
+	By       string
+	Gets     []string
+	Offset   int
+	Count    int
+	HasLimit bool
+	Desc     bool
+	Alpha    bool
+	Store    string
+}
+
+type sortItem struct {
+	element string
+	weight  string
+	hasKey  bool
+	score   float64
+}
+
+// Sort sorts the elements of the list, set or sorted set stored at key.
+// Missing GET lookups are returned as nil. When opts.Store is set the result
+// is written as a list to that key and the number of stored elements is
+// returned instead.
+func (s *Store) Sort(key string, opts SortOptions) ([]*string, int, error) {
+	// BY and GET patterns lazily expire the keys they look up
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	var elements []string
+	sortByDefault := true
+	if value, exists := db.data[key]; exists && !s.isExpired(key) {
+		switch value.Type {
+		case ListType:
+			elements = append(elements, value.List()...)
+		case SetType:
+			for member := range value.Set() {
+				elements = append(elements, member)
+			}
+		case ZSetType:
+			for _, m := range value.ZSet().Sorted {
+				elements = append(elements, m.Member)
+			}
+			sortByDefault = false
+		default:
+			return nil, 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+	}
+
+	dontSort := opts.By != "" && !strings.Contains(opts.By, "*")
+	if dontSort && sortByDefault {
+		// Sets have no natural order, so keep the output deterministic
+		sort.Strings(elements)
+	}
+
+	items := make([]sortItem, len(elements))
+	for i, element := range elements {
+		items[i] = sortItem{element: element, weight: element, hasKey: true}
+		if dontSort {
+			continue
+		}
+		if opts.By != "" {
+			items[i].weight, items[i].hasKey = s.lookupByPattern(db, opts.By, element)
+		}
+		if !opts.Alpha && items[i].hasKey {
+			score, err := strconv.ParseFloat(items[i].weight, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("ERR One or more scores can't be converted into double")
+			}
+			items[i].score = score
+		}
+	}
+
+	if !dontSort {
+		sort.SliceStable(items, func(i, j int) bool {
+			cmp := compareSortItems(items[i], items[j], opts.Alpha)
+			if opts.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	} else if opts.Desc && !sortByDefault {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	start, end := 0, len(items)
+	if opts.HasLimit {
+		start = opts.Offset
+		if start < 0 {
+			start = 0
+		}
+		if start > len(items) {
+			start = len(items)
+		}
+		if opts.Count >= 0 && start+opts.Count < end {
+			end = start + opts.Count
+		}
+	}
+	items = items[start:end]
+
+	var result []*string
+	for _, item := range items {
+		if len(opts.Gets) == 0 {
+			element := item.element
+			result = append(result, &element)
+			continue
+		}
+		for _, pattern := range opts.Gets {
+			if value, ok := s.lookupByPattern(db, pattern, item.element); ok {
+				result = append(result, &value)
+			} else {
+				result = append(result, nil)
+			}
+		}
+	}
+
+	if opts.Store != "" {
+		list := make([]string, len(result))
+		for i, value := range result {
+			if value != nil {
+				list[i] = *value
+			}
+		}
+		if len(list) == 0 {
+			if _, exists := db.data[opts.Store]; exists {
+				s.removeKey(db, opts.Store)
+			}
+			return nil, 0, nil
+		}
+		delete(db.expiration, opts.Store)
+		s.setKey(db, opts.Store, ListValue(list))
+		s.indexKey(db, opts.Store)
+		s.notify(db, GenericEvent, "sortstore", opts.Store)
+		return nil, len(list), nil
+	}
+
+	return result, len(result), nil
+}
+
+func compareSortItems(a, b sortItem, alpha bool) int {
+	if !alpha {
+		if a.score < b.score {
+			return -1
+		}
+		if a.score > b.score {
+			return 1
+		}
+		return strings.Compare(a.element, b.element)
+	}
+
+	if !a.hasKey || !b.hasKey {
+		switch {
+		case a.hasKey == b.hasKey:
+			return 0
+		case !a.hasKey:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return strings.Compare(a.weight, b.weight)
+}
+
+// lookupByPattern resolves a SORT BY/GET pattern for the given element.
+// "#" yields the element itself, "prefix*suffix" a string key and
+// "prefix*suffix->field" a hash field.
+func (s *Store) lookupByPattern(db *Database, pattern, element string) (string, bool) {
+	if pattern == "#" {
+		return element, true
+	}
+
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", false
+	}
+
+	keyPattern, field := pattern, ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 {
+		arrow += star + 1
+		if arrow+2 < len(pattern) {
+			keyPattern, field = pattern[:arrow], pattern[arrow+2:]
+		}
+	}
+
+	key := keyPattern[:star] + element + keyPattern[star+1:]
+	s.cleanupExpired(key)
+	value, exists := db.data[key]
+	if !exists {
+		return "", false
+	}
+
+	if field != "" {
+		if value.Type != HashType {
+			return "", false
+		}
+		return value.hashField(field)
+	}
+
+	if value.Type != StringType {
+		return "", false
+	}
+	return value.String(), true
+}
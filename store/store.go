@@ -1,8 +1,9 @@
 package store
 
 import (
-	"encoding/json"
 	"keyra/persistence"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,6 +18,12 @@ const (
 	ZSetType
 	JSONType
 	StreamType
+	TimeSeriesType
+	BloomType
+	CuckooType
+	CMSType
+	TopKType
+	TDigestType
 )
 
 func (dt DataType) String() string {
@@ -35,6 +42,18 @@ func (dt DataType) String() string {
 		return "ReJSON-RL"
 	case StreamType:
 		return "stream"
+	case TimeSeriesType:
+		return "TSDB-TYPE"
+	case BloomType:
+		return "MBbloom--"
+	case CuckooType:
+		return "MBbloomCF"
+	case CMSType:
+		return "CMSk-TYPE"
+	case TopKType:
+		return "TopK-TYPE"
+	case TDigestType:
+		return "TDIS-TYPE"
 	default:
 		return "none"
 	}
@@ -48,6 +67,13 @@ type ZSetMember struct {
 type RedisValue struct {
 	Type  DataType
 	Value interface{}
+
+	// fieldExpiration holds per-field expiration times for hashes
+	fieldExpiration map[string]time.Time
+
+	// scanOrder caches the members of a set in the order SSCAN walks them.
+	// Adding or removing a member in place discards it.
+	scanOrder []scanMember
 }
 
 func StringValue(s string) *RedisValue {
@@ -70,7 +96,7 @@ func ZSetValue(zs *ZSet) *RedisValue {
 	return &RedisValue{Type: ZSetType, Value: zs}
 }
 
-func JSONValue(j interface{}) *RedisValue {
+func JSONValue(j *JSONNode) *RedisValue {
 	return &RedisValue{Type: JSONType, Value: j}
 }
 
@@ -78,39 +104,47 @@ func StreamValueFromStream(s *Stream) *RedisValue {
 	return &RedisValue{Type: StreamType, Value: s}
 }
 
-// Stream represents a Redis Stream
+// Stream represents a Redis Stream. Entries are packed into nodes indexed
+// by their IDs, see streamindex.go.
 type Stream struct {
-	Entries      []StreamEntry
-	LastID       string
+	index        streamIndex
+	length       int64
+	LastID       StreamID
+	FirstID      StreamID
 	Groups       map[string]*ConsumerGroup
-	MaxLen       int64 // 0 means unlimited
-	FirstID      string
+	EntriesAdded int64    // entries ever added, including deleted ones
+	MaxDeletedID StreamID // highest ID removed by XDEL
 }
 
 // StreamEntry represents a single entry in a stream
 type StreamEntry struct {
-	ID     string
-	Fields map[string]string
+	ID     StreamID
+	Fields []string // alternating fields and values in insertion order
 }
 
 // ConsumerGroup represents a consumer group
 type ConsumerGroup struct {
 	Name            string
-	LastDeliveredID string
-	Pending         map[string]*PendingEntry // entry ID -> pending info
+	LastDeliveredID StreamID
+	EntriesRead     int64 // logical read counter, InvalidEntriesRead if unknown
+	Pending         map[StreamID]*PendingEntry // entry ID -> pending info
 	Consumers       map[string]*Consumer
 }
 
+// InvalidEntriesRead marks a group whose read counter can't be determined
+const InvalidEntriesRead int64 = -1
+
 // Consumer represents a consumer in a group
 type Consumer struct {
 	Name        string
 	Pending     int64
 	LastSeenTime time.Time
+	ActiveTime   time.Time // last successful read or claim, zero if never
 }
 
 // PendingEntry represents a pending entry
 type PendingEntry struct {
-	EntryID       string
+	EntryID       StreamID
 	ConsumerName  string
 	DeliveryTime  time.Time
 	DeliveryCount int64
@@ -118,8 +152,7 @@ type PendingEntry struct {
 
 func NewStream() *Stream {
 	return &Stream{
-		Entries: make([]StreamEntry, 0),
-		Groups:  make(map[string]*ConsumerGroup),
+		Groups: make(map[string]*ConsumerGroup),
 	}
 }
 
@@ -148,6 +181,20 @@ func (rv *RedisValue) Hash() map[string]string {
 	if rv.Type != HashType {
 		panic("value is not a hash")
 	}
+	if lp, ok := rv.Value.(listpack); ok {
+		hash := make(map[string]string)
+		var field string
+		isField := true
+		lp.forEach(func(entry string) {
+			if isField {
+				field = entry
+			} else {
+				hash[field] = entry
+			}
+			isField = !isField
+		})
+		return hash
+	}
 	return rv.Value.(map[string]string)
 }
 
@@ -155,6 +202,20 @@ func (rv *RedisValue) Set() map[string]bool {
 	if rv.Type != SetType {
 		panic("value is not a set")
 	}
+	switch set := rv.Value.(type) {
+	case intset:
+		members := make(map[string]bool, len(set))
+		for _, v := range set {
+			members[strconv.FormatInt(v, 10)] = true
+		}
+		return members
+	case listpack:
+		members := make(map[string]bool)
+		set.forEach(func(entry string) {
+			members[entry] = true
+		})
+		return members
+	}
 	return rv.Value.(map[string]bool)
 }
 
@@ -165,27 +226,34 @@ func (rv *RedisValue) ZSet() *ZSet {
 	return rv.Value.(*ZSet)
 }
 
-func (rv *RedisValue) JSON() interface{} {
+func (rv *RedisValue) JSON() *JSONNode {
 	if rv.Type != JSONType {
 		panic("value is not JSON")
 	}
-	return rv.Value
+	return rv.Value.(*JSONNode)
 }
 
 type ZSet struct {
-	Members map[string]float64 // member -> score lookup
+	Members map[string]float64 // member -> score lookup, nil while listpack-encoded
 	Sorted  []ZSetMember       // sorted by score, then lexicographically
 }
 
 type Database struct {
 	data       map[string]*RedisValue
 	expiration map[string]time.Time
+	// hashFieldTTLKeys tracks hashes that may have expiring fields so that
+	// active expiry does not need to scan the whole keyspace
+	hashFieldTTLKeys map[string]bool
+	// indexes holds the search indexes created in this database by name
+	indexes map[string]*searchIndex
 }
 
 func newDatabase() *Database {
 	return &Database{
-		data:       make(map[string]*RedisValue),
-		expiration: make(map[string]time.Time),
+		data:             make(map[string]*RedisValue),
+		expiration:       make(map[string]time.Time),
+		hashFieldTTLKeys: make(map[string]bool),
+		indexes:          make(map[string]*searchIndex),
 	}
 }
 
@@ -194,12 +262,15 @@ type Store struct {
 	currentDB   int
 	mu          sync.RWMutex
 	persistence *persistence.Persistence
+	encoding    EncodingConfig
+	notifier    KeyspaceNotifier
 }
 
 func New(persistenceFile string) *Store {
 	s := &Store{
 		currentDB:   0,
 		persistence: persistence.New(persistenceFile),
+		encoding:    DefaultEncodingConfig(),
 	}
 	
 	// Initialize all 16 databases
@@ -214,6 +285,7 @@ func New(persistenceFile string) *Store {
 func NewInMemory() *Store {
 	s := &Store{
 		currentDB: 0,
+		encoding:  DefaultEncodingConfig(),
 	}
 	
 	// Initialize all 16 databases
@@ -237,19 +309,29 @@ func (s *Store) isExpired(key string) bool {
 }
 
 func (s *Store) cleanupExpired(key string) {
+	db := s.getCurrentDB()
 	if s.isExpired(key) {
-		db := s.getCurrentDB()
+		_, exists := db.data[key]
 		delete(db.data, key)
 		delete(db.expiration, key)
+		delete(db.hashFieldTTLKeys, key)
+		s.indexKey(db, key)
+		if exists {
+			s.notify(db, ExpiredEvent, "expired", key)
+		}
+		return
 	}
+	s.expireHashFields(db, key)
 }
 
 func (s *Store) Set(key, value string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
-	db.data[key] = StringValue(value)
+	s.setKey(db, key, StringValue(value))
 	delete(db.expiration, key)
+	s.indexKey(db, key)
+	s.notify(db, StringEvent, "set", key)
 }
 
 func (s *Store) Get(key string) (string, bool) {
@@ -257,7 +339,7 @@ func (s *Store) Get(key string) (string, bool) {
 	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != StringType {
 		return "", false
 	}
@@ -281,15 +363,14 @@ func (s *Store) Del(key string) bool {
 	db := s.getCurrentDB()
 	_, exists := db.data[key]
 	if exists {
-		delete(db.data, key)
-		delete(db.expiration, key)
+		s.removeKey(db, key)
 	}
 	return exists
 }
 
 func (s *Store) Exists(key string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	_, exists := db.data[key]
@@ -297,15 +378,15 @@ func (s *Store) Exists(key string) bool {
 }
 
 func (s *Store) Keys(pattern string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 	
 	var keys []string
 	for key := range db.data {
 		s.cleanupExpired(key)
 		if _, exists := db.data[key]; exists {
-			if pattern == "*" || matchPattern(pattern, key) {
+			if pattern == "*" || GlobMatch(pattern, key) {
 				keys = append(keys, key)
 			}
 		}
@@ -314,8 +395,8 @@ func (s *Store) Keys(pattern string) []string {
 }
 
 func (s *Store) DBSize() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 	
 	count := 0
@@ -334,11 +415,13 @@ func (s *Store) FlushDB() {
 	db := s.getCurrentDB()
 	db.data = make(map[string]*RedisValue)
 	db.expiration = make(map[string]time.Time)
+	db.hashFieldTTLKeys = make(map[string]bool)
+	db.indexes = make(map[string]*searchIndex)
 }
 
 func (s *Store) GetType(key string) DataType {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	
 	db := s.getCurrentDB()
@@ -354,8 +437,8 @@ func (s *Store) GetCurrentDB() int {
 }
 
 func (s *Store) GetList(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	
 	db := s.getCurrentDB()
@@ -371,8 +454,8 @@ func (s *Store) GetList(key string) []string {
 }
 
 func (s *Store) GetSet(key string) map[string]bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	
 	db := s.getCurrentDB()
@@ -390,8 +473,8 @@ func (s *Store) GetSet(key string) map[string]bool {
 }
 
 func (s *Store) GetHash(key string) map[string]string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	
 	db := s.getCurrentDB()
@@ -409,8 +492,8 @@ func (s *Store) GetHash(key string) map[string]string {
 }
 
 func (s *Store) GetZSet(key string) *ZSet {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	
 	db := s.getCurrentDB()
@@ -453,79 +536,16 @@ func (s *Store) Save() error {
 		}
 		
 		for k, v := range db.data {
-			sv := persistence.SerializedValue{
-				Type: persistence.DataType(v.Type),
-			}
-			
-			switch v.Type {
-			case StringType:
-				sv.StringValue = v.String()
-			case ListType:
-				// Make a copy of the list
-				list := v.List()
-				sv.ListValue = make([]string, len(list))
-				copy(sv.ListValue, list)
-			case HashType:
-				// Make a copy of the hash
-				hash := v.Hash()
-				sv.HashValue = make(map[string]string)
-				for hk, hv := range hash {
-					sv.HashValue[hk] = hv
-				}
-			case SetType:
-				// Make a copy of the set
-				set := v.Set()
-				sv.SetValue = make(map[string]bool)
-				for sk, sval := range set {
-					sv.SetValue[sk] = sval
-				}
-			case ZSetType:
-				// Make a copy of the zset
-				zset := v.ZSet()
-				sv.ZSetValue = &persistence.ZSetData{
-					Members: make(map[string]float64),
-					Sorted:  make([]persistence.ZSetMember, len(zset.Sorted)),
-				}
-				for mk, mv := range zset.Members {
-					sv.ZSetValue.Members[mk] = mv
-				}
-				for i, m := range zset.Sorted {
-					sv.ZSetValue.Sorted[i] = persistence.ZSetMember{
-						Member: m.Member,
-						Score:  m.Score,
-					}
-				}
-			case JSONType:
-				// Serialize JSON value to bytes
-				jsonBytes, err := json.Marshal(v.JSON())
-				if err == nil {
-					sv.JSONValue = jsonBytes
-				}
-			case StreamType:
-				// Serialize stream
-				stream := v.Stream()
-				sv.StreamValue = &persistence.StreamData{
-					Entries: make([]persistence.StreamEntry, len(stream.Entries)),
-					LastID:  stream.LastID,
-					FirstID: stream.FirstID,
-				}
-				for i, e := range stream.Entries {
-					sv.StreamValue.Entries[i] = persistence.StreamEntry{
-						ID:     e.ID,
-						Fields: make(map[string]string),
-					}
-					for fk, fv := range e.Fields {
-						sv.StreamValue.Entries[i].Fields[fk] = fv
-					}
-				}
-			}
-			
-			databases[dbIdx].Data[k] = sv
+			databases[dbIdx].Data[k] = serializeValue(v)
 		}
 		
 		for k, v := range db.expiration {
 			databases[dbIdx].Expiration[k] = v
 		}
+		
+		for _, def := range searchDefinitions(db) {
+			databases[dbIdx].Indexes = append(databases[dbIdx].Indexes, def.Args())
+		}
 	}
 	
 	return s.persistence.SaveDatabases(databases)
@@ -549,76 +569,319 @@ func (s *Store) Load() error {
 		db := s.databases[dbIdx]
 		
 		for k, sv := range dbSnapshot.Data {
-			switch persistence.DataType(sv.Type) {
-			case persistence.StringType:
-				db.data[k] = StringValue(sv.StringValue)
-			case persistence.ListType:
-				// Make a copy of the list
-				list := make([]string, len(sv.ListValue))
-				copy(list, sv.ListValue)
-				db.data[k] = ListValue(list)
-			case persistence.HashType:
-				// Make a copy of the hash
-				hash := make(map[string]string)
-				for hk, hv := range sv.HashValue {
-					hash[hk] = hv
-				}
-				db.data[k] = HashValue(hash)
-			case persistence.SetType:
-				// Make a copy of the set
-				set := make(map[string]bool)
-				for sk, sval := range sv.SetValue {
-					set[sk] = sval
-				}
-				db.data[k] = SetValue(set)
-			case persistence.ZSetType:
-				if sv.ZSetValue != nil {
-					zset := &ZSet{
-						Members: make(map[string]float64),
-						Sorted:  make([]ZSetMember, len(sv.ZSetValue.Sorted)),
-					}
-					for mk, mv := range sv.ZSetValue.Members {
-						zset.Members[mk] = mv
-					}
-					for i, m := range sv.ZSetValue.Sorted {
-						zset.Sorted[i] = ZSetMember{
-							Member: m.Member,
-							Score:  m.Score,
-						}
-					}
-					db.data[k] = ZSetValue(zset)
-				}
-			case persistence.JSONType:
-				if sv.JSONValue != nil {
-					var jsonData interface{}
-					if err := json.Unmarshal(sv.JSONValue, &jsonData); err == nil {
-						db.data[k] = JSONValue(jsonData)
-					}
-				}
-			case persistence.StreamType:
-				if sv.StreamValue != nil {
-					stream := &Stream{
-						Entries: make([]StreamEntry, len(sv.StreamValue.Entries)),
-						LastID:  sv.StreamValue.LastID,
-						FirstID: sv.StreamValue.FirstID,
-						Groups:  make(map[string]*ConsumerGroup),
-					}
-					for i, e := range sv.StreamValue.Entries {
-						stream.Entries[i] = StreamEntry{
-							ID:     e.ID,
-							Fields: make(map[string]string),
-						}
-						for fk, fv := range e.Fields {
-							stream.Entries[i].Fields[fk] = fv
-						}
-					}
-					db.data[k] = StreamValueFromStream(stream)
+			if value, ok := deserializeValue(sv); ok {
+				db.data[k] = s.compactValue(value)
+				if len(value.fieldExpiration) > 0 {
+					db.hashFieldTTLKeys[k] = true
 				}
 			}
 		}
 		
 		db.expiration = dbSnapshot.Expiration
+		
+		for _, args := range dbSnapshot.Indexes {
+			if def, err := ParseSearchDefinition(args); err == nil {
+				db.indexes[def.Name] = buildSearchIndex(db, def)
+			}
+		}
 	}
 	
 	return nil
 }
+
+// serializeValue converts a RedisValue into its persistence form, copying
+// any mutable collections
+func serializeValue(v *RedisValue) persistence.SerializedValue {
+	sv := persistence.SerializedValue{
+		Type: persistence.DataType(v.Type),
+	}
+
+	switch v.Type {
+	case StringType:
+		sv.StringValue = v.String()
+	case ListType:
+		list := v.List()
+		sv.ListValue = make([]string, len(list))
+		copy(sv.ListValue, list)
+	case HashType:
+		hash := v.Hash()
+		sv.HashValue = make(map[string]string)
+		for hk, hv := range hash {
+			sv.HashValue[hk] = hv
+		}
+		if len(v.fieldExpiration) > 0 {
+			sv.HashFieldExpiration = make(map[string]time.Time)
+			for field, at := range v.fieldExpiration {
+				sv.HashFieldExpiration[field] = at
+			}
+		}
+	case SetType:
+		set := v.Set()
+		sv.SetValue = make(map[string]bool)
+		for sk, sval := range set {
+			sv.SetValue[sk] = sval
+		}
+	case ZSetType:
+		zset := v.ZSet()
+		sv.ZSetValue = &persistence.ZSetData{
+			Members: make(map[string]float64),
+			Sorted:  make([]persistence.ZSetMember, len(zset.Sorted)),
+		}
+		for i, m := range zset.Sorted {
+			sv.ZSetValue.Members[m.Member] = m.Score
+			sv.ZSetValue.Sorted[i] = persistence.ZSetMember{
+				Member: m.Member,
+				Score:  m.Score,
+			}
+		}
+	case JSONType:
+		sv.JSONValue = encodeJSONNode(v.JSON())
+	case TimeSeriesType:
+		sv.TimeSeriesValue = serializeTimeSeries(v.TimeSeries())
+	case BloomType:
+		sv.BloomValue = serializeBloom(v.Bloom())
+	case CuckooType:
+		sv.CuckooValue = serializeCuckoo(v.Cuckoo())
+	case CMSType:
+		sv.CMSValue = serializeCMS(v.CMS())
+	case TopKType:
+		sv.TopKValue = serializeTopK(v.TopK())
+	case TDigestType:
+		sv.TDigestValue = serializeTDigest(v.TDigest())
+	case StreamType:
+		stream := v.Stream()
+		sv.StreamValue = &persistence.StreamData{
+			Entries:      make([]persistence.StreamEntry, 0, stream.Len()),
+			LastID:       stream.LastID.String(),
+			FirstID:      stream.FirstID.String(),
+			EntriesAdded: stream.EntriesAdded,
+			MaxDeletedID: stream.MaxDeletedID.String(),
+		}
+		stream.ascend(StreamID{}, MaxStreamID, func(e StreamEntry) bool {
+			sv.StreamValue.Entries = append(sv.StreamValue.Entries, persistence.StreamEntry{
+				ID:     e.ID.String(),
+				Values: e.Fields,
+			})
+			return true
+		})
+		for _, name := range sortedGroupNames(stream) {
+			g := stream.Groups[name]
+			group := persistence.StreamGroup{
+				Name:            g.Name,
+				LastDeliveredID: g.LastDeliveredID.String(),
+				EntriesRead:     g.EntriesRead,
+			}
+			for _, c := range g.Consumers {
+				group.Consumers = append(group.Consumers, persistence.StreamConsumer{
+					Name:       c.Name,
+					SeenTime:   c.LastSeenTime,
+					ActiveTime: c.ActiveTime,
+				})
+			}
+			sort.Slice(group.Consumers, func(i, j int) bool {
+				return group.Consumers[i].Name < group.Consumers[j].Name
+			})
+			for _, p := range g.pendingRange(StreamID{}, MaxStreamID, -1, "", 0, time.Time{}) {
+				group.Pending = append(group.Pending, persistence.StreamPendingEntry{
+					ID:            p.EntryID.String(),
+					Consumer:      p.ConsumerName,
+					DeliveryTime:  p.DeliveryTime,
+					DeliveryCount: p.DeliveryCount,
+				})
+			}
+			sv.StreamValue.Groups = append(sv.StreamValue.Groups, group)
+		}
+	}
+
+	return sv
+}
+
+// deserializeValue rebuilds a RedisValue from its persistence form. It
+// reports false when the serialized value is incomplete or malformed.
+func deserializeValue(sv persistence.SerializedValue) (*RedisValue, bool) {
+	switch persistence.DataType(sv.Type) {
+	case persistence.StringType:
+		return StringValue(sv.StringValue), true
+	case persistence.ListType:
+		list := make([]string, len(sv.ListValue))
+		copy(list, sv.ListValue)
+		return ListValue(list), true
+	case persistence.HashType:
+		hash := make(map[string]string)
+		for hk, hv := range sv.HashValue {
+			hash[hk] = hv
+		}
+		value := HashValue(hash)
+		now := time.Now()
+		for field, at := range sv.HashFieldExpiration {
+			if _, exists := hash[field]; !exists {
+				continue
+			}
+			if !at.After(now) {
+				delete(hash, field)
+				continue
+			}
+			if value.fieldExpiration == nil {
+				value.fieldExpiration = make(map[string]time.Time)
+			}
+			value.fieldExpiration[field] = at
+		}
+		if len(hash) == 0 {
+			return nil, false
+		}
+		return value, true
+	case persistence.SetType:
+		set := make(map[string]bool)
+		for sk, sval := range sv.SetValue {
+			set[sk] = sval
+		}
+		return SetValue(set), true
+	case persistence.ZSetType:
+		if sv.ZSetValue == nil {
+			return nil, false
+		}
+		zset := &ZSet{
+			Members: make(map[string]float64),
+			Sorted:  make([]ZSetMember, len(sv.ZSetValue.Sorted)),
+		}
+		for mk, mv := range sv.ZSetValue.Members {
+			zset.Members[mk] = mv
+		}
+		for i, m := range sv.ZSetValue.Sorted {
+			zset.Sorted[i] = ZSetMember{
+				Member: m.Member,
+				Score:  m.Score,
+			}
+		}
+		return ZSetValue(zset), true
+	case persistence.JSONType:
+		if sv.JSONValue == nil {
+			return nil, false
+		}
+		node, err := decodeJSONNode(sv.JSONValue)
+		if err != nil {
+			return nil, false
+		}
+		return JSONValue(node), true
+	case persistence.TimeSeriesType:
+		if sv.TimeSeriesValue == nil {
+			return nil, false
+		}
+		ts, ok := deserializeTimeSeries(sv.TimeSeriesValue)
+		if !ok {
+			return nil, false
+		}
+		return TimeSeriesValue(ts), true
+	case persistence.BloomType:
+		if sv.BloomValue == nil {
+			return nil, false
+		}
+		bf, ok := deserializeBloom(sv.BloomValue)
+		if !ok {
+			return nil, false
+		}
+		return BloomValue(bf), true
+	case persistence.CuckooType:
+		if sv.CuckooValue == nil {
+			return nil, false
+		}
+		cf, ok := deserializeCuckoo(sv.CuckooValue)
+		if !ok {
+			return nil, false
+		}
+		return CuckooValue(cf), true
+	case persistence.CMSType:
+		if sv.CMSValue == nil {
+			return nil, false
+		}
+		cms, ok := deserializeCMS(sv.CMSValue)
+		if !ok {
+			return nil, false
+		}
+		return CMSValue(cms), true
+	case persistence.TopKType:
+		if sv.TopKValue == nil {
+			return nil, false
+		}
+		topk, ok := deserializeTopK(sv.TopKValue)
+		if !ok {
+			return nil, false
+		}
+		return TopKValue(topk), true
+	case persistence.TDigestType:
+		if sv.TDigestValue == nil {
+			return nil, false
+		}
+		td, ok := deserializeTDigest(sv.TDigestValue)
+		if !ok {
+			return nil, false
+		}
+		return TDigestValue(td), true
+	case persistence.StreamType:
+		if sv.StreamValue == nil {
+			return nil, false
+		}
+		data := sv.StreamValue
+		stream := NewStream()
+		stream.EntriesAdded = data.EntriesAdded
+		var ok bool
+		if stream.LastID, ok = parseStoredStreamID(data.LastID); !ok {
+			return nil, false
+		}
+		if stream.MaxDeletedID, ok = parseStoredStreamID(data.MaxDeletedID); !ok {
+			return nil, false
+		}
+		var prev StreamID
+		for _, e := range data.Entries {
+			id, err := ParseStreamID(e.ID)
+			if err != nil || (stream.length > 0 && id.Compare(prev) <= 0) {
+				return nil, false
+			}
+			fields := e.Values
+			if fields == nil {
+				fields = fieldPairs(e.Fields)
+			}
+			stream.push(id, fields)
+			prev = id
+		}
+		if prev.Compare(stream.LastID) > 0 {
+			stream.LastID = prev
+		}
+		if stream.EntriesAdded < stream.length {
+			stream.EntriesAdded = stream.length
+		}
+		for _, group := range data.Groups {
+			lastDelivered, ok := parseStoredStreamID(group.LastDeliveredID)
+			if !ok {
+				return nil, false
+			}
+			g := &ConsumerGroup{
+				Name:            group.Name,
+				LastDeliveredID: lastDelivered,
+				EntriesRead:     group.EntriesRead,
+				Pending:         make(map[StreamID]*PendingEntry),
+				Consumers:       make(map[string]*Consumer),
+			}
+			for _, c := range group.Consumers {
+				g.Consumers[c.Name] = &Consumer{Name: c.Name, LastSeenTime: c.SeenTime, ActiveTime: c.ActiveTime}
+			}
+			for _, p := range group.Pending {
+				id, err := ParseStreamID(p.ID)
+				if err != nil {
+					return nil, false
+				}
+				c := g.consumer(p.Consumer, p.DeliveryTime)
+				g.Pending[id] = &PendingEntry{
+					EntryID:       id,
+					ConsumerName:  p.Consumer,
+					DeliveryTime:  p.DeliveryTime,
+					DeliveryCount: p.DeliveryCount,
+				}
+				c.Pending++
+			}
+			stream.Groups[group.Name] = g
+		}
+		return StreamValueFromStream(stream), true
+	}
+	return nil, false
+}
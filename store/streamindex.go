@@ -0,0 +1,479 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StreamID identifies a stream entry by its millisecond timestamp and
+// sequence number
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the greatest possible stream ID
+var MaxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Compare returns -1, 0 or 1 depending on whether id sorts before, equal to
+// or after other
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms < other.Ms:
+		return -1
+	case id.Ms > other.Ms:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+// next returns the smallest ID greater than id
+func (id StreamID) next() (StreamID, bool) {
+	if id.Seq < math.MaxUint64 {
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	}
+	if id.Ms < math.MaxUint64 {
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest ID smaller than id
+func (id StreamID) prev() (StreamID, bool) {
+	if id.Seq > 0 {
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	}
+	if id.Ms > 0 {
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// ParseStreamID parses an ID given as "ms-seq" or "ms", the latter meaning
+// a sequence number of 0
+func ParseStreamID(id string) (StreamID, error) {
+	return parseStreamID(id, 0)
+}
+
+func parseStreamID(id string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+	}
+	seq := missingSeq
+	if hasSeq {
+		seq, err = strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			return StreamID{}, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// Limits of a single stream node, matching the stream-node-max-entries and
+// stream-node-max-bytes defaults
+const (
+	streamNodeEntries  = 100
+	streamNodeMaxBytes = 4096
+)
+
+// streamNode holds a run of consecutive entries. IDs are kept as binary
+// values for binary search while the fields of all entries are packed into
+// one listpack, the fields of entry i ending at ends[i].
+type streamNode struct {
+	ids  []StreamID
+	ends []uint32
+	data listpack
+}
+
+func (n *streamNode) full() bool {
+	return len(n.ids) >= streamNodeEntries || len(n.data) >= streamNodeMaxBytes
+}
+
+func (n *streamNode) lastID() StreamID {
+	return n.ids[len(n.ids)-1]
+}
+
+func (n *streamNode) start(i int) uint32 {
+	if i == 0 {
+		return 0
+	}
+	return n.ends[i-1]
+}
+
+// search returns the index of the first entry with an ID of at least id
+func (n *streamNode) search(id StreamID) int {
+	return sort.Search(len(n.ids), func(i int) bool {
+		return n.ids[i].Compare(id) >= 0
+	})
+}
+
+func (n *streamNode) entry(i int) StreamEntry {
+	entry := StreamEntry{ID: n.ids[i], Fields: []string{}}
+	n.data[n.start(i):n.ends[i]].forEach(func(field string) {
+		entry.Fields = append(entry.Fields, field)
+	})
+	return entry
+}
+
+func (n *streamNode) push(id StreamID, fields []string) {
+	for _, field := range fields {
+		n.data = n.data.push(field)
+	}
+	n.ids = append(n.ids, id)
+	n.ends = append(n.ends, uint32(len(n.data)))
+}
+
+// remove deletes the entries i through j-1 and compacts the packed fields
+func (n *streamNode) remove(i, j int) {
+	from, to := n.start(i), n.ends[j-1]
+	n.data = append(n.data[:from], n.data[to:]...)
+	n.ids = append(n.ids[:i], n.ids[j:]...)
+	n.ends = append(n.ends[:i], n.ends[j:]...)
+	for k := i; k < len(n.ends); k++ {
+		n.ends[k] -= to - from
+	}
+}
+
+// streamTreeFanout is the most children or stream nodes a tree node holds
+const streamTreeFanout = 64
+
+// streamIndex is a B+tree over the nodes of a stream in ID order. Leaves
+// hold the stream nodes and are linked to their neighbours for iteration.
+// Entries are only ever appended after the last node, so a full tail leaf
+// gets a new sibling instead of being split and leaves stay full. A tree
+// node is freed once it is empty.
+type streamIndex struct {
+	root       *streamTreeNode
+	head, tail *streamTreeNode
+	count      int // stream nodes
+	treeNodes  int
+}
+
+// streamTreeNode is a leaf holding stream nodes or an inner node holding
+// children. seps[i] bounds the IDs under child i from above; the last child
+// has no bound so the tail can grow. Entries deleted later can leave a
+// separator above the IDs it bounds, which only ever sends a search one
+// leaf early.
+type streamTreeNode struct {
+	leaf       bool
+	parent     *streamTreeNode
+	children   []*streamTreeNode
+	seps       []StreamID
+	nodes      []*streamNode
+	prev, next *streamTreeNode
+}
+
+// streamPos is the position of a stream node in the index. The zero value
+// is the position past the last node.
+type streamPos struct {
+	leaf *streamTreeNode
+	i    int
+}
+
+func (p streamPos) valid() bool {
+	return p.leaf != nil
+}
+
+func (p streamPos) node() *streamNode {
+	return p.leaf.nodes[p.i]
+}
+
+func (p streamPos) next() streamPos {
+	if p.i+1 < len(p.leaf.nodes) {
+		return streamPos{leaf: p.leaf, i: p.i + 1}
+	}
+	return streamPos{leaf: p.leaf.next}
+}
+
+// prev returns the position before p, reporting false when p is the first
+func (idx *streamIndex) prev(p streamPos) (streamPos, bool) {
+	switch {
+	case p.leaf == nil:
+		if idx.tail == nil {
+			return p, false
+		}
+		return streamPos{leaf: idx.tail, i: len(idx.tail.nodes) - 1}, true
+	case p.i > 0:
+		return streamPos{leaf: p.leaf, i: p.i - 1}, true
+	case p.leaf.prev == nil:
+		return p, false
+	}
+	return streamPos{leaf: p.leaf.prev, i: len(p.leaf.prev.nodes) - 1}, true
+}
+
+func (idx *streamIndex) first() *streamNode {
+	if idx.head == nil {
+		return nil
+	}
+	return idx.head.nodes[0]
+}
+
+func (idx *streamIndex) last() *streamNode {
+	if idx.tail == nil {
+		return nil
+	}
+	return idx.tail.nodes[len(idx.tail.nodes)-1]
+}
+
+// seek returns the position of the first node with an entry of at least id
+func (idx *streamIndex) seek(id StreamID) streamPos {
+	t := idx.root
+	if t == nil {
+		return streamPos{}
+	}
+	for !t.leaf {
+		t = t.children[sort.Search(len(t.seps), func(i int) bool {
+			return t.seps[i].Compare(id) >= 0
+		})]
+	}
+	i := sort.Search(len(t.nodes), func(i int) bool {
+		return t.nodes[i].lastID().Compare(id) >= 0
+	})
+	if i == len(t.nodes) {
+		return streamPos{leaf: t.next}
+	}
+	return streamPos{leaf: t, i: i}
+}
+
+// append adds n after the last node
+func (idx *streamIndex) append(n *streamNode) {
+	if idx.root == nil {
+		leaf := &streamTreeNode{leaf: true}
+		idx.root, idx.head, idx.tail = leaf, leaf, leaf
+		idx.treeNodes++
+	}
+	if len(idx.tail.nodes) == streamTreeFanout {
+		leaf := &streamTreeNode{leaf: true, prev: idx.tail}
+		idx.tail.next = leaf
+		idx.treeNodes++
+		idx.attach(idx.tail, leaf)
+		idx.tail = leaf
+	}
+	idx.tail.nodes = append(idx.tail.nodes, n)
+	idx.count++
+}
+
+// attach adds right as the sibling after left, the last child of its
+// parent, growing the tree by a level when the root is full
+func (idx *streamIndex) attach(left, right *streamTreeNode) {
+	sep := left.maxID()
+	parent := left.parent
+	if parent == nil {
+		idx.root = &streamTreeNode{children: []*streamTreeNode{left, right}, seps: []StreamID{sep}}
+		left.parent, right.parent = idx.root, idx.root
+		idx.treeNodes++
+		return
+	}
+	if len(parent.children) == streamTreeFanout {
+		sibling := &streamTreeNode{}
+		idx.treeNodes++
+		idx.attach(parent, sibling)
+		sibling.children = []*streamTreeNode{right}
+		right.parent = sibling
+		return
+	}
+	parent.children = append(parent.children, right)
+	parent.seps = append(parent.seps, sep)
+	right.parent = parent
+}
+
+// maxID returns the last ID under t
+func (t *streamTreeNode) maxID() StreamID {
+	for !t.leaf {
+		t = t.children[len(t.children)-1]
+	}
+	return t.nodes[len(t.nodes)-1].lastID()
+}
+
+// remove deletes the node at p, freeing the tree nodes it leaves empty
+func (idx *streamIndex) remove(p streamPos) {
+	leaf := p.leaf
+	leaf.nodes = append(leaf.nodes[:p.i], leaf.nodes[p.i+1:]...)
+	idx.count--
+	if len(leaf.nodes) > 0 {
+		return
+	}
+
+	if leaf.prev != nil {
+		leaf.prev.next = leaf.next
+	} else {
+		idx.head = leaf.next
+	}
+	if leaf.next != nil {
+		leaf.next.prev = leaf.prev
+	} else {
+		idx.tail = leaf.prev
+	}
+	idx.detach(leaf)
+	for idx.root != nil && !idx.root.leaf && len(idx.root.children) == 1 {
+		idx.root = idx.root.children[0]
+		idx.root.parent = nil
+		idx.treeNodes--
+	}
+}
+
+// detach unlinks the empty tree node t from its parent
+func (idx *streamIndex) detach(t *streamTreeNode) {
+	idx.treeNodes--
+	parent := t.parent
+	if parent == nil {
+		idx.root = nil
+		return
+	}
+
+	j := 0
+	for parent.children[j] != t {
+		j++
+	}
+	parent.children = append(parent.children[:j], parent.children[j+1:]...)
+	switch {
+	case j < len(parent.seps):
+		parent.seps = append(parent.seps[:j], parent.seps[j+1:]...)
+	case j > 0:
+		parent.seps = parent.seps[:j-1]
+	}
+	if len(parent.children) == 0 {
+		idx.detach(parent)
+	}
+}
+
+// Len returns the number of entries in the stream
+func (stream *Stream) Len() int64 {
+	return stream.length
+}
+
+// seek returns the position of the node holding the first entry with an
+// ID of at least id and the index of that entry in it. The position is
+// past the last node if there is none.
+func (stream *Stream) seek(id StreamID) (streamPos, int) {
+	p := stream.index.seek(id)
+	if !p.valid() {
+		return p, 0
+	}
+	return p, p.node().search(id)
+}
+
+// ascend calls fn for the entries with IDs between start and end inclusive
+// in ascending order until fn returns false
+func (stream *Stream) ascend(start, end StreamID, fn func(StreamEntry) bool) {
+	p, j := stream.seek(start)
+	for ; p.valid(); p, j = p.next(), 0 {
+		n := p.node()
+		for ; j < len(n.ids); j++ {
+			if n.ids[j].Compare(end) > 0 || !fn(n.entry(j)) {
+				return
+			}
+		}
+	}
+}
+
+// descend calls fn for the entries with IDs between start and end inclusive
+// in descending order until fn returns false
+func (stream *Stream) descend(start, end StreamID, fn func(StreamEntry) bool) {
+	p, j := streamPos{}, 0
+	if after, ok := end.next(); ok {
+		p, j = stream.seek(after)
+	}
+	for {
+		if j == 0 {
+			var ok bool
+			if p, ok = stream.index.prev(p); !ok {
+				return
+			}
+			j = len(p.node().ids)
+		}
+		j--
+		n := p.node()
+		if n.ids[j].Compare(start) < 0 || !fn(n.entry(j)) {
+			return
+		}
+	}
+}
+
+// entry looks up an entry by ID
+func (stream *Stream) entry(id StreamID) (StreamEntry, bool) {
+	p, j := stream.seek(id)
+	if !p.valid() || p.node().ids[j] != id {
+		return StreamEntry{}, false
+	}
+	return p.node().entry(j), true
+}
+
+// lastEntry returns the entry with the greatest ID
+func (stream *Stream) lastEntry() (StreamEntry, bool) {
+	n := stream.index.last()
+	if n == nil {
+		return StreamEntry{}, false
+	}
+	return n.entry(len(n.ids) - 1), true
+}
+
+// push appends an entry, which must have a greater ID than the last one
+func (stream *Stream) push(id StreamID, fields []string) {
+	if n := stream.index.last(); n == nil || n.full() {
+		stream.index.append(&streamNode{})
+	}
+	stream.index.last().push(id, fields)
+	stream.length++
+	if stream.length == 1 {
+		stream.FirstID = id
+	}
+}
+
+// delete removes the entry with the given ID, dropping its node once empty
+func (stream *Stream) delete(id StreamID) bool {
+	p, j := stream.seek(id)
+	if !p.valid() || p.node().ids[j] != id {
+		return false
+	}
+	n := p.node()
+	n.remove(j, j+1)
+	if len(n.ids) == 0 {
+		stream.index.remove(p)
+	}
+	stream.length--
+	stream.updateFirstID()
+	return true
+}
+
+// dropHead removes the first node
+func (stream *Stream) dropHead() {
+	stream.length -= int64(len(stream.index.first().ids))
+	stream.index.remove(streamPos{leaf: stream.index.head})
+}
+
+func (stream *Stream) updateFirstID() {
+	n := stream.index.first()
+	if n == nil {
+		stream.FirstID = StreamID{}
+		return
+	}
+	stream.FirstID = n.ids[0]
+}
+
+// nodeCount returns the number of nodes the entries are packed into
+func (stream *Stream) nodeCount() int64 {
+	return int64(stream.index.count)
+}
+
+// treeNodeCount returns the number of nodes of the tree indexing them
+func (stream *Stream) treeNodeCount() int64 {
+	return int64(stream.index.treeNodes)
+}
@@ -2,214 +2,230 @@ package store
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"keyra/persistence"
 )
 
-// XAdd adds an entry to a stream
-func (s *Store) XAdd(key string, id string, fields map[string]string, maxLen int64, approximate bool) (string, error) {
+// TrimOptions describes how a stream is trimmed by XADD and XTRIM. An empty
+// Strategy disables trimming; a zero Limit means no limit.
+type TrimOptions struct {
+	Strategy    string // MAXLEN or MINID
+	MaxLen      int64
+	MinID       string
+	Approximate bool
+	Limit       int64
+}
+
+// XAdd adds an entry to a stream. fields holds alternating fields and
+// values, which keep their order.
+func (s *Store) XAdd(key string, id string, fields []string, trim TrimOptions) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
+	minID, err := trim.minID()
+	if err != nil {
+		return "", err
+	}
+
 	var stream *Stream
 	value, exists := db.data[key]
-	if !exists {
-		stream = NewStream()
-		db.data[key] = StreamValueFromStream(stream)
-	} else if value.Type != StreamType {
+	if exists && value.Type != StreamType {
 		return "", fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
-	} else {
+	} else if exists {
 		stream = value.Stream()
+	} else {
+		stream = NewStream()
 	}
 
 	// Generate or validate ID
-	entryID, err := s.generateStreamID(stream, id)
+	entryID, err := stream.nextID(id)
 	if err != nil {
 		return "", err
 	}
 
-	// Create entry
-	entry := StreamEntry{
-		ID:     entryID,
-		Fields: fields,
+	stream.push(entryID, fields)
+	stream.LastID = entryID
+	stream.EntriesAdded++
+	if !exists {
+		s.setKey(db, key, StreamValueFromStream(stream))
+	}
+	s.notify(db, StreamEvent, "xadd", key)
+
+	if stream.trim(trim, minID) > 0 {
+		s.notify(db, StreamEvent, "xtrim", key)
 	}
 
-	// Add to stream
-	stream.Entries = append(stream.Entries, entry)
-	stream.LastID = entryID
-	if stream.FirstID == "" {
-		stream.FirstID = entryID
-	}
-
-	// Apply MAXLEN if specified
-	if maxLen > 0 {
-		if approximate {
-			// Approximate trimming - only trim if significantly over
-			if int64(len(stream.Entries)) > maxLen+100 {
-				trimCount := int64(len(stream.Entries)) - maxLen
-				stream.Entries = stream.Entries[trimCount:]
-				if len(stream.Entries) > 0 {
-					stream.FirstID = stream.Entries[0].ID
-				}
-			}
-		} else {
-			// Exact trimming
-			if int64(len(stream.Entries)) > maxLen {
-				trimCount := int64(len(stream.Entries)) - maxLen
-				stream.Entries = stream.Entries[trimCount:]
-				if len(stream.Entries) > 0 {
-					stream.FirstID = stream.Entries[0].ID
-				}
-			}
+	return entryID.String(), nil
+}
+
+func (opts TrimOptions) minID() (StreamID, error) {
+	if opts.Strategy != "MINID" {
+		return StreamID{}, nil
+	}
+	return ParseStreamID(opts.MinID)
+}
+
+// trim evicts entries from the head of the stream according to opts and
+// returns how many were evicted. Approximate trimming only evicts whole
+// nodes, and stops once evicting the next node would exceed the limit.
+func (stream *Stream) trim(opts TrimOptions, minID StreamID) int64 {
+	if opts.Strategy != "MAXLEN" && opts.Strategy != "MINID" {
+		return 0
+	}
+
+	var evicted int64
+	for stream.index.count > 0 {
+		if opts.Strategy == "MAXLEN" && stream.length <= opts.MaxLen {
+			break
+		}
+
+		n := stream.index.first()
+		entries := int64(len(n.ids))
+		if opts.Limit > 0 && evicted+entries > opts.Limit {
+			break
+		}
+
+		whole := n.lastID().Compare(minID) < 0
+		if opts.Strategy == "MAXLEN" {
+			whole = stream.length-entries >= opts.MaxLen
+		}
+		if whole {
+			stream.dropHead()
+			evicted += entries
+			continue
 		}
+		if opts.Approximate {
+			break
+		}
+
+		evict := n.search(minID)
+		if opts.Strategy == "MAXLEN" {
+			evict = int(stream.length - opts.MaxLen)
+		}
+		if evict > 0 {
+			n.remove(0, evict)
+			stream.length -= int64(evict)
+			evicted += int64(evict)
+		}
+		break
 	}
 
-	return entryID, nil
+	stream.updateFirstID()
+	return evicted
 }
 
-// generateStreamID generates or validates a stream entry ID
-func (s *Store) generateStreamID(stream *Stream, id string) (string, error) {
-	now := time.Now().UnixMilli()
+// nextID generates or validates the ID of an entry about to be added
+func (stream *Stream) nextID(id string) (StreamID, error) {
+	last := stream.LastID
 
 	if id == "*" {
-		// Auto-generate ID
-		seq := int64(0)
-		if stream.LastID != "" {
-			lastTime, lastSeq := parseStreamID(stream.LastID)
-			if now == lastTime {
-				seq = lastSeq + 1
-			} else if now < lastTime {
-				// Clock went backwards, use last time + 1
-				now = lastTime
-				seq = lastSeq + 1
-			}
+		now := uint64(time.Now().UnixMilli())
+		if now > last.Ms {
+			return StreamID{Ms: now}, nil
+		}
+		// Clock went backwards or several entries in the same millisecond
+		next, ok := last.next()
+		if !ok {
+			return StreamID{}, fmt.Errorf("ERR The stream has exhausted the last possible ID, unable to add more items")
 		}
-		return fmt.Sprintf("%d-%d", now, seq), nil
+		return next, nil
 	}
 
 	// Partial auto-generate (e.g., "12345-*")
 	if strings.HasSuffix(id, "-*") {
-		timeStr := strings.TrimSuffix(id, "-*")
-		specTime, err := strconv.ParseInt(timeStr, 10, 64)
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
 		if err != nil {
-			return "", fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+			return StreamID{}, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
 		}
-
-		seq := int64(0)
-		if stream.LastID != "" {
-			lastTime, lastSeq := parseStreamID(stream.LastID)
-			if specTime == lastTime {
-				seq = lastSeq + 1
-			} else if specTime < lastTime {
-				return "", fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
-			}
+		if ms > last.Ms {
+			return StreamID{Ms: ms}, nil
 		}
-		return fmt.Sprintf("%d-%d", specTime, seq), nil
-	}
-
-	// Explicit ID - validate it's greater than last
-	if stream.LastID != "" {
-		if compareStreamIDs(id, stream.LastID) <= 0 {
-			return "", fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		if ms < last.Ms || last.Seq == MaxStreamID.Seq {
+			return StreamID{}, fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
 		}
+		return StreamID{Ms: ms, Seq: last.Seq + 1}, nil
 	}
 
-	// Validate ID format
-	if !isValidStreamID(id) {
-		return "", fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+	entryID, err := ParseStreamID(id)
+	if err != nil {
+		return StreamID{}, err
 	}
-
-	return id, nil
+	if entryID.IsZero() {
+		return StreamID{}, fmt.Errorf("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if entryID.Compare(last) <= 0 {
+		return StreamID{}, fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	return entryID, nil
 }
 
 // XLen returns the length of a stream
 func (s *Store) XLen(key string) int64 {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != StreamType {
 		return 0
 	}
 
-	return int64(len(value.Stream().Entries))
+	return value.Stream().Len()
 }
 
-// XRange returns entries from a stream in a range
-func (s *Store) XRange(key, start, end string, count int64) []StreamEntry {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// XRange returns up to count entries with IDs between start and end, a
+// count of 0 meaning no limit
+func (s *Store) XRange(key string, start, end StreamID, count int64) []StreamEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != StreamType {
 		return nil
 	}
 
-	stream := value.Stream()
-	return s.rangeEntries(stream, start, end, count, false)
+	var result []StreamEntry
+	value.Stream().ascend(start, end, func(entry StreamEntry) bool {
+		result = append(result, entry)
+		return count <= 0 || int64(len(result)) < count
+	})
+	return result
 }
 
 // XRevRange returns entries from a stream in reverse order
-func (s *Store) XRevRange(key, end, start string, count int64) []StreamEntry {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Store) XRevRange(key string, end, start StreamID, count int64) []StreamEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != StreamType {
 		return nil
 	}
 
-	stream := value.Stream()
-	return s.rangeEntries(stream, start, end, count, true)
-}
-
-func (s *Store) rangeEntries(stream *Stream, start, end string, count int64, reverse bool) []StreamEntry {
-	// Normalize special IDs
-	if start == "-" {
-		start = "0-0"
-	}
-	if end == "+" {
-		end = "18446744073709551615-18446744073709551615"
-	}
-
 	var result []StreamEntry
-
-	if reverse {
-		for i := len(stream.Entries) - 1; i >= 0; i-- {
-			entry := stream.Entries[i]
-			if compareStreamIDs(entry.ID, start) >= 0 && compareStreamIDs(entry.ID, end) <= 0 {
-				result = append(result, entry)
-				if count > 0 && int64(len(result)) >= count {
-					break
-				}
-			}
-		}
-	} else {
-		for _, entry := range stream.Entries {
-			if compareStreamIDs(entry.ID, start) >= 0 && compareStreamIDs(entry.ID, end) <= 0 {
-				result = append(result, entry)
-				if count > 0 && int64(len(result)) >= count {
-					break
-				}
-			}
-		}
-	}
-
+	value.Stream().descend(start, end, func(entry StreamEntry) bool {
+		result = append(result, entry)
+		return count <= 0 || int64(len(result)) < count
+	})
 	return result
 }
 
-// XRead reads from one or more streams
-func (s *Store) XRead(keys []string, ids []string, count int64) map[string][]StreamEntry {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// XRead returns the entries with an ID greater than the matching ID of
+// each stream. Keys without new entries are left out of the map.
+func (s *Store) XRead(keys []string, ids []StreamID, count int64) map[string][]StreamEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 
 	result := make(map[string][]StreamEntry)
@@ -220,28 +236,16 @@ func (s *Store) XRead(keys []string, ids []string, count int64) map[string][]Str
 		if !exists || value.Type != StreamType {
 			continue
 		}
-
-		stream := value.Stream()
-		startID := ids[i]
-
-		// Handle special "$" ID - means only new entries
-		if startID == "$" {
-			startID = stream.LastID
-			if startID == "" {
-				startID = "0-0"
-			}
+		start, ok := ids[i].next()
+		if !ok {
+			continue
 		}
 
 		var entries []StreamEntry
-		for _, entry := range stream.Entries {
-			if compareStreamIDs(entry.ID, startID) > 0 {
-				entries = append(entries, entry)
-				if count > 0 && int64(len(entries)) >= count {
-					break
-				}
-			}
-		}
-
+		value.Stream().ascend(start, MaxStreamID, func(entry StreamEntry) bool {
+			entries = append(entries, entry)
+			return count <= 0 || int64(len(entries)) < count
+		})
 		if len(entries) > 0 {
 			result[key] = entries
 		}
@@ -250,122 +254,313 @@ func (s *Store) XRead(keys []string, ids []string, count int64) map[string][]Str
 	return result
 }
 
-// XTrim trims a stream to a maximum length
-func (s *Store) XTrim(key string, maxLen int64, approximate bool) int64 {
+// XResolveLastIDs parses the IDs given to XREAD, replacing each "$" with the
+// last ID of the matching stream so that a blocking read only sees entries
+// added after it started
+func (s *Store) XResolveLastIDs(keys []string, ids []string) ([]StreamID, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
 
+	resolved := make([]StreamID, len(ids))
+	for i, id := range ids {
+		if id != "$" {
+			parsed, err := ParseStreamID(id)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = parsed
+			continue
+		}
+		s.cleanupExpired(keys[i])
+		if value, exists := db.data[keys[i]]; exists && value.Type == StreamType {
+			resolved[i] = value.Stream().LastID
+		}
+	}
+	return resolved, nil
+}
+
+// XTrim trims a stream and returns the number of evicted entries
+func (s *Store) XTrim(key string, trim TrimOptions) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	minID, err := trim.minID()
+	if err != nil {
+		return 0, err
+	}
+
 	value, exists := db.data[key]
-	if !exists || value.Type != StreamType {
-		return 0
+	if !exists {
+		return 0, nil
+	}
+	if value.Type != StreamType {
+		return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 
-	stream := value.Stream()
-	originalLen := int64(len(stream.Entries))
+	evicted := value.Stream().trim(trim, minID)
+	if evicted > 0 {
+		s.notify(db, StreamEvent, "xtrim", key)
+	}
+	return evicted, nil
+}
 
-	if maxLen >= originalLen {
-		return 0
+// XDel deletes entries from a stream, remembering the highest deleted ID
+// so consumer group lag can tell whether a range has holes
+func (s *Store) XDel(key string, ids []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	parsed, err := parseStreamIDs(ids)
+	if err != nil {
+		return 0, err
 	}
 
-	trimCount := originalLen - maxLen
-	if approximate && trimCount < 100 {
-		return 0
+	value, exists := db.data[key]
+	if !exists {
+		return 0, nil
+	}
+	if value.Type != StreamType {
+		return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 
-	stream.Entries = stream.Entries[trimCount:]
-	if len(stream.Entries) > 0 {
-		stream.FirstID = stream.Entries[0].ID
-	} else {
-		stream.FirstID = ""
+	stream := value.Stream()
+	deleted := int64(0)
+	for _, id := range parsed {
+		if !stream.delete(id) {
+			continue
+		}
+		deleted++
+		if id.Compare(stream.MaxDeletedID) > 0 {
+			stream.MaxDeletedID = id
+		}
+	}
+	if deleted > 0 {
+		s.notify(db, StreamEvent, "xdel", key)
 	}
 
-	return trimCount
+	return deleted, nil
 }
 
-// XDel deletes entries from a stream
-func (s *Store) XDel(key string, ids []string) int64 {
+// XSetID sets the last generated ID of a stream and optionally its entries
+// added counter and maximal deleted ID. A negative entriesAdded and an empty
+// maxDeletedID leave those untouched.
+func (s *Store) XSetID(key, id string, entriesAdded int64, maxDeletedID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
+	lastID, err := ParseStreamID(id)
+	if err != nil {
+		return err
+	}
+	var maxDeleted StreamID
+	if maxDeletedID != "" {
+		maxDeleted, err = ParseStreamID(maxDeletedID)
+		if err != nil {
+			return err
+		}
+		if lastID.Compare(maxDeleted) < 0 {
+			return fmt.Errorf("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+		}
+	}
+
 	value, exists := db.data[key]
-	if !exists || value.Type != StreamType {
-		return 0
+	if !exists {
+		return fmt.Errorf("ERR no such key")
+	}
+	if value.Type != StreamType {
+		return fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
 	}
 
 	stream := value.Stream()
-	idSet := make(map[string]bool)
-	for _, id := range ids {
-		idSet[id] = true
+	if top, ok := stream.lastEntry(); ok {
+		if lastID.Compare(top.ID) < 0 {
+			return fmt.Errorf("ERR The ID specified in XSETID is smaller than the target stream top item")
+		}
+		if entriesAdded >= 0 && entriesAdded < stream.Len() {
+			return fmt.Errorf("ERR The entries_added specified in XSETID is smaller than the target stream length")
+		}
 	}
 
-	var newEntries []StreamEntry
-	deleted := int64(0)
+	stream.LastID = lastID
+	if entriesAdded >= 0 {
+		stream.EntriesAdded = entriesAdded
+	}
+	if !maxDeleted.IsZero() {
+		stream.MaxDeletedID = maxDeleted
+	}
+	s.notify(db, StreamEvent, "xsetid", key)
+	return nil
+}
 
-	for _, entry := range stream.Entries {
-		if idSet[entry.ID] {
-			deleted++
-		} else {
-			newEntries = append(newEntries, entry)
+// StreamInfo describes a stream as reported by XINFO STREAM. Entries holds
+// the first and last entry, or the first entries of the stream when the
+// full form was requested, in which case Groups is populated as well.
+type StreamInfo struct {
+	Length          int64
+	RadixTreeKeys   int64
+	RadixTreeNodes  int64
+	LastGeneratedID StreamID
+	MaxDeletedID    StreamID
+	EntriesAdded    int64
+	FirstID         StreamID
+	GroupCount      int64
+	Entries         []StreamEntry
+	Groups          []StreamGroupInfo
+}
+
+// StreamGroupInfo describes a consumer group. EntriesRead is
+// InvalidEntriesRead and Lag is negative when they can't be determined.
+// Pending and Consumers are only populated for XINFO STREAM FULL.
+type StreamGroupInfo struct {
+	Name            string
+	LastDeliveredID StreamID
+	EntriesRead     int64
+	Lag             int64
+	ConsumerCount   int64
+	PendingCount    int64
+	Pending         []PendingEntry
+	Consumers       []StreamConsumerInfo
+}
+
+// StreamConsumerInfo describes a consumer of a group. ActiveTime is zero if
+// the consumer never read or claimed an entry.
+type StreamConsumerInfo struct {
+	Name         string
+	SeenTime     time.Time
+	ActiveTime   time.Time
+	PendingCount int64
+	Pending      []PendingEntry
+}
+
+// XInfoStream returns information about a stream. With full set, up to
+// count entries and pending entries are included, zero meaning all of them.
+func (s *Store) XInfoStream(key string, full bool, count int64) (*StreamInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	stream, err := lookupStream(db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &StreamInfo{
+		Length:          stream.Len(),
+		RadixTreeKeys:   stream.nodeCount(),
+		RadixTreeNodes:  stream.treeNodeCount(),
+		LastGeneratedID: stream.LastID,
+		MaxDeletedID:    stream.MaxDeletedID,
+		EntriesAdded:    stream.EntriesAdded,
+		FirstID:         stream.FirstID,
+		GroupCount:      int64(len(stream.Groups)),
+	}
+
+	if !full {
+		if last, ok := stream.lastEntry(); ok {
+			first, _ := stream.entry(stream.FirstID)
+			info.Entries = []StreamEntry{first, last}
 		}
+		return info, nil
 	}
 
-	stream.Entries = newEntries
-	if len(stream.Entries) > 0 {
-		stream.FirstID = stream.Entries[0].ID
-		stream.LastID = stream.Entries[len(stream.Entries)-1].ID
-	} else {
-		stream.FirstID = ""
-		stream.LastID = ""
+	limit := int64(-1)
+	if count > 0 {
+		limit = count
+	}
+	stream.ascend(StreamID{}, MaxStreamID, func(entry StreamEntry) bool {
+		info.Entries = append(info.Entries, entry)
+		return limit < 0 || int64(len(info.Entries)) < limit
+	})
+
+	now := time.Now()
+	for _, name := range sortedGroupNames(stream) {
+		g := stream.Groups[name]
+		group := stream.groupInfo(g)
+		for _, p := range g.pendingRange(StreamID{}, MaxStreamID, limit, "", 0, now) {
+			group.Pending = append(group.Pending, *p)
+		}
+		for _, c := range sortedConsumers(g) {
+			consumer := consumerInfo(c)
+			for _, p := range g.pendingRange(StreamID{}, MaxStreamID, limit, c.Name, 0, now) {
+				consumer.Pending = append(consumer.Pending, *p)
+			}
+			group.Consumers = append(group.Consumers, consumer)
+		}
+		info.Groups = append(info.Groups, group)
 	}
 
-	return deleted
+	return info, nil
 }
 
-// XInfo returns information about a stream
-func (s *Store) XInfoStream(key string) (map[string]interface{}, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// XInfoGroups returns the consumer groups of a stream sorted by name
+func (s *Store) XInfoGroups(key string) ([]StreamGroupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
-	value, exists := db.data[key]
-	if !exists || value.Type != StreamType {
-		return nil, false
+	stream, err := lookupStream(db, key)
+	if err != nil {
+		return nil, err
 	}
 
-	stream := value.Stream()
-	info := map[string]interface{}{
-		"length":           int64(len(stream.Entries)),
-		"radix-tree-keys":  int64(1),
-		"radix-tree-nodes": int64(2),
-		"last-generated-id": stream.LastID,
-		"groups":           int64(len(stream.Groups)),
-		"first-entry":      nil,
-		"last-entry":       nil,
+	groups := make([]StreamGroupInfo, 0, len(stream.Groups))
+	for _, name := range sortedGroupNames(stream) {
+		groups = append(groups, stream.groupInfo(stream.Groups[name]))
 	}
+	return groups, nil
+}
 
-	if len(stream.Entries) > 0 {
-		info["first-entry"] = stream.Entries[0]
-		info["last-entry"] = stream.Entries[len(stream.Entries)-1]
+// XInfoConsumers returns the consumers of a group sorted by name
+func (s *Store) XInfoConsumers(key, group string) ([]StreamConsumerInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	stream, err := lookupStream(db, key)
+	if err != nil {
+		return nil, err
+	}
+	g, exists := stream.Groups[group]
+	if !exists {
+		return nil, fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
 	}
 
-	return info, true
+	consumers := make([]StreamConsumerInfo, 0, len(g.Consumers))
+	for _, c := range sortedConsumers(g) {
+		consumers = append(consumers, consumerInfo(c))
+	}
+	return consumers, nil
 }
 
-// XGroupCreate creates a consumer group
-func (s *Store) XGroupCreate(key, group, id string, mkstream bool) error {
+// XGroupCreate creates a consumer group. entriesRead is the group's logical
+// read counter, InvalidEntriesRead when unknown.
+func (s *Store) XGroupCreate(key, group, id string, mkstream bool, entriesRead int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 
+	if id != "$" {
+		if _, err := ParseStreamID(id); err != nil {
+			return err
+		}
+	}
+
 	value, exists := db.data[key]
 	if !exists {
 		if mkstream {
-			stream := NewStream()
-			db.data[key] = StreamValueFromStream(stream)
-			value = db.data[key]
+			value = StreamValueFromStream(NewStream())
+			s.setKey(db, key, value)
 		} else {
 			return fmt.Errorf("ERR The XGROUP subcommand requires the key to exist")
 		}
@@ -379,22 +574,19 @@ func (s *Store) XGroupCreate(key, group, id string, mkstream bool) error {
 		return fmt.Errorf("BUSYGROUP Consumer Group name already exists")
 	}
 
-	lastID := id
-	if id == "$" {
-		lastID = stream.LastID
-		if lastID == "" {
-			lastID = "0-0"
-		}
-	} else if id == "0" {
-		lastID = "0-0"
+	lastID, err := groupStartID(stream, id)
+	if err != nil {
+		return err
 	}
 
 	stream.Groups[group] = &ConsumerGroup{
 		Name:            group,
 		LastDeliveredID: lastID,
-		Pending:         make(map[string]*PendingEntry),
+		EntriesRead:     entriesRead,
+		Pending:         make(map[StreamID]*PendingEntry),
 		Consumers:       make(map[string]*Consumer),
 	}
+	s.notify(db, StreamEvent, "xgroup-create", key)
 
 	return nil
 }
@@ -416,47 +608,683 @@ func (s *Store) XGroupDestroy(key, group string) (bool, error) {
 	}
 
 	delete(stream.Groups, group)
+	s.notify(db, StreamEvent, "xgroup-destroy", key)
 	return true, nil
 }
 
-// Helper functions
+// XReadGroup reads entries on behalf of a consumer of a group. An ID of ">"
+// delivers entries never delivered to the group and adds them to the pending
+// entries list unless noack is set; any other ID returns the consumer's own
+// pending entries with a greater ID. Keys without a result are left out of
+// the map, except for history reads which always report the key.
+func (s *Store) XReadGroup(group, consumer string, keys, ids []string, count int64, noack bool) (map[string][]StreamEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.getCurrentDB()
+
+	starts := make([]StreamID, len(keys))
+	for i, key := range keys {
+		s.cleanupExpired(key)
+		if ids[i] == ">" {
+			continue
+		}
+		start, err := ParseStreamID(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		starts[i] = start
+	}
+
+	groups := make([]*ConsumerGroup, len(keys))
+	for i, key := range keys {
+		_, g, err := streamGroup(db, key, group, " in XREADGROUP with GROUP option")
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = g
+	}
 
-func parseStreamID(id string) (int64, int64) {
-	parts := strings.Split(id, "-")
-	if len(parts) != 2 {
-		return 0, 0
+	now := time.Now()
+	result := make(map[string][]StreamEntry)
+
+	for i, key := range keys {
+		stream := db.data[key].Stream()
+		g := groups[i]
+		c := s.groupConsumer(db, key, g, consumer, now)
+		c.LastSeenTime = now
+
+		if ids[i] != ">" {
+			limit := int64(-1)
+			if count > 0 {
+				limit = count
+			}
+			var entries []StreamEntry
+			if start, ok := starts[i].next(); ok {
+				for _, pending := range g.pendingRange(start, MaxStreamID, limit, consumer, 0, now) {
+					entry, ok := stream.entry(pending.EntryID)
+					if !ok {
+						entry = StreamEntry{ID: pending.EntryID}
+					}
+					entries = append(entries, entry)
+				}
+			}
+			result[key] = entries
+			continue
+		}
+
+		start, ok := g.LastDeliveredID.next()
+		if !ok {
+			continue
+		}
+		var entries []StreamEntry
+		stream.ascend(start, MaxStreamID, func(entry StreamEntry) bool {
+			entries = append(entries, entry)
+			stream.advanceGroup(g, entry.ID)
+			if !noack {
+				g.deliver(entry.ID, c, now)
+			}
+			return count <= 0 || int64(len(entries)) < count
+		})
+		if len(entries) > 0 {
+			c.ActiveTime = now
+			result[key] = entries
+		}
 	}
-	time, _ := strconv.ParseInt(parts[0], 10, 64)
-	seq, _ := strconv.ParseInt(parts[1], 10, 64)
-	return time, seq
+
+	return result, nil
 }
 
-func compareStreamIDs(a, b string) int {
-	aTime, aSeq := parseStreamID(a)
-	bTime, bSeq := parseStreamID(b)
+// XAck removes entries from the pending entries list of a group and returns
+// how many were acknowledged
+func (s *Store) XAck(key, group string, ids []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
 
-	if aTime < bTime {
-		return -1
+	parsed, err := parseStreamIDs(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	value, exists := db.data[key]
+	if !exists {
+		return 0, nil
+	}
+	if value.Type != StreamType {
+		return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	g, exists := value.Stream().Groups[group]
+	if !exists {
+		return 0, nil
+	}
+
+	acked := int64(0)
+	for _, id := range parsed {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	return acked, nil
+}
+
+// XPending returns the pending entries of a group between start and end,
+// sorted by ID. A negative count means no limit, an empty consumer matches
+// every consumer and minIdle filters out entries delivered more recently.
+func (s *Store) XPending(key, group string, start, end StreamID, count int64, consumer string, minIdle time.Duration) ([]PendingEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	_, g, err := streamGroup(db, key, group, "")
+	if err != nil {
+		return nil, err
 	}
-	if aTime > bTime {
-		return 1
+
+	pending := g.pendingRange(start, end, count, consumer, minIdle, time.Now())
+	result := make([]PendingEntry, len(pending))
+	for i, p := range pending {
+		result[i] = *p
 	}
-	if aSeq < bSeq {
+	return result, nil
+}
+
+// XGroupCreateConsumer creates a consumer in a group, reporting whether it
+// did not exist yet
+func (s *Store) XGroupCreateConsumer(key, group, consumer string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	_, g, err := xgroupLookup(db, key, group)
+	if err != nil {
+		return false, err
+	}
+	if _, exists := g.Consumers[consumer]; exists {
+		return false, nil
+	}
+	s.groupConsumer(db, key, g, consumer, time.Now())
+	return true, nil
+}
+
+// XGroupDelConsumer deletes a consumer and its pending entries, returning
+// how many entries it had pending
+func (s *Store) XGroupDelConsumer(key, group, consumer string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	_, g, err := xgroupLookup(db, key, group)
+	if err != nil {
+		return 0, err
+	}
+	c, exists := g.Consumers[consumer]
+	if !exists {
+		return 0, nil
+	}
+
+	pending := c.Pending
+	for id, entry := range g.Pending {
+		if entry.ConsumerName == consumer {
+			delete(g.Pending, id)
+		}
+	}
+	delete(g.Consumers, consumer)
+	s.notify(db, StreamEvent, "xgroup-delconsumer", key)
+	return pending, nil
+}
+
+// XGroupSetID sets the last delivered ID and the logical read counter of a
+// group
+func (s *Store) XGroupSetID(key, group, id string, entriesRead int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	stream, g, err := xgroupLookup(db, key, group)
+	if err != nil {
+		return err
+	}
+	lastID, err := groupStartID(stream, id)
+	if err != nil {
+		return err
+	}
+	g.LastDeliveredID = lastID
+	g.EntriesRead = entriesRead
+	s.notify(db, StreamEvent, "xgroup-setid", key)
+	return nil
+}
+
+// ClaimOptions controls how XCLAIM updates the claimed pending entries
+type ClaimOptions struct {
+	DeliveryTime time.Time // zero means now
+	RetryCount   int64     // negative means increment the delivery count
+	Force        bool
+	JustID       bool
+	LastID       string
+}
+
+// ClaimResult describes the outcome of XCLAIM and XAUTOCLAIM
+type ClaimResult struct {
+	Entries         []StreamEntry
+	Claimed         []PendingEntry
+	Deleted         []StreamID
+	Cursor          StreamID
+	LastDeliveredID StreamID
+}
+
+// XClaim transfers ownership of pending entries idle for at least minIdle
+// to consumer. Entries no longer present in the stream are dropped from the
+// pending entries list instead of being claimed.
+func (s *Store) XClaim(key, group, consumer string, minIdle time.Duration, ids []string, opts ClaimOptions) (*ClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	parsed, err := parseStreamIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	var lastID StreamID
+	if opts.LastID != "" {
+		if lastID, err = ParseStreamID(opts.LastID); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, g, err := streamGroup(db, key, group, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if lastID.Compare(g.LastDeliveredID) > 0 {
+		g.LastDeliveredID = lastID
+	}
+
+	now := time.Now()
+	deliveryTime := opts.DeliveryTime
+	if deliveryTime.IsZero() || deliveryTime.After(now) {
+		deliveryTime = now
+	}
+
+	c := s.groupConsumer(db, key, g, consumer, now)
+	c.LastSeenTime = now
+	result := &ClaimResult{LastDeliveredID: g.LastDeliveredID}
+
+	for _, id := range parsed {
+		entry, inStream := stream.entry(id)
+		pending, exists := g.Pending[id]
+
+		if !exists {
+			if !opts.Force || !inStream {
+				continue
+			}
+			pending = &PendingEntry{EntryID: id}
+			g.Pending[id] = pending
+		} else {
+			if minIdle > 0 && now.Sub(pending.DeliveryTime) < minIdle {
+				continue
+			}
+			if !inStream {
+				g.ack(id)
+				result.Deleted = append(result.Deleted, id)
+				continue
+			}
+		}
+
+		g.claim(pending, c, deliveryTime, opts.RetryCount, opts.JustID)
+		c.ActiveTime = now
+		result.Entries = append(result.Entries, entry)
+		result.Claimed = append(result.Claimed, *pending)
+	}
+
+	return result, nil
+}
+
+// XAutoClaim scans the pending entries list from start and claims up to
+// count entries idle for at least minIdle. The cursor in the result is the
+// ID to continue from, or 0-0 once the whole list has been scanned.
+func (s *Store) XAutoClaim(key, group, consumer string, minIdle time.Duration, start StreamID, count int64, justID bool) (*ClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	stream, g, err := streamGroup(db, key, group, "")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c := s.groupConsumer(db, key, g, consumer, now)
+	c.LastSeenTime = now
+	result := &ClaimResult{LastDeliveredID: g.LastDeliveredID}
+
+	attempts := count * 10
+	claimed := int64(0)
+	for _, pending := range g.pendingRange(start, MaxStreamID, -1, "", 0, now) {
+		if attempts == 0 || claimed == count {
+			result.Cursor = pending.EntryID
+			break
+		}
+		attempts--
+
+		if minIdle > 0 && now.Sub(pending.DeliveryTime) < minIdle {
+			continue
+		}
+		entry, inStream := stream.entry(pending.EntryID)
+		if !inStream {
+			g.ack(pending.EntryID)
+			result.Deleted = append(result.Deleted, pending.EntryID)
+			continue
+		}
+
+		g.claim(pending, c, now, -1, justID)
+		c.ActiveTime = now
+		result.Entries = append(result.Entries, entry)
+		result.Claimed = append(result.Claimed, *pending)
+		claimed++
+	}
+
+	return result, nil
+}
+
+// StreamSnapshot returns a copy of the stream stored at key, including its
+// consumer groups, for rewriting the AOF
+func (s *Store) StreamSnapshot(key string) *persistence.StreamData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	value, exists := db.data[key]
+	if !exists || value.Type != StreamType {
+		return nil
+	}
+	return serializeValue(value).StreamValue
+}
+
+func sortedGroupNames(stream *Stream) []string {
+	names := make([]string, 0, len(stream.Groups))
+	for name := range stream.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedConsumers(g *ConsumerGroup) []*Consumer {
+	consumers := make([]*Consumer, 0, len(g.Consumers))
+	for _, c := range g.Consumers {
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers
+}
+
+func consumerInfo(c *Consumer) StreamConsumerInfo {
+	return StreamConsumerInfo{
+		Name:         c.Name,
+		SeenTime:     c.LastSeenTime,
+		ActiveTime:   c.ActiveTime,
+		PendingCount: c.Pending,
+	}
+}
+
+func lookupStream(db *Database, key string) (*Stream, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERR no such key")
+	}
+	if value.Type != StreamType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.Stream(), nil
+}
+
+func xgroupLookup(db *Database, key, group string) (*Stream, *ConsumerGroup, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, nil, fmt.Errorf("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	if value.Type != StreamType {
+		return nil, nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	stream := value.Stream()
+	g, exists := stream.Groups[group]
+	if !exists {
+		return nil, nil, fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+	}
+	return stream, g, nil
+}
+
+// streamGroup looks up a group, failing with NOGROUP when the key or the
+// group does not exist. context is appended to the error message.
+func streamGroup(db *Database, key, group, context string) (*Stream, *ConsumerGroup, error) {
+	value, exists := db.data[key]
+	if exists && value.Type != StreamType {
+		return nil, nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	var g *ConsumerGroup
+	if exists {
+		g = value.Stream().Groups[group]
+	}
+	if g == nil {
+		return nil, nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'%s", key, group, context)
+	}
+	return value.Stream(), g, nil
+}
+
+// groupStartID resolves the ID given to XGROUP CREATE and SETID
+func groupStartID(stream *Stream, id string) (StreamID, error) {
+	if id == "$" {
+		return stream.LastID, nil
+	}
+	return ParseStreamID(id)
+}
+
+// consumer returns the named consumer, creating it if needed
+func (g *ConsumerGroup) consumer(name string, now time.Time) *Consumer {
+	c, exists := g.Consumers[name]
+	if !exists {
+		c = &Consumer{Name: name, LastSeenTime: now}
+		g.Consumers[name] = c
+	}
+	return c
+}
+
+// groupConsumer returns the named consumer of the group at key, creating
+// it and raising an xgroup-createconsumer event if needed
+func (s *Store) groupConsumer(db *Database, key string, g *ConsumerGroup, name string, now time.Time) *Consumer {
+	if _, exists := g.Consumers[name]; !exists {
+		s.notify(db, StreamEvent, "xgroup-createconsumer", key)
+	}
+	return g.consumer(name, now)
+}
+
+// deliver records a delivery of id to c in the pending entries list
+func (g *ConsumerGroup) deliver(id StreamID, c *Consumer, now time.Time) {
+	if entry, exists := g.Pending[id]; exists {
+		if owner, ok := g.Consumers[entry.ConsumerName]; ok {
+			owner.Pending--
+		}
+		entry.ConsumerName = c.Name
+		entry.DeliveryTime = now
+		entry.DeliveryCount++
+	} else {
+		g.Pending[id] = &PendingEntry{
+			EntryID:       id,
+			ConsumerName:  c.Name,
+			DeliveryTime:  now,
+			DeliveryCount: 1,
+		}
+	}
+	c.Pending++
+}
+
+// claim hands a pending entry over to c, updating its delivery time and
+// either setting or incrementing its delivery count
+func (g *ConsumerGroup) claim(entry *PendingEntry, c *Consumer, deliveryTime time.Time, retryCount int64, justID bool) {
+	if owner, ok := g.Consumers[entry.ConsumerName]; ok && entry.ConsumerName != "" {
+		owner.Pending--
+	}
+	entry.ConsumerName = c.Name
+	entry.DeliveryTime = deliveryTime
+	if retryCount >= 0 {
+		entry.DeliveryCount = retryCount
+	} else if !justID {
+		entry.DeliveryCount++
+	}
+	c.Pending++
+}
+
+// ack removes id from the pending entries list
+func (g *ConsumerGroup) ack(id StreamID) bool {
+	entry, exists := g.Pending[id]
+	if !exists {
+		return false
+	}
+	if c, ok := g.Consumers[entry.ConsumerName]; ok {
+		c.Pending--
+	}
+	delete(g.Pending, id)
+	return true
+}
+
+// pendingRange returns pending entries with IDs between start and end
+// inclusive sorted by ID. A negative count means no limit.
+func (g *ConsumerGroup) pendingRange(start, end StreamID, count int64, consumer string, minIdle time.Duration, now time.Time) []*PendingEntry {
+	var matched []*PendingEntry
+	for _, entry := range g.Pending {
+		if consumer != "" && entry.ConsumerName != consumer {
+			continue
+		}
+		if entry.EntryID.Compare(start) < 0 || entry.EntryID.Compare(end) > 0 {
+			continue
+		}
+		if minIdle > 0 && now.Sub(entry.DeliveryTime) < minIdle {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].EntryID.Compare(matched[j].EntryID) < 0
+	})
+	if count >= 0 && int64(len(matched)) > count {
+		matched = matched[:count]
+	}
+	return matched
+}
+
+// groupInfo summarizes a group without its pending entries and consumers
+func (stream *Stream) groupInfo(g *ConsumerGroup) StreamGroupInfo {
+	return StreamGroupInfo{
+		Name:            g.Name,
+		LastDeliveredID: g.LastDeliveredID,
+		EntriesRead:     g.EntriesRead,
+		Lag:             stream.lag(g),
+		ConsumerCount:   int64(len(g.Consumers)),
+		PendingCount:    int64(len(g.Pending)),
+	}
+}
+
+// advanceGroup moves the last delivered ID of a group to id, keeping its
+// logical read counter in step when it can be trusted
+func (stream *Stream) advanceGroup(g *ConsumerGroup, id StreamID) {
+	if g.EntriesRead != InvalidEntriesRead && !stream.rangeHasTombstones(id) {
+		g.EntriesRead++
+	} else if stream.EntriesAdded > 0 {
+		g.EntriesRead = stream.estimateDistance(id)
+	}
+	g.LastDeliveredID = id
+}
+
+// lag returns the number of entries the group has yet to read, or -1 when
+// deletions make it impossible to tell
+func (stream *Stream) lag(g *ConsumerGroup) int64 {
+	if stream.EntriesAdded == 0 {
+		return 0
+	}
+	if g.EntriesRead != InvalidEntriesRead && !stream.rangeHasTombstones(g.LastDeliveredID) &&
+		g.LastDeliveredID.Compare(stream.FirstID) >= 0 {
+		return stream.EntriesAdded - g.EntriesRead
+	}
+	entriesRead := stream.estimateDistance(g.LastDeliveredID)
+	if entriesRead == InvalidEntriesRead {
 		return -1
 	}
-	if aSeq > bSeq {
-		return 1
+	return stream.EntriesAdded - entriesRead
+}
+
+// estimateDistance returns the number of entries added to the stream up to
+// and including id, or InvalidEntriesRead if deletions make it unknowable
+func (stream *Stream) estimateDistance(id StreamID) int64 {
+	if stream.EntriesAdded == 0 {
+		return 0
+	}
+	cmpLast := id.Compare(stream.LastID)
+	if stream.Len() == 0 && cmpLast <= 0 {
+		return stream.EntriesAdded
+	}
+	if cmpLast == 0 {
+		return stream.EntriesAdded
+	} else if cmpLast > 0 {
+		return InvalidEntriesRead
 	}
-	return 0
+
+	if stream.MaxDeletedID.IsZero() || stream.MaxDeletedID.Compare(stream.FirstID) < 0 {
+		switch cmpFirst := id.Compare(stream.FirstID); {
+		case cmpFirst < 0:
+			return stream.EntriesAdded - stream.Len()
+		case cmpFirst == 0:
+			return stream.EntriesAdded - stream.Len() + 1
+		}
+	}
+	return InvalidEntriesRead
 }
 
-func isValidStreamID(id string) bool {
-	parts := strings.Split(id, "-")
-	if len(parts) != 2 {
+// rangeHasTombstones reports whether entries from start onwards may have
+// been deleted with XDEL
+func (stream *Stream) rangeHasTombstones(start StreamID) bool {
+	if stream.Len() == 0 || stream.MaxDeletedID.IsZero() {
 		return false
 	}
-	_, err1 := strconv.ParseInt(parts[0], 10, 64)
-	_, err2 := strconv.ParseInt(parts[1], 10, 64)
-	return err1 == nil && err2 == nil
+	return start.Compare(stream.MaxDeletedID) <= 0
 }
 
+// NormalizeStreamRange resolves a range bound as accepted by XRANGE and
+// XPENDING: "-" and "+", a full or partial ID, or an exclusive "(" ID
+func NormalizeStreamRange(id string, isEnd bool) (StreamID, error) {
+	switch id {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return MaxStreamID, nil
+	}
+
+	missingSeq := uint64(0)
+	if isEnd {
+		missingSeq = MaxStreamID.Seq
+	}
+
+	exclusive := strings.HasPrefix(id, "(")
+	parsed, err := parseStreamID(strings.TrimPrefix(id, "("), missingSeq)
+	if err != nil || !exclusive {
+		return parsed, err
+	}
+
+	if isEnd {
+		if prev, ok := parsed.prev(); ok {
+			return prev, nil
+		}
+		return StreamID{}, fmt.Errorf("ERR invalid end ID for the interval")
+	}
+	if next, ok := parsed.next(); ok {
+		return next, nil
+	}
+	return StreamID{}, fmt.Errorf("ERR invalid start ID for the interval")
+}
+
+func parseStreamIDs(ids []string) ([]StreamID, error) {
+	parsed := make([]StreamID, len(ids))
+	for i, id := range ids {
+		n, err := ParseStreamID(id)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// parseStoredStreamID parses an ID read from a snapshot, where an empty
+// string stands for 0-0
+func parseStoredStreamID(id string) (StreamID, bool) {
+	if id == "" {
+		return StreamID{}, true
+	}
+	parsed, err := ParseStreamID(id)
+	return parsed, err == nil
+}
+
+// fieldPairs flattens fields stored as a map by older snapshots
+func fieldPairs(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(fields)*2)
+	for _, name := range names {
+		pairs = append(pairs, name, fields[name])
+	}
+	return pairs
+}
@@ -8,8 +8,11 @@ func (s *Store) SetWithExpiration(key, value string, expiration time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	db := s.getCurrentDB()
-	db.data[key] = StringValue(value)
+	s.setKey(db, key, StringValue(value))
 	db.expiration[key] = expiration
+	s.indexKey(db, key)
+	s.notify(db, StringEvent, "set", key)
+	s.notify(db, GenericEvent, "expire", key)
 }
 
 func (s *Store) Append(key, value string) int {
@@ -17,24 +20,26 @@ func (s *Store) Append(key, value string) int {
 	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
+	defer s.notify(db, StringEvent, "append", key)
+	defer s.indexKey(db, key)
 	
 	if existing, exists := db.data[key]; exists && existing.Type == StringType {
 		newValue := existing.String() + value
 		db.data[key] = StringValue(newValue)
 		return len(newValue)
 	} else {
-		db.data[key] = StringValue(value)
+		s.setKey(db, key, StringValue(value))
 		return len(value)
 	}
 }
 
 func (s *Store) GetRange(key string, start, end int) string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != StringType {
 		return ""
 	}
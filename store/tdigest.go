@@ -0,0 +1,459 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"keyra/persistence"
+)
+
+// TDigest estimates quantiles with a merging t-digest. Added values are
+// buffered and folded into centroids once the buffer outgrows the
+// compression; centroid sizes are bounded by the k1 scale function so the
+// tails stay precise.
+type TDigest struct {
+	Compression  float64
+	Centroids    []TDigestCentroid
+	Buffer       []float64
+	Min          float64
+	Max          float64
+	Compressions int64
+}
+
+// TDigestCentroid is a cluster of values with their mean and count
+type TDigestCentroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigestInfo describes a t-digest for TDIGEST.INFO
+type TDigestInfo struct {
+	Compression    float64
+	Capacity       int64
+	MergedNodes    int64
+	UnmergedNodes  int64
+	MergedWeight   float64
+	UnmergedWeight float64
+	Observations   float64
+	Compressions   int64
+	MemoryUsage    int64
+}
+
+// DefaultTDigestCompression is the compression of t-digests created
+// without COMPRESSION
+const DefaultTDigestCompression = 100
+
+func TDigestValue(td *TDigest) *RedisValue {
+	return &RedisValue{Type: TDigestType, Value: td}
+}
+
+func (rv *RedisValue) TDigest() *TDigest {
+	if rv.Type != TDigestType {
+		panic("value is not a t-digest")
+	}
+	return rv.Value.(*TDigest)
+}
+
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{Compression: compression, Min: math.Inf(1), Max: math.Inf(-1)}
+}
+
+// capacity is the number of buffered values that triggers a merge
+func (td *TDigest) capacity() int {
+	return int(6*td.Compression) + 10
+}
+
+// Add buffers a value, merging the buffer when it is full
+func (td *TDigest) Add(value float64) {
+	td.Buffer = append(td.Buffer, value)
+	td.Min = math.Min(td.Min, value)
+	td.Max = math.Max(td.Max, value)
+	if len(td.Buffer) >= td.capacity() {
+		td.Centroids = td.merged()
+		td.Buffer = nil
+		td.Compressions++
+	}
+}
+
+func (td *TDigest) weight() float64 {
+	total := float64(len(td.Buffer))
+	for _, c := range td.Centroids {
+		total += c.Weight
+	}
+	return total
+}
+
+// merged folds the buffer into the centroids without modifying td
+func (td *TDigest) merged() []TDigestCentroid {
+	all := make([]TDigestCentroid, 0, len(td.Centroids)+len(td.Buffer))
+	all = append(all, td.Centroids...)
+	for _, v := range td.Buffer {
+		all = append(all, TDigestCentroid{Mean: v, Weight: 1})
+	}
+	return compressCentroids(all, td.Compression)
+}
+
+func compressCentroids(all []TDigestCentroid, compression float64) []TDigestCentroid {
+	if len(all) == 0 {
+		return nil
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+
+	total := 0.0
+	for _, c := range all {
+		total += c.Weight
+	}
+	scale := func(q float64) float64 {
+		return compression / (2 * math.Pi) * math.Asin(2*q-1)
+	}
+	limit := func(q float64) float64 {
+		k := scale(q) + 1
+		if k >= compression/4 {
+			return 1
+		}
+		return (math.Sin(k*2*math.Pi/compression) + 1) / 2
+	}
+
+	result := []TDigestCentroid{all[0]}
+	soFar := 0.0
+	qLimit := limit(0)
+	for _, next := range all[1:] {
+		current := &result[len(result)-1]
+		if (soFar+current.Weight+next.Weight)/total <= qLimit {
+			weight := current.Weight + next.Weight
+			current.Mean += (next.Mean - current.Mean) * next.Weight / weight
+			current.Weight = weight
+			continue
+		}
+		soFar += current.Weight
+		qLimit = limit(soFar / total)
+		result = append(result, next)
+	}
+	return result
+}
+
+// Quantile estimates the value below which the fraction q of the values
+// fall, interpolating between centroid means. Single-value centroids are
+// treated as exact values.
+func (td *TDigest) Quantile(q float64) float64 {
+	centroids := td.merged()
+	if len(centroids) == 0 {
+		return math.NaN()
+	}
+	total := 0.0
+	for _, c := range centroids {
+		total += c.Weight
+	}
+	index := q * total
+
+	first, last := centroids[0], centroids[len(centroids)-1]
+	if index < 1 {
+		return td.Min
+	}
+	if first.Weight > 1 && index < first.Weight/2 {
+		return td.Min + (index-1)/(first.Weight/2-1)*(first.Mean-td.Min)
+	}
+	if index > total-1 {
+		return td.Max
+	}
+	if last.Weight > 1 && total-index <= last.Weight/2 {
+		return td.Max - (total-index-1)/(last.Weight/2-1)*(td.Max-last.Mean)
+	}
+
+	soFar := first.Weight / 2
+	for i := 0; i < len(centroids)-1; i++ {
+		left, right := centroids[i], centroids[i+1]
+		step := (left.Weight + right.Weight) / 2
+		if soFar+step <= index {
+			soFar += step
+			continue
+		}
+		leftUnit, rightUnit := 0.0, 0.0
+		if left.Weight == 1 {
+			if index-soFar < 0.5 {
+				return left.Mean
+			}
+			leftUnit = 0.5
+		}
+		if right.Weight == 1 {
+			if soFar+step-index <= 0.5 {
+				return right.Mean
+			}
+			rightUnit = 0.5
+		}
+		lower := index - soFar - leftUnit
+		upper := soFar + step - index - rightUnit
+		return (left.Mean*upper + right.Mean*lower) / (lower + upper)
+	}
+	return last.Mean
+}
+
+// CDF estimates the fraction of values below value, counting values equal
+// to it as half below
+func (td *TDigest) CDF(value float64) float64 {
+	centroids := td.merged()
+	if len(centroids) == 0 {
+		return math.NaN()
+	}
+	if value < td.Min {
+		return 0
+	}
+	if value > td.Max {
+		return 1
+	}
+	if td.Min == td.Max {
+		return 0.5
+	}
+	total := 0.0
+	for _, c := range centroids {
+		total += c.Weight
+	}
+
+	first, last := centroids[0], centroids[len(centroids)-1]
+	if value < first.Mean {
+		return (value - td.Min) / (first.Mean - td.Min) * first.Weight / 2 / total
+	}
+	if value > last.Mean {
+		return 1 - (td.Max-value)/(td.Max-last.Mean)*last.Weight/2/total
+	}
+
+	soFar := 0.0
+	for i, c := range centroids {
+		if c.Mean == value {
+			equal := 0.0
+			for _, same := range centroids[i:] {
+				if same.Mean != value {
+					break
+				}
+				equal += same.Weight
+			}
+			return (soFar + equal/2) / total
+		}
+		if i+1 < len(centroids) && value < centroids[i+1].Mean {
+			next := centroids[i+1]
+			step := (c.Weight + next.Weight) / 2
+			return (soFar + c.Weight/2 + step*(value-c.Mean)/(next.Mean-c.Mean)) / total
+		}
+		soFar += c.Weight
+	}
+	return 1
+}
+
+// TDigestCreate creates an empty t-digest
+func (s *Store) TDigestCreate(key string, compression float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR T-Digest: key already exists")
+	}
+	s.setKey(db, key, TDigestValue(NewTDigest(compression)))
+	return nil
+}
+
+// TDigestAdd adds values to a t-digest
+func (s *Store) TDigestAdd(key string, values []float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	td, err := lookupTDigest(db, key)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		td.Add(v)
+	}
+	return nil
+}
+
+// TDigestReset empties a t-digest, keeping its compression
+func (s *Store) TDigestReset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	td, err := lookupTDigest(db, key)
+	if err != nil {
+		return err
+	}
+	*td = *NewTDigest(td.Compression)
+	return nil
+}
+
+// TDigestMerge merges the source digests into dest, which is created when
+// missing. With override the current contents of dest are discarded; a
+// zero compression keeps the largest compression of the inputs.
+func (s *Store) TDigestMerge(dest string, sources []string, compression float64, override bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(dest)
+	db := s.getCurrentDB()
+
+	var digests []*TDigest
+	for _, source := range sources {
+		s.cleanupExpired(source)
+		td, err := lookupTDigest(db, source)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, td)
+	}
+
+	var target *TDigest
+	if _, exists := db.data[dest]; exists {
+		var err error
+		if target, err = lookupTDigest(db, dest); err != nil {
+			return err
+		}
+		if !override {
+			digests = append(digests, target)
+		}
+	}
+
+	if compression == 0 {
+		for _, td := range digests {
+			compression = math.Max(compression, td.Compression)
+		}
+	}
+	result := NewTDigest(compression)
+	var all []TDigestCentroid
+	for _, td := range digests {
+		all = append(all, td.merged()...)
+		result.Min = math.Min(result.Min, td.Min)
+		result.Max = math.Max(result.Max, td.Max)
+	}
+	result.Centroids = compressCentroids(all, compression)
+	result.Compressions = 1
+
+	if target == nil {
+		s.setKey(db, dest, TDigestValue(result))
+	} else {
+		*target = *result
+	}
+	return nil
+}
+
+// TDigestQuantiles estimates the values at each of the fractions
+func (s *Store) TDigestQuantiles(key string, fractions []float64) ([]float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	td, err := s.readTDigest(key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]float64, len(fractions))
+	for i, q := range fractions {
+		result[i] = td.Quantile(q)
+	}
+	return result, nil
+}
+
+// TDigestCDF estimates the fraction of values below each of values
+func (s *Store) TDigestCDF(key string, values []float64) ([]float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	td, err := s.readTDigest(key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]float64, len(values))
+	for i, v := range values {
+		result[i] = td.CDF(v)
+	}
+	return result, nil
+}
+
+// TDigestMinMax returns the smallest and largest value added, NaN when the
+// digest is empty
+func (s *Store) TDigestMinMax(key string) (float64, float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	td, err := s.readTDigest(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if td.weight() == 0 {
+		return math.NaN(), math.NaN(), nil
+	}
+	return td.Min, td.Max, nil
+}
+
+// TDigestInfo describes a t-digest
+func (s *Store) TDigestInfo(key string) (*TDigestInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	td, err := s.readTDigest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TDigestInfo{
+		Compression:    td.Compression,
+		Capacity:       int64(td.capacity()),
+		MergedNodes:    int64(len(td.Centroids)),
+		UnmergedNodes:  int64(len(td.Buffer)),
+		UnmergedWeight: float64(len(td.Buffer)),
+		Compressions:   td.Compressions,
+	}
+	for _, c := range td.Centroids {
+		info.MergedWeight += c.Weight
+	}
+	info.Observations = info.MergedWeight + info.UnmergedWeight
+	info.MemoryUsage = int64(len(td.Centroids))*16 + int64(cap(td.Buffer))*8 + 64
+	return info, nil
+}
+
+func (s *Store) readTDigest(key string) (*TDigest, error) {
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR T-Digest: key does not exist")
+	}
+	return lookupTDigest(s.getCurrentDB(), key)
+}
+
+func lookupTDigest(db *Database, key string) (*TDigest, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERR T-Digest: key does not exist")
+	}
+	if value.Type != TDigestType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.TDigest(), nil
+}
+
+func serializeTDigest(td *TDigest) *persistence.TDigestData {
+	data := &persistence.TDigestData{
+		Compression:  td.Compression,
+		Means:        make([]float64, len(td.Centroids)),
+		Weights:      make([]float64, len(td.Centroids)),
+		Buffer:       append([]float64(nil), td.Buffer...),
+		Min:          td.Min,
+		Max:          td.Max,
+		Compressions: td.Compressions,
+	}
+	for i, c := range td.Centroids {
+		data.Means[i] = c.Mean
+		data.Weights[i] = c.Weight
+	}
+	return data
+}
+
+func deserializeTDigest(data *persistence.TDigestData) (*TDigest, bool) {
+	if data.Compression <= 0 || len(data.Means) != len(data.Weights) {
+		return nil, false
+	}
+	td := NewTDigest(data.Compression)
+	td.Min, td.Max = data.Min, data.Max
+	td.Compressions = data.Compressions
+	td.Buffer = append([]float64(nil), data.Buffer...)
+	for i, mean := range data.Means {
+		td.Centroids = append(td.Centroids, TDigestCentroid{Mean: mean, Weight: data.Weights[i]})
+	}
+	return td, true
+}
@@ -0,0 +1,1051 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"keyra/persistence"
+)
+
+// TimeSeries is a series of samples ordered by timestamp. Samples older
+// than Retention milliseconds before the newest one are dropped; a zero
+// Retention keeps them forever.
+type TimeSeries struct {
+	Samples         []TimeSeriesSample
+	Retention       int64
+	DuplicatePolicy string // BLOCK, FIRST, LAST, MIN, MAX or SUM
+	ChunkSize       int64
+	Labels          []TimeSeriesLabel
+	Rules           []TimeSeriesRule
+	SourceKey       string // series this one is compacted from, if any
+
+	trimmed int // dropped samples still held at the front of the backing array
+}
+
+// TimeSeriesSample is a single timestamped value
+type TimeSeriesSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// TimeSeriesLabel is a name/value pair attached to a series
+type TimeSeriesLabel struct {
+	Name  string
+	Value string
+}
+
+// TimeSeriesRule downsamples a series into DestKey. The open bucket is
+// always the one holding the newest source sample; older buckets are
+// written to the destination as they close.
+type TimeSeriesRule struct {
+	DestKey     string
+	Aggregation string
+	Bucket      int64
+	Align       int64
+}
+
+// TimeSeriesOptions configures a series on creation and TS.ALTER. The Set
+// flags mark which fields TS.ALTER changes; an empty DuplicatePolicy leaves
+// the policy unchanged.
+type TimeSeriesOptions struct {
+	Retention       int64
+	ChunkSize       int64
+	DuplicatePolicy string
+	Labels          []TimeSeriesLabel
+
+	SetRetention bool
+	SetChunkSize bool
+	SetLabels    bool
+}
+
+// TimeSeriesQuery describes a range query. An empty Aggregation returns the
+// raw samples; a zero Count means no limit.
+type TimeSeriesQuery struct {
+	From, To        int64
+	Reverse         bool
+	Latest          bool
+	FilterByTS      []int64
+	FilterByValue   bool
+	MinValue        float64
+	MaxValue        float64
+	Count           int
+	Aggregation     string
+	Bucket          int64
+	Align           int64
+	BucketTimestamp string // start, end or mid
+	Empty           bool
+	GroupBy         string
+	Reducer         string
+}
+
+// TimeSeriesFilter matches series by label. Values holds the accepted
+// values, where an empty value matches series without the label.
+type TimeSeriesFilter struct {
+	Label  string
+	Values []string
+	Negate bool
+}
+
+// TimeSeriesResult is the reply for one series of TS.MRANGE or TS.MGET
+type TimeSeriesResult struct {
+	Key     string
+	Labels  []TimeSeriesLabel
+	Samples []TimeSeriesSample
+}
+
+// TimeSeriesInfo describes a series for TS.INFO
+type TimeSeriesInfo struct {
+	TotalSamples    int
+	MemoryUsage     int
+	FirstTimestamp  int64
+	LastTimestamp   int64
+	Retention       int64
+	ChunkCount      int64
+	ChunkSize       int64
+	DuplicatePolicy string
+	Labels          []TimeSeriesLabel
+	SourceKey       string
+	Rules           []TimeSeriesRule
+}
+
+// DefaultTimeSeriesChunkSize is the chunk size of series created without
+// CHUNK_SIZE
+const DefaultTimeSeriesChunkSize = 4096
+
+var timeSeriesAggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true, "range": true, "count": true,
+	"first": true, "last": true, "std.p": true, "std.s": true, "var.p": true, "var.s": true,
+}
+
+var timeSeriesPolicies = map[string]bool{
+	"BLOCK": true, "FIRST": true, "LAST": true, "MIN": true, "MAX": true, "SUM": true,
+}
+
+func TimeSeriesValue(ts *TimeSeries) *RedisValue {
+	return &RedisValue{Type: TimeSeriesType, Value: ts}
+}
+
+func (rv *RedisValue) TimeSeries() *TimeSeries {
+	if rv.Type != TimeSeriesType {
+		panic("value is not a time series")
+	}
+	return rv.Value.(*TimeSeries)
+}
+
+// ParseTimeSeriesAggregation validates an aggregation type, returning it
+// in lower case
+func ParseTimeSeriesAggregation(name string) (string, error) {
+	name = strings.ToLower(name)
+	if !timeSeriesAggregations[name] {
+		return "", fmt.Errorf("ERR TSDB: Unknown aggregation type")
+	}
+	return name, nil
+}
+
+// ParseTimeSeriesPolicy validates a duplicate policy, returning it in upper
+// case
+func ParseTimeSeriesPolicy(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if !timeSeriesPolicies[name] {
+		return "", fmt.Errorf("ERR TSDB: Unknown DUPLICATE_POLICY")
+	}
+	return name, nil
+}
+
+// ParseTimeSeriesFilters parses label matchers of the form label=value,
+// label!=value, label= , label!= , label=(a,b) and label!=(a,b). At least
+// one matcher has to require a label value.
+func ParseTimeSeriesFilters(exprs []string) ([]TimeSeriesFilter, error) {
+	filters := make([]TimeSeriesFilter, 0, len(exprs))
+	positive := false
+	for _, expr := range exprs {
+		eq := strings.Index(expr, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("ERR TSDB: failed parsing labels")
+		}
+		filter := TimeSeriesFilter{Label: expr[:eq]}
+		if strings.HasSuffix(filter.Label, "!") {
+			filter.Label = filter.Label[:len(filter.Label)-1]
+			filter.Negate = true
+		}
+		if filter.Label == "" {
+			return nil, fmt.Errorf("ERR TSDB: failed parsing labels")
+		}
+		value := expr[eq+1:]
+		if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+			filter.Values = strings.Split(value[1:len(value)-1], ",")
+		} else {
+			filter.Values = []string{value}
+		}
+		if !filter.Negate && value != "" {
+			positive = true
+		}
+		filters = append(filters, filter)
+	}
+	if !positive {
+		return nil, fmt.Errorf("ERR TSDB: please provide at least one matcher")
+	}
+	return filters, nil
+}
+
+func (f TimeSeriesFilter) match(labels []TimeSeriesLabel) bool {
+	value, has := "", false
+	for _, label := range labels {
+		if label.Name == f.Label {
+			value, has = label.Value, true
+			break
+		}
+	}
+	matched := false
+	for _, want := range f.Values {
+		if (want == "" && !has) || (has && want == value) {
+			matched = true
+			break
+		}
+	}
+	return matched != f.Negate
+}
+
+// TSCreate creates an empty series
+func (s *Store) TSCreate(key string, opts TimeSeriesOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR TSDB: key already exists")
+	}
+	s.setKey(db, key, TimeSeriesValue(newTimeSeries(opts)))
+	return nil
+}
+
+// TSAlter changes the retention, chunk size, duplicate policy or labels of
+// a series
+func (s *Store) TSAlter(key string, opts TimeSeriesOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	series, err := lookupTimeSeries(db, key)
+	if err != nil {
+		return err
+	}
+	if opts.SetRetention {
+		series.Retention = opts.Retention
+		series.trimRetention()
+	}
+	if opts.SetChunkSize {
+		series.ChunkSize = opts.ChunkSize
+	}
+	if opts.DuplicatePolicy != "" {
+		series.DuplicatePolicy = opts.DuplicatePolicy
+	}
+	if opts.SetLabels {
+		series.Labels = opts.Labels
+	}
+	return nil
+}
+
+// TSAdd appends a sample, creating the series with opts when it doesn't
+// exist; a nil opts requires the series to exist. An onDuplicate policy
+// overrides the series policy for this sample.
+func (s *Store) TSAdd(key string, timestamp int64, value float64, onDuplicate string, opts *TimeSeriesOptions) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	var series *TimeSeries
+	if existing, exists := db.data[key]; exists {
+		if existing.Type != TimeSeriesType {
+			return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		series = existing.TimeSeries()
+	} else if opts == nil {
+		return 0, fmt.Errorf("ERR TSDB: the key does not exist")
+	} else {
+		series = newTimeSeries(*opts)
+		s.setKey(db, key, TimeSeriesValue(series))
+	}
+
+	policy := series.DuplicatePolicy
+	if onDuplicate != "" {
+		policy = onDuplicate
+	}
+	if err := s.tsUpsert(db, key, series, timestamp, value, policy); err != nil {
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+// TSIncrBy adds delta to the newest sample, or appends a sample holding the
+// newest value plus delta when timestamp is past it
+func (s *Store) TSIncrBy(key string, timestamp int64, delta float64, opts TimeSeriesOptions) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	var series *TimeSeries
+	if existing, exists := db.data[key]; exists {
+		if existing.Type != TimeSeriesType {
+			return 0, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		series = existing.TimeSeries()
+	} else {
+		series = newTimeSeries(opts)
+		s.setKey(db, key, TimeSeriesValue(series))
+	}
+
+	value := delta
+	if n := len(series.Samples); n > 0 {
+		last := series.Samples[n-1]
+		if timestamp < last.Timestamp {
+			return 0, fmt.Errorf("ERR TSDB: timestamp must be equal to or higher than the maximum existing timestamp")
+		}
+		value += last.Value
+		if math.IsInf(value, 0) {
+			return 0, fmt.Errorf("ERR TSDB: invalid value")
+		}
+	}
+	if err := s.tsUpsert(db, key, series, timestamp, value, "LAST"); err != nil {
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+// TSDel removes the samples between from and to inclusive, updating the
+// compactions of the series
+func (s *Store) TSDel(key string, from, to int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	series, err := lookupTimeSeries(db, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(series.Samples) == 0 {
+		return 0, nil
+	}
+	from = max(from, series.Samples[0].Timestamp)
+	to = min(to, series.Samples[len(series.Samples)-1].Timestamp)
+	removed := series.remove(from, to)
+	if removed == 0 {
+		return 0, nil
+	}
+	for _, rule := range s.tsRules(db, key, series) {
+		dest := db.data[rule.DestKey].TimeSeries()
+		series.compact(dest, rule, from, to)
+	}
+	return removed, nil
+}
+
+// TSGet returns the newest sample of a series, or nil when it is empty.
+// With latest, a compacted series reports its open bucket.
+func (s *Store) TSGet(key string, latest bool) (*TimeSeriesSample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TSDB: the key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	series, err := lookupTimeSeries(db, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.tsLast(db, key, series, latest), nil
+}
+
+// TSRange returns the samples of a series matching q
+func (s *Store) TSRange(key string, q TimeSeriesQuery) ([]TimeSeriesSample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TSDB: the key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	series, err := lookupTimeSeries(db, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.tsQuery(db, key, series, q), nil
+}
+
+// TSMRange runs q over every series matching filters, ordered by key. With
+// GroupBy, series sharing a label value are reduced into one result.
+func (s *Store) TSMRange(filters []TimeSeriesFilter, q TimeSeriesQuery) []TimeSeriesResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	var results []TimeSeriesResult
+	for _, key := range s.tsMatch(db, filters) {
+		series := db.data[key].TimeSeries()
+		results = append(results, TimeSeriesResult{
+			Key:     key,
+			Labels:  series.Labels,
+			Samples: s.tsQuery(db, key, series, q),
+		})
+	}
+	if q.GroupBy != "" {
+		results = groupTimeSeries(results, q.GroupBy, q.Reducer, q.Reverse)
+	}
+	return results
+}
+
+// TSMGet returns the newest sample of every series matching filters,
+// ordered by key
+func (s *Store) TSMGet(filters []TimeSeriesFilter, latest bool) []TimeSeriesResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.getCurrentDB()
+
+	var results []TimeSeriesResult
+	for _, key := range s.tsMatch(db, filters) {
+		series := db.data[key].TimeSeries()
+		result := TimeSeriesResult{Key: key, Labels: series.Labels}
+		if sample := s.tsLast(db, key, series, latest); sample != nil {
+			result.Samples = []TimeSeriesSample{*sample}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// TSQueryIndex returns the keys of the series matching filters
+func (s *Store) TSQueryIndex(filters []TimeSeriesFilter) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tsMatch(s.getCurrentDB(), filters)
+}
+
+// TSInfo describes a series
+func (s *Store) TSInfo(key string) (*TimeSeriesInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TSDB: the key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	series, err := lookupTimeSeries(db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TimeSeriesInfo{
+		TotalSamples:    len(series.Samples),
+		Retention:       series.Retention,
+		ChunkSize:       series.ChunkSize,
+		DuplicatePolicy: series.DuplicatePolicy,
+		Labels:          series.Labels,
+		Rules:           s.tsRules(db, key, series),
+	}
+	if n := len(series.Samples); n > 0 {
+		info.FirstTimestamp = series.Samples[0].Timestamp
+		info.LastTimestamp = series.Samples[n-1].Timestamp
+	}
+	bytes := int64(len(series.Samples)) * 16
+	info.ChunkCount = max(1, (bytes+series.ChunkSize-1)/series.ChunkSize)
+	info.MemoryUsage = int(info.ChunkCount*series.ChunkSize) + 128
+	for _, label := range series.Labels {
+		info.MemoryUsage += len(label.Name) + len(label.Value)
+	}
+	if source := s.tsSource(db, key, series); source != nil {
+		info.SourceKey = series.SourceKey
+	}
+	return info, nil
+}
+
+// TSCreateRule compacts sourceKey into destKey with the given aggregation,
+// bucket duration and alignment
+func (s *Store) TSCreateRule(sourceKey, destKey, aggregation string, bucket, align int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(sourceKey)
+	s.cleanupExpired(destKey)
+	db := s.getCurrentDB()
+
+	if sourceKey == destKey {
+		return fmt.Errorf("ERR TSDB: the source key and destination key should be different")
+	}
+	source, err := lookupTimeSeries(db, sourceKey)
+	if err != nil {
+		return err
+	}
+	dest, err := lookupTimeSeries(db, destKey)
+	if err != nil {
+		return err
+	}
+	if s.tsSource(db, sourceKey, source) != nil {
+		return fmt.Errorf("ERR TSDB: the source key already has a source rule")
+	}
+	if s.tsSource(db, destKey, dest) != nil {
+		return fmt.Errorf("ERR TSDB: the destination key already has a src rule")
+	}
+	if len(s.tsRules(db, destKey, dest)) > 0 {
+		return fmt.Errorf("ERR TSDB: the destination key already has a dst rule")
+	}
+
+	source.Rules = append(s.tsRules(db, sourceKey, source), TimeSeriesRule{
+		DestKey:     destKey,
+		Aggregation: aggregation,
+		Bucket:      bucket,
+		Align:       align,
+	})
+	dest.SourceKey = sourceKey
+	return nil
+}
+
+// TSDeleteRule removes the compaction from sourceKey into destKey
+func (s *Store) TSDeleteRule(sourceKey, destKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(sourceKey)
+	db := s.getCurrentDB()
+
+	source, err := lookupTimeSeries(db, sourceKey)
+	if err != nil {
+		return err
+	}
+	rules := s.tsRules(db, sourceKey, source)
+	for i, rule := range rules {
+		if rule.DestKey == destKey {
+			source.Rules = append(rules[:i], rules[i+1:]...)
+			db.data[destKey].TimeSeries().SourceKey = ""
+			return nil
+		}
+	}
+	return fmt.Errorf("ERR TSDB: compaction rule does not exist")
+}
+
+func newTimeSeries(opts TimeSeriesOptions) *TimeSeries {
+	series := &TimeSeries{
+		Retention:       opts.Retention,
+		ChunkSize:       opts.ChunkSize,
+		DuplicatePolicy: opts.DuplicatePolicy,
+		Labels:          opts.Labels,
+	}
+	if series.ChunkSize == 0 {
+		series.ChunkSize = DefaultTimeSeriesChunkSize
+	}
+	if series.DuplicatePolicy == "" {
+		series.DuplicatePolicy = "BLOCK"
+	}
+	return series
+}
+
+func lookupTimeSeries(db *Database, key string) (*TimeSeries, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERR TSDB: the key does not exist")
+	}
+	if value.Type != TimeSeriesType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.TimeSeries(), nil
+}
+
+// tsUpsert stores a sample and updates the compactions of the series. A
+// sample in a later bucket closes the open one; a sample in a closed bucket
+// has that bucket recomputed.
+func (s *Store) tsUpsert(db *Database, key string, series *TimeSeries, timestamp int64, value float64, policy string) error {
+	n := len(series.Samples)
+	if n > 0 && series.Retention > 0 && timestamp < series.Samples[n-1].Timestamp-series.Retention {
+		return fmt.Errorf("ERR TSDB: Timestamp is older than retention")
+	}
+
+	var last int64
+	if n > 0 {
+		last = series.Samples[n-1].Timestamp
+	}
+	if err := series.upsert(timestamp, value, policy); err != nil {
+		return err
+	}
+
+	if n > 0 {
+		for _, rule := range s.tsRules(db, key, series) {
+			dest := db.data[rule.DestKey].TimeSeries()
+			bucket := rule.bucketStart(timestamp)
+			open := rule.bucketStart(last)
+			if bucket > open {
+				series.compact(dest, rule, open, open)
+			} else if bucket < open {
+				series.compact(dest, rule, bucket, bucket)
+			}
+		}
+	}
+	series.trimRetention()
+	return nil
+}
+
+// tsRules returns the rules of a series whose destination still exists and
+// still names it as its source
+func (s *Store) tsRules(db *Database, key string, series *TimeSeries) []TimeSeriesRule {
+	var rules []TimeSeriesRule
+	for _, rule := range series.Rules {
+		dest, exists := db.data[rule.DestKey]
+		if !exists || dest.Type != TimeSeriesType || dest.TimeSeries().SourceKey != key || s.isExpired(rule.DestKey) {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// tsSource returns the rule compacting into a series, if its source still
+// has it
+func (s *Store) tsSource(db *Database, key string, series *TimeSeries) *TimeSeriesRule {
+	if series.SourceKey == "" || s.isExpired(series.SourceKey) {
+		return nil
+	}
+	source, exists := db.data[series.SourceKey]
+	if !exists || source.Type != TimeSeriesType {
+		return nil
+	}
+	for _, rule := range source.TimeSeries().Rules {
+		if rule.DestKey == key {
+			return &rule
+		}
+	}
+	return nil
+}
+
+func (s *Store) tsMatch(db *Database, filters []TimeSeriesFilter) []string {
+	var keys []string
+	for key, value := range db.data {
+		if value.Type != TimeSeriesType || s.isExpired(key) {
+			continue
+		}
+		matched := true
+		for _, filter := range filters {
+			if !filter.match(value.TimeSeries().Labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tsLatestBucket computes the open bucket of a compacted series from its
+// source
+func (s *Store) tsLatestBucket(db *Database, key string, series *TimeSeries) *TimeSeriesSample {
+	rule := s.tsSource(db, key, series)
+	if rule == nil {
+		return nil
+	}
+	source := db.data[series.SourceKey].TimeSeries()
+	n := len(source.Samples)
+	if n == 0 {
+		return nil
+	}
+	start := rule.bucketStart(source.Samples[n-1].Timestamp)
+	values := source.values(start, n)
+	return &TimeSeriesSample{Timestamp: start, Value: aggregateTimeSeries(rule.Aggregation, values)}
+}
+
+func (s *Store) tsLast(db *Database, key string, series *TimeSeries, latest bool) *TimeSeriesSample {
+	if latest {
+		if sample := s.tsLatestBucket(db, key, series); sample != nil {
+			return sample
+		}
+	}
+	if n := len(series.Samples); n > 0 {
+		sample := series.Samples[n-1]
+		return &sample
+	}
+	return nil
+}
+
+func (s *Store) tsQuery(db *Database, key string, series *TimeSeries, q TimeSeriesQuery) []TimeSeriesSample {
+	samples := series.rangeSamples(q.From, q.To)
+	if q.Latest {
+		if sample := s.tsLatestBucket(db, key, series); sample != nil && sample.Timestamp >= q.From && sample.Timestamp <= q.To {
+			samples = append(samples, *sample)
+		}
+	}
+
+	if q.FilterByTS != nil || q.FilterByValue {
+		filtered := samples[:0]
+		for _, sample := range samples {
+			if q.FilterByTS != nil && !containsTimestamp(q.FilterByTS, sample.Timestamp) {
+				continue
+			}
+			if q.FilterByValue && (sample.Value < q.MinValue || sample.Value > q.MaxValue) {
+				continue
+			}
+			filtered = append(filtered, sample)
+		}
+		samples = filtered
+	}
+
+	if q.Aggregation != "" {
+		samples = aggregateBuckets(samples, q)
+	}
+	if q.Reverse {
+		for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+			samples[i], samples[j] = samples[j], samples[i]
+		}
+	}
+	if q.Count > 0 && len(samples) > q.Count {
+		samples = samples[:q.Count]
+	}
+	return samples
+}
+
+func containsTimestamp(timestamps []int64, ts int64) bool {
+	for _, t := range timestamps {
+		if t == ts {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateBuckets folds samples into buckets of q.Bucket milliseconds
+// aligned to q.Align
+func aggregateBuckets(samples []TimeSeriesSample, q TimeSeriesQuery) []TimeSeriesSample {
+	rule := TimeSeriesRule{Aggregation: q.Aggregation, Bucket: q.Bucket, Align: q.Align}
+	var result []TimeSeriesSample
+	var lastStart int64
+	var lastValue float64
+	for i := 0; i < len(samples); {
+		start := rule.bucketStart(samples[i].Timestamp)
+		j := i
+		values := make([]float64, 0, 1)
+		for j < len(samples) && samples[j].Timestamp-start < rule.Bucket {
+			values = append(values, samples[j].Value)
+			j++
+		}
+		if q.Empty && len(result) > 0 {
+			for empty := lastStart + rule.Bucket; empty < start; empty += rule.Bucket {
+				result = append(result, TimeSeriesSample{Timestamp: empty, Value: emptyBucketValue(q.Aggregation, lastValue)})
+			}
+		}
+		result = append(result, TimeSeriesSample{Timestamp: start, Value: aggregateTimeSeries(q.Aggregation, values)})
+		lastStart, lastValue = start, values[len(values)-1]
+		i = j
+	}
+
+	var shift int64
+	switch q.BucketTimestamp {
+	case "end":
+		shift = rule.Bucket
+	case "mid":
+		shift = rule.Bucket / 2
+	}
+	for i := range result {
+		result[i].Timestamp += shift
+	}
+	return result
+}
+
+func emptyBucketValue(aggregation string, previous float64) float64 {
+	switch aggregation {
+	case "sum", "count":
+		return 0
+	case "last":
+		return previous
+	}
+	return math.NaN()
+}
+
+func aggregateTimeSeries(aggregation string, values []float64) float64 {
+	if len(values) == 0 {
+		return emptyBucketValue(aggregation, math.NaN())
+	}
+	switch aggregation {
+	case "first":
+		return values[0]
+	case "last":
+		return values[len(values)-1]
+	case "count":
+		return float64(len(values))
+	case "min", "max", "range":
+		lo, hi := values[0], values[0]
+		for _, v := range values[1:] {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+		switch aggregation {
+		case "min":
+			return lo
+		case "max":
+			return hi
+		}
+		return hi - lo
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	switch aggregation {
+	case "sum":
+		return sum
+	case "avg":
+		return mean
+	}
+
+	squares := 0.0
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	n := float64(len(values))
+	if strings.HasSuffix(aggregation, ".s") {
+		if n == 1 {
+			return 0
+		}
+		n--
+	}
+	if strings.HasPrefix(aggregation, "std") {
+		return math.Sqrt(squares / n)
+	}
+	return squares / n
+}
+
+// groupTimeSeries reduces the results sharing a value of label into one
+// result per value, combining samples with equal timestamps
+func groupTimeSeries(results []TimeSeriesResult, label, reducer string, reverse bool) []TimeSeriesResult {
+	groups := make(map[string][]TimeSeriesResult)
+	var values []string
+	for _, result := range results {
+		for _, l := range result.Labels {
+			if l.Name != label {
+				continue
+			}
+			if _, exists := groups[l.Value]; !exists {
+				values = append(values, l.Value)
+			}
+			groups[l.Value] = append(groups[l.Value], result)
+			break
+		}
+	}
+	sort.Strings(values)
+
+	grouped := make([]TimeSeriesResult, 0, len(values))
+	for _, value := range values {
+		members := groups[value]
+		byTimestamp := make(map[int64][]float64)
+		var timestamps []int64
+		sources := make([]string, len(members))
+		for i, member := range members {
+			sources[i] = member.Key
+			for _, sample := range member.Samples {
+				if _, exists := byTimestamp[sample.Timestamp]; !exists {
+					timestamps = append(timestamps, sample.Timestamp)
+				}
+				byTimestamp[sample.Timestamp] = append(byTimestamp[sample.Timestamp], sample.Value)
+			}
+		}
+		sort.Slice(timestamps, func(i, j int) bool {
+			if reverse {
+				return timestamps[i] > timestamps[j]
+			}
+			return timestamps[i] < timestamps[j]
+		})
+
+		samples := make([]TimeSeriesSample, len(timestamps))
+		for i, ts := range timestamps {
+			samples[i] = TimeSeriesSample{Timestamp: ts, Value: aggregateTimeSeries(reducer, byTimestamp[ts])}
+		}
+		grouped = append(grouped, TimeSeriesResult{
+			Key: label + "=" + value,
+			Labels: []TimeSeriesLabel{
+				{Name: label, Value: value},
+				{Name: "__reducer__", Value: reducer},
+				{Name: "__source__", Value: strings.Join(sources, ",")},
+			},
+			Samples: samples,
+		})
+	}
+	return grouped
+}
+
+func (r TimeSeriesRule) bucketStart(timestamp int64) int64 {
+	offset := (timestamp - r.Align) % r.Bucket
+	if offset < 0 {
+		offset += r.Bucket
+	}
+	return timestamp - offset
+}
+
+// search returns the index of the first sample at or after timestamp
+func (ts *TimeSeries) search(timestamp int64) int {
+	return sort.Search(len(ts.Samples), func(i int) bool {
+		return ts.Samples[i].Timestamp >= timestamp
+	})
+}
+
+func (ts *TimeSeries) upsert(timestamp int64, value float64, policy string) error {
+	i := ts.search(timestamp)
+	if i < len(ts.Samples) && ts.Samples[i].Timestamp == timestamp {
+		current := ts.Samples[i].Value
+		switch policy {
+		case "BLOCK":
+			return fmt.Errorf("ERR TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+		case "FIRST":
+			value = current
+		case "MIN":
+			value = math.Min(current, value)
+		case "MAX":
+			value = math.Max(current, value)
+		case "SUM":
+			value += current
+		}
+		ts.Samples[i].Value = value
+		return nil
+	}
+	if len(ts.Samples) == cap(ts.Samples) {
+		ts.trimmed = 0
+	}
+	ts.Samples = append(ts.Samples, TimeSeriesSample{})
+	copy(ts.Samples[i+1:], ts.Samples[i:])
+	ts.Samples[i] = TimeSeriesSample{Timestamp: timestamp, Value: value}
+	return nil
+}
+
+// remove deletes the samples between from and to inclusive
+func (ts *TimeSeries) remove(from, to int64) int {
+	if from > to {
+		return 0
+	}
+	lo, hi := ts.search(from), ts.search(to+1)
+	ts.Samples = append(ts.Samples[:lo], ts.Samples[hi:]...)
+	return hi - lo
+}
+
+func (ts *TimeSeries) trimRetention() {
+	n := len(ts.Samples)
+	if ts.Retention <= 0 || n == 0 {
+		return
+	}
+	cut := ts.search(ts.Samples[n-1].Timestamp - ts.Retention)
+	if cut == 0 {
+		return
+	}
+	// Re-slicing keeps a trim O(1) but leaves the dropped samples in the
+	// backing array, so once they fill half of it the retained samples
+	// move to a new one. Each copy is paid for by the samples dropped.
+	ts.Samples = ts.Samples[cut:]
+	ts.trimmed += cut
+	if ts.trimmed >= cap(ts.Samples) {
+		ts.Samples = append(make([]TimeSeriesSample, 0, len(ts.Samples)), ts.Samples...)
+		ts.trimmed = 0
+	}
+}
+
+func (ts *TimeSeries) rangeSamples(from, to int64) []TimeSeriesSample {
+	if from > to {
+		return nil
+	}
+	lo := ts.search(from)
+	hi := len(ts.Samples)
+	if to < math.MaxInt64 {
+		hi = ts.search(to + 1)
+	}
+	return append([]TimeSeriesSample(nil), ts.Samples[lo:hi]...)
+}
+
+// values returns the sample values from the first sample at or after start
+// up to index end
+func (ts *TimeSeries) values(start int64, end int) []float64 {
+	var values []float64
+	for _, sample := range ts.Samples[ts.search(start):end] {
+		values = append(values, sample.Value)
+	}
+	return values
+}
+
+// compact rewrites the closed buckets of rule overlapping from and to in
+// dest from the samples of ts
+func (ts *TimeSeries) compact(dest *TimeSeries, rule TimeSeriesRule, from, to int64) {
+	lo := rule.bucketStart(from)
+	hi := rule.bucketStart(to)
+	dest.remove(lo, hi+rule.Bucket-1)
+
+	open := int64(math.MaxInt64)
+	if n := len(ts.Samples); n > 0 {
+		open = rule.bucketStart(ts.Samples[n-1].Timestamp)
+	}
+	i := ts.search(lo)
+	for i < len(ts.Samples) && ts.Samples[i].Timestamp-hi < rule.Bucket {
+		start := rule.bucketStart(ts.Samples[i].Timestamp)
+		j := i
+		for j < len(ts.Samples) && ts.Samples[j].Timestamp-start < rule.Bucket {
+			j++
+		}
+		if start != open {
+			dest.upsert(start, aggregateTimeSeries(rule.Aggregation, ts.values(start, j)), "LAST")
+		}
+		i = j
+	}
+	dest.trimRetention()
+}
+
+func serializeTimeSeries(ts *TimeSeries) *persistence.TimeSeriesData {
+	data := &persistence.TimeSeriesData{
+		Samples:         make([]persistence.TimeSeriesSample, len(ts.Samples)),
+		Retention:       ts.Retention,
+		DuplicatePolicy: ts.DuplicatePolicy,
+		ChunkSize:       ts.ChunkSize,
+		SourceKey:       ts.SourceKey,
+	}
+	for i, sample := range ts.Samples {
+		data.Samples[i] = persistence.TimeSeriesSample{Timestamp: sample.Timestamp, Value: sample.Value}
+	}
+	for _, label := range ts.Labels {
+		data.Labels = append(data.Labels, label.Name, label.Value)
+	}
+	for _, rule := range ts.Rules {
+		data.Rules = append(data.Rules, persistence.TimeSeriesRule{
+			DestKey:     rule.DestKey,
+			Aggregation: rule.Aggregation,
+			Bucket:      rule.Bucket,
+			Align:       rule.Align,
+		})
+	}
+	return data
+}
+
+func deserializeTimeSeries(data *persistence.TimeSeriesData) (*TimeSeries, bool) {
+	if len(data.Labels)%2 != 0 || data.ChunkSize <= 0 || !timeSeriesPolicies[data.DuplicatePolicy] {
+		return nil, false
+	}
+	ts := &TimeSeries{
+		Samples:         make([]TimeSeriesSample, len(data.Samples)),
+		Retention:       data.Retention,
+		DuplicatePolicy: data.DuplicatePolicy,
+		ChunkSize:       data.ChunkSize,
+		SourceKey:       data.SourceKey,
+	}
+	for i, sample := range data.Samples {
+		if i > 0 && sample.Timestamp <= data.Samples[i-1].Timestamp {
+			return nil, false
+		}
+		ts.Samples[i] = TimeSeriesSample{Timestamp: sample.Timestamp, Value: sample.Value}
+	}
+	for i := 0; i < len(data.Labels); i += 2 {
+		ts.Labels = append(ts.Labels, TimeSeriesLabel{Name: data.Labels[i], Value: data.Labels[i+1]})
+	}
+	for _, rule := range data.Rules {
+		if rule.Bucket <= 0 || !timeSeriesAggregations[rule.Aggregation] {
+			return nil, false
+		}
+		ts.Rules = append(ts.Rules, TimeSeriesRule(rule))
+	}
+	return ts, true
+}
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"keyra/persistence"
+)
+
+// TopK tracks the K heaviest items with the HeavyKeeper algorithm: Depth
+// rows of Width buckets each hold a fingerprint and a counter that decays
+// with probability Decay^count when another item lands on it.
+type TopK struct {
+	K       int64
+	Width   int64
+	Depth   int64
+	Decay   float64
+	Buckets []topKBucket // Depth rows of Width buckets
+	Heap    []TopKItem   // tracked items, heaviest first
+	rng     uint64
+}
+
+type topKBucket struct {
+	fingerprint uint64
+	count       int64
+}
+
+// TopKItem is a tracked item with its estimated count
+type TopKItem struct {
+	Item  string
+	Count int64
+}
+
+// TopKInfo describes a top-k structure for TOPK.INFO
+type TopKInfo struct {
+	K     int64
+	Width int64
+	Depth int64
+	Decay float64
+}
+
+// Defaults for TOPK.RESERVE without width, depth and decay
+const (
+	DefaultTopKWidth = 8
+	DefaultTopKDepth = 7
+	DefaultTopKDecay = 0.9
+)
+
+// MaxTopKIncrement bounds a single TOPK.INCRBY increment, since each unit
+// of it may roll a decay on every colliding bucket
+const MaxTopKIncrement = 100000
+
+// topKSeed seeds the generator deciding decays, so replaying the same
+// additions rebuilds the same structure
+const topKSeed = 0x9e3779b97f4a7c15
+
+func TopKValue(topk *TopK) *RedisValue {
+	return &RedisValue{Type: TopKType, Value: topk}
+}
+
+func (rv *RedisValue) TopK() *TopK {
+	if rv.Type != TopKType {
+		panic("value is not a top-k")
+	}
+	return rv.Value.(*TopK)
+}
+
+func NewTopK(k, width, depth int64, decay float64) *TopK {
+	return &TopK{
+		K:       k,
+		Width:   width,
+		Depth:   depth,
+		Decay:   decay,
+		Buckets: make([]topKBucket, width*depth),
+		rng:     topKSeed,
+	}
+}
+
+// random returns a deterministic pseudo-random number in [0, 1)
+func (t *TopK) random() float64 {
+	t.rng ^= t.rng << 13
+	t.rng ^= t.rng >> 7
+	t.rng ^= t.rng << 17
+	return float64(t.rng>>11) / (1 << 53)
+}
+
+// IncrBy counts item increment times, returning the item expelled from
+// the top-k list to make room for it, if any
+func (t *TopK) IncrBy(item string, increment int64) (string, bool) {
+	h1, h2 := sketchHash(item)
+	fingerprint := h1
+	var estimate int64
+	for row := int64(0); row < t.Depth; row++ {
+		bucket := &t.Buckets[row*t.Width+int64((h1+uint64(row)*h2)%uint64(t.Width))]
+		switch {
+		case bucket.count == 0:
+			bucket.fingerprint, bucket.count = fingerprint, increment
+		case bucket.fingerprint == fingerprint:
+			bucket.count += increment
+		default:
+			for remaining := increment; remaining > 0; remaining-- {
+				if t.random() < math.Pow(t.Decay, float64(bucket.count)) {
+					bucket.count--
+					if bucket.count == 0 {
+						bucket.fingerprint, bucket.count = fingerprint, remaining
+						break
+					}
+				}
+			}
+		}
+		if bucket.fingerprint == fingerprint {
+			estimate = max(estimate, bucket.count)
+		}
+	}
+	return t.track(item, estimate)
+}
+
+// track updates item in the list with its estimated count, expelling the
+// lightest item when the list is full and item outweighs it
+func (t *TopK) track(item string, count int64) (string, bool) {
+	for i := range t.Heap {
+		if t.Heap[i].Item == item {
+			t.Heap[i].Count = max(t.Heap[i].Count, count)
+			t.sortHeap()
+			return "", false
+		}
+	}
+	if count == 0 {
+		return "", false
+	}
+	if int64(len(t.Heap)) < t.K {
+		t.Heap = append(t.Heap, TopKItem{Item: item, Count: count})
+		t.sortHeap()
+		return "", false
+	}
+	last := len(t.Heap) - 1
+	if count <= t.Heap[last].Count {
+		return "", false
+	}
+	expelled := t.Heap[last].Item
+	t.Heap[last] = TopKItem{Item: item, Count: count}
+	t.sortHeap()
+	return expelled, true
+}
+
+func (t *TopK) sortHeap() {
+	sort.SliceStable(t.Heap, func(i, j int) bool {
+		return t.Heap[i].Count > t.Heap[j].Count
+	})
+}
+
+// Contains reports whether item is in the top-k list
+func (t *TopK) Contains(item string) bool {
+	for _, tracked := range t.Heap {
+		if tracked.Item == item {
+			return true
+		}
+	}
+	return false
+}
+
+// TopKReserve creates an empty top-k structure
+func (s *Store) TopKReserve(key string, k, width, depth int64, decay float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	if _, exists := db.data[key]; exists {
+		return fmt.Errorf("ERR TopK: key already exists")
+	}
+	s.setKey(db, key, TopKValue(NewTopK(k, width, depth, decay)))
+	return nil
+}
+
+// TopKIncrBy counts each item by its increment. Each result holds the item
+// expelled from the list, or nil.
+func (s *Store) TopKIncrBy(key string, items []string, increments []int64) ([]*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupExpired(key)
+	db := s.getCurrentDB()
+
+	topk, err := lookupTopK(db, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*string, len(items))
+	for i, item := range items {
+		if expelled, ok := topk.IncrBy(item, increments[i]); ok {
+			result[i] = &expelled
+		}
+	}
+	return result, nil
+}
+
+// TopKQuery reports whether each item is in the top-k list
+func (s *Store) TopKQuery(key string, items []string) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TopK: key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	topk, err := lookupTopK(db, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]bool, len(items))
+	for i, item := range items {
+		result[i] = topk.Contains(item)
+	}
+	return result, nil
+}
+
+// TopKList returns the tracked items, heaviest first
+func (s *Store) TopKList(key string) ([]TopKItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TopK: key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	topk, err := lookupTopK(db, key)
+	if err != nil {
+		return nil, err
+	}
+	return append([]TopKItem(nil), topk.Heap...), nil
+}
+
+// TopKInfo describes a top-k structure
+func (s *Store) TopKInfo(key string) (*TopKInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isExpired(key) {
+		return nil, fmt.Errorf("ERR TopK: key does not exist")
+	}
+	db := s.getCurrentDB()
+
+	topk, err := lookupTopK(db, key)
+	if err != nil {
+		return nil, err
+	}
+	return &TopKInfo{K: topk.K, Width: topk.Width, Depth: topk.Depth, Decay: topk.Decay}, nil
+}
+
+func lookupTopK(db *Database, key string) (*TopK, error) {
+	value, exists := db.data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERR TopK: key does not exist")
+	}
+	if value.Type != TopKType {
+		return nil, fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	return value.TopK(), nil
+}
+
+func serializeTopK(topk *TopK) *persistence.TopKData {
+	data := &persistence.TopKData{
+		K:            topk.K,
+		Width:        topk.Width,
+		Depth:        topk.Depth,
+		Decay:        topk.Decay,
+		Fingerprints: make([]uint64, len(topk.Buckets)),
+		Counts:       make([]int64, len(topk.Buckets)),
+		Rng:          topk.rng,
+	}
+	for i, bucket := range topk.Buckets {
+		data.Fingerprints[i] = bucket.fingerprint
+		data.Counts[i] = bucket.count
+	}
+	for _, item := range topk.Heap {
+		data.Items = append(data.Items, item.Item)
+		data.ItemCounts = append(data.ItemCounts, item.Count)
+	}
+	return data
+}
+
+func deserializeTopK(data *persistence.TopKData) (*TopK, bool) {
+	size := data.Width * data.Depth
+	if data.K <= 0 || data.Width <= 0 || data.Depth <= 0 || int64(len(data.Fingerprints)) != size ||
+		int64(len(data.Counts)) != size || len(data.Items) != len(data.ItemCounts) || data.Rng == 0 {
+		return nil, false
+	}
+	topk := NewTopK(data.K, data.Width, data.Depth, data.Decay)
+	topk.rng = data.Rng
+	for i := range topk.Buckets {
+		topk.Buckets[i] = topKBucket{fingerprint: data.Fingerprints[i], count: data.Counts[i]}
+	}
+	for i, item := range data.Items {
+		topk.Heap = append(topk.Heap, TopKItem{Item: item, Count: data.ItemCounts[i]})
+	}
+	return topk, true
+}
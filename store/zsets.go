@@ -12,9 +12,24 @@ func newZSet() *ZSet {
 	}
 }
 
+func (zs *ZSet) score(member string) (float64, bool) {
+	if zs.Members != nil {
+		score, exists := zs.Members[member]
+		return score, exists
+	}
+	for _, m := range zs.Sorted {
+		if m.Member == member {
+			return m.Score, true
+		}
+	}
+	return 0, false
+}
+
 func (zs *ZSet) add(member string, score float64) bool {
-	_, exists := zs.Members[member]
-	zs.Members[member] = score
+	_, exists := zs.score(member)
+	if zs.Members != nil {
+		zs.Members[member] = score
+	}
 	
 	if exists {
 		for i, m := range zs.Sorted {
@@ -41,12 +56,13 @@ func (zs *ZSet) add(member string, score float64) bool {
 }
 
 func (zs *ZSet) remove(member string) bool {
-	_, exists := zs.Members[member]
-	if !exists {
+	if _, exists := zs.score(member); !exists {
 		return false
 	}
 	
-	delete(zs.Members, member)
+	if zs.Members != nil {
+		delete(zs.Members, member)
+	}
 	
 	for i, m := range zs.Sorted {
 		if m.Member == member {
@@ -157,14 +173,15 @@ func (zs *ZSet) getByRevRank(start, stop int, withScores bool) []string {
 func (s *Store) ZAdd(key string, members map[string]float64) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
 	var zset *ZSet
 	
 	if !exists {
-		zset = newZSet()
-		db.data[key] = ZSetValue(zset)
+		zset = s.newZSet()
+		s.setKey(db, key, ZSetValue(zset))
 	} else if value.Type != ZSetType {
 		return -1
 	} else {
@@ -172,11 +189,20 @@ func (s *Store) ZAdd(key string, members map[string]float64) int {
 	}
 	
 	count := 0
+	changed := false
 	for member, score := range members {
+		if current, ok := zset.score(member); ok && current == score {
+			continue
+		}
+		changed = true
 		if zset.add(member, score) {
 			count++
 		}
 	}
+	s.convertZSet(zset)
+	if changed {
+		s.notify(db, ZSetEvent, "zadd", key)
+	}
 	
 	return count
 }
@@ -184,6 +210,7 @@ func (s *Store) ZAdd(key string, members map[string]float64) int {
 func (s *Store) ZRem(key string, members ...string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
@@ -199,20 +226,25 @@ func (s *Store) ZRem(key string, members ...string) int {
 		}
 	}
 	
-	if len(zset.Members) == 0 {
-		delete(db.data, key)
+	if count == 0 {
+		return 0
+	}
+	
+	s.notify(db, ZSetEvent, "zrem", key)
+	if len(zset.Sorted) == 0 {
+		s.removeKey(db, key)
 	}
 	
 	return count
 }
 
 func (s *Store) ZRange(key string, start, stop int, withScores bool) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return []string{}
 	}
@@ -221,12 +253,12 @@ func (s *Store) ZRange(key string, start, stop int, withScores bool) []string {
 }
 
 func (s *Store) ZRevRange(key string, start, stop int, withScores bool) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return []string{}
 	}
@@ -235,12 +267,12 @@ func (s *Store) ZRevRange(key string, start, stop int, withScores bool) []string
 }
 
 func (s *Store) ZRangeByScore(key string, min, max float64, withScores bool) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return []string{}
 	}
@@ -249,12 +281,12 @@ func (s *Store) ZRangeByScore(key string, min, max float64, withScores bool) []s
 }
 
 func (s *Store) ZRevRangeByScore(key string, max, min float64, withScores bool) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return []string{}
 	}
@@ -277,12 +309,12 @@ func (s *Store) ZRevRangeByScore(key string, max, min float64, withScores bool)
 }
 
 func (s *Store) ZRank(key, member string) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return -1, false
 	}
@@ -295,12 +327,12 @@ func (s *Store) ZRank(key, member string) (int, bool) {
 }
 
 func (s *Store) ZRevRank(key, member string) (int, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return -1, false
 	}
@@ -313,41 +345,40 @@ func (s *Store) ZRevRank(key, member string) (int, bool) {
 }
 
 func (s *Store) ZScore(key, member string) (float64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return 0, false
 	}
 	
-	score, exists := value.ZSet().Members[member]
-	return score, exists
+	return value.ZSet().score(member)
 }
 
 func (s *Store) ZCard(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return 0
 	}
 	
-	return len(value.ZSet().Members)
+	return len(value.ZSet().Sorted)
 }
 
 func (s *Store) ZCount(key string, min, max float64) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
-	value, exists := db.data[key]
+	value, exists := s.lookupRead(db, key)
 	if !exists || value.Type != ZSetType {
 		return 0
 	}
@@ -364,23 +395,26 @@ func (s *Store) ZCount(key string, min, max float64) int {
 func (s *Store) ZIncrBy(key, member string, increment float64) (float64, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cleanupExpired(key)
 	db := s.getCurrentDB()
 	
 	value, exists := db.data[key]
 	var zset *ZSet
 	
 	if !exists {
-		zset = newZSet()
-		db.data[key] = ZSetValue(zset)
+		zset = s.newZSet()
+		s.setKey(db, key, ZSetValue(zset))
 	} else if value.Type != ZSetType {
 		return 0, false 
 	} else {
 		zset = value.ZSet()
 	}
 	
-	currentScore := zset.Members[member]
+	currentScore, _ := zset.score(member)
 	newScore := currentScore + increment
 	
 	zset.add(member, newScore)
+	s.convertZSet(zset)
+	s.notify(db, ZSetEvent, "zincr", key)
 	return newScore, true
 }
\ No newline at end of file